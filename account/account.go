@@ -3,8 +3,10 @@ package account
 import (
 	// nolint: gosec
 	"crypto/md5"
+	"errors"
 	"time"
 
+	"github.com/patrickmn/go-cache"
 	"github.com/sgostarter/i/commerr"
 	"github.com/sgostarter/i/l"
 	"github.com/sgostarter/libeasygo/crypt"
@@ -14,11 +16,73 @@ type Config struct {
 	PasswordHashIterCount int    `yaml:"passwordHashIterCount" json:"passwordHashIterCount"`
 	TokenSignKey          string `yaml:"tokenSignKey" json:"tokenSignKey"`
 
+	// KeySet signs and verifies tokens by key id, HS256 with TokenSignKey is used when not set
+	KeySet *KeySet `yaml:"-" json:"-"`
+	Issuer string  `yaml:"issuer" json:"issuer"`
+	// Audience is set as the aud claim of issued tokens, a token is accepted when its aud contains any of them
+	Audience []string `yaml:"audience" json:"audience"`
+	// TokenClaimExpiresAfter sets the exp claim for downstream verifiers, 0 means no exp claim
+	TokenClaimExpiresAfter time.Duration `yaml:"tokenClaimExpiresAfter" json:"tokenClaimExpiresAfter"`
+
 	TokenExpiresAfter time.Duration `yaml:"tokenExpiresAfter" json:"tokenExpiresAfter"`
 	AutoRenewDuration time.Duration `yaml:"autoRenewDuration" json:"autoRenewDuration"`
+
+	// PasswordHasher defaults to crypt.HashPassword with PasswordHashIterCount
+	PasswordHasher PasswordHasher `yaml:"-" json:"-"`
+
+	// RefreshTokenExpiresAfter enables refresh tokens on LoginEx/Refresh when > 0
+	RefreshTokenExpiresAfter time.Duration `yaml:"refreshTokenExpiresAfter" json:"refreshTokenExpiresAfter"`
+
+	TOTPIssuer string `yaml:"totpIssuer" json:"totpIssuer"`
+
+	RevokeSessionsOnPasswordChange bool `yaml:"revokeSessionsOnPasswordChange" json:"revokeSessionsOnPasswordChange"`
+
+	// LoginThrottle enables login failure throttling and lockout when not nil
+	LoginThrottle *LoginThrottleConfig `yaml:"loginThrottle" json:"loginThrottle"`
+
+	// StatelessWho makes Who trust the signature and exp claim of tokens and check them against an in-memory
+	// revocation list instead of Storage. TokenClaimExpiresAfter must be set, it bounds the delay of Logout
+	// when the feed loses revocations
+	StatelessWho   bool           `yaml:"statelessWho" json:"statelessWho"`
+	RevocationFeed RevocationFeed `yaml:"-" json:"-"`
+
+	// RoleCacheExpiresAfter is how long HasPermission caches roles, role changes made by other instances
+	// take effect after it. Default is 10 seconds
+	RoleCacheExpiresAfter time.Duration `yaml:"roleCacheExpiresAfter" json:"roleCacheExpiresAfter"`
+	// RolesInToken embeds the roles of the user in the roles claim of tokens
+	RolesInToken bool `yaml:"rolesInToken" json:"rolesInToken"`
+
+	// RegisterPendingVerification registers accounts in pending verification state, they can't login until Enable
+	// or CompleteContactVerification
+	RegisterPendingVerification bool `yaml:"registerPendingVerification" json:"registerPendingVerification"`
+
+	// Notifier sends password reset and contact verification tokens
+	Notifier                 Notifier      `yaml:"-" json:"-"`
+	OneTimeTokenExpiresAfter time.Duration `yaml:"oneTimeTokenExpiresAfter" json:"oneTimeTokenExpiresAfter"`
+
+	// AuditSink records security events when not nil
+	AuditSink AuditSink `yaml:"-" json:"-"`
+
+	// IdentityProviders are the OpenID Connect providers of LoginWithIdentity, by IdentityProvider.Name
+	IdentityProviders []*IdentityProvider `yaml:"identityProviders" json:"identityProviders"`
+
+	// TenantID is set in the tid claim of tokens, tokens of other tenants are rejected. See TenantAccounts
+	TenantID string `yaml:"tenantID" json:"tenantID"`
+
+	// HookQueueSize is how many events can wait for async hooks, default is 1024
+	HookQueueSize int `yaml:"hookQueueSize" json:"hookQueueSize"`
+
+	// PasswordPolicy rejects weak passwords when not nil
+	PasswordPolicy *PasswordPolicy `yaml:"passwordPolicy" json:"passwordPolicy"`
 }
 
 func NewAccount(storage Storage, cfg *Config, logger l.Wrapper) Account {
+	return newAccount(storage, cfg, logger, nil)
+}
+
+// newAccount subscribes cfg.RevocationFeed when revocations is nil, the owner of shared revocations subscribes
+// for them.
+func newAccount(storage Storage, cfg *Config, logger l.Wrapper, revocations *revocationList) Account {
 	if logger == nil {
 		logger = l.NewNopLoggerWrapper()
 	}
@@ -43,14 +107,82 @@ func NewAccount(storage Storage, cfg *Config, logger l.Wrapper) Account {
 		cfg.TokenExpiresAfter = time.Hour * 24 * 356
 	}
 
+	if cfg.PasswordHasher == nil {
+		cfg.PasswordHasher = &legacyPasswordHasher{
+			iterCount: cfg.PasswordHashIterCount,
+		}
+	}
+
+	if cfg.LoginThrottle != nil {
+		cfg.LoginThrottle.fix()
+	}
+
+	if cfg.PasswordPolicy != nil {
+		cfg.PasswordPolicy.fix()
+	}
+
+	if cfg.OneTimeTokenExpiresAfter <= 0 {
+		cfg.OneTimeTokenExpiresAfter = time.Minute * 30
+	}
+
+	if cfg.RoleCacheExpiresAfter <= 0 {
+		cfg.RoleCacheExpiresAfter = time.Second * 10
+	}
+
+	if cfg.TenantID != "" && !ValidTenantID(cfg.TenantID) {
+		logger.Error("invalid tenant id")
+
+		return nil
+	}
+
+	if cfg.StatelessWho && cfg.TokenClaimExpiresAfter <= 0 {
+		logger.Error("stateless who needs token claim expires after")
+
+		return nil
+	}
+
+	identityProviders, err := newIdentityProviders(cfg.IdentityProviders)
+	if err != nil {
+		logger.WithFields(l.ErrorField(err)).Error("invalid identity providers")
+
+		return nil
+	}
+
 	tokenKey := md5.Sum([]byte(cfg.TokenSignKey)) // nolint: gosec
 
-	return &accountImpl{
-		logger:   logger.WithFields(l.StringField(l.ClsKey, "accountImpl")),
-		storage:  storage,
-		cfg:      cfg,
-		tokenKey: tokenKey[:],
+	subscribeRevocations := revocations == nil && cfg.RevocationFeed != nil
+
+	if revocations == nil {
+		revocations = newRevocationList()
 	}
+
+	impl := &accountImpl{
+		logger:      logger.WithFields(l.StringField(l.ClsKey, "accountImpl")),
+		storage:     storage,
+		cfg:         cfg,
+		tokenKey:    tokenKey[:],
+		keySet:      cfg.KeySet,
+		revocations: revocations,
+		roleCache:   cache.New(cfg.RoleCacheExpiresAfter, cfg.RoleCacheExpiresAfter*2),
+
+		identityProviders: identityProviders,
+
+		hooks: newHookRegistry(cfg.HookQueueSize, logger.WithFields(l.StringField(l.ClsKey, "hookRegistry"))),
+	}
+
+	if impl.keySet == nil {
+		impl.keySet = impl.getKeySet()
+	}
+
+	if subscribeRevocations {
+		if err := cfg.RevocationFeed.Subscribe(impl.revocations.add); err != nil {
+			logger.WithFields(l.ErrorField(err)).Error("subscribe revocation feed failed")
+
+			return nil
+		}
+	}
+
+	return impl
 }
 
 type accountImpl struct {
@@ -58,7 +190,16 @@ type accountImpl struct {
 	storage Storage
 	cfg     *Config
 
-	tokenKey []byte
+	tokenKey    []byte
+	keySet      *KeySet
+	revocations *revocationList
+	roleCache   *cache.Cache
+
+	auditMetadata map[string]string
+
+	identityProviders map[string]*identityProvider
+
+	hooks *hookRegistry
 }
 
 func (impl *accountImpl) Register(accountName, password string) (uid uint64, err error) {
@@ -66,77 +207,211 @@ func (impl *accountImpl) Register(accountName, password string) (uid uint64, err
 }
 
 func (impl *accountImpl) RegisterEx(userID uint64, accountName, password string, data []byte) (uid uint64, err error) {
-	hashedPassword, err := crypt.HashPassword(password, impl.cfg.PasswordHashIterCount)
+	err = impl.checkPasswordPolicy(accountName, password, nil)
 	if err != nil {
+		impl.audit(&AuditEvent{AccountName: accountName, Action: AuditActionRegister}, err)
+
 		return
 	}
 
-	uid, err = impl.storage.AddAccountEx(userID, accountName, hashedPassword, data)
-
-	return
+	return impl.register(userID, accountName, password, data, nil)
 }
 
-func (impl *accountImpl) Login(accountName, password string) (uid uint64, token string, err error) {
-	uid, userHashedPassword, err := impl.storage.FindAccount(accountName)
+// register skips the password policy, it's checked by callers when needed.
+// register adds the account and fires HookEventRegistered, prepare runs before the hook and the account is removed
+// again when prepare or the hook fails.
+func (impl *accountImpl) register(userID uint64, accountName, password string, data []byte,
+	prepare func(uid uint64) error) (uid uint64, err error) {
+	defer func() {
+		impl.audit(&AuditEvent{UID: uid, AccountName: accountName, Action: AuditActionRegister}, err)
+	}()
+
+	hashedPassword, err := impl.cfg.PasswordHasher.Hash(password)
 	if err != nil {
 		return
 	}
 
-	if userHashedPassword == "" {
-		userHashedPassword, err = crypt.HashPassword(password, impl.cfg.PasswordHashIterCount)
-		if err != nil {
-			return
-		}
+	uid, err = impl.storage.AddAccountEx(userID, accountName, hashedPassword, data)
+	if err != nil {
+		return
+	}
 
-		err = impl.storage.SetHashedPassword(uid, userHashedPassword)
+	if impl.cfg.RegisterPendingVerification {
+		err = impl.storage.SetAccountState(uid, AccountStatePendingVerification)
 		if err != nil {
 			return
 		}
-	} else {
-		ok := crypt.CheckHashedPassword(password, userHashedPassword, impl.cfg.PasswordHashIterCount)
-		if !ok {
-			err = commerr.ErrPermissionDenied
+	}
 
-			return
+	if prepare != nil {
+		err = prepare(uid)
+	}
+
+	if err == nil {
+		err = impl.fireHook(&HookEvent{Type: HookEventRegistered, UID: uid, AccountName: accountName})
+	}
+
+	if err != nil {
+		if e := impl.storage.DelAccount(uid); e != nil {
+			impl.logger.WithFields(l.ErrorField(e), l.UInt64Field("uid", uid)).Error("roll back registration failed")
 		}
+
+		uid = 0
 	}
 
-	token, err = impl.tokenNew(uid, accountName)
+	return
+}
+
+func (impl *accountImpl) Login(accountName, password string) (uid uint64, token string, err error) {
+	result, err := impl.login(accountName, password, false, loginOptionNew())
 	if err != nil {
 		return
 	}
 
-	tokenExpiresAfter := impl.cfg.TokenExpiresAfter
+	uid = result.UID
+	token = result.Token
 
-	advanceConfig, err := impl.storage.GetAdvanceConfig(uid)
+	if result.ChallengeToken != "" {
+		token = result.ChallengeToken
+		err = ErrTOTPRequired
+	}
+
+	return
+}
+
+func (impl *accountImpl) LoginEx(accountName, password string, options ...LoginOption) (result *LoginResult, err error) {
+	return impl.login(accountName, password, impl.cfg.RefreshTokenExpiresAfter > 0, loginOptionNew(options...))
+}
+
+func (impl *accountImpl) Refresh(refreshToken string) (result *LoginResult, err error) {
+	if impl.cfg.RefreshTokenExpiresAfter <= 0 {
+		err = commerr.ErrUnavailable
+
+		return
+	}
+
+	info, err := impl.storage.GetRefreshToken(refreshToken)
 	if err != nil {
 		return
 	}
 
-	if advanceConfig != nil && advanceConfig.TokenExpiresAfter > 0 {
-		tokenExpiresAfter = advanceConfig.TokenExpiresAfter
+	if info.Rotated {
+		impl.revokeRefreshTokenFamily(info.FamilyID)
+
+		err = ErrRefreshTokenReused
+
+		return
 	}
 
-	err = impl.storage.AddToken(token, uid, time.Now().Add(tokenExpiresAfter))
+	if time.Now().After(info.ExpiredAt) {
+		err = commerr.ErrNotFound
+
+		return
+	}
+
+	accountName, _, err := impl.storage.GetAccount(info.UID)
+	if err != nil {
+		return
+	}
+
+	err = impl.checkAccountActive(info.UID)
 	if err != nil {
 		return
 	}
 
+	session := info.Session
+	if session == nil {
+		session = &Session{
+			SessionID: info.FamilyID,
+			CreatedAt: time.Now(),
+		}
+	}
+
+	token, err := impl.issueToken(info.UID, accountName, session)
+	if err != nil {
+		return
+	}
+
+	newRefreshToken, err := newRandomToken()
+	if err != nil {
+		return
+	}
+
+	err = impl.storage.RotateRefreshToken(refreshToken, newRefreshToken, &RefreshTokenInfo{
+		UID:         info.UID,
+		FamilyID:    info.FamilyID,
+		AccessToken: token,
+		ExpiredAt:   time.Now().Add(impl.cfg.RefreshTokenExpiresAfter),
+		Session:     session,
+	})
+	if err != nil {
+		_ = impl.storage.DelToken(token)
+
+		if errors.Is(err, ErrRefreshTokenReused) {
+			impl.revokeRefreshTokenFamily(info.FamilyID)
+		}
+
+		return
+	}
+
+	result = &LoginResult{
+		UID:          info.UID,
+		Token:        token,
+		RefreshToken: newRefreshToken,
+		SessionID:    session.SessionID,
+	}
+
 	return
 }
 
+func (impl *accountImpl) JWKS() ([]byte, error) {
+	return impl.getKeySet().JWKS()
+}
+
+func (impl *accountImpl) Unlock(uid uint64) error {
+	return impl.storage.ResetLoginFailure(uidThrottleKey(uid))
+}
+
 func (impl *accountImpl) GetAccount(uid uint64) (accountName string, hashedPassword string, err error) {
 	return impl.storage.GetAccount(uid)
 }
 
 func (impl *accountImpl) RenameAccountName(uid uint64, newAccountName string) (err error) {
+	oldAccountName, _, _ := impl.storage.GetAccount(uid)
+
 	err = impl.storage.RenameAccountName(uid, newAccountName)
 
+	impl.audit(&AuditEvent{
+		UID:    uid,
+		Action: AuditActionRenameAccount,
+		Metadata: map[string]string{
+			"oldAccountName": oldAccountName,
+			"newAccountName": newAccountName,
+		},
+	}, err)
+
+	if err != nil || oldAccountName == newAccountName {
+		return
+	}
+
+	_ = impl.fireHook(&HookEvent{Type: HookEventRenamed, UID: uid, AccountName: newAccountName, OldAccountName: oldAccountName})
+
 	return
 }
 
 func (impl *accountImpl) SetAdvanceConfig(uid uint64, cfg *AdvanceConfig) (err error) {
 	err = impl.storage.SetAdvanceConfig(uid, cfg)
+
+	var metadata map[string]string
+
+	if cfg != nil {
+		metadata = map[string]string{
+			"tokenExpiresAfter": cfg.TokenExpiresAfter.String(),
+		}
+	}
+
+	impl.audit(&AuditEvent{UID: uid, Action: AuditActionSetAdvanceConfig, Metadata: metadata}, err)
+
 	if err != nil {
 		return
 	}
@@ -156,8 +431,21 @@ func (impl *accountImpl) GetData(uid uint64) (data []byte, err error) {
 	return impl.storage.GetAccountData(uid)
 }
 
-func (impl *accountImpl) Logout(token string) error {
-	return impl.storage.DelToken(token)
+func (impl *accountImpl) Logout(token string) (err error) {
+	uid, _, _ := impl.tokenCheck(token)
+
+	defer func() {
+		impl.audit(&AuditEvent{UID: uid, Action: AuditActionLogout}, err)
+	}()
+
+	err = impl.storage.DelToken(token)
+	if err != nil {
+		return
+	}
+
+	impl.revokeToken(token)
+
+	return
 }
 
 func (impl *accountImpl) HasAccount() (f bool, err error) {
@@ -165,12 +453,60 @@ func (impl *accountImpl) HasAccount() (f bool, err error) {
 }
 
 func (impl *accountImpl) ChangePassword(uid uint64, newPassword string) (err error) {
-	hashedPassword, err := crypt.HashPassword(newPassword, impl.cfg.PasswordHashIterCount)
+	err = impl.changePassword(uid, newPassword)
+
+	impl.audit(&AuditEvent{UID: uid, Action: AuditActionChangePassword}, err)
+
+	return
+}
+
+func (impl *accountImpl) changePassword(uid uint64, newPassword string) (err error) {
+	recentHashedPasswords, err := impl.recentHashedPasswords(uid)
+	if err != nil {
+		return
+	}
+
+	if impl.cfg.PasswordPolicy != nil {
+		var accountName string
+
+		accountName, _, err = impl.storage.GetAccount(uid)
+		if err != nil {
+			return
+		}
+
+		err = impl.checkPasswordPolicy(accountName, newPassword, recentHashedPasswords)
+		if err != nil {
+			return
+		}
+	}
+
+	hashedPassword, err := impl.cfg.PasswordHasher.Hash(newPassword)
 	if err != nil {
 		return
 	}
 
 	err = impl.storage.SetHashedPassword(uid, hashedPassword)
+	if err != nil {
+		return
+	}
+
+	// the new password is the current one, the history keeps the others
+	if n := impl.cfg.PasswordPolicy.historySize() - 1; n > 0 && len(recentHashedPasswords) > 0 {
+		if len(recentHashedPasswords) > n {
+			recentHashedPasswords = recentHashedPasswords[:n]
+		}
+
+		err = impl.storage.SetPasswordHistory(uid, recentHashedPasswords)
+		if err != nil {
+			return
+		}
+	}
+
+	_ = impl.fireHook(&HookEvent{Type: HookEventPasswordChanged, UID: uid})
+
+	if impl.cfg.RevokeSessionsOnPasswordChange {
+		err = impl.RevokeAllSessions(uid, "")
+	}
 
 	return
 }
@@ -187,12 +523,9 @@ func (impl *accountImpl) ResetPassword(accountName string, newPassword string) (
 		return
 	}
 
-	hashedPassword, err := crypt.HashPassword(newPassword, impl.cfg.PasswordHashIterCount)
-	if err != nil {
-		return
-	}
+	err = impl.changePassword(uid, newPassword)
 
-	err = impl.storage.SetHashedPassword(uid, hashedPassword)
+	impl.audit(&AuditEvent{UID: uid, AccountName: accountName, Action: AuditActionResetPassword}, err)
 
 	return
 }
@@ -231,7 +564,238 @@ func (impl *accountImpl) GetPropertyDataByUserID(uid uint64, d interface{}) erro
 //
 //
 
+func (impl *accountImpl) login(accountName, password string, withRefreshToken bool, opts *LoginOptions) (result *LoginResult, err error) {
+	defer func() {
+		impl.auditLogin(AuditActionLogin, 0, accountName, result, err, opts)
+	}()
+
+	sourceKey := sourceThrottleKey(opts.throttleSource())
+
+	var maxFailures, sourceMaxFailures int
+
+	if impl.cfg.LoginThrottle != nil {
+		maxFailures = impl.cfg.LoginThrottle.MaxFailures
+		sourceMaxFailures = impl.cfg.LoginThrottle.SourceMaxFailures
+	}
+
+	err = impl.checkLoginThrottle(sourceKey, sourceMaxFailures)
+	if err != nil {
+		return
+	}
+
+	uid, userHashedPassword, err := impl.storage.FindAccount(accountName)
+	if err != nil {
+		if errors.Is(err, commerr.ErrNotFound) {
+			impl.onLoginFailed(sourceKey)
+		}
+
+		return
+	}
+
+	uidKey := uidThrottleKey(uid)
+
+	err = impl.checkLoginThrottle(uidKey, maxFailures)
+	if err != nil {
+		return
+	}
+
+	if userHashedPassword == "" {
+		userHashedPassword, err = impl.cfg.PasswordHasher.Hash(password)
+		if err != nil {
+			return
+		}
+
+		err = impl.storage.SetHashedPassword(uid, userHashedPassword)
+		if err != nil {
+			return
+		}
+	} else {
+		var ok bool
+
+		ok, err = impl.verifyPassword(password, userHashedPassword)
+		if err != nil {
+			return
+		}
+
+		if !ok {
+			impl.onLoginFailed(uidKey, sourceKey)
+
+			err = commerr.ErrPermissionDenied
+
+			return
+		}
+
+		impl.onLoginSucceeded(uid)
+
+		impl.rehashPasswordIfNeeded(uid, password, userHashedPassword)
+	}
+
+	err = impl.checkAccountActive(uid)
+	if err != nil {
+		return
+	}
+
+	return impl.loginResultOrChallenge(uid, accountName, withRefreshToken, opts)
+}
+
+// loginResultOrChallenge returns a TOTP challenge instead of tokens when TOTP is confirmed.
+func (impl *accountImpl) loginResultOrChallenge(uid uint64, accountName string, withRefreshToken bool,
+	opts *LoginOptions) (result *LoginResult, err error) {
+	totpInfo, err := impl.storage.GetTOTP(uid)
+	if err != nil {
+		return
+	}
+
+	if totpInfo != nil && totpInfo.Confirmed {
+		result = &LoginResult{
+			UID: uid,
+		}
+
+		result.ChallengeToken, err = impl.challengeNew(uid, accountName, totpChallengePurpose, totpChallengeExpiresIn)
+
+		return
+	}
+
+	return impl.newLoginResult(uid, accountName, withRefreshToken, opts.newSession())
+}
+
+// newLoginResult issues the tokens of a new session, the refresh token family shares the session id.
+func (impl *accountImpl) newLoginResult(uid uint64, accountName string, withRefreshToken bool, session *Session) (result *LoginResult, err error) {
+	defer func() {
+		if err == nil {
+			_ = impl.fireHook(&HookEvent{Type: HookEventLogin, UID: uid, AccountName: accountName, SessionID: session.SessionID})
+		}
+	}()
+
+	session.SessionID, err = newRandomToken()
+	if err != nil {
+		return
+	}
+
+	token, err := impl.issueToken(uid, accountName, session)
+	if err != nil {
+		return
+	}
+
+	result = &LoginResult{
+		UID:       uid,
+		Token:     token,
+		SessionID: session.SessionID,
+	}
+
+	if !withRefreshToken {
+		return
+	}
+
+	result.RefreshToken, err = newRandomToken()
+	if err != nil {
+		return
+	}
+
+	err = impl.storage.AddRefreshToken(result.RefreshToken, &RefreshTokenInfo{
+		UID:         uid,
+		FamilyID:    session.SessionID,
+		AccessToken: token,
+		ExpiredAt:   time.Now().Add(impl.cfg.RefreshTokenExpiresAfter),
+		Session:     session,
+	})
+
+	return
+}
+
+func (impl *accountImpl) verifyPassword(password, hashedPassword string) (ok bool, err error) {
+	if isLegacyHashedPassword(hashedPassword) {
+		ok = crypt.CheckHashedPassword(password, hashedPassword, impl.cfg.PasswordHashIterCount)
+
+		return
+	}
+
+	return impl.cfg.PasswordHasher.Verify(password, hashedPassword)
+}
+
+func (impl *accountImpl) rehashPasswordIfNeeded(uid uint64, password, hashedPassword string) {
+	if !impl.cfg.PasswordHasher.NeedsRehash(hashedPassword) {
+		return
+	}
+
+	newHashedPassword, err := impl.cfg.PasswordHasher.Hash(password)
+	if err == nil {
+		err = impl.storage.SetHashedPassword(uid, newHashedPassword)
+	}
+
+	if err != nil {
+		impl.logger.WithFields(l.ErrorField(err), l.UInt64Field("uid", uid)).Error("rehash password failed")
+	}
+}
+
+func (impl *accountImpl) issueToken(uid uint64, accountName string, session *Session) (token string, err error) {
+	claims := impl.newClaims(uid, accountName, "", impl.cfg.TokenClaimExpiresAfter)
+	if session != nil {
+		claims.SessionID = session.SessionID
+	}
+
+	if impl.cfg.RolesInToken {
+		claims.Roles, err = impl.getUserRolesCached(uid)
+		if err != nil {
+			return
+		}
+	}
+
+	token, err = impl.getKeySet().Sign(claims)
+	if err != nil {
+		return
+	}
+
+	tokenExpiresAfter := impl.cfg.TokenExpiresAfter
+
+	advanceConfig, err := impl.storage.GetAdvanceConfig(uid)
+	if err != nil {
+		return
+	}
+
+	if advanceConfig != nil && advanceConfig.TokenExpiresAfter > 0 {
+		tokenExpiresAfter = advanceConfig.TokenExpiresAfter
+	}
+
+	err = impl.storage.AddTokenEx(token, uid, time.Now().Add(tokenExpiresAfter), session)
+
+	return
+}
+
+func (impl *accountImpl) revokeRefreshTokenFamily(familyID string) {
+	if err := impl.storage.RevokeRefreshTokenFamily(familyID); err != nil {
+		impl.logger.WithFields(l.ErrorField(err), l.StringField("familyID", familyID)).
+			Error("revoke refresh token family failed")
+	}
+
+	impl.revokeSessionTokens(familyID)
+}
+
 func (impl *accountImpl) who(token string) (uid uint64, accountName string, err error) {
+	if isAPIKey(token) {
+		var info *APIKey
+
+		info, accountName, err = impl.WhoAPIKey(token)
+		if err != nil {
+			return
+		}
+
+		uid = info.UID
+
+		return
+	}
+
+	if impl.cfg.StatelessWho {
+		return impl.statelessWho(token)
+	}
+
+	// tokens of other tenants never exist in our storage, reject them as tokenParse does
+	if tenantID, ok := unverifiedTenantID(token); ok && tenantID != impl.cfg.TenantID {
+		err = commerr.ErrUnauthenticated
+
+		return
+	}
+
 	exists, err := impl.storage.TokenExists(token, impl.cfg.AutoRenewDuration)
 	if err != nil {
 		return
@@ -244,6 +808,12 @@ func (impl *accountImpl) who(token string) (uid uint64, accountName string, err
 	}
 
 	uid, accountName, err = impl.tokenCheck(token)
+	if err != nil {
+		return
+	}
+
+	// stateless Who skips the storage, sessions of inactive accounts are revoked by SetAccountState
+	err = impl.checkAccountActive(uid)
 
 	return
 }
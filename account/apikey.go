@@ -0,0 +1,207 @@
+package account
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/sgostarter/i/commerr"
+	"github.com/sgostarter/i/l"
+)
+
+const (
+	apiKeyPrefix = "ak_"
+
+	apiKeyTouchInterval = time.Minute
+)
+
+// APIKey is a named long-lived credential of a user, the key itself is "ak_<KeyID>_<secret>" and
+// only the hash of the secret is stored.
+type APIKey struct {
+	KeyID        string    `json:"keyID" yaml:"keyID"`
+	UID          uint64    `json:"uid" yaml:"uid"`
+	Name         string    `json:"name" yaml:"name"`
+	Scopes       []string  `json:"scopes,omitempty" yaml:"scopes,omitempty"`
+	HashedSecret string    `json:"hashedSecret,omitempty" yaml:"hashedSecret,omitempty"`
+	CreatedAt    time.Time `json:"createdAt" yaml:"createdAt"`
+	ExpiredAt    time.Time `json:"expiredAt,omitempty" yaml:"expiredAt,omitempty"` // zero means never
+	LastUsedAt   time.Time `json:"lastUsedAt,omitempty" yaml:"lastUsedAt,omitempty"`
+}
+
+// HasScope matches scope like Role.HasPermission.
+func (key *APIKey) HasScope(scope string) bool {
+	for _, granted := range key.Scopes {
+		if matchPermission(granted, scope) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (key *APIKey) expired() bool {
+	return !key.ExpiredAt.IsZero() && time.Now().After(key.ExpiredAt)
+}
+
+// CreateAPIKey returns the key which can't be read again, expiresAfter 0 means never expires.
+func (impl *accountImpl) CreateAPIKey(uid uint64, name string, scopes []string, expiresAfter time.Duration) (key string, info *APIKey, err error) {
+	_, _, err = impl.storage.GetAccount(uid)
+	if err != nil {
+		return
+	}
+
+	keyID, err := newAPIKeyID()
+	if err != nil {
+		return
+	}
+
+	secret, err := newRandomToken()
+	if err != nil {
+		return
+	}
+
+	info = &APIKey{
+		KeyID:        keyID,
+		UID:          uid,
+		Name:         name,
+		Scopes:       scopes,
+		HashedSecret: hashSecretToken(secret),
+		CreatedAt:    time.Now(),
+	}
+
+	if expiresAfter > 0 {
+		info.ExpiredAt = info.CreatedAt.Add(expiresAfter)
+	}
+
+	err = impl.storage.AddAPIKey(info)
+	if err != nil {
+		return
+	}
+
+	key = apiKeyPrefix + keyID + "_" + secret
+	info.HashedSecret = ""
+
+	return
+}
+
+// ListAPIKeys lists keys of the user without their secret hashes.
+func (impl *accountImpl) ListAPIKeys(uid uint64) (keys []*APIKey, err error) {
+	keys, err = impl.storage.ListAPIKeys(uid)
+	if err != nil {
+		return
+	}
+
+	for _, key := range keys {
+		key.HashedSecret = ""
+	}
+
+	return
+}
+
+func (impl *accountImpl) RevokeAPIKey(uid uint64, keyID string) (err error) {
+	info, err := impl.storage.GetAPIKey(keyID)
+	if err != nil {
+		return
+	}
+
+	if info.UID != uid {
+		err = commerr.ErrNotFound
+
+		return
+	}
+
+	return impl.storage.DelAPIKey(uid, keyID)
+}
+
+func (impl *accountImpl) WhoAPIKey(key string) (info *APIKey, accountName string, err error) {
+	keyID, secret, ok := parseAPIKey(key)
+	if !ok {
+		err = commerr.ErrUnauthenticated
+
+		return
+	}
+
+	info, err = impl.storage.GetAPIKey(keyID)
+	if err != nil {
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(info.HashedSecret), []byte(hashSecretToken(secret))) != 1 {
+		err = commerr.ErrUnauthenticated
+
+		return
+	}
+
+	if info.expired() {
+		err = commerr.ErrNotFound
+
+		return
+	}
+
+	accountName, _, err = impl.storage.GetAccount(info.UID)
+	if err != nil {
+		return
+	}
+
+	err = impl.checkAccountActive(info.UID)
+	if err != nil {
+		return
+	}
+
+	// last used timestamps are coarse, so using a key doesn't write storage on every request
+	if time.Since(info.LastUsedAt) > apiKeyTouchInterval {
+		info.LastUsedAt = time.Now()
+
+		if e := impl.storage.TouchAPIKey(keyID, info.LastUsedAt); e != nil {
+			impl.logger.WithFields(l.ErrorField(e), l.StringField("keyID", keyID)).Error("touch api key failed")
+		}
+	}
+
+	info.HashedSecret = ""
+
+	return
+}
+
+//
+//
+//
+
+func isAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+func parseAPIKey(key string) (keyID, secret string, ok bool) {
+	if !isAPIKey(key) {
+		return
+	}
+
+	keyID, secret, ok = strings.Cut(strings.TrimPrefix(key, apiKeyPrefix), "_")
+	if keyID == "" || secret == "" {
+		ok = false
+	}
+
+	return
+}
+
+func newAPIKeyID() (keyID string, err error) {
+	d := make([]byte, 8)
+
+	_, err = rand.Read(d)
+	if err != nil {
+		return
+	}
+
+	keyID = hex.EncodeToString(d)
+
+	return
+}
+
+// hashSecretToken uses plain sha256, random tokens are not guessable like passwords.
+func hashSecretToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+
+	return hex.EncodeToString(sum[:])
+}
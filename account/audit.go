@@ -0,0 +1,155 @@
+package account
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sgostarter/i/commerr"
+	"github.com/sgostarter/i/l"
+)
+
+const defaultAuditEventLimit = 50
+
+type AuditAction string
+
+const (
+	AuditActionRegister         AuditAction = "register"
+	AuditActionLogin            AuditAction = "login"
+	AuditActionLoginTOTP        AuditAction = "loginTOTP"
+	AuditActionLogout           AuditAction = "logout"
+	AuditActionChangePassword   AuditAction = "changePassword"
+	AuditActionResetPassword    AuditAction = "resetPassword"
+	AuditActionRenameAccount    AuditAction = "renameAccount"
+	AuditActionSetAdvanceConfig AuditAction = "setAdvanceConfig"
+	AuditActionChangeState      AuditAction = "changeState"
+	AuditActionPurge            AuditAction = "purge"
+	AuditActionLoginIdentity    AuditAction = "loginIdentity"
+	AuditActionLinkIdentity     AuditAction = "linkIdentity"
+	AuditActionUnlinkIdentity   AuditAction = "unlinkIdentity"
+)
+
+type AuditResult string
+
+const (
+	AuditResultSuccess AuditResult = "success"
+	AuditResultFailure AuditResult = "failure"
+	// AuditResultChallenged is a login which passed the password check and waits for LoginVerifyTOTP
+	AuditResultChallenged AuditResult = "challenged"
+)
+
+type AuditEvent struct {
+	ID  string `json:"id"`
+	UID uint64 `json:"uid"`
+	// TenantID is Config.TenantID
+	TenantID string `json:"tenantID,omitempty"`
+	// AccountName is set by login and register events, UID is 0 when the account doesn't exist
+	AccountName string      `json:"accountName,omitempty"`
+	Action      AuditAction `json:"action"`
+	Result      AuditResult `json:"result"`
+	// Reason is the error of failed events
+	Reason   string            `json:"reason,omitempty"`
+	Time     time.Time         `json:"time"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// AuditSink records security events of accounts, Record is called synchronously by the operations and its
+// errors are only logged.
+type AuditSink interface {
+	Record(event *AuditEvent) error
+	// ListUserEvents returns at most limit recent events of the user, newest first
+	ListUserEvents(uid uint64, limit int) (events []*AuditEvent, err error)
+}
+
+// WithAuditMetadata returns an Account which adds metadata (e.g. operator, client ip) to its audit events.
+func (impl *accountImpl) WithAuditMetadata(metadata map[string]string) Account {
+	newImpl := *impl
+	newImpl.auditMetadata = mergeAuditMetadata(impl.auditMetadata, metadata)
+
+	return &newImpl
+}
+
+func (impl *accountImpl) ListAuditEvents(uid uint64, limit int) (events []*AuditEvent, err error) {
+	if impl.cfg.AuditSink == nil {
+		err = commerr.ErrUnavailable
+
+		return
+	}
+
+	if limit <= 0 {
+		limit = defaultAuditEventLimit
+	}
+
+	return impl.cfg.AuditSink.ListUserEvents(uid, limit)
+}
+
+//
+//
+//
+
+// audit records the event, Result is set by err when it's empty.
+func (impl *accountImpl) audit(event *AuditEvent, err error) {
+	if impl.cfg.AuditSink == nil {
+		return
+	}
+
+	event.ID = uuid.NewString()
+	event.TenantID = impl.cfg.TenantID
+	event.Time = time.Now()
+	event.Metadata = mergeAuditMetadata(impl.auditMetadata, event.Metadata)
+
+	if err != nil {
+		event.Result = AuditResultFailure
+		event.Reason = err.Error()
+	} else if event.Result == "" {
+		event.Result = AuditResultSuccess
+	}
+
+	if e := impl.cfg.AuditSink.Record(event); e != nil {
+		impl.logger.WithFields(l.ErrorField(e), l.StringField("action", string(event.Action)),
+			l.UInt64Field("uid", event.UID)).Error("record audit event failed")
+	}
+}
+
+// auditLogin looks up the uid of failed logins by accountName.
+func (impl *accountImpl) auditLogin(action AuditAction, uid uint64, accountName string, result *LoginResult,
+	err error, opts *LoginOptions) {
+	if impl.cfg.AuditSink == nil {
+		return
+	}
+
+	event := &AuditEvent{
+		UID:         uid,
+		AccountName: accountName,
+		Action:      action,
+		Metadata:    opts.auditMetadata(),
+	}
+
+	if result != nil {
+		event.UID = result.UID
+
+		if result.ChallengeToken != "" {
+			event.Result = AuditResultChallenged
+		}
+	}
+
+	if event.UID == 0 && accountName != "" {
+		event.UID, _, _ = impl.storage.GetIDFromAccountName(accountName)
+	}
+
+	impl.audit(event, err)
+}
+
+// mergeAuditMetadata returns a new map, values of later maps win.
+func mergeAuditMetadata(ms ...map[string]string) (metadata map[string]string) {
+	for _, m := range ms {
+		for k, v := range m {
+			if metadata == nil {
+				metadata = make(map[string]string)
+			}
+
+			metadata[k] = v
+		}
+	}
+
+	return
+}
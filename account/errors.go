@@ -0,0 +1,15 @@
+package account
+
+import "errors"
+
+var (
+	ErrRefreshTokenReused = errors.New("refreshTokenReused")
+	ErrLoginThrottled     = errors.New("loginThrottled")
+	ErrTOTPRequired       = errors.New("totpRequired")
+	ErrAccountInactive    = errors.New("accountInactive")
+	// ErrPropertyVersionConflict is returned when a property namespace is changed by others, or UpdatePropertyData
+	// keeps conflicting
+	ErrPropertyVersionConflict = errors.New("propertyVersionConflict")
+	// ErrPasswordPolicy is matched by PasswordPolicyError
+	ErrPasswordPolicy = errors.New("passwordPolicy")
+)
@@ -0,0 +1,308 @@
+package account
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sgostarter/i/l"
+)
+
+const (
+	defaultHookQueueSize   = 1024
+	defaultHookMaxAttempts = 3
+	defaultHookBackoff     = time.Second
+)
+
+type HookEventType string
+
+const (
+	HookEventRegistered      HookEventType = "registered"
+	HookEventLogin           HookEventType = "login"
+	HookEventPasswordChanged HookEventType = "passwordChanged"
+	HookEventRenamed         HookEventType = "renamed"
+	HookEventPurged          HookEventType = "purged"
+)
+
+// HookEvent is shared by all handlers of an event, handlers must not modify it.
+type HookEvent struct {
+	Type        HookEventType
+	UID         uint64
+	TenantID    string
+	AccountName string
+	// OldAccountName is set by HookEventRenamed
+	OldAccountName string
+	// SessionID is set by HookEventLogin
+	SessionID string
+	Time      time.Time
+}
+
+// HookHandler handles account events, the error of a synchronous OnRegistered handler rolls back the registration.
+type HookHandler func(event *HookEvent) error
+
+type HookOptions struct {
+	async       bool
+	maxAttempts int
+	backoff     time.Duration
+}
+
+type HookOption func(o *HookOptions)
+
+func hookOptionNew(option ...HookOption) *HookOptions {
+	opts := &HookOptions{
+		maxAttempts: defaultHookMaxAttempts,
+		backoff:     defaultHookBackoff,
+	}
+
+	for _, o := range option {
+		o(opts)
+	}
+
+	return opts
+}
+
+// AsyncHookOption runs the handler in the background after the operation returns, events are dropped with an
+// error log when Config.HookQueueSize events are waiting or the Account is closed
+func AsyncHookOption() HookOption {
+	return func(o *HookOptions) {
+		o.async = true
+	}
+}
+
+// RetryHookOption sets how many times an async handler is called until it succeeds, the backoff doubles after
+// each failure. Default is 3 attempts starting with a 1 second backoff
+func RetryHookOption(maxAttempts int, backoff time.Duration) HookOption {
+	return func(o *HookOptions) {
+		if maxAttempts > 0 {
+			o.maxAttempts = maxAttempts
+		}
+
+		if backoff > 0 {
+			o.backoff = backoff
+		}
+	}
+}
+
+// OnRegistered is called after the account is added, synchronous handlers see pending verification accounts too.
+func (impl *accountImpl) OnRegistered(handler HookHandler, options ...HookOption) {
+	impl.hooks.add(HookEventRegistered, handler, options...)
+}
+
+// OnLogin is called when a login issues tokens, logins waiting for LoginVerifyTOTP are called after it.
+func (impl *accountImpl) OnLogin(handler HookHandler, options ...HookOption) {
+	impl.hooks.add(HookEventLogin, handler, options...)
+}
+
+// OnPasswordChanged is called by ChangePassword, ResetPassword and CompletePasswordReset.
+func (impl *accountImpl) OnPasswordChanged(handler HookHandler, options ...HookOption) {
+	impl.hooks.add(HookEventPasswordChanged, handler, options...)
+}
+
+func (impl *accountImpl) OnRenamed(handler HookHandler, options ...HookOption) {
+	impl.hooks.add(HookEventRenamed, handler, options...)
+}
+
+// OnPurged is called after Purge removed the account.
+func (impl *accountImpl) OnPurged(handler HookHandler, options ...HookOption) {
+	impl.hooks.add(HookEventPurged, handler, options...)
+}
+
+func (impl *accountImpl) Close() {
+	impl.hooks.close()
+}
+
+//
+//
+//
+
+// fireHook runs the synchronous handlers in the order they were added and stops at the first error, the async
+// handlers are queued only when all synchronous handlers succeed.
+func (impl *accountImpl) fireHook(event *HookEvent) (err error) {
+	event.TenantID = impl.cfg.TenantID
+	event.Time = time.Now()
+
+	return impl.hooks.fire(event)
+}
+
+type hook struct {
+	handler HookHandler
+	opts    *HookOptions
+}
+
+type hookDelivery struct {
+	hook    *hook
+	event   *HookEvent
+	attempt int
+	backoff time.Duration
+}
+
+type hookRegistry struct {
+	logger l.Wrapper
+
+	lock   sync.RWMutex
+	hooks  map[HookEventType][]*hook
+	closed bool
+
+	queue     chan *hookDelivery
+	startOnce sync.Once
+	closing   chan struct{}
+	stopped   chan struct{}
+}
+
+func newHookRegistry(queueSize int, logger l.Wrapper) *hookRegistry {
+	if queueSize <= 0 {
+		queueSize = defaultHookQueueSize
+	}
+
+	return &hookRegistry{
+		logger:  logger,
+		hooks:   make(map[HookEventType][]*hook),
+		queue:   make(chan *hookDelivery, queueSize),
+		closing: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+func (r *hookRegistry) add(eventType HookEventType, handler HookHandler, options ...HookOption) {
+	if handler == nil {
+		return
+	}
+
+	h := &hook{
+		handler: handler,
+		opts:    hookOptionNew(options...),
+	}
+
+	if h.opts.async {
+		r.startOnce.Do(func() {
+			go r.run()
+		})
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.hooks[eventType] = append(r.hooks[eventType], h)
+}
+
+func (r *hookRegistry) fire(event *HookEvent) (err error) {
+	r.lock.RLock()
+	hooks := r.hooks[event.Type]
+	r.lock.RUnlock()
+
+	for _, h := range hooks {
+		if h.opts.async {
+			continue
+		}
+
+		err = h.handler(event)
+		if err != nil {
+			r.logger.WithFields(l.ErrorField(err), l.StringField("event", string(event.Type)),
+				l.UInt64Field("uid", event.UID)).Warn("hook failed")
+
+			return
+		}
+	}
+
+	for _, h := range hooks {
+		if h.opts.async {
+			r.enqueue(&hookDelivery{
+				hook:    h,
+				event:   event,
+				backoff: h.opts.backoff,
+			})
+		}
+	}
+
+	return
+}
+
+// close waits for the worker to deliver the queued events, the events enqueued after it are dropped.
+func (r *hookRegistry) close() {
+	r.lock.Lock()
+
+	if r.closed {
+		r.lock.Unlock()
+
+		return
+	}
+
+	r.closed = true
+
+	r.lock.Unlock()
+
+	close(r.closing)
+
+	// there's no worker to wait for if no async hook was added
+	r.startOnce.Do(func() {
+		close(r.stopped)
+	})
+
+	<-r.stopped
+}
+
+func (r *hookRegistry) enqueue(delivery *hookDelivery) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	logger := r.logger.WithFields(l.StringField("event", string(delivery.event.Type)),
+		l.UInt64Field("uid", delivery.event.UID), l.IntField("attempt", delivery.attempt))
+
+	if r.closed {
+		logger.Error("hooks are closed, drop event")
+
+		return
+	}
+
+	select {
+	case r.queue <- delivery:
+	default:
+		logger.Error("hook queue is full, drop event")
+	}
+}
+
+func (r *hookRegistry) run() {
+	defer close(r.stopped)
+
+	for {
+		select {
+		case delivery := <-r.queue:
+			r.deliver(delivery)
+		case <-r.closing:
+			for {
+				select {
+				case delivery := <-r.queue:
+					r.deliver(delivery)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (r *hookRegistry) deliver(delivery *hookDelivery) {
+	err := delivery.hook.handler(delivery.event)
+	if err == nil {
+		return
+	}
+
+	delivery.attempt++
+
+	logger := r.logger.WithFields(l.ErrorField(err), l.StringField("event", string(delivery.event.Type)),
+		l.UInt64Field("uid", delivery.event.UID), l.IntField("attempt", delivery.attempt))
+
+	if delivery.attempt >= delivery.hook.opts.maxAttempts {
+		logger.Error("async hook failed, drop event")
+
+		return
+	}
+
+	logger.Warn("async hook failed, retry later")
+
+	backoff := delivery.backoff
+	delivery.backoff *= 2
+
+	time.AfterFunc(backoff, func() {
+		r.enqueue(delivery)
+	})
+}
@@ -6,6 +6,35 @@ type User struct {
 	UserName string
 	UserID   uint64
 	CreateAt int64
+	State    AccountState
+}
+
+type LoginResult struct {
+	UID          uint64
+	Token        string
+	RefreshToken string
+	SessionID    string
+
+	// ChallengeToken is set instead of Token when the account has 2FA enabled, finish it by LoginVerifyTOTP
+	ChallengeToken string
+}
+
+type Session struct {
+	SessionID  string    `json:"sessionID" yaml:"sessionID"`
+	DeviceName string    `json:"deviceName,omitempty" yaml:"deviceName,omitempty"`
+	ClientIP   string    `json:"clientIP,omitempty" yaml:"clientIP,omitempty"`
+	UserAgent  string    `json:"userAgent,omitempty" yaml:"userAgent,omitempty"`
+	CreatedAt  time.Time `json:"createdAt" yaml:"createdAt"`
+	ExpiredAt  time.Time `json:"expiredAt" yaml:"expiredAt"`
+}
+
+type RefreshTokenInfo struct {
+	UID         uint64
+	FamilyID    string
+	AccessToken string
+	ExpiredAt   time.Time
+	Rotated     bool
+	Session     *Session `json:",omitempty"`
 }
 
 type AdvanceConfig struct {
@@ -16,11 +45,58 @@ type Account interface {
 	Register(accountName, password string) (uid uint64, err error)
 	RegisterEx(userID uint64, accountName, password string, data []byte) (uid uint64, err error)
 	Login(accountName, password string) (uid uint64, token string, err error)
+	LoginEx(accountName, password string, options ...LoginOption) (result *LoginResult, err error)
+	Refresh(refreshToken string) (result *LoginResult, err error)
+	Unlock(uid uint64) error
+	JWKS() (jwks []byte, err error)
+
+	EnrollTOTP(uid uint64) (secret, uri string, err error)
+	ConfirmTOTP(uid uint64, code string) (recoveryCodes []string, err error)
+	DisableTOTP(uid uint64) error
+	LoginVerifyTOTP(challenge, code string, options ...LoginOption) (result *LoginResult, err error)
+
+	LoginWithIdentity(provider, idToken string, options ...LoginOption) (result *LoginResult, err error)
+	LinkIdentity(uid uint64, provider, idToken string) (identity *Identity, err error)
+	UnlinkIdentity(uid uint64, provider, subject string) error
+	ListIdentities(uid uint64) (identities []*Identity, err error)
+
+	SetRole(role *Role) error
+	DelRole(roleName string) error
+	GetRole(roleName string) (role *Role, err error)
+	ListRoles() (roles []*Role, err error)
+	AssignRole(uid uint64, roleName string) error
+	UnassignRole(uid uint64, roleName string) error
+	GetUserRoles(uid uint64) (roleNames []string, err error)
+	ListUsersByRole(roleName string) (uids []uint64, err error)
+	HasPermission(uid uint64, permission string) (ok bool, err error)
+
+	CreateAPIKey(uid uint64, name string, scopes []string, expiresAfter time.Duration) (key string, info *APIKey, err error)
+	ListAPIKeys(uid uint64) (keys []*APIKey, err error)
+	RevokeAPIKey(uid uint64, keyID string) error
+	WhoAPIKey(key string) (info *APIKey, accountName string, err error)
+
+	RequestPasswordReset(accountName string) (token string, err error)
+	CompletePasswordReset(token, newPassword string) error
+	RequestContactVerification(uid uint64, contact string) (token string, err error)
+	CompleteContactVerification(token string) (uid uint64, err error)
+	GetContact(uid uint64) (contact string, verified bool, err error)
+
+	GetAccountState(uid uint64) (state AccountState, err error)
+	Disable(uid uint64) error
+	Enable(uid uint64) error
+	SoftDelete(uid uint64) error
+	Restore(uid uint64) error
+	Purge(uid uint64) error
+
+	ListSessions(uid uint64) (sessions []*Session, err error)
+	RevokeSession(uid uint64, sessionID string) error
+	RevokeAllSessions(uid uint64, exceptCurrentToken string) error
 	GetAccount(uid uint64) (accountName string, hashedPassword string, err error)
 	RenameAccountName(uid uint64, newAccountName string) (err error)
 	SetAdvanceConfig(uid uint64, cfg *AdvanceConfig) error
 	GetAdvanceConfig(uid uint64) (cfg *AdvanceConfig, err error)
 
+	// Who resolves session tokens and API keys, tokens are revoked when the account becomes inactive
 	Who(token string) (uid uint64, accountName string, err error)
 	GetData(uid uint64) (data []byte, err error)
 	Logout(token string) error
@@ -28,17 +104,40 @@ type Account interface {
 	ChangePassword(uid uint64, newPassword string) (err error)
 	ResetPassword(accountName string, newPassword string) (err error)
 	ListUsers(createdAtStart, createdAtFinish int64) (accounts []User, err error)
+	QueryUsers(query *UserQuery) (page *UserPage, err error)
+
+	// WithAuditMetadata returns an Account sharing everything but adding metadata to audit events
+	WithAuditMetadata(metadata map[string]string) Account
+	ListAuditEvents(uid uint64, limit int) (events []*AuditEvent, err error)
+
+	// OnRegistered and the other hooks run handlers synchronously unless AsyncHookOption is given, see HookHandler
+	OnRegistered(handler HookHandler, options ...HookOption)
+	OnLogin(handler HookHandler, options ...HookOption)
+	OnPasswordChanged(handler HookHandler, options ...HookOption)
+	OnRenamed(handler HookHandler, options ...HookOption)
+	OnPurged(handler HookHandler, options ...HookOption)
+	// Close delivers the queued events of async hooks and stops their worker, later events are dropped
+	Close()
 
 	SetPropertyData(token string, d interface{}) error
 	SetPropertyDataByUserID(uid uint64, d interface{}) error
 	GetPropertyData(token string, d interface{}) error
 	GetPropertyDataByUserID(uid uint64, d interface{}) error
+
+	// GetPropertyNamespace returns version 0 when the namespace doesn't exist, use GetProperty for typed access
+	GetPropertyNamespace(uid uint64, ns string) (data []byte, version uint64, err error)
+	// UpdatePropertyData updates a namespace without losing concurrent writes, use UpdateProperty for typed access
+	UpdatePropertyData(uid uint64, ns string, fn PropertyUpdater) (version uint64, err error)
 }
 
+// Storage keeps accounts for Account, storagetest.RunStorageTests checks an implementation against the behaviours below.
+// Methods on a missing account return commerr.ErrNotFound, adding an existing account name, uid or token returns
+// commerr.ErrAlreadyExists.
 type Storage interface {
 	AddAccount(accountName, hashedPassword string) (uid uint64, err error)
 	AddAccountEx(userID uint64, accountName, hashedPassword string, data []byte) (uid uint64, err error)
 	SetHashedPassword(uid uint64, hashedPassword string) (err error)
+	// RenameAccountName frees the old name, renaming to the current name is a no-op
 	RenameAccountName(uid uint64, newAccountName string) error
 	SetAdvanceConfig(uid uint64, cfg *AdvanceConfig) (err error)
 	GetAdvanceConfig(uid uint64) (cfg *AdvanceConfig, err error)
@@ -46,15 +145,85 @@ type Storage interface {
 	GetAccount(uid uint64) (accountName string, hashedPassword string, err error)
 	GetAccountData(uid uint64) (data []byte, err error)
 	HasAccount() (f bool, err error)
+	// ListUsers lists accounts ordered by create time within the inclusive range, 0 means unbounded
 	ListUsers(createdAtStart, createdAtFinish int64) (accounts []User, err error)
+	// QueryUsers gets a normalized query: Limit and SortBy are set and Cursor is valid
+	QueryUsers(query *UserQuery) (page *UserPage, err error)
 	GetIDFromAccountName(accountName string) (uid uint64, exists bool, err error)
+	// SetAccountState removes deleted accounts from ListUsers and HasAccount
+	SetAccountState(uid uint64, state AccountState) error
+	GetAccountState(uid uint64) (state AccountState, err error)
+	// DelAccount removes the account, its property data, linked identities and indexes
+	DelAccount(uid uint64) error
+	SetContact(uid uint64, contact string, verified bool) error
+	GetContact(uid uint64) (contact string, verified bool, err error)
 
 	AddToken(token string, uid uint64, expiredAt time.Time) error
+	AddTokenEx(token string, uid uint64, expiredAt time.Time, session *Session) error
+	ListTokens(uid uint64) (tokens map[string]*Session, err error)
 	DelToken(token string) error
+	// TokenExists reports unexpired tokens only, a positive renewDuration pushes the expiry of the token out by it
 	TokenExists(token string, renewDuration time.Duration) (bool, error)
 
+	AddRefreshToken(refreshToken string, info *RefreshTokenInfo) error
+	GetRefreshToken(refreshToken string) (info *RefreshTokenInfo, err error)
+	RotateRefreshToken(oldRefreshToken, newRefreshToken string, info *RefreshTokenInfo) error
+	RevokeRefreshTokenFamily(familyID string) error
+	RevokeUserRefreshTokens(uid uint64, exceptFamilyID string) error
+
+	IncLoginFailure(key string, expiresAfter time.Duration) (failures int64, err error)
+	GetLoginFailure(key string) (failures int64, lastFailedAt time.Time, err error)
+	ResetLoginFailure(key string) error
+
+	SetTOTP(uid uint64, info *TOTPInfo) error
+	GetTOTP(uid uint64) (info *TOTPInfo, err error)
+	// CompareAndSetTOTP sets info only when the stored info still equals oldInfo, commerr.ErrAborted is returned
+	// when it was changed by others
+	CompareAndSetTOTP(uid uint64, oldInfo, info *TOTPInfo) error
+
+	// SetPasswordHistory keeps hashes of the previous passwords of the account, newest first
+	SetPasswordHistory(uid uint64, hashedPasswords []string) error
+	// GetPasswordHistory returns nil when no history was set
+	GetPasswordHistory(uid uint64) (hashedPasswords []string, err error)
+
+	SetRole(role *Role) error
+	// DelRole also unassigns the role from all users
+	DelRole(roleName string) error
+	GetRole(roleName string) (role *Role, err error)
+	ListRoles() (roles []*Role, err error)
+	AssignRole(uid uint64, roleName string) error
+	UnassignRole(uid uint64, roleName string) error
+	GetUserRoles(uid uint64) (roleNames []string, err error)
+	ListUsersByRole(roleName string) (uids []uint64, err error)
+
+	AddAPIKey(info *APIKey) error
+	GetAPIKey(keyID string) (info *APIKey, err error)
+	ListAPIKeys(uid uint64) (keys []*APIKey, err error)
+	DelAPIKey(uid uint64, keyID string) error
+	TouchAPIKey(keyID string, lastUsedAt time.Time) error
+
+	AddOneTimeToken(hashedToken string, info *OneTimeTokenInfo) error
+	// ConsumeOneTimeToken gets and deletes the token atomically
+	ConsumeOneTimeToken(hashedToken string) (info *OneTimeTokenInfo, err error)
+	DelOneTimeTokens(uid uint64, purpose string) error
+
+	// LinkIdentity returns commerr.ErrAlreadyExists when the provider subject is linked to any account
+	LinkIdentity(identity *Identity) error
+	FindIdentity(provider, subject string) (identity *Identity, err error)
+	ListIdentities(uid uint64) (identities []*Identity, err error)
+	// UnlinkIdentity returns commerr.ErrNotFound when the provider subject isn't linked to uid
+	UnlinkIdentity(uid uint64, provider, subject string) error
+
+	// GetPropertyData and GetPropertyDataByUserID return commerr.ErrNotFound and leave d unchanged if the data
+	// was never set
 	SetPropertyData(accountName string, d interface{}) error
 	SetPropertyDataByUserID(uid uint64, d interface{}) error
 	GetPropertyData(accountName string, d interface{}) error
 	GetPropertyDataByUserID(uid uint64, d interface{}) error
+
+	// GetPropertyNamespace returns nil data and version 0 when the namespace doesn't exist
+	GetPropertyNamespace(uid uint64, ns string) (data []byte, version uint64, err error)
+	// SetPropertyNamespace sets data when the namespace is still at version and returns the new version,
+	// ErrPropertyVersionConflict otherwise. Namespaces are removed by DelAccount
+	SetPropertyNamespace(uid uint64, ns string, version uint64, data []byte) (newVersion uint64, err error)
 }
@@ -0,0 +1,346 @@
+package account
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sgostarter/i/commerr"
+	"github.com/sgostarter/i/l"
+	"github.com/sgostarter/libeasygo/cuserror"
+)
+
+const (
+	idTokenLeeway = time.Minute
+
+	jwksRefreshInterval = time.Minute
+	jwksMaxSize         = 1 << 20
+)
+
+// IdentityProvider is an OpenID Connect provider whose ID tokens sign users in.
+type IdentityProvider struct {
+	// Name identifies the provider in linked identities, it should never change
+	Name     string `yaml:"name" json:"name"`
+	Issuer   string `yaml:"issuer" json:"issuer"`
+	ClientID string `yaml:"clientID" json:"clientID"`
+
+	// KeySet verifies ID tokens, JWKSURL is fetched when it's nil and again when an unknown key id shows up
+	KeySet     *KeySet      `yaml:"-" json:"-"`
+	JWKSURL    string       `yaml:"jwksURL" json:"jwksURL"`
+	HTTPClient *http.Client `yaml:"-" json:"-"`
+
+	// AutoProvision registers an account on the first login of an identity which isn't linked yet
+	AutoProvision bool `yaml:"autoProvision" json:"autoProvision"`
+	// AccountNameClaim names auto provisioned accounts, "<Name>:<sub>" is used when it's empty or missing in the token
+	AccountNameClaim string `yaml:"accountNameClaim" json:"accountNameClaim"`
+}
+
+func (provider *IdentityProvider) valid() bool {
+	return provider != nil && provider.Name != "" && provider.Issuer != "" && provider.ClientID != "" &&
+		(provider.KeySet != nil || provider.JWKSURL != "")
+}
+
+// Identity links the subject of an identity provider to an account.
+type Identity struct {
+	Provider string    `json:"provider" yaml:"provider"`
+	Subject  string    `json:"subject" yaml:"subject"`
+	UID      uint64    `json:"uid" yaml:"uid"`
+	LinkedAt time.Time `json:"linkedAt" yaml:"linkedAt"`
+}
+
+// LoginWithIdentity signs in with an ID token of provider, see IdentityProvider.AutoProvision for identities
+// which aren't linked. NonceLoginOption checks the nonce claim.
+func (impl *accountImpl) LoginWithIdentity(provider, idToken string, options ...LoginOption) (result *LoginResult, err error) {
+	opts := loginOptionNew(options...)
+
+	var (
+		uid         uint64
+		accountName string
+	)
+
+	defer func() {
+		opts.metadata = mergeAuditMetadata(opts.metadata, map[string]string{"provider": provider})
+
+		impl.auditLogin(AuditActionLoginIdentity, uid, accountName, result, err, opts)
+	}()
+
+	p, claims, err := impl.verifyIDToken(provider, idToken, opts.nonce)
+	if err != nil {
+		return
+	}
+
+	identity, err := impl.storage.FindIdentity(p.Name, claims.subject)
+	if err == nil {
+		uid = identity.UID
+	} else if errors.Is(err, commerr.ErrNotFound) && p.AutoProvision {
+		uid, err = impl.provisionIdentity(p, claims)
+	}
+
+	if err != nil {
+		return
+	}
+
+	accountName, _, err = impl.storage.GetAccount(uid)
+	if err != nil {
+		return
+	}
+
+	err = impl.checkAccountActive(uid)
+	if err != nil {
+		return
+	}
+
+	return impl.loginResultOrChallenge(uid, accountName, impl.cfg.RefreshTokenExpiresAfter > 0, opts)
+}
+
+// LinkIdentity links the subject of the ID token to uid, commerr.ErrAlreadyExists is returned when it's linked
+// to any account.
+func (impl *accountImpl) LinkIdentity(uid uint64, provider, idToken string) (identity *Identity, err error) {
+	defer func() {
+		event := &AuditEvent{UID: uid, Action: AuditActionLinkIdentity, Metadata: map[string]string{"provider": provider}}
+		if identity != nil {
+			event.Metadata["subject"] = identity.Subject
+		}
+
+		impl.audit(event, err)
+	}()
+
+	p, claims, err := impl.verifyIDToken(provider, idToken, "")
+	if err != nil {
+		return
+	}
+
+	identity = &Identity{
+		Provider: p.Name,
+		Subject:  claims.subject,
+		UID:      uid,
+		LinkedAt: time.Now(),
+	}
+
+	err = impl.storage.LinkIdentity(identity)
+	if err != nil {
+		identity = nil
+
+		return
+	}
+
+	return
+}
+
+func (impl *accountImpl) UnlinkIdentity(uid uint64, provider, subject string) (err error) {
+	err = impl.storage.UnlinkIdentity(uid, provider, subject)
+
+	impl.audit(&AuditEvent{
+		UID:    uid,
+		Action: AuditActionUnlinkIdentity,
+		Metadata: map[string]string{
+			"provider": provider,
+			"subject":  subject,
+		},
+	}, err)
+
+	return
+}
+
+func (impl *accountImpl) ListIdentities(uid uint64) (identities []*Identity, err error) {
+	return impl.storage.ListIdentities(uid)
+}
+
+//
+//
+//
+
+type idTokenClaims struct {
+	subject string
+	nonce   string
+	claims  jwt.MapClaims
+}
+
+// identityProvider keeps the keys fetched from IdentityProvider.JWKSURL.
+type identityProvider struct {
+	*IdentityProvider
+
+	lock      sync.Mutex
+	keySet    *KeySet
+	fetchedAt time.Time
+}
+
+func newIdentityProviders(providers []*IdentityProvider) (m map[string]*identityProvider, err error) {
+	m = make(map[string]*identityProvider, len(providers))
+
+	for _, provider := range providers {
+		if !provider.valid() {
+			err = commerr.ErrInvalidArgument
+
+			return
+		}
+
+		if _, ok := m[provider.Name]; ok {
+			err = cuserror.NewWithErrorMsg("duplicate identity provider: " + provider.Name)
+
+			return
+		}
+
+		m[provider.Name] = &identityProvider{
+			IdentityProvider: provider,
+			keySet:           provider.KeySet,
+		}
+	}
+
+	return
+}
+
+// getKeySet refetches the JWKS at most once per jwksRefreshInterval when kid is unknown.
+func (p *identityProvider) getKeySet(kid string) (ks *KeySet, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.keySet != nil && (p.JWKSURL == "" || p.keySet.hasKey(kid) || time.Since(p.fetchedAt) < jwksRefreshInterval) {
+		ks = p.keySet
+
+		return
+	}
+
+	ks, err = p.fetchJWKS()
+	if err != nil {
+		if p.keySet != nil {
+			ks, err = p.keySet, nil
+		}
+
+		return
+	}
+
+	p.keySet = ks
+	p.fetchedAt = time.Now()
+
+	return
+}
+
+func (p *identityProvider) fetchJWKS() (ks *KeySet, err error) {
+	httpClient := p.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.JWKSURL, nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = cuserror.NewWithErrorMsg("fetch jwks failed: " + resp.Status)
+
+		return
+	}
+
+	d, err := io.ReadAll(io.LimitReader(resp.Body, jwksMaxSize))
+	if err != nil {
+		return
+	}
+
+	return ParseJWKS(d)
+}
+
+// verifyIDToken checks the signature, iss, aud, exp and iat of idToken, and the nonce claim when nonce isn't empty.
+func (impl *accountImpl) verifyIDToken(provider, idToken, nonce string) (p *identityProvider, claims *idTokenClaims, err error) {
+	p, ok := impl.identityProviders[provider]
+	if !ok {
+		err = commerr.ErrInvalidArgument
+
+		return
+	}
+
+	var kid string
+
+	if token, _, e := jwt.NewParser().ParseUnverified(idToken, jwt.MapClaims{}); e == nil {
+		kid, _ = token.Header["kid"].(string)
+	}
+
+	ks, err := p.getKeySet(kid)
+	if err != nil {
+		return
+	}
+
+	mapClaims := jwt.MapClaims{}
+
+	err = ks.Parse(idToken, mapClaims, jwt.WithIssuer(p.Issuer), jwt.WithAudience(p.ClientID),
+		jwt.WithExpirationRequired(), jwt.WithIssuedAt(), jwt.WithLeeway(idTokenLeeway))
+	if err != nil {
+		impl.logger.WithFields(l.ErrorField(err), l.StringField("provider", provider)).Warn("invalid id token")
+
+		err = commerr.ErrUnauthenticated
+
+		return
+	}
+
+	claims = &idTokenClaims{
+		claims: mapClaims,
+	}
+
+	claims.subject, _ = mapClaims.GetSubject()
+	claims.nonce, _ = mapClaims["nonce"].(string)
+
+	if claims.subject == "" || (nonce != "" && claims.nonce != nonce) {
+		err = commerr.ErrUnauthenticated
+
+		return
+	}
+
+	return
+}
+
+// provisionIdentity registers an account with an unusable random password and links the identity to it before
+// HookEventRegistered is fired, the account is removed again when a concurrent login links the identity first.
+func (impl *accountImpl) provisionIdentity(p *identityProvider, claims *idTokenClaims) (uid uint64, err error) {
+	accountName := p.Name + ":" + claims.subject
+
+	if p.AccountNameClaim != "" {
+		if name, ok := claims.claims[p.AccountNameClaim].(string); ok && name != "" {
+			accountName = name
+		}
+	}
+
+	password, err := newRandomToken()
+	if err != nil {
+		return
+	}
+
+	var linkErr error
+
+	uid, err = impl.register(0, accountName, password, nil, func(uid uint64) error {
+		linkErr = impl.storage.LinkIdentity(&Identity{
+			Provider: p.Name,
+			Subject:  claims.subject,
+			UID:      uid,
+			LinkedAt: time.Now(),
+		})
+
+		return linkErr
+	})
+	if !errors.Is(linkErr, commerr.ErrAlreadyExists) {
+		return
+	}
+
+	identity, err := impl.storage.FindIdentity(p.Name, claims.subject)
+	if err != nil {
+		return
+	}
+
+	uid = identity.UID
+
+	return
+}
@@ -0,0 +1,177 @@
+package fmaccountstorage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/sgostarter/i/l"
+	"github.com/sgostarter/libcomponents/account"
+)
+
+const (
+	defaultAuditFileMaxSize    = 10 * 1024 * 1024
+	defaultAuditFileMaxBackups = 3
+)
+
+// NewFileAuditSink appends events as JSON lines to fileName. The file is rotated to fileName.1 when it grows
+// over maxSize and at most maxBackups rotated files are kept, ListUserEvents only sees events in these files.
+func NewFileAuditSink(fileName string, maxSize int64, maxBackups int, logger l.Wrapper) account.AuditSink {
+	if logger == nil {
+		logger = l.NewNopLoggerWrapper()
+	}
+
+	if maxSize <= 0 {
+		maxSize = defaultAuditFileMaxSize
+	}
+
+	if maxBackups <= 0 {
+		maxBackups = defaultAuditFileMaxBackups
+	}
+
+	return &fileAuditSink{
+		logger:     logger.WithFields(l.StringField(l.ClsKey, "fileAuditSink")),
+		fileName:   fileName,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+}
+
+type fileAuditSink struct {
+	logger     l.Wrapper
+	fileName   string
+	maxSize    int64
+	maxBackups int
+
+	lock sync.Mutex
+}
+
+func (impl *fileAuditSink) Record(event *account.AuditEvent) (err error) {
+	d, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	impl.lock.Lock()
+	defer impl.lock.Unlock()
+
+	f, err := os.OpenFile(impl.fileName, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return
+	}
+
+	_, err = f.Write(append(d, '\n'))
+
+	var size int64
+
+	if fi, e := f.Stat(); e == nil {
+		size = fi.Size()
+	}
+
+	if e := f.Close(); err == nil {
+		err = e
+	}
+
+	if err != nil || size < impl.maxSize {
+		return
+	}
+
+	return impl.rotate()
+}
+
+func (impl *fileAuditSink) ListUserEvents(uid uint64, limit int) (events []*account.AuditEvent, err error) {
+	impl.lock.Lock()
+	defer impl.lock.Unlock()
+
+	for idx := 0; idx <= impl.maxBackups && len(events) < limit; idx++ {
+		fileEvents, e := impl.readUserEvents(impl.backupFileName(idx), uid)
+		if e != nil {
+			err = e
+
+			return
+		}
+
+		for i := len(fileEvents) - 1; i >= 0 && len(events) < limit; i-- {
+			events = append(events, fileEvents[i])
+		}
+	}
+
+	return
+}
+
+//
+//
+//
+
+// backupFileName returns fileName for idx 0.
+func (impl *fileAuditSink) backupFileName(idx int) string {
+	if idx == 0 {
+		return impl.fileName
+	}
+
+	return fmt.Sprintf("%s.%d", impl.fileName, idx)
+}
+
+func (impl *fileAuditSink) rotate() (err error) {
+	err = os.Remove(impl.backupFileName(impl.maxBackups))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return
+	}
+
+	for idx := impl.maxBackups - 1; idx >= 0; idx-- {
+		err = os.Rename(impl.backupFileName(idx), impl.backupFileName(idx+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return
+		}
+	}
+
+	err = nil
+
+	return
+}
+
+// readUserEvents returns the events of the user in the file order.
+func (impl *fileAuditSink) readUserEvents(fileName string, uid uint64) (events []*account.AuditEvent, err error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+
+		return
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var event account.AuditEvent
+
+		if e := json.Unmarshal(line, &event); e != nil {
+			impl.logger.WithFields(l.ErrorField(e), l.StringField("fileName", fileName)).Error("unmarshal audit event failed")
+
+			continue
+		}
+
+		if event.UID == uid {
+			events = append(events, &event)
+		}
+	}
+
+	err = scanner.Err()
+
+	return
+}
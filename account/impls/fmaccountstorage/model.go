@@ -1,6 +1,8 @@
 package fmaccountstorage
 
 import (
+	"time"
+
 	"github.com/sgostarter/libcomponents/account"
 )
 
@@ -9,8 +11,22 @@ type AccountInfo struct {
 	AccountName    string
 	HashedPassword string
 	CreateAt       int64
+	State          account.AccountState `json:"state,omitempty" yaml:"state,omitempty"`
+
+	Cfg   *account.AdvanceConfig
+	TOTP  *account.TOTPInfo `json:"totp,omitempty" yaml:"totp,omitempty"`
+	Roles []string          `json:"roles,omitempty" yaml:"roles,omitempty"`
+
+	Contact         string `json:"contact,omitempty" yaml:"contact,omitempty"`
+	ContactVerified bool   `json:"contactVerified,omitempty" yaml:"contactVerified,omitempty"`
 
-	Cfg *account.AdvanceConfig
+	PasswordHistory []string `json:"passwordHistory,omitempty" yaml:"passwordHistory,omitempty"`
 
 	Data []byte `json:"data,omitempty" yaml:"data,omitempty"`
 }
+
+type LoginFailureInfo struct {
+	Failures     int64
+	LastFailedAt time.Time
+	ExpiredAt    time.Time
+}
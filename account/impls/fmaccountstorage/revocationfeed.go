@@ -0,0 +1,170 @@
+package fmaccountstorage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sgostarter/i/l"
+	"github.com/sgostarter/libcomponents/account"
+)
+
+// NewFileRevocationFeed shares revocations by appending JSON lines to fileName, subscribers poll the file
+// every pollInterval, which bounds the delay of Logout on other instances. Subscriptions end when ctx is done.
+// The file can be truncated when all revocations in it are expired.
+func NewFileRevocationFeed(ctx context.Context, fileName string, pollInterval time.Duration, logger l.Wrapper) account.RevocationFeed {
+	if logger == nil {
+		logger = l.NewNopLoggerWrapper()
+	}
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if pollInterval <= 0 {
+		pollInterval = time.Second
+	}
+
+	return &fileRevocationFeed{
+		ctx:          ctx,
+		logger:       logger.WithFields(l.StringField(l.ClsKey, "fileRevocationFeed")),
+		fileName:     fileName,
+		pollInterval: pollInterval,
+	}
+}
+
+type fileRevocationFeed struct {
+	ctx          context.Context
+	logger       l.Wrapper
+	fileName     string
+	pollInterval time.Duration
+
+	lock sync.Mutex
+}
+
+func (impl *fileRevocationFeed) Publish(revocation *account.Revocation) (err error) {
+	d, err := json.Marshal(revocation)
+	if err != nil {
+		return
+	}
+
+	impl.lock.Lock()
+	defer impl.lock.Unlock()
+
+	f, err := os.OpenFile(impl.fileName, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return
+	}
+
+	_, err = f.Write(append(d, '\n'))
+
+	if e := f.Close(); err == nil {
+		err = e
+	}
+
+	return
+}
+
+func (impl *fileRevocationFeed) Subscribe(handler func(revocation *account.Revocation)) error {
+	// load revocations published before, expired ones are dropped by the handler
+	offset, err := impl.poll(0, handler)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(impl.pollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-impl.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			newOffset, e := impl.poll(offset, handler)
+			if e != nil {
+				impl.logger.WithFields(l.ErrorField(e)).Error("poll revocations failed")
+
+				continue
+			}
+
+			offset = newOffset
+		}
+	}()
+
+	return nil
+}
+
+//
+//
+//
+
+// poll handles the complete lines after offset and returns the offset of the first unhandled byte.
+func (impl *fileRevocationFeed) poll(offset int64, handler func(revocation *account.Revocation)) (newOffset int64, err error) {
+	f, err := os.Open(impl.fileName)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+
+		return
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+
+	if fi.Size() < offset {
+		// truncated
+		offset = 0
+	}
+
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return
+	}
+
+	newOffset = offset
+
+	reader := bufio.NewReader(f)
+
+	for {
+		line, e := reader.ReadBytes('\n')
+		if e != nil {
+			// a partial line is read again by the next poll
+			break
+		}
+
+		newOffset += int64(len(line))
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		var revocation account.Revocation
+
+		if e = json.Unmarshal(line, &revocation); e != nil {
+			impl.logger.WithFields(l.ErrorField(e)).Error("unmarshal revocation failed")
+
+			continue
+		}
+
+		handler(&revocation)
+	}
+
+	return
+}
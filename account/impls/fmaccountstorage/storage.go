@@ -1,8 +1,12 @@
 package fmaccountstorage
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -37,6 +41,34 @@ func NewFMAccountStorageEx(root string, storage stg.FileStorage, prettySerial bo
 			make(map[uint64][]byte), &mwf.JSONSerial{
 				MarshalIndent: prettySerial,
 			}, &sync.RWMutex{}, filepath.Join(root, "accountProperties.json"), storage),
+		refreshTokenStorage: mwf.NewMemWithFile[map[string]*account.RefreshTokenInfo, mwf.Serial, mwf.Lock](
+			make(map[string]*account.RefreshTokenInfo), &mwf.JSONSerial{
+				MarshalIndent: prettySerial,
+			}, &sync.RWMutex{}, filepath.Join(root, "refreshTokens.json"), storage),
+		loginFailureStorage: mwf.NewMemWithFile[map[string]*LoginFailureInfo, mwf.Serial, mwf.Lock](
+			make(map[string]*LoginFailureInfo), &mwf.JSONSerial{
+				MarshalIndent: prettySerial,
+			}, &sync.RWMutex{}, filepath.Join(root, "loginFailures.json"), storage),
+		roleStorage: mwf.NewMemWithFile[map[string]*account.Role, mwf.Serial, mwf.Lock](
+			make(map[string]*account.Role), &mwf.JSONSerial{
+				MarshalIndent: prettySerial,
+			}, &sync.RWMutex{}, filepath.Join(root, "roles.json"), storage),
+		apiKeyStorage: mwf.NewMemWithFile[map[string]*account.APIKey, mwf.Serial, mwf.Lock](
+			make(map[string]*account.APIKey), &mwf.JSONSerial{
+				MarshalIndent: prettySerial,
+			}, &sync.RWMutex{}, filepath.Join(root, "apiKeys.json"), storage),
+		oneTimeTokenStorage: mwf.NewMemWithFile[map[string]*account.OneTimeTokenInfo, mwf.Serial, mwf.Lock](
+			make(map[string]*account.OneTimeTokenInfo), &mwf.JSONSerial{
+				MarshalIndent: prettySerial,
+			}, &sync.RWMutex{}, filepath.Join(root, "oneTimeTokens.json"), storage),
+		propertyNamespaceStorage: mwf.NewMemWithFile[map[uint64]map[string]*PropertyNamespace, mwf.Serial, mwf.Lock](
+			make(map[uint64]map[string]*PropertyNamespace), &mwf.JSONSerial{
+				MarshalIndent: prettySerial,
+			}, &sync.RWMutex{}, filepath.Join(root, "propertyNamespaces.json"), storage),
+		identityStorage: mwf.NewMemWithFile[map[string]*account.Identity, mwf.Serial, mwf.Lock](
+			make(map[string]*account.Identity), &mwf.JSONSerial{
+				MarshalIndent: prettySerial,
+			}, &sync.RWMutex{}, filepath.Join(root, "identities.json"), storage),
 	}
 
 	impl.init()
@@ -44,18 +76,45 @@ func NewFMAccountStorageEx(root string, storage stg.FileStorage, prettySerial bo
 	return impl
 }
 
+// NewFMTenantStorageFactory keeps each tenant in the directory "<root>/tenants/<tenantID>".
+func NewFMTenantStorageFactory(root string, storage stg.FileStorage, prettySerial bool) account.TenantStorageFactory {
+	return func(tenantID string) (account.Storage, error) {
+		if !account.ValidTenantID(tenantID) {
+			return nil, commerr.ErrInvalidArgument
+		}
+
+		return NewFMAccountStorageEx(filepath.Join(root, "tenants", tenantID), storage, prettySerial), nil
+	}
+}
+
 type TokenInfo struct {
 	ExpiredAt time.Time
 	UID       uint64
+	Session   *account.Session `json:"session,omitempty"`
+}
+
+type PropertyNamespace struct {
+	Data    []byte
+	Version uint64
 }
 
 type fsAccountStorageImpl struct {
-	accountStorage          *mwf.MemWithFile[map[uint64]*AccountInfo, mwf.Serial, mwf.Lock] // uid -> user info
-	tokenStorage            *mwf.MemWithFile[map[string]*TokenInfo, mwf.Serial, mwf.Lock]   // token -> uid, expireAt
-	accountPropertyStorage  *mwf.MemWithFile[map[uint64][]byte, mwf.Serial, mwf.Lock]       // uid -> property
+	accountStorage          *mwf.MemWithFile[map[uint64]*AccountInfo, mwf.Serial, mwf.Lock]              // uid -> user info
+	tokenStorage            *mwf.MemWithFile[map[string]*TokenInfo, mwf.Serial, mwf.Lock]                // token -> uid, expireAt
+	accountPropertyStorage  *mwf.MemWithFile[map[uint64][]byte, mwf.Serial, mwf.Lock]                    // uid -> property
+	refreshTokenStorage     *mwf.MemWithFile[map[string]*account.RefreshTokenInfo, mwf.Serial, mwf.Lock] // refresh token -> family info
+	loginFailureStorage     *mwf.MemWithFile[map[string]*LoginFailureInfo, mwf.Serial, mwf.Lock]         // throttle key -> failures
+	roleStorage             *mwf.MemWithFile[map[string]*account.Role, mwf.Serial, mwf.Lock]             // role name -> role
+	apiKeyStorage           *mwf.MemWithFile[map[string]*account.APIKey, mwf.Serial, mwf.Lock]           // key id -> api key
+	oneTimeTokenStorage     *mwf.MemWithFile[map[string]*account.OneTimeTokenInfo, mwf.Serial, mwf.Lock] // hashed token -> info
 	lastCleanExpiredTokenAt time.Time
 
+	propertyNamespaceStorage *mwf.MemWithFile[map[uint64]map[string]*PropertyNamespace, mwf.Serial, mwf.Lock] // uid -> namespace -> data
+
+	identityStorage *mwf.MemWithFile[map[string]*account.Identity, mwf.Serial, mwf.Lock] // provider, subject -> identity
+
 	accountName2UserID sync.Map // account name -> uid
+	userIndex          userIndex
 }
 
 func (impl *fsAccountStorageImpl) init() {
@@ -75,6 +134,8 @@ func (impl *fsAccountStorageImpl) init() {
 
 				changed = true
 			}
+
+			impl.userIndex.add(info)
 		}
 
 		if !changed {
@@ -139,6 +200,7 @@ func (impl *fsAccountStorageImpl) AddAccountEx(userID uint64, accountName, hashe
 		}
 
 		impl.accountName2UserID.Store(accountName, uid)
+		impl.userIndex.add(newM[uid])
 
 		return
 	})
@@ -209,90 +271,62 @@ func (impl *fsAccountStorageImpl) GetAdvanceConfig(uid uint64) (cfg *account.Adv
 	return
 }
 
-func (impl *fsAccountStorageImpl) FindAccount(accountName string) (uid uint64, hashedPassword string, err error) {
-	uid, exists, err := impl.GetIDFromAccountName(accountName)
-	if err != nil {
-		return
-	}
-
-	if !exists {
-		err = commerr.ErrNotFound
-
-		return
-	}
-
-	impl.accountStorage.Read(func(m map[uint64]*AccountInfo) {
-		if info, ok := m[uid]; ok {
-			uid = info.ID
-			hashedPassword = info.HashedPassword
-		} else {
-			err = commerr.ErrNotFound
+func (impl *fsAccountStorageImpl) SetTOTP(uid uint64, info *account.TOTPInfo) (err error) {
+	err = impl.accountStorage.Change(func(oldM map[uint64]*AccountInfo) (newM map[uint64]*AccountInfo, err error) {
+		newM = oldM
+		if len(newM) == 0 {
+			newM = make(map[uint64]*AccountInfo)
 		}
-	})
 
-	return
-}
-
-func (impl *fsAccountStorageImpl) GetAccount(uid uint64) (accountName string, hashedPassword string, err error) {
-	impl.accountStorage.Read(func(m map[uint64]*AccountInfo) {
-		if info, ok := m[uid]; ok {
-			accountName = info.AccountName
-			hashedPassword = info.HashedPassword
-		} else {
+		if _, ok := newM[uid]; !ok {
 			err = commerr.ErrNotFound
+
+			return
 		}
-	})
 
-	return
-}
+		newM[uid].TOTP = info
 
-func (impl *fsAccountStorageImpl) GetAccountData(uid uint64) (data []byte, err error) {
-	impl.accountStorage.Read(func(m map[uint64]*AccountInfo) {
-		if info, ok := m[uid]; ok {
-			data = info.Data
-		} else {
-			err = commerr.ErrNotFound
-		}
+		return
 	})
 
 	return
 }
 
-func (impl *fsAccountStorageImpl) HasAccount() (f bool, err error) {
+func (impl *fsAccountStorageImpl) GetTOTP(uid uint64) (info *account.TOTPInfo, err error) {
 	impl.accountStorage.Read(func(m map[uint64]*AccountInfo) {
-		f = len(m) > 0
-	})
+		ai, ok := m[uid]
+		if !ok {
+			err = commerr.ErrNotFound
 
-	return
-}
+			return
+		}
 
-func (impl *fsAccountStorageImpl) ListUsers(createdAtStart, createdAtFinish int64) (accounts []account.User, err error) {
-	impl.accountStorage.Read(func(m map[uint64]*AccountInfo) {
-		accounts = make([]account.User, 0, len(m))
+		if ai.TOTP != nil {
+			newInfo := *ai.TOTP
+			newInfo.RecoveryCodes = append([]string(nil), ai.TOTP.RecoveryCodes...)
 
-		for _, info := range m {
-			if (createdAtStart > 0 && info.CreateAt < createdAtStart) ||
-				(createdAtFinish > 0 && info.CreateAt > createdAtFinish) {
-				continue
+			if ai.TOTP.UsedChallenges != nil {
+				newInfo.UsedChallenges = make(map[string]int64, len(ai.TOTP.UsedChallenges))
+				for jti, expiredAt := range ai.TOTP.UsedChallenges {
+					newInfo.UsedChallenges[jti] = expiredAt
+				}
 			}
 
-			accounts = append(accounts, account.User{
-				UserName: info.AccountName,
-				UserID:   info.ID,
-				CreateAt: info.CreateAt,
-			})
+			info = &newInfo
 		}
 	})
 
 	return
 }
 
-func (impl *fsAccountStorageImpl) RenameAccountName(uid uint64, newAccountName string) error {
-	return impl.accountStorage.Change(func(oldM map[uint64]*AccountInfo) (newM map[uint64]*AccountInfo, err error) {
+func (impl *fsAccountStorageImpl) CompareAndSetTOTP(uid uint64, oldInfo, info *account.TOTPInfo) (err error) {
+	oldD, err := json.Marshal(oldInfo)
+	if err != nil {
+		return
+	}
+
+	err = impl.accountStorage.Change(func(oldM map[uint64]*AccountInfo) (newM map[uint64]*AccountInfo, err error) {
 		newM = oldM
-		if len(newM) == 0 {
-			newM = make(map[uint64]*AccountInfo)
-		}
 
 		ai, ok := newM[uid]
 		if !ok {
@@ -301,199 +335,1356 @@ func (impl *fsAccountStorageImpl) RenameAccountName(uid uint64, newAccountName s
 			return
 		}
 
-		if ai.AccountName == newAccountName {
-			return
-		}
-
-		_, exists, err := impl.GetIDFromAccountName(newAccountName)
+		d, err := json.Marshal(ai.TOTP)
 		if err != nil {
 			return
 		}
 
-		if exists {
-			err = commerr.ErrAlreadyExists
+		if !bytes.Equal(d, oldD) {
+			err = commerr.ErrAborted
 
 			return
 		}
 
-		impl.accountName2UserID.Delete(ai.AccountName)
-		impl.accountName2UserID.Store(newAccountName, uid)
-
-		newM[uid].AccountName = newAccountName
+		ai.TOTP = info
 
 		return
 	})
-}
-
-func (impl *fsAccountStorageImpl) cleanExpiredTokenOnSafe(m map[string]*TokenInfo) (cleanedCount int) {
-	impl.lastCleanExpiredTokenAt = time.Now()
-
-	for k, tokenInfo := range m {
-		if time.Now().After(tokenInfo.ExpiredAt) {
-			delete(m, k)
-
-			cleanedCount++
-		}
-	}
 
 	return
 }
 
-func (impl *fsAccountStorageImpl) AddToken(token string, uid uint64, expiredAt time.Time) error {
-	return impl.tokenStorage.Change(func(oldM map[string]*TokenInfo) (newM map[string]*TokenInfo, err error) {
+func (impl *fsAccountStorageImpl) SetPasswordHistory(uid uint64, hashedPasswords []string) error {
+	return impl.accountStorage.Change(func(oldM map[uint64]*AccountInfo) (newM map[uint64]*AccountInfo, err error) {
 		newM = oldM
-		if len(newM) == 0 {
-			newM = make(map[string]*TokenInfo)
-		}
 
-		if _, ok := newM[token]; ok {
-			err = commerr.ErrAlreadyExists
+		ai, ok := newM[uid]
+		if !ok {
+			err = commerr.ErrNotFound
 
 			return
 		}
 
-		impl.cleanExpiredTokenOnSafe(newM)
+		ai.PasswordHistory = append([]string(nil), hashedPasswords...)
 
-		newM[token] = &TokenInfo{
-			ExpiredAt: expiredAt,
-			UID:       uid,
+		return
+	})
+}
+
+func (impl *fsAccountStorageImpl) GetPasswordHistory(uid uint64) (hashedPasswords []string, err error) {
+	impl.accountStorage.Read(func(m map[uint64]*AccountInfo) {
+		ai, ok := m[uid]
+		if !ok {
+			err = commerr.ErrNotFound
+
+			return
 		}
 
-		return
+		hashedPasswords = append([]string(nil), ai.PasswordHistory...)
 	})
+
+	return
 }
 
-func (impl *fsAccountStorageImpl) DelToken(token string) error {
-	return impl.tokenStorage.Change(func(oldM map[string]*TokenInfo) (newM map[string]*TokenInfo, err error) {
+func (impl *fsAccountStorageImpl) SetAccountState(uid uint64, state account.AccountState) error {
+	return impl.accountStorage.Change(func(oldM map[uint64]*AccountInfo) (newM map[uint64]*AccountInfo, err error) {
 		newM = oldM
-		if len(newM) == 0 {
-			newM = make(map[string]*TokenInfo)
-		}
 
-		if _, ok := newM[token]; !ok {
+		ai, ok := newM[uid]
+		if !ok {
 			err = commerr.ErrNotFound
 
 			return
 		}
 
-		impl.cleanExpiredTokenOnSafe(newM)
-
-		delete(newM, token)
+		ai.State = state
 
 		return
 	})
 }
 
-func (impl *fsAccountStorageImpl) TokenExists(token string, renewDuration time.Duration) (exists bool, err error) {
-	impl.tokenStorage.Read(func(m map[string]*TokenInfo) {
-		_, exists = m[token]
-	})
+func (impl *fsAccountStorageImpl) GetAccountState(uid uint64) (state account.AccountState, err error) {
+	impl.accountStorage.Read(func(m map[uint64]*AccountInfo) {
+		ai, ok := m[uid]
+		if !ok {
+			err = commerr.ErrNotFound
 
-	if exists && renewDuration > 0 {
-		_ = impl.tokenStorage.Change(func(oldM map[string]*TokenInfo) (newM map[string]*TokenInfo, err error) {
-			newM = oldM
-			if len(newM) == 0 {
-				newM = make(map[string]*TokenInfo)
-			}
+			return
+		}
 
-			var i any
+		state = ai.State
+	})
 
-			i, exists = newM[token]
-			if !exists {
-				err = commerr.ErrNotFound
+	return
+}
 
-				return
-			}
+func (impl *fsAccountStorageImpl) DelAccount(uid uint64) (err error) {
+	err = impl.accountStorage.Change(func(oldM map[uint64]*AccountInfo) (newM map[uint64]*AccountInfo, err error) {
+		newM = oldM
 
-			expiredAt, ok := i.(time.Time)
-			if !ok {
-				err = commerr.ErrInternal
+		ai, ok := newM[uid]
+		if !ok {
+			err = commerr.ErrNotFound
 
-				return
-			}
+			return
+		}
 
-			expiredAt = expiredAt.Add(renewDuration)
+		delete(newM, uid)
+		impl.userIndex.remove(ai)
 
-			newM[token].ExpiredAt = expiredAt
+		if id, exists, _ := impl.GetIDFromAccountName(ai.AccountName); exists && id == uid {
+			impl.accountName2UserID.Delete(ai.AccountName)
+		}
 
-			return
-		})
+		return
+	})
+	if err != nil {
+		return
 	}
 
-	if time.Since(impl.lastCleanExpiredTokenAt) > time.Hour {
-		_ = impl.tokenStorage.Change(func(oldM map[string]*TokenInfo) (newM map[string]*TokenInfo, err error) {
-			newM = oldM
-			if len(newM) == 0 {
-				newM = make(map[string]*TokenInfo)
-			}
-
-			if impl.cleanExpiredTokenOnSafe(newM) <= 0 {
-				err = commerr.ErrAborted
+	err = impl.accountPropertyStorage.Change(func(oldM map[uint64][]byte) (newM map[uint64][]byte, err error) {
+		newM = oldM
 
-				return
-			}
+		if _, ok := newM[uid]; !ok {
+			err = commerr.ErrAborted
 
 			return
-		})
-	}
+		}
 
-	return
-}
+		delete(newM, uid)
 
-func (impl *fsAccountStorageImpl) SetPropertyData(accountName string, d interface{}) (err error) {
-	uid, exists, err := impl.GetIDFromAccountName(accountName)
-	if err != nil {
 		return
-	}
-
-	if !exists {
-		err = commerr.ErrNotFound
+	})
 
-		return
+	if errors.Is(err, commerr.ErrAborted) {
+		err = nil
 	}
 
-	return impl.SetPropertyDataByUserID(uid, d)
-}
-
-func (impl *fsAccountStorageImpl) SetPropertyDataByUserID(uid uint64, d interface{}) error {
-	dd, err := json.Marshal(d)
 	if err != nil {
-		return err
+		return
 	}
 
-	return impl.accountPropertyStorage.Change(func(oldM map[uint64][]byte) (newM map[uint64][]byte, err error) {
+	err = impl.propertyNamespaceStorage.Change(func(oldM map[uint64]map[string]*PropertyNamespace) (
+		newM map[uint64]map[string]*PropertyNamespace, err error) {
 		newM = oldM
-		if len(newM) == 0 {
-			newM = make(map[uint64][]byte)
+
+		if _, ok := newM[uid]; !ok {
+			err = commerr.ErrAborted
+
+			return
 		}
 
-		newM[uid] = dd
+		delete(newM, uid)
 
 		return
 	})
-}
 
-func (impl *fsAccountStorageImpl) GetPropertyData(accountName string, d interface{}) error {
-	uid, exists, err := impl.GetIDFromAccountName(accountName)
-	if err != nil {
-		return err
+	if errors.Is(err, commerr.ErrAborted) {
+		err = nil
 	}
 
-	if !exists {
-		return commerr.ErrNotFound
+	if err != nil {
+		return
 	}
 
-	return impl.GetPropertyDataByUserID(uid, d)
-}
+	err = impl.identityStorage.Change(func(oldM map[string]*account.Identity) (newM map[string]*account.Identity, err error) {
+		newM = oldM
 
-func (impl *fsAccountStorageImpl) GetPropertyDataByUserID(uid uint64, d interface{}) (err error) {
-	impl.accountPropertyStorage.Read(func(m map[uint64][]byte) {
-		if dd, ok := m[uid]; ok {
-			err = json.Unmarshal(dd, d)
-		} else {
-			err = commerr.ErrNotFound
-		}
-	})
+		var removedCount int
+
+		for k, identity := range newM {
+			if identity.UID == uid {
+				delete(newM, k)
+
+				removedCount++
+			}
+		}
+
+		if removedCount == 0 {
+			err = commerr.ErrAborted
+		}
+
+		return
+	})
+
+	if errors.Is(err, commerr.ErrAborted) {
+		err = nil
+	}
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) SetContact(uid uint64, contact string, verified bool) error {
+	return impl.accountStorage.Change(func(oldM map[uint64]*AccountInfo) (newM map[uint64]*AccountInfo, err error) {
+		newM = oldM
+
+		ai, ok := newM[uid]
+		if !ok {
+			err = commerr.ErrNotFound
+
+			return
+		}
+
+		ai.Contact = contact
+		ai.ContactVerified = verified
+
+		return
+	})
+}
+
+func (impl *fsAccountStorageImpl) GetContact(uid uint64) (contact string, verified bool, err error) {
+	impl.accountStorage.Read(func(m map[uint64]*AccountInfo) {
+		ai, ok := m[uid]
+		if !ok {
+			err = commerr.ErrNotFound
+
+			return
+		}
+
+		contact = ai.Contact
+		verified = ai.ContactVerified
+	})
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) SetRole(role *account.Role) error {
+	return impl.roleStorage.Change(func(oldM map[string]*account.Role) (newM map[string]*account.Role, err error) {
+		newM = oldM
+		if len(newM) == 0 {
+			newM = make(map[string]*account.Role)
+		}
+
+		newM[role.Name] = copyRole(role)
+
+		return
+	})
+}
+
+func (impl *fsAccountStorageImpl) DelRole(roleName string) (err error) {
+	err = impl.roleStorage.Change(func(oldM map[string]*account.Role) (newM map[string]*account.Role, err error) {
+		newM = oldM
+
+		if _, ok := newM[roleName]; !ok {
+			err = commerr.ErrNotFound
+
+			return
+		}
+
+		delete(newM, roleName)
+
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	err = impl.accountStorage.Change(func(oldM map[uint64]*AccountInfo) (newM map[uint64]*AccountInfo, err error) {
+		newM = oldM
+
+		var changed bool
+
+		for _, ai := range newM {
+			if roles, removed := removeRoleName(ai.Roles, roleName); removed {
+				ai.Roles = roles
+				changed = true
+			}
+		}
+
+		if !changed {
+			err = commerr.ErrAborted
+		}
+
+		return
+	})
+
+	if errors.Is(err, commerr.ErrAborted) {
+		err = nil
+	}
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) GetRole(roleName string) (role *account.Role, err error) {
+	impl.roleStorage.Read(func(m map[string]*account.Role) {
+		r, ok := m[roleName]
+		if !ok {
+			err = commerr.ErrNotFound
+
+			return
+		}
+
+		role = copyRole(r)
+	})
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) ListRoles() (roles []*account.Role, err error) {
+	impl.roleStorage.Read(func(m map[string]*account.Role) {
+		roles = make([]*account.Role, 0, len(m))
+
+		for _, role := range m {
+			roles = append(roles, copyRole(role))
+		}
+	})
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) AssignRole(uid uint64, roleName string) (err error) {
+	impl.roleStorage.Read(func(m map[string]*account.Role) {
+		if _, ok := m[roleName]; !ok {
+			err = commerr.ErrNotFound
+		}
+	})
+
+	if err != nil {
+		return
+	}
+
+	err = impl.accountStorage.Change(func(oldM map[uint64]*AccountInfo) (newM map[uint64]*AccountInfo, err error) {
+		newM = oldM
+
+		ai, ok := newM[uid]
+		if !ok {
+			err = commerr.ErrNotFound
+
+			return
+		}
+
+		for _, r := range ai.Roles {
+			if r == roleName {
+				err = commerr.ErrAborted
+
+				return
+			}
+		}
+
+		ai.Roles = append(ai.Roles, roleName)
+
+		return
+	})
+
+	if errors.Is(err, commerr.ErrAborted) {
+		err = nil
+	}
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) UnassignRole(uid uint64, roleName string) (err error) {
+	err = impl.accountStorage.Change(func(oldM map[uint64]*AccountInfo) (newM map[uint64]*AccountInfo, err error) {
+		newM = oldM
+
+		ai, ok := newM[uid]
+		if !ok {
+			err = commerr.ErrNotFound
+
+			return
+		}
+
+		roles, removed := removeRoleName(ai.Roles, roleName)
+		if !removed {
+			err = commerr.ErrAborted
+
+			return
+		}
+
+		ai.Roles = roles
+
+		return
+	})
+
+	if errors.Is(err, commerr.ErrAborted) {
+		err = nil
+	}
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) GetUserRoles(uid uint64) (roleNames []string, err error) {
+	impl.accountStorage.Read(func(m map[uint64]*AccountInfo) {
+		ai, ok := m[uid]
+		if !ok {
+			err = commerr.ErrNotFound
+
+			return
+		}
+
+		roleNames = append([]string(nil), ai.Roles...)
+	})
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) ListUsersByRole(roleName string) (uids []uint64, err error) {
+	impl.accountStorage.Read(func(m map[uint64]*AccountInfo) {
+		for uid, ai := range m {
+			for _, r := range ai.Roles {
+				if r == roleName {
+					uids = append(uids, uid)
+
+					break
+				}
+			}
+		}
+	})
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) AddAPIKey(info *account.APIKey) error {
+	return impl.apiKeyStorage.Change(func(oldM map[string]*account.APIKey) (newM map[string]*account.APIKey, err error) {
+		newM = oldM
+		if len(newM) == 0 {
+			newM = make(map[string]*account.APIKey)
+		}
+
+		if _, ok := newM[info.KeyID]; ok {
+			err = commerr.ErrAlreadyExists
+
+			return
+		}
+
+		for keyID, key := range newM {
+			if !key.ExpiredAt.IsZero() && time.Now().After(key.ExpiredAt) {
+				delete(newM, keyID)
+			}
+		}
+
+		newM[info.KeyID] = copyAPIKey(info)
+
+		return
+	})
+}
+
+func (impl *fsAccountStorageImpl) GetAPIKey(keyID string) (info *account.APIKey, err error) {
+	impl.apiKeyStorage.Read(func(m map[string]*account.APIKey) {
+		key, ok := m[keyID]
+		if !ok {
+			err = commerr.ErrNotFound
+
+			return
+		}
+
+		info = copyAPIKey(key)
+	})
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) ListAPIKeys(uid uint64) (keys []*account.APIKey, err error) {
+	impl.apiKeyStorage.Read(func(m map[string]*account.APIKey) {
+		for _, key := range m {
+			if key.UID != uid {
+				continue
+			}
+
+			if !key.ExpiredAt.IsZero() && time.Now().After(key.ExpiredAt) {
+				continue
+			}
+
+			keys = append(keys, copyAPIKey(key))
+		}
+	})
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) DelAPIKey(uid uint64, keyID string) error {
+	return impl.apiKeyStorage.Change(func(oldM map[string]*account.APIKey) (newM map[string]*account.APIKey, err error) {
+		newM = oldM
+
+		if key, ok := newM[keyID]; !ok || key.UID != uid {
+			err = commerr.ErrNotFound
+
+			return
+		}
+
+		delete(newM, keyID)
+
+		return
+	})
+}
+
+func (impl *fsAccountStorageImpl) TouchAPIKey(keyID string, lastUsedAt time.Time) error {
+	return impl.apiKeyStorage.Change(func(oldM map[string]*account.APIKey) (newM map[string]*account.APIKey, err error) {
+		newM = oldM
+
+		key, ok := newM[keyID]
+		if !ok {
+			err = commerr.ErrNotFound
+
+			return
+		}
+
+		key.LastUsedAt = lastUsedAt
+
+		return
+	})
+}
+
+func (impl *fsAccountStorageImpl) AddOneTimeToken(hashedToken string, info *account.OneTimeTokenInfo) error {
+	return impl.oneTimeTokenStorage.Change(func(oldM map[string]*account.OneTimeTokenInfo) (newM map[string]*account.OneTimeTokenInfo, err error) {
+		newM = oldM
+		if len(newM) == 0 {
+			newM = make(map[string]*account.OneTimeTokenInfo)
+		}
+
+		if _, ok := newM[hashedToken]; ok {
+			err = commerr.ErrAlreadyExists
+
+			return
+		}
+
+		for t, i := range newM {
+			if time.Now().After(i.ExpiredAt) {
+				delete(newM, t)
+			}
+		}
+
+		newInfo := *info
+		newM[hashedToken] = &newInfo
+
+		return
+	})
+}
+
+func (impl *fsAccountStorageImpl) ConsumeOneTimeToken(hashedToken string) (info *account.OneTimeTokenInfo, err error) {
+	err = impl.oneTimeTokenStorage.Change(func(oldM map[string]*account.OneTimeTokenInfo) (newM map[string]*account.OneTimeTokenInfo, err error) {
+		newM = oldM
+
+		i, ok := newM[hashedToken]
+		if !ok {
+			err = commerr.ErrNotFound
+
+			return
+		}
+
+		delete(newM, hashedToken)
+
+		info = i
+
+		return
+	})
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) DelOneTimeTokens(uid uint64, purpose string) (err error) {
+	err = impl.oneTimeTokenStorage.Change(func(oldM map[string]*account.OneTimeTokenInfo) (newM map[string]*account.OneTimeTokenInfo, err error) {
+		newM = oldM
+
+		var removedCount int
+
+		for t, i := range newM {
+			if i.UID == uid && i.Purpose == purpose {
+				delete(newM, t)
+
+				removedCount++
+			}
+		}
+
+		if removedCount == 0 {
+			err = commerr.ErrAborted
+		}
+
+		return
+	})
+
+	if errors.Is(err, commerr.ErrAborted) {
+		err = nil
+	}
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) LinkIdentity(identity *account.Identity) (err error) {
+	impl.accountStorage.Read(func(m map[uint64]*AccountInfo) {
+		if _, ok := m[identity.UID]; !ok {
+			err = commerr.ErrNotFound
+		}
+	})
+
+	if err != nil {
+		return
+	}
+
+	return impl.identityStorage.Change(func(oldM map[string]*account.Identity) (newM map[string]*account.Identity, err error) {
+		newM = oldM
+		if len(newM) == 0 {
+			newM = make(map[string]*account.Identity)
+		}
+
+		key := identityKey(identity.Provider, identity.Subject)
+
+		if _, ok := newM[key]; ok {
+			err = commerr.ErrAlreadyExists
+
+			return
+		}
+
+		newIdentity := *identity
+		newM[key] = &newIdentity
+
+		return
+	})
+}
+
+func (impl *fsAccountStorageImpl) FindIdentity(provider, subject string) (identity *account.Identity, err error) {
+	impl.identityStorage.Read(func(m map[string]*account.Identity) {
+		if i, ok := m[identityKey(provider, subject)]; ok {
+			newIdentity := *i
+			identity = &newIdentity
+		} else {
+			err = commerr.ErrNotFound
+		}
+	})
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) ListIdentities(uid uint64) (identities []*account.Identity, err error) {
+	impl.identityStorage.Read(func(m map[string]*account.Identity) {
+		for _, identity := range m {
+			if identity.UID == uid {
+				newIdentity := *identity
+				identities = append(identities, &newIdentity)
+			}
+		}
+	})
+
+	sort.Slice(identities, func(i, j int) bool {
+		return identities[i].LinkedAt.Before(identities[j].LinkedAt)
+	})
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) UnlinkIdentity(uid uint64, provider, subject string) error {
+	return impl.identityStorage.Change(func(oldM map[string]*account.Identity) (newM map[string]*account.Identity, err error) {
+		newM = oldM
+
+		key := identityKey(provider, subject)
+
+		if identity, ok := newM[key]; !ok || identity.UID != uid {
+			err = commerr.ErrNotFound
+
+			return
+		}
+
+		delete(newM, key)
+
+		return
+	})
+}
+
+func (impl *fsAccountStorageImpl) FindAccount(accountName string) (uid uint64, hashedPassword string, err error) {
+	uid, exists, err := impl.GetIDFromAccountName(accountName)
+	if err != nil {
+		return
+	}
+
+	if !exists {
+		err = commerr.ErrNotFound
+
+		return
+	}
+
+	impl.accountStorage.Read(func(m map[uint64]*AccountInfo) {
+		if info, ok := m[uid]; ok {
+			uid = info.ID
+			hashedPassword = info.HashedPassword
+		} else {
+			err = commerr.ErrNotFound
+		}
+	})
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) GetAccount(uid uint64) (accountName string, hashedPassword string, err error) {
+	impl.accountStorage.Read(func(m map[uint64]*AccountInfo) {
+		if info, ok := m[uid]; ok {
+			accountName = info.AccountName
+			hashedPassword = info.HashedPassword
+		} else {
+			err = commerr.ErrNotFound
+		}
+	})
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) GetAccountData(uid uint64) (data []byte, err error) {
+	impl.accountStorage.Read(func(m map[uint64]*AccountInfo) {
+		if info, ok := m[uid]; ok {
+			data = info.Data
+		} else {
+			err = commerr.ErrNotFound
+		}
+	})
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) HasAccount() (f bool, err error) {
+	impl.accountStorage.Read(func(m map[uint64]*AccountInfo) {
+		for _, info := range m {
+			if info.State != account.AccountStateDeleted {
+				f = true
+
+				break
+			}
+		}
+	})
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) ListUsers(createdAtStart, createdAtFinish int64) (accounts []account.User, err error) {
+	impl.accountStorage.Read(func(m map[uint64]*AccountInfo) {
+		accounts = make([]account.User, 0, len(m))
+
+		for _, info := range m {
+			if info.State == account.AccountStateDeleted {
+				continue
+			}
+
+			if (createdAtStart > 0 && info.CreateAt < createdAtStart) ||
+				(createdAtFinish > 0 && info.CreateAt > createdAtFinish) {
+				continue
+			}
+
+			accounts = append(accounts, account.User{
+				UserName: info.AccountName,
+				UserID:   info.ID,
+				CreateAt: info.CreateAt,
+			})
+		}
+	})
+
+	sort.Slice(accounts, func(i, j int) bool {
+		if accounts[i].CreateAt != accounts[j].CreateAt {
+			return accounts[i].CreateAt < accounts[j].CreateAt
+		}
+
+		return accounts[i].UserID < accounts[j].UserID
+	})
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) QueryUsers(query *account.UserQuery) (page *account.UserPage, err error) {
+	impl.accountStorage.Read(func(m map[uint64]*AccountInfo) {
+		page, err = impl.userIndex.query(query, func(e *userIndexEntry) (user account.User, ok bool) {
+			ai, exists := m[e.uid]
+			if !exists || !matchUserQuery(query, ai) {
+				return
+			}
+
+			user = account.User{
+				UserName: ai.AccountName,
+				UserID:   ai.ID,
+				CreateAt: ai.CreateAt,
+				State:    accountState(ai),
+			}
+			ok = true
+
+			return
+		})
+	})
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) RenameAccountName(uid uint64, newAccountName string) error {
+	return impl.accountStorage.Change(func(oldM map[uint64]*AccountInfo) (newM map[uint64]*AccountInfo, err error) {
+		newM = oldM
+		if len(newM) == 0 {
+			newM = make(map[uint64]*AccountInfo)
+		}
+
+		ai, ok := newM[uid]
+		if !ok {
+			err = commerr.ErrNotFound
+
+			return
+		}
+
+		if ai.AccountName == newAccountName {
+			return
+		}
+
+		_, exists, err := impl.GetIDFromAccountName(newAccountName)
+		if err != nil {
+			return
+		}
+
+		if exists {
+			err = commerr.ErrAlreadyExists
+
+			return
+		}
+
+		impl.accountName2UserID.Delete(ai.AccountName)
+		impl.accountName2UserID.Store(newAccountName, uid)
+
+		impl.userIndex.remove(ai)
+		newM[uid].AccountName = newAccountName
+		impl.userIndex.add(ai)
+
+		return
+	})
+}
+
+func (impl *fsAccountStorageImpl) cleanExpiredTokenOnSafe(m map[string]*TokenInfo) (cleanedCount int) {
+	impl.lastCleanExpiredTokenAt = time.Now()
+
+	for k, tokenInfo := range m {
+		if time.Now().After(tokenInfo.ExpiredAt) {
+			delete(m, k)
+
+			cleanedCount++
+		}
+	}
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) AddToken(token string, uid uint64, expiredAt time.Time) error {
+	return impl.AddTokenEx(token, uid, expiredAt, nil)
+}
+
+func (impl *fsAccountStorageImpl) AddTokenEx(token string, uid uint64, expiredAt time.Time, session *account.Session) error {
+	return impl.tokenStorage.Change(func(oldM map[string]*TokenInfo) (newM map[string]*TokenInfo, err error) {
+		newM = oldM
+		if len(newM) == 0 {
+			newM = make(map[string]*TokenInfo)
+		}
+
+		impl.cleanExpiredTokenOnSafe(newM)
+
+		if _, ok := newM[token]; ok {
+			err = commerr.ErrAlreadyExists
+
+			return
+		}
+
+		newM[token] = &TokenInfo{
+			ExpiredAt: expiredAt,
+			UID:       uid,
+			Session:   session,
+		}
+
+		return
+	})
+}
+
+func (impl *fsAccountStorageImpl) ListTokens(uid uint64) (tokens map[string]*account.Session, err error) {
+	tokens = make(map[string]*account.Session)
+
+	impl.tokenStorage.Read(func(m map[string]*TokenInfo) {
+		for token, info := range m {
+			if info.UID != uid || time.Now().After(info.ExpiredAt) {
+				continue
+			}
+
+			var session *account.Session
+
+			if info.Session != nil {
+				newSession := *info.Session
+				session = &newSession
+			} else {
+				session = &account.Session{}
+			}
+
+			session.ExpiredAt = info.ExpiredAt
+
+			tokens[token] = session
+		}
+	})
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) DelToken(token string) error {
+	return impl.tokenStorage.Change(func(oldM map[string]*TokenInfo) (newM map[string]*TokenInfo, err error) {
+		newM = oldM
+		if len(newM) == 0 {
+			newM = make(map[string]*TokenInfo)
+		}
+
+		if _, ok := newM[token]; !ok {
+			err = commerr.ErrNotFound
+
+			return
+		}
+
+		impl.cleanExpiredTokenOnSafe(newM)
+
+		delete(newM, token)
+
+		return
+	})
+}
+
+func (impl *fsAccountStorageImpl) TokenExists(token string, renewDuration time.Duration) (exists bool, err error) {
+	impl.tokenStorage.Read(func(m map[string]*TokenInfo) {
+		if info, ok := m[token]; ok {
+			exists = time.Now().Before(info.ExpiredAt)
+		}
+	})
+
+	if exists && renewDuration > 0 {
+		_ = impl.tokenStorage.Change(func(oldM map[string]*TokenInfo) (newM map[string]*TokenInfo, err error) {
+			newM = oldM
+			if len(newM) == 0 {
+				newM = make(map[string]*TokenInfo)
+			}
+
+			info, ok := newM[token]
+			if !ok {
+				exists = false
+				err = commerr.ErrAborted
+
+				return
+			}
+
+			info.ExpiredAt = info.ExpiredAt.Add(renewDuration)
+
+			return
+		})
+	}
+
+	if time.Since(impl.lastCleanExpiredTokenAt) > time.Hour {
+		_ = impl.tokenStorage.Change(func(oldM map[string]*TokenInfo) (newM map[string]*TokenInfo, err error) {
+			newM = oldM
+			if len(newM) == 0 {
+				newM = make(map[string]*TokenInfo)
+			}
+
+			if impl.cleanExpiredTokenOnSafe(newM) <= 0 {
+				err = commerr.ErrAborted
+
+				return
+			}
+
+			return
+		})
+	}
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) cleanExpiredRefreshTokenOnSafe(m map[string]*account.RefreshTokenInfo) {
+	for k, info := range m {
+		if time.Now().After(info.ExpiredAt) {
+			delete(m, k)
+		}
+	}
+}
+
+func (impl *fsAccountStorageImpl) AddRefreshToken(refreshToken string, info *account.RefreshTokenInfo) error {
+	return impl.refreshTokenStorage.Change(func(oldM map[string]*account.RefreshTokenInfo) (newM map[string]*account.RefreshTokenInfo, err error) {
+		newM = oldM
+		if len(newM) == 0 {
+			newM = make(map[string]*account.RefreshTokenInfo)
+		}
+
+		if _, ok := newM[refreshToken]; ok {
+			err = commerr.ErrAlreadyExists
+
+			return
+		}
+
+		impl.cleanExpiredRefreshTokenOnSafe(newM)
+
+		newInfo := *info
+		newM[refreshToken] = &newInfo
+
+		return
+	})
+}
+
+func (impl *fsAccountStorageImpl) GetRefreshToken(refreshToken string) (info *account.RefreshTokenInfo, err error) {
+	impl.refreshTokenStorage.Read(func(m map[string]*account.RefreshTokenInfo) {
+		i, ok := m[refreshToken]
+		if !ok || time.Now().After(i.ExpiredAt) {
+			err = commerr.ErrNotFound
+
+			return
+		}
+
+		newInfo := *i
+		info = &newInfo
+	})
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) RotateRefreshToken(oldRefreshToken, newRefreshToken string, info *account.RefreshTokenInfo) error {
+	return impl.refreshTokenStorage.Change(func(oldM map[string]*account.RefreshTokenInfo) (newM map[string]*account.RefreshTokenInfo, err error) {
+		newM = oldM
+		if len(newM) == 0 {
+			newM = make(map[string]*account.RefreshTokenInfo)
+		}
+
+		oldInfo, ok := newM[oldRefreshToken]
+		if !ok || time.Now().After(oldInfo.ExpiredAt) {
+			err = commerr.ErrNotFound
+
+			return
+		}
+
+		if oldInfo.Rotated {
+			err = account.ErrRefreshTokenReused
+
+			return
+		}
+
+		if _, ok = newM[newRefreshToken]; ok {
+			err = commerr.ErrAlreadyExists
+
+			return
+		}
+
+		oldInfo.Rotated = true
+
+		newInfo := *info
+		newM[newRefreshToken] = &newInfo
+
+		return
+	})
+}
+
+func (impl *fsAccountStorageImpl) RevokeRefreshTokenFamily(familyID string) error {
+	return impl.revokeRefreshTokens(func(info *account.RefreshTokenInfo) bool {
+		return info.FamilyID == familyID
+	})
+}
+
+func (impl *fsAccountStorageImpl) RevokeUserRefreshTokens(uid uint64, exceptFamilyID string) error {
+	return impl.revokeRefreshTokens(func(info *account.RefreshTokenInfo) bool {
+		return info.UID == uid && info.FamilyID != exceptFamilyID
+	})
+}
+
+func (impl *fsAccountStorageImpl) revokeRefreshTokens(match func(info *account.RefreshTokenInfo) bool) error {
+	var accessTokens []string
+
+	err := impl.refreshTokenStorage.Change(func(oldM map[string]*account.RefreshTokenInfo) (newM map[string]*account.RefreshTokenInfo, err error) {
+		newM = oldM
+		if len(newM) == 0 {
+			newM = make(map[string]*account.RefreshTokenInfo)
+		}
+
+		var removedCount int
+
+		for refreshToken, info := range newM {
+			if !match(info) {
+				continue
+			}
+
+			if info.AccessToken != "" {
+				accessTokens = append(accessTokens, info.AccessToken)
+			}
+
+			delete(newM, refreshToken)
+
+			removedCount++
+		}
+
+		if removedCount == 0 {
+			err = commerr.ErrAborted
+		}
+
+		return
+	})
+	if err != nil {
+		if errors.Is(err, commerr.ErrAborted) {
+			err = nil
+		}
+
+		return err
+	}
+
+	return impl.tokenStorage.Change(func(oldM map[string]*TokenInfo) (newM map[string]*TokenInfo, err error) {
+		newM = oldM
+		if len(newM) == 0 {
+			newM = make(map[string]*TokenInfo)
+		}
+
+		for _, token := range accessTokens {
+			delete(newM, token)
+		}
+
+		return
+	})
+}
+
+func (impl *fsAccountStorageImpl) IncLoginFailure(key string, expiresAfter time.Duration) (failures int64, err error) {
+	err = impl.loginFailureStorage.Change(func(oldM map[string]*LoginFailureInfo) (newM map[string]*LoginFailureInfo, err error) {
+		newM = oldM
+		if len(newM) == 0 {
+			newM = make(map[string]*LoginFailureInfo)
+		}
+
+		now := time.Now()
+
+		for k, info := range newM {
+			if now.After(info.ExpiredAt) {
+				delete(newM, k)
+			}
+		}
+
+		info, ok := newM[key]
+		if !ok {
+			info = &LoginFailureInfo{}
+			newM[key] = info
+		}
+
+		info.Failures++
+		info.LastFailedAt = now
+		info.ExpiredAt = now.Add(expiresAfter)
+
+		failures = info.Failures
+
+		return
+	})
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) GetLoginFailure(key string) (failures int64, lastFailedAt time.Time, err error) {
+	impl.loginFailureStorage.Read(func(m map[string]*LoginFailureInfo) {
+		info, ok := m[key]
+		if !ok || time.Now().After(info.ExpiredAt) {
+			return
+		}
+
+		failures = info.Failures
+		lastFailedAt = info.LastFailedAt
+	})
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) ResetLoginFailure(key string) error {
+	err := impl.loginFailureStorage.Change(func(oldM map[string]*LoginFailureInfo) (newM map[string]*LoginFailureInfo, err error) {
+		newM = oldM
+
+		if _, ok := newM[key]; !ok {
+			err = commerr.ErrAborted
+
+			return
+		}
+
+		delete(newM, key)
+
+		return
+	})
+	if errors.Is(err, commerr.ErrAborted) {
+		err = nil
+	}
+
+	return err
+}
+
+func (impl *fsAccountStorageImpl) SetPropertyData(accountName string, d interface{}) (err error) {
+	uid, exists, err := impl.GetIDFromAccountName(accountName)
+	if err != nil {
+		return
+	}
+
+	if !exists {
+		err = commerr.ErrNotFound
+
+		return
+	}
+
+	return impl.SetPropertyDataByUserID(uid, d)
+}
+
+func (impl *fsAccountStorageImpl) SetPropertyDataByUserID(uid uint64, d interface{}) error {
+	dd, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	impl.accountStorage.Read(func(m map[uint64]*AccountInfo) {
+		if _, ok := m[uid]; !ok {
+			err = commerr.ErrNotFound
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return impl.accountPropertyStorage.Change(func(oldM map[uint64][]byte) (newM map[uint64][]byte, err error) {
+		newM = oldM
+		if len(newM) == 0 {
+			newM = make(map[uint64][]byte)
+		}
+
+		newM[uid] = dd
+
+		return
+	})
+}
+
+func (impl *fsAccountStorageImpl) GetPropertyData(accountName string, d interface{}) error {
+	uid, exists, err := impl.GetIDFromAccountName(accountName)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return commerr.ErrNotFound
+	}
+
+	return impl.GetPropertyDataByUserID(uid, d)
+}
+
+func (impl *fsAccountStorageImpl) GetPropertyDataByUserID(uid uint64, d interface{}) (err error) {
+	impl.accountPropertyStorage.Read(func(m map[uint64][]byte) {
+		if dd, ok := m[uid]; ok {
+			err = json.Unmarshal(dd, d)
+		} else {
+			err = commerr.ErrNotFound
+		}
+	})
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) GetPropertyNamespace(uid uint64, ns string) (data []byte, version uint64, err error) {
+	impl.propertyNamespaceStorage.Read(func(m map[uint64]map[string]*PropertyNamespace) {
+		if pn, ok := m[uid][ns]; ok {
+			data = append([]byte(nil), pn.Data...)
+			version = pn.Version
+		}
+	})
+
+	return
+}
+
+func (impl *fsAccountStorageImpl) SetPropertyNamespace(uid uint64, ns string, version uint64, data []byte) (newVersion uint64, err error) {
+	impl.accountStorage.Read(func(m map[uint64]*AccountInfo) {
+		if _, ok := m[uid]; !ok {
+			err = commerr.ErrNotFound
+		}
+	})
+
+	if err != nil {
+		return
+	}
+
+	err = impl.propertyNamespaceStorage.Change(func(oldM map[uint64]map[string]*PropertyNamespace) (
+		newM map[uint64]map[string]*PropertyNamespace, err error) {
+		newM = oldM
+		if len(newM) == 0 {
+			newM = make(map[uint64]map[string]*PropertyNamespace)
+		}
+
+		pn, ok := newM[uid][ns]
+		if !ok {
+			pn = &PropertyNamespace{}
+		}
+
+		if pn.Version != version {
+			err = account.ErrPropertyVersionConflict
+
+			return
+		}
+
+		if newM[uid] == nil {
+			newM[uid] = make(map[string]*PropertyNamespace)
+		}
+
+		newVersion = version + 1
+
+		newM[uid][ns] = &PropertyNamespace{
+			Data:    append([]byte(nil), data...),
+			Version: newVersion,
+		}
+
+		return
+	})
+
+	return
+}
+
+//
+//
+//
+
+func accountState(ai *AccountInfo) account.AccountState {
+	if ai.State == "" {
+		return account.AccountStateActive
+	}
+
+	return ai.State
+}
+
+func matchUserQuery(q *account.UserQuery, ai *AccountInfo) bool {
+	state := accountState(ai)
+
+	if (q.State == "" && state == account.AccountStateDeleted) || (q.State != "" && state != q.State) {
+		return false
+	}
+
+	if !strings.HasPrefix(ai.AccountName, q.NamePrefix) || !strings.Contains(ai.AccountName, q.NameContains) {
+		return false
+	}
+
+	if (q.CreatedAtStart > 0 && ai.CreateAt < q.CreatedAtStart) || (q.CreatedAtFinish > 0 && ai.CreateAt > q.CreatedAtFinish) {
+		return false
+	}
+
+	if q.Role == "" {
+		return true
+	}
+
+	for _, r := range ai.Roles {
+		if r == q.Role {
+			return true
+		}
+	}
+
+	return false
+}
+
+func copyRole(role *account.Role) *account.Role {
+	newRole := *role
+	newRole.Permissions = append([]string(nil), role.Permissions...)
+
+	return &newRole
+}
+
+func copyAPIKey(key *account.APIKey) *account.APIKey {
+	newKey := *key
+	newKey.Scopes = append([]string(nil), key.Scopes...)
+
+	return &newKey
+}
+
+func removeRoleName(roles []string, roleName string) (newRoles []string, removed bool) {
+	for _, r := range roles {
+		if r == roleName {
+			removed = true
+
+			continue
+		}
+
+		newRoles = append(newRoles, r)
+	}
 
 	return
 }
+
+func identityKey(provider, subject string) string {
+	return provider + "\x00" + subject
+}
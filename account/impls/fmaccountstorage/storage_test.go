@@ -0,0 +1,177 @@
+// nolint
+package fmaccountstorage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sgostarter/libcomponents/account"
+	"github.com/sgostarter/libcomponents/account/storagetest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccount(t *testing.T) {
+	storagetest.RunAccountTests(t, func(t *testing.T) account.Storage {
+		return NewFMAccountStorage(t.TempDir(), nil)
+	})
+}
+
+func TestStorage(t *testing.T) {
+	storagetest.RunStorageTests(t, func(t *testing.T) account.Storage {
+		return NewFMAccountStorage(t.TempDir(), nil)
+	})
+}
+
+func TestTenant(t *testing.T) {
+	storagetest.RunTenantTests(t, func(t *testing.T) account.TenantStorageFactory {
+		return NewFMTenantStorageFactory(t.TempDir(), nil, false)
+	})
+}
+
+func newTestAccount(t *testing.T, cfg *account.Config) (account.Account, account.Storage) {
+	stg := NewFMAccountStorage(t.TempDir(), nil)
+
+	if cfg == nil {
+		cfg = &account.Config{}
+	}
+
+	cfg.TokenSignKey = "abcd"
+	cfg.PasswordHashIterCount = 16
+
+	return account.NewAccount(stg, cfg, nil), stg
+}
+
+func TestStatelessWho(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	feedFile := filepath.Join(t.TempDir(), "revocations.log")
+
+	newStatelessConfig := func() *account.Config {
+		return &account.Config{
+			TokenClaimExpiresAfter:   time.Minute,
+			RefreshTokenExpiresAfter: time.Hour,
+			StatelessWho:             true,
+			RevocationFeed:           NewFileRevocationFeed(ctx, feedFile, time.Millisecond*50, nil),
+		}
+	}
+
+	acc1, _ := newTestAccount(t, newStatelessConfig())
+	// acc2 has its own storage, it never sees the tokens of acc1
+	acc2, _ := newTestAccount(t, newStatelessConfig())
+
+	assert.Nil(t, account.NewAccount(NewFMAccountStorage(t.TempDir(), nil), &account.Config{StatelessWho: true}, nil))
+
+	uid, err := acc1.Register("user1", "pass1")
+	assert.Nil(t, err)
+
+	result1, err := acc1.LoginEx("user1", "pass1")
+	assert.Nil(t, err)
+
+	result2, err := acc1.LoginEx("user1", "pass1")
+	assert.Nil(t, err)
+
+	uid2, accountName, err := acc2.Who(result1.Token)
+	assert.Nil(t, err)
+	assert.EqualValues(t, uid, uid2)
+	assert.EqualValues(t, "user1", accountName)
+
+	err = acc1.Logout(result1.Token)
+	assert.Nil(t, err)
+
+	_, _, err = acc1.Who(result1.Token)
+	assert.NotNil(t, err)
+
+	assert.Eventually(t, func() bool {
+		_, _, err = acc2.Who(result1.Token)
+
+		return err != nil
+	}, time.Second, time.Millisecond*10)
+
+	_, _, err = acc2.Who(result2.Token)
+	assert.Nil(t, err)
+
+	// revoking the session also revokes the tokens issued by refresh
+	result3, err := acc1.Refresh(result2.RefreshToken)
+	assert.Nil(t, err)
+
+	err = acc1.RevokeSession(uid, result2.SessionID)
+	assert.Nil(t, err)
+
+	assert.Eventually(t, func() bool {
+		_, _, err2 := acc2.Who(result2.Token)
+		_, _, err3 := acc2.Who(result3.Token)
+
+		return err2 != nil && err3 != nil
+	}, time.Second, time.Millisecond*10)
+
+	// a new instance loads revocations published before
+	acc3, _ := newTestAccount(t, newStatelessConfig())
+
+	_, _, err = acc3.Who(result1.Token)
+	assert.NotNil(t, err)
+}
+
+func TestAuditLog(t *testing.T) {
+	auditFileName := filepath.Join(t.TempDir(), "audit.log")
+
+	acc, _ := newTestAccount(t, &account.Config{
+		AuditSink: NewFileAuditSink(auditFileName, 1024, 2, nil),
+	})
+
+	uid, err := acc.Register("user1", "pass1")
+	assert.Nil(t, err)
+
+	_, err = acc.LoginEx("user1", "bad", account.SessionLoginOption("", "1.2.3.4", ""))
+	assert.NotNil(t, err)
+
+	result, err := acc.LoginEx("user1", "pass1", account.AuditLoginOption(map[string]string{"app": "web"}))
+	assert.Nil(t, err)
+
+	assert.Nil(t, acc.WithAuditMetadata(map[string]string{"operator": "admin"}).ChangePassword(uid, "pass2"))
+	assert.Nil(t, acc.RenameAccountName(uid, "user2"))
+	assert.Nil(t, acc.SetAdvanceConfig(uid, &account.AdvanceConfig{TokenExpiresAfter: time.Hour}))
+	assert.Nil(t, acc.Logout(result.Token))
+
+	events, err := acc.ListAuditEvents(uid, 0)
+	assert.Nil(t, err)
+
+	var actions []account.AuditAction
+
+	for _, event := range events {
+		assert.EqualValues(t, uid, event.UID)
+
+		actions = append(actions, event.Action)
+	}
+
+	assert.EqualValues(t, []account.AuditAction{account.AuditActionLogout, account.AuditActionSetAdvanceConfig,
+		account.AuditActionRenameAccount, account.AuditActionChangePassword, account.AuditActionLogin,
+		account.AuditActionLogin, account.AuditActionRegister}, actions)
+
+	assert.EqualValues(t, "user2", events[2].Metadata["newAccountName"])
+	assert.EqualValues(t, "admin", events[3].Metadata["operator"])
+	assert.EqualValues(t, account.AuditResultSuccess, events[4].Result)
+	assert.EqualValues(t, "web", events[4].Metadata["app"])
+	assert.EqualValues(t, account.AuditResultFailure, events[5].Result)
+	assert.EqualValues(t, "1.2.3.4", events[5].Metadata["clientIP"])
+	assert.EqualValues(t, "user1", events[5].AccountName)
+
+	events, err = acc.ListAuditEvents(uid, 2)
+	assert.Nil(t, err)
+	assert.Len(t, events, 2)
+
+	// rotated files are limited
+	for idx := 0; idx < 50; idx++ {
+		_, _, _ = acc.Login("user2", "bad")
+	}
+
+	assert.FileExists(t, auditFileName+".2")
+	assert.NoFileExists(t, auditFileName+".3")
+
+	events, err = acc.ListAuditEvents(uid, 100)
+	assert.Nil(t, err)
+	assert.True(t, len(events) < 50)
+	assert.EqualValues(t, account.AuditActionLogin, events[0].Action)
+}
@@ -0,0 +1,164 @@
+package fmaccountstorage
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sgostarter/libcomponents/account"
+)
+
+type userIndexEntry struct {
+	uid      uint64
+	name     string
+	createAt int64
+}
+
+func (e *userIndexEntry) sortKey(sortBy account.UserSortField) string {
+	if sortBy == account.UserSortByName {
+		return e.name
+	}
+
+	return strconv.FormatInt(e.createAt, 10)
+}
+
+func lessByName(a, b *userIndexEntry) bool {
+	if a.name != b.name {
+		return a.name < b.name
+	}
+
+	return a.uid < b.uid
+}
+
+func lessByCreateAt(a, b *userIndexEntry) bool {
+	if a.createAt != b.createAt {
+		return a.createAt < b.createAt
+	}
+
+	return a.uid < b.uid
+}
+
+// userIndex keeps accounts sorted by name and by create time, so queries don't sort the whole account map.
+type userIndex struct {
+	lock       sync.RWMutex
+	byName     []*userIndexEntry
+	byCreateAt []*userIndexEntry
+}
+
+func (idx *userIndex) add(ai *AccountInfo) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	e := &userIndexEntry{
+		uid:      ai.ID,
+		name:     ai.AccountName,
+		createAt: ai.CreateAt,
+	}
+
+	idx.byName = insertUserIndexEntry(idx.byName, e, lessByName)
+	idx.byCreateAt = insertUserIndexEntry(idx.byCreateAt, e, lessByCreateAt)
+}
+
+func (idx *userIndex) remove(ai *AccountInfo) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	e := &userIndexEntry{
+		uid:      ai.ID,
+		name:     ai.AccountName,
+		createAt: ai.CreateAt,
+	}
+
+	idx.byName = removeUserIndexEntry(idx.byName, e, lessByName)
+	idx.byCreateAt = removeUserIndexEntry(idx.byCreateAt, e, lessByCreateAt)
+}
+
+// query scans the index from the cursor, match filters the entries and returns the user of them.
+func (idx *userIndex) query(q *account.UserQuery, match func(e *userIndexEntry) (account.User, bool)) (page *account.UserPage, err error) {
+	cursor, err := account.DecodeUserCursor(q.Cursor)
+	if err != nil {
+		return
+	}
+
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	entries, less := idx.byCreateAt, lessByCreateAt
+	if q.SortBy == account.UserSortByName {
+		entries, less = idx.byName, lessByName
+	}
+
+	lo, hi := 0, len(entries)
+
+	if q.SortBy == account.UserSortByName && q.NamePrefix != "" {
+		lo = sort.Search(len(entries), func(i int) bool {
+			return entries[i].name >= q.NamePrefix
+		})
+		hi = sort.Search(len(entries), func(i int) bool {
+			return entries[i].name >= q.NamePrefix && !strings.HasPrefix(entries[i].name, q.NamePrefix)
+		})
+	}
+
+	if cursor != nil {
+		ce := &userIndexEntry{
+			uid:  cursor.UID,
+			name: cursor.SortKey,
+		}
+		ce.createAt, _ = strconv.ParseInt(cursor.SortKey, 10, 64)
+
+		if q.Desc {
+			if i := sort.Search(len(entries), func(i int) bool { return !less(entries[i], ce) }); i < hi {
+				hi = i
+			}
+		} else {
+			if i := sort.Search(len(entries), func(i int) bool { return less(ce, entries[i]) }); i > lo {
+				lo = i
+			}
+		}
+	}
+
+	page = &account.UserPage{}
+
+	var last *userIndexEntry
+
+	for n := 0; n < hi-lo && len(page.Users) < q.Limit; n++ {
+		e := entries[lo+n]
+		if q.Desc {
+			e = entries[hi-1-n]
+		}
+
+		if user, ok := match(e); ok {
+			page.Users = append(page.Users, user)
+			last = e
+		}
+	}
+
+	if len(page.Users) == q.Limit {
+		page.NextCursor = account.EncodeUserCursor(&account.UserCursor{
+			SortKey: last.sortKey(q.SortBy),
+			UID:     last.uid,
+		})
+	}
+
+	return
+}
+
+func insertUserIndexEntry(entries []*userIndexEntry, e *userIndexEntry, less func(a, b *userIndexEntry) bool) []*userIndexEntry {
+	i := sort.Search(len(entries), func(i int) bool { return !less(entries[i], e) })
+
+	entries = append(entries, nil)
+	copy(entries[i+1:], entries[i:])
+	entries[i] = e
+
+	return entries
+}
+
+func removeUserIndexEntry(entries []*userIndexEntry, e *userIndexEntry, less func(a, b *userIndexEntry) bool) []*userIndexEntry {
+	i := sort.Search(len(entries), func(i int) bool { return !less(entries[i], e) })
+	if i < len(entries) && entries[i].uid == e.uid {
+		entries = append(entries[:i], entries[i+1:]...)
+	}
+
+	return entries
+}
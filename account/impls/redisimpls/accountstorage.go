@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"sort"
 	"strconv"
 	"time"
 
@@ -15,7 +16,29 @@ import (
 	"github.com/spf13/cast"
 )
 
+// NewRedisAccountStorage builds the user indexes of the accounts created before them when it opens preKey the first
+// time, so run one instance first when deploying a new version. It returns nil when that fails.
 func NewRedisAccountStorage(preKey string, redisCli *redis.Client, logger l.Wrapper) account.Storage {
+	impl, err := newRedisAccountStorage(preKey, redisCli, logger)
+	if err != nil {
+		return nil
+	}
+
+	return impl
+}
+
+// NewRedisTenantStorageFactory keeps each tenant under "<preKey>t:<tenantID>:", including its name and user indexes.
+func NewRedisTenantStorageFactory(preKey string, redisCli *redis.Client, logger l.Wrapper) account.TenantStorageFactory {
+	return func(tenantID string) (account.Storage, error) {
+		if !account.ValidTenantID(tenantID) {
+			return nil, commerr.ErrInvalidArgument
+		}
+
+		return newRedisAccountStorage(preKey+"t:"+tenantID+":", redisCli, logger)
+	}
+}
+
+func newRedisAccountStorage(preKey string, redisCli *redis.Client, logger l.Wrapper) (*accountsStorage, error) {
 	if logger == nil {
 		logger = l.NewNopLoggerWrapper()
 	}
@@ -26,11 +49,19 @@ func NewRedisAccountStorage(preKey string, redisCli *redis.Client, logger l.Wrap
 		logger.Fatal("no redis client")
 	}
 
-	return &accountsStorage{
+	impl := &accountsStorage{
 		logger:   logger,
 		preKey:   preKey,
 		redisCli: redisCli,
 	}
+
+	if err := impl.migrateUserIndexes(); err != nil {
+		logger.WithFields(l.ErrorField(err)).Error("migrate user indexes failed")
+
+		return nil, err
+	}
+
+	return impl, nil
 }
 
 type accountsStorage struct {
@@ -50,23 +81,40 @@ func (impl *accountsStorage) AddAccountEx(userID uint64, accountName, hashedPass
 		uid = snowflake.ID()
 	}
 
-	err = addAccountScript.Run(context.Background(), impl.redisCli, []string{impl.accountKey(uid),
-		impl.accountNameKey(accountName), impl.accountCreateAtKey()}, uid, accountName, hashedPassword,
-		data, time.Now().Unix()).Err()
+	n, err := addAccountScript.Run(context.Background(), impl.redisCli, []string{impl.accountKey(uid),
+		impl.accountNameKey(accountName), impl.accountCreateAtKey(), impl.usersNameKey()}, uid, accountName, hashedPassword,
+		data, time.Now().Unix()).Int()
+	if err != nil {
+		return
+	}
+
+	if n != 0 {
+		err = commerr.ErrAlreadyExists
+	}
 
 	return
 }
 
 func (impl *accountsStorage) SetHashedPassword(uid uint64, hashedPassword string) (err error) {
-	err = updateAccountPasswordScript.Run(context.Background(), impl.redisCli, []string{impl.accountKey(uid)},
-		hashedPassword).Err()
-
-	return
+	return impl.runAccountUpdateScript(updateAccountPasswordScript, uid, hashedPassword)
 }
 
-func (impl *accountsStorage) RenameAccountName(uid uint64, newAccountName string) error {
-	return updateAccountNameScript.Run(context.Background(), impl.redisCli, []string{impl.accountKey(uid)},
-		newAccountName).Err()
+func (impl *accountsStorage) RenameAccountName(uid uint64, newAccountName string) (err error) {
+	n, err := updateAccountNameScript.Run(context.Background(), impl.redisCli, []string{impl.accountKey(uid),
+		impl.accountNameKey(newAccountName), impl.usersNameKey()}, impl.preKey, newAccountName, uid).Int()
+	if err != nil {
+		return
+	}
+
+	switch n {
+	case 0:
+	case 2:
+		err = commerr.ErrNotFound
+	default:
+		err = commerr.ErrAlreadyExists
+	}
+
+	return
 }
 
 func (impl *accountsStorage) SetAdvanceConfig(uid uint64, cfg *account.AdvanceConfig) (err error) {
@@ -83,18 +131,29 @@ func (impl *accountsStorage) SetAdvanceConfig(uid uint64, cfg *account.AdvanceCo
 		v = string(vb)
 	}
 
-	return updateAccountAdvanceConfigScript.Run(context.Background(), impl.redisCli, []string{impl.accountKey(uid)}, v).Err()
+	return impl.runAccountUpdateScript(updateAccountAdvanceConfigScript, uid, v)
 }
 
 func (impl *accountsStorage) GetAdvanceConfig(uid uint64) (cfg *account.AdvanceConfig, err error) {
-	d, err := impl.redisCli.HGet(context.Background(), impl.accountKey(uid), "adv_cfg").Bytes()
+	is, err := impl.redisCli.HMGet(context.Background(), impl.accountKey(uid), "name", "adv_cfg").Result()
 	if err != nil {
 		return
 	}
 
+	if is[0] == nil {
+		err = commerr.ErrNotFound
+
+		return
+	}
+
+	d := cast.ToString(is[1])
+	if d == "" {
+		return
+	}
+
 	cfg = new(account.AdvanceConfig)
 
-	err = json.Unmarshal(d, cfg)
+	err = json.Unmarshal([]byte(d), cfg)
 
 	return
 }
@@ -102,10 +161,17 @@ func (impl *accountsStorage) GetAdvanceConfig(uid uint64) (cfg *account.AdvanceC
 func (impl *accountsStorage) FindAccount(accountName string) (uid uint64, hashedPassword string, err error) {
 	uid, err = impl.redisCli.Get(context.Background(), impl.accountNameKey(accountName)).Uint64()
 	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			err = commerr.ErrNotFound
+		}
+
 		return
 	}
 
 	hashedPassword, err = impl.redisCli.HGet(context.Background(), impl.accountKey(uid), "pass").Result()
+	if errors.Is(err, redis.Nil) {
+		err = commerr.ErrNotFound
+	}
 
 	return
 }
@@ -116,6 +182,12 @@ func (impl *accountsStorage) GetAccount(uid uint64) (accountName string, hashedP
 		return
 	}
 
+	if is[0] == nil {
+		err = commerr.ErrNotFound
+
+		return
+	}
+
 	accountName, err = cast.ToStringE(is[0])
 	if err != nil {
 		return
@@ -128,6 +200,9 @@ func (impl *accountsStorage) GetAccount(uid uint64) (accountName string, hashedP
 
 func (impl *accountsStorage) GetAccountData(uid uint64) (data []byte, err error) {
 	data, err = impl.redisCli.HGet(context.Background(), impl.accountKey(uid), "data").Bytes()
+	if errors.Is(err, redis.Nil) {
+		err = commerr.ErrNotFound
+	}
 
 	return
 }
@@ -219,23 +294,102 @@ func (impl *accountsStorage) GetIDFromAccountName(accountName string) (uid uint6
 }
 
 func (impl *accountsStorage) AddToken(token string, uid uint64, expiredAt time.Time) error {
+	return impl.AddTokenEx(token, uid, expiredAt, nil)
+}
+
+func (impl *accountsStorage) AddTokenEx(token string, uid uint64, expiredAt time.Time, session *account.Session) error {
 	d := time.Until(expiredAt)
 	if d <= 0 {
 		return nil
 	}
 
-	return tokenAddScript.Run(context.Background(), impl.redisCli, []string{impl.accountTokenKey(token),
-		impl.accountIdTokensKey(uid)}, token, uid, int64(d.Seconds())).Err()
+	sessionD, err := marshalSession(session)
+	if err != nil {
+		return err
+	}
+
+	n, err := tokenAddScript.Run(context.Background(), impl.redisCli, []string{impl.accountTokenKey(token),
+		impl.accountIdTokensKey(uid), impl.accountTokenSessionKey(token)}, token, uid, int64(d.Seconds()), sessionD).Int()
+	if err != nil {
+		return err
+	}
+
+	if n != 0 {
+		return commerr.ErrAlreadyExists
+	}
+
+	return nil
+}
+
+func (impl *accountsStorage) ListTokens(uid uint64) (tokens map[string]*account.Session, err error) {
+	members, err := impl.redisCli.SMembers(context.Background(), impl.accountIdTokensKey(uid)).Result()
+	if err != nil {
+		return
+	}
+
+	pipe := impl.redisCli.Pipeline()
+
+	ttlCmds := make([]*redis.DurationCmd, 0, len(members))
+	sessionCmds := make([]*redis.StringCmd, 0, len(members))
+
+	for _, token := range members {
+		ttlCmds = append(ttlCmds, pipe.PTTL(context.Background(), impl.accountTokenKey(token)))
+		sessionCmds = append(sessionCmds, pipe.Get(context.Background(), impl.accountTokenSessionKey(token)))
+	}
+
+	_, err = pipe.Exec(context.Background())
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return
+	}
+
+	err = nil
+
+	tokens = make(map[string]*account.Session, len(members))
+
+	var expiredTokens []interface{}
+
+	for idx, token := range members {
+		ttl := ttlCmds[idx].Val()
+		if ttl == -2 {
+			expiredTokens = append(expiredTokens, token)
+
+			continue
+		}
+
+		session := &account.Session{}
+
+		if d, e := sessionCmds[idx].Bytes(); e == nil && len(d) > 0 {
+			if e = json.Unmarshal(d, session); e != nil {
+				impl.logger.WithFields(l.ErrorField(e)).Error("invalid token session")
+			}
+		}
+
+		if ttl > 0 {
+			session.ExpiredAt = time.Now().Add(ttl)
+		}
+
+		tokens[token] = session
+	}
+
+	if len(expiredTokens) > 0 {
+		_ = impl.redisCli.SRem(context.Background(), impl.accountIdTokensKey(uid), expiredTokens...).Err()
+	}
+
+	return
 }
 
 func (impl *accountsStorage) DelToken(token string) (err error) {
 	uid, err := impl.redisCli.Get(context.Background(), impl.accountTokenKey(token)).Uint64()
 	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			err = commerr.ErrNotFound
+		}
+
 		return
 	}
 
 	err = tokenDelScript.Run(context.Background(), impl.redisCli, []string{impl.accountTokenKey(token),
-		impl.accountIdTokensKey(uid)}, token).Err()
+		impl.accountIdTokensKey(uid), impl.accountTokenSessionKey(token)}, token).Err()
 
 	return
 }
@@ -243,54 +397,158 @@ func (impl *accountsStorage) DelToken(token string) (err error) {
 func (impl *accountsStorage) TokenExists(token string, renewDuration time.Duration) (exists bool, err error) {
 	seconds := int64(renewDuration.Seconds())
 
-	exists, err = tokenCheckScript.Run(context.Background(), impl.redisCli, []string{impl.accountTokenKey(token)},
-		seconds).Bool()
+	exists, err = tokenCheckScript.Run(context.Background(), impl.redisCli, []string{impl.accountTokenKey(token),
+		impl.accountTokenSessionKey(token)}, seconds).Bool()
 
 	return
 }
 
-func (impl *accountsStorage) SetPropertyData(accountName string, d interface{}) (err error) {
-	uid, exists, err := impl.GetIDFromAccountName(accountName)
+func (impl *accountsStorage) AddRefreshToken(refreshToken string, info *account.RefreshTokenInfo) error {
+	if time.Until(info.ExpiredAt) <= 0 {
+		return nil
+	}
+
+	sessionD, err := marshalSession(info.Session)
+	if err != nil {
+		return err
+	}
+
+	return refreshTokenAddScript.Run(context.Background(), impl.redisCli, []string{impl.refreshTokenKey(refreshToken),
+		impl.refreshTokenFamilyKey(info.FamilyID), impl.userRefreshTokenFamiliesKey(info.UID)}, refreshToken, info.UID,
+		info.FamilyID, info.AccessToken, info.ExpiredAt.Unix(), sessionD).Err()
+}
+
+func (impl *accountsStorage) GetRefreshToken(refreshToken string) (info *account.RefreshTokenInfo, err error) {
+	m, err := impl.redisCli.HGetAll(context.Background(), impl.refreshTokenKey(refreshToken)).Result()
 	if err != nil {
 		return
 	}
 
-	if !exists {
+	if len(m) == 0 {
 		err = commerr.ErrNotFound
 
 		return
 	}
 
-	return impl.SetPropertyDataByUserID(uid, d)
+	info = &account.RefreshTokenInfo{
+		UID:         cast.ToUint64(m["uid"]),
+		FamilyID:    m["family"],
+		AccessToken: m["access"],
+		ExpiredAt:   time.Unix(cast.ToInt64(m["expired_at"]), 0),
+		Rotated:     m["rotated"] == "1",
+	}
+
+	if m["session"] != "" {
+		info.Session = &account.Session{}
+
+		err = json.Unmarshal([]byte(m["session"]), info.Session)
+	}
+
+	return
 }
 
-func (impl *accountsStorage) SetPropertyDataByUserID(uid uint64, data interface{}) (err error) {
-	d, err := json.Marshal(data)
+func (impl *accountsStorage) RotateRefreshToken(oldRefreshToken, newRefreshToken string, info *account.RefreshTokenInfo) (err error) {
+	sessionD, err := marshalSession(info.Session)
+	if err != nil {
+		return
+	}
+
+	n, err := refreshTokenRotateScript.Run(context.Background(), impl.redisCli, []string{impl.refreshTokenKey(oldRefreshToken),
+		impl.refreshTokenKey(newRefreshToken), impl.refreshTokenFamilyKey(info.FamilyID),
+		impl.userRefreshTokenFamiliesKey(info.UID)}, newRefreshToken, info.UID, info.FamilyID, info.AccessToken,
+		info.ExpiredAt.Unix(), sessionD).Int()
 	if err != nil {
 		return
 	}
 
-	return updateAccountPropertyDataScript.Run(context.Background(), impl.redisCli, []string{impl.accountKey(uid)},
-		d).Err()
+	switch n {
+	case 0:
+	case 1:
+		err = commerr.ErrNotFound
+	case 2:
+		err = account.ErrRefreshTokenReused
+	case 3:
+		err = commerr.ErrAlreadyExists
+	default:
+		err = commerr.ErrInternal
+	}
+
+	return
 }
 
-func (impl *accountsStorage) GetPropertyData(accountName string, d interface{}) (err error) {
-	uid, exists, err := impl.GetIDFromAccountName(accountName)
+func (impl *accountsStorage) RevokeRefreshTokenFamily(familyID string) error {
+	return refreshTokenFamilyRevokeScript.Run(context.Background(), impl.redisCli, []string{impl.refreshTokenFamilyKey(familyID)},
+		impl.preKey, familyID).Err()
+}
+
+func (impl *accountsStorage) RevokeUserRefreshTokens(uid uint64, exceptFamilyID string) (err error) {
+	familyIDs, err := impl.redisCli.SMembers(context.Background(), impl.userRefreshTokenFamiliesKey(uid)).Result()
 	if err != nil {
 		return
 	}
 
-	if !exists {
-		err = commerr.ErrNotFound
+	for _, familyID := range familyIDs {
+		if familyID == exceptFamilyID {
+			continue
+		}
+
+		err = impl.RevokeRefreshTokenFamily(familyID)
+		if err != nil {
+			return
+		}
+
+		// families which expired by themselves are left in the index
+		err = impl.redisCli.SRem(context.Background(), impl.userRefreshTokenFamiliesKey(uid), familyID).Err()
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
 
+func (impl *accountsStorage) IncLoginFailure(key string, expiresAfter time.Duration) (failures int64, err error) {
+	failures, err = loginFailureIncScript.Run(context.Background(), impl.redisCli, []string{impl.loginFailureKey(key)},
+		time.Now().UnixMilli(), expiresAfter.Milliseconds()).Int64()
+
+	return
+}
+
+func (impl *accountsStorage) GetLoginFailure(key string) (failures int64, lastFailedAt time.Time, err error) {
+	is, err := impl.redisCli.HMGet(context.Background(), impl.loginFailureKey(key), "failures", "last_at").Result()
+	if err != nil {
 		return
 	}
 
-	return impl.GetPropertyDataByUserID(uid, d)
+	failures = cast.ToInt64(is[0])
+	lastFailedAt = time.UnixMilli(cast.ToInt64(is[1]))
+
+	return
 }
 
-func (impl *accountsStorage) GetPropertyDataByUserID(uid uint64, d interface{}) (err error) {
-	ds, err := impl.redisCli.HGet(context.Background(), impl.accountKey(uid), "property_data").Bytes()
+func (impl *accountsStorage) ResetLoginFailure(key string) error {
+	return impl.redisCli.Del(context.Background(), impl.loginFailureKey(key)).Err()
+}
+
+func (impl *accountsStorage) SetTOTP(uid uint64, info *account.TOTPInfo) (err error) {
+	var v string
+
+	if info != nil {
+		var vb []byte
+
+		vb, err = json.Marshal(info)
+		if err != nil {
+			return
+		}
+
+		v = string(vb)
+	}
+
+	return impl.runAccountUpdateScript(updateAccountTOTPScript, uid, v)
+}
+
+func (impl *accountsStorage) GetTOTP(uid uint64) (info *account.TOTPInfo, err error) {
+	d, err := impl.redisCli.HGet(context.Background(), impl.accountKey(uid), "totp").Bytes()
 	if err != nil {
 		if errors.Is(err, redis.Nil) {
 			err = nil
@@ -299,31 +557,746 @@ func (impl *accountsStorage) GetPropertyDataByUserID(uid uint64, d interface{})
 		return
 	}
 
-	err = json.Unmarshal(ds, d)
+	if len(d) == 0 {
+		return
+	}
+
+	info = new(account.TOTPInfo)
+
+	err = json.Unmarshal(d, info)
 
 	return
 }
 
-//
-//
-//
+func (impl *accountsStorage) CompareAndSetTOTP(uid uint64, oldInfo, info *account.TOTPInfo) (err error) {
+	var oldV, v string
 
-func (impl *accountsStorage) accountKey(userID uint64) string {
-	return impl.preKey + "uid:" + strconv.FormatUint(userID, 10)
+	if oldInfo != nil {
+		var vb []byte
+
+		vb, err = json.Marshal(oldInfo)
+		if err != nil {
+			return
+		}
+
+		oldV = string(vb)
+	}
+
+	if info != nil {
+		var vb []byte
+
+		vb, err = json.Marshal(info)
+		if err != nil {
+			return
+		}
+
+		v = string(vb)
+	}
+
+	n, err := compareAndSetAccountTOTPScript.Run(context.Background(), impl.redisCli, []string{impl.accountKey(uid)},
+		oldV, v).Int()
+	if err != nil {
+		return
+	}
+
+	switch n {
+	case 1:
+		err = commerr.ErrNotFound
+	case 2:
+		err = commerr.ErrAborted
+	}
+
+	return
 }
 
-func (impl *accountsStorage) accountNameKey(userName string) string {
-	return impl.preKey + "un:" + userName
+func (impl *accountsStorage) SetPasswordHistory(uid uint64, hashedPasswords []string) (err error) {
+	v, err := json.Marshal(hashedPasswords)
+	if err != nil {
+		return
+	}
+
+	return impl.runAccountUpdateScript(updateAccountPasswordHistoryScript, uid, string(v))
 }
 
-func (impl *accountsStorage) accountCreateAtKey() string {
-	return impl.preKey + "users:create_at"
+func (impl *accountsStorage) GetPasswordHistory(uid uint64) (hashedPasswords []string, err error) {
+	vs, err := impl.redisCli.HMGet(context.Background(), impl.accountKey(uid), "name", "pwdHistory").Result()
+	if err != nil {
+		return
+	}
+
+	if vs[0] == nil {
+		err = commerr.ErrNotFound
+
+		return
+	}
+
+	if d, ok := vs[1].(string); ok && d != "" {
+		err = json.Unmarshal([]byte(d), &hashedPasswords)
+	}
+
+	return
 }
 
-func (impl *accountsStorage) accountTokenKey(token string) string {
-	return impl.preKey + "utk:" + token
+func (impl *accountsStorage) SetAccountState(uid uint64, state account.AccountState) (err error) {
+	n, err := updateAccountStateScript.Run(context.Background(), impl.redisCli, []string{impl.accountKey(uid),
+		impl.accountCreateAtKey(), impl.usersDeletedKey()}, string(state), uid).Int()
+	if err != nil {
+		return
+	}
+
+	if n != 0 {
+		err = commerr.ErrNotFound
+	}
+
+	return
 }
 
-func (impl *accountsStorage) accountIdTokensKey(userID uint64) string {
-	return impl.preKey + "utk-s:" + strconv.FormatUint(userID, 10)
+func (impl *accountsStorage) GetAccountState(uid uint64) (state account.AccountState, err error) {
+	is, err := impl.redisCli.HMGet(context.Background(), impl.accountKey(uid), "name", "state").Result()
+	if err != nil {
+		return
+	}
+
+	if is[0] == nil {
+		err = commerr.ErrNotFound
+
+		return
+	}
+
+	state = account.AccountState(cast.ToString(is[1]))
+
+	return
+}
+
+func (impl *accountsStorage) DelAccount(uid uint64) (err error) {
+	n, err := delAccountScript.Run(context.Background(), impl.redisCli, []string{impl.accountKey(uid),
+		impl.accountCreateAtKey(), impl.usersDeletedKey(), impl.usersNameKey()}, impl.preKey, uid).Int()
+	if err != nil {
+		return
+	}
+
+	if n != 0 {
+		err = commerr.ErrNotFound
+	}
+
+	return
+}
+
+func (impl *accountsStorage) SetContact(uid uint64, contact string, verified bool) error {
+	return impl.runAccountUpdateScript(updateAccountContactScript, uid, contact, verified)
+}
+
+func (impl *accountsStorage) GetContact(uid uint64) (contact string, verified bool, err error) {
+	is, err := impl.redisCli.HMGet(context.Background(), impl.accountKey(uid), "name", "contact", "contact_verified").Result()
+	if err != nil {
+		return
+	}
+
+	if is[0] == nil {
+		err = commerr.ErrNotFound
+
+		return
+	}
+
+	contact = cast.ToString(is[1])
+	verified = cast.ToBool(is[2])
+
+	return
+}
+
+func (impl *accountsStorage) SetRole(role *account.Role) error {
+	d, err := json.Marshal(role)
+	if err != nil {
+		return err
+	}
+
+	return impl.redisCli.HSet(context.Background(), impl.rolesKey(), role.Name, d).Err()
+}
+
+func (impl *accountsStorage) DelRole(roleName string) (err error) {
+	n, err := roleDelScript.Run(context.Background(), impl.redisCli, []string{impl.rolesKey(), impl.roleUsersKey(roleName),
+		impl.roleUsersCreateAtKey(roleName), impl.roleUsersNameKey(roleName)}, impl.preKey, roleName).Int()
+	if err != nil {
+		return
+	}
+
+	if n != 0 {
+		err = commerr.ErrNotFound
+	}
+
+	return
+}
+
+func (impl *accountsStorage) GetRole(roleName string) (role *account.Role, err error) {
+	d, err := impl.redisCli.HGet(context.Background(), impl.rolesKey(), roleName).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			err = commerr.ErrNotFound
+		}
+
+		return
+	}
+
+	role = new(account.Role)
+
+	err = json.Unmarshal(d, role)
+
+	return
+}
+
+func (impl *accountsStorage) ListRoles() (roles []*account.Role, err error) {
+	m, err := impl.redisCli.HGetAll(context.Background(), impl.rolesKey()).Result()
+	if err != nil {
+		return
+	}
+
+	roles = make([]*account.Role, 0, len(m))
+
+	for _, d := range m {
+		role := new(account.Role)
+
+		err = json.Unmarshal([]byte(d), role)
+		if err != nil {
+			return
+		}
+
+		roles = append(roles, role)
+	}
+
+	return
+}
+
+func (impl *accountsStorage) AssignRole(uid uint64, roleName string) (err error) {
+	n, err := roleAssignScript.Run(context.Background(), impl.redisCli, []string{impl.rolesKey(), impl.accountKey(uid),
+		impl.userRolesKey(uid), impl.roleUsersKey(roleName), impl.roleUsersCreateAtKey(roleName),
+		impl.roleUsersNameKey(roleName)}, roleName, uid).Int()
+	if err != nil {
+		return
+	}
+
+	if n != 0 {
+		err = commerr.ErrNotFound
+	}
+
+	return
+}
+
+func (impl *accountsStorage) UnassignRole(uid uint64, roleName string) error {
+	return roleUnassignScript.Run(context.Background(), impl.redisCli, []string{impl.accountKey(uid), impl.userRolesKey(uid),
+		impl.roleUsersKey(roleName), impl.roleUsersCreateAtKey(roleName), impl.roleUsersNameKey(roleName)}, roleName, uid).Err()
+}
+
+func (impl *accountsStorage) GetUserRoles(uid uint64) (roleNames []string, err error) {
+	roleNames, err = impl.redisCli.SMembers(context.Background(), impl.userRolesKey(uid)).Result()
+	if err != nil || len(roleNames) > 0 {
+		return
+	}
+
+	n, err := impl.redisCli.Exists(context.Background(), impl.accountKey(uid)).Result()
+	if err != nil {
+		return
+	}
+
+	if n == 0 {
+		err = commerr.ErrNotFound
+	}
+
+	return
+}
+
+func (impl *accountsStorage) ListUsersByRole(roleName string) (uids []uint64, err error) {
+	ss, err := impl.redisCli.SMembers(context.Background(), impl.roleUsersKey(roleName)).Result()
+	if err != nil {
+		return
+	}
+
+	for _, s := range ss {
+		uids = append(uids, cast.ToUint64(s))
+	}
+
+	return
+}
+
+func (impl *accountsStorage) AddAPIKey(info *account.APIKey) (err error) {
+	d, err := json.Marshal(info)
+	if err != nil {
+		return
+	}
+
+	var expireAt int64
+
+	if !info.ExpiredAt.IsZero() {
+		expireAt = info.ExpiredAt.UnixMilli()
+	}
+
+	n, err := apiKeyAddScript.Run(context.Background(), impl.redisCli, []string{impl.apiKeyKey(info.KeyID),
+		impl.userAPIKeysKey(info.UID)}, d, info.KeyID, expireAt).Int()
+	if err != nil {
+		return
+	}
+
+	if n != 0 {
+		err = commerr.ErrAlreadyExists
+	}
+
+	return
+}
+
+func (impl *accountsStorage) GetAPIKey(keyID string) (info *account.APIKey, err error) {
+	is, err := impl.redisCli.HMGet(context.Background(), impl.apiKeyKey(keyID), "info", "last_used").Result()
+	if err != nil {
+		return
+	}
+
+	d, ok := is[0].(string)
+	if !ok {
+		err = commerr.ErrNotFound
+
+		return
+	}
+
+	info = new(account.APIKey)
+
+	err = json.Unmarshal([]byte(d), info)
+	if err != nil {
+		return
+	}
+
+	if lastUsedAt := cast.ToInt64(is[1]); lastUsedAt > 0 {
+		info.LastUsedAt = time.UnixMilli(lastUsedAt)
+	}
+
+	return
+}
+
+func (impl *accountsStorage) ListAPIKeys(uid uint64) (keys []*account.APIKey, err error) {
+	keyIDs, err := impl.redisCli.SMembers(context.Background(), impl.userAPIKeysKey(uid)).Result()
+	if err != nil {
+		return
+	}
+
+	for _, keyID := range keyIDs {
+		info, e := impl.GetAPIKey(keyID)
+		if e != nil {
+			if !errors.Is(e, commerr.ErrNotFound) {
+				err = e
+
+				return
+			}
+
+			// expired
+			_ = impl.redisCli.SRem(context.Background(), impl.userAPIKeysKey(uid), keyID).Err()
+
+			continue
+		}
+
+		if !info.ExpiredAt.IsZero() && time.Now().After(info.ExpiredAt) {
+			continue
+		}
+
+		keys = append(keys, info)
+	}
+
+	return
+}
+
+func (impl *accountsStorage) DelAPIKey(uid uint64, keyID string) (err error) {
+	var delCmd *redis.IntCmd
+
+	_, err = impl.redisCli.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		delCmd = pipe.Del(context.Background(), impl.apiKeyKey(keyID))
+		pipe.SRem(context.Background(), impl.userAPIKeysKey(uid), keyID)
+
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	if delCmd.Val() == 0 {
+		err = commerr.ErrNotFound
+	}
+
+	return
+}
+
+func (impl *accountsStorage) TouchAPIKey(keyID string, lastUsedAt time.Time) (err error) {
+	n, err := apiKeyTouchScript.Run(context.Background(), impl.redisCli, []string{impl.apiKeyKey(keyID)},
+		lastUsedAt.UnixMilli()).Int()
+	if err != nil {
+		return
+	}
+
+	if n != 0 {
+		err = commerr.ErrNotFound
+	}
+
+	return
+}
+
+func (impl *accountsStorage) AddOneTimeToken(hashedToken string, info *account.OneTimeTokenInfo) (err error) {
+	d, err := json.Marshal(info)
+	if err != nil {
+		return
+	}
+
+	expiresAfter := time.Until(info.ExpiredAt).Milliseconds()
+	if expiresAfter <= 0 {
+		return
+	}
+
+	n, err := oneTimeTokenAddScript.Run(context.Background(), impl.redisCli, []string{impl.oneTimeTokenKey(hashedToken),
+		impl.userOneTimeTokensKey(info.UID, info.Purpose)}, d, hashedToken, expiresAfter).Int()
+	if err != nil {
+		return
+	}
+
+	if n != 0 {
+		err = commerr.ErrAlreadyExists
+	}
+
+	return
+}
+
+func (impl *accountsStorage) ConsumeOneTimeToken(hashedToken string) (info *account.OneTimeTokenInfo, err error) {
+	d, err := oneTimeTokenConsumeScript.Run(context.Background(), impl.redisCli, []string{impl.oneTimeTokenKey(hashedToken)}).Text()
+	if err != nil {
+		return
+	}
+
+	if d == "" {
+		err = commerr.ErrNotFound
+
+		return
+	}
+
+	info = new(account.OneTimeTokenInfo)
+
+	err = json.Unmarshal([]byte(d), info)
+
+	return
+}
+
+func (impl *accountsStorage) DelOneTimeTokens(uid uint64, purpose string) error {
+	return oneTimeTokensDelScript.Run(context.Background(), impl.redisCli, []string{impl.userOneTimeTokensKey(uid, purpose)},
+		impl.preKey).Err()
+}
+
+func (impl *accountsStorage) LinkIdentity(identity *account.Identity) (err error) {
+	d, err := json.Marshal(identity)
+	if err != nil {
+		return
+	}
+
+	n, err := identityLinkScript.Run(context.Background(), impl.redisCli, []string{impl.accountKey(identity.UID),
+		impl.identitiesKey(), impl.userIdentitiesKey(identity.UID)}, identityField(identity.Provider, identity.Subject),
+		d).Int()
+	if err != nil {
+		return
+	}
+
+	switch n {
+	case 0:
+	case 1:
+		err = commerr.ErrNotFound
+	default:
+		err = commerr.ErrAlreadyExists
+	}
+
+	return
+}
+
+func (impl *accountsStorage) FindIdentity(provider, subject string) (identity *account.Identity, err error) {
+	d, err := impl.redisCli.HGet(context.Background(), impl.identitiesKey(), identityField(provider, subject)).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			err = commerr.ErrNotFound
+		}
+
+		return
+	}
+
+	identity = new(account.Identity)
+
+	err = json.Unmarshal(d, identity)
+
+	return
+}
+
+func (impl *accountsStorage) ListIdentities(uid uint64) (identities []*account.Identity, err error) {
+	fields, err := impl.redisCli.SMembers(context.Background(), impl.userIdentitiesKey(uid)).Result()
+	if err != nil || len(fields) == 0 {
+		return
+	}
+
+	is, err := impl.redisCli.HMGet(context.Background(), impl.identitiesKey(), fields...).Result()
+	if err != nil {
+		return
+	}
+
+	for _, i := range is {
+		d, ok := i.(string)
+		if !ok {
+			continue
+		}
+
+		identity := new(account.Identity)
+
+		if e := json.Unmarshal([]byte(d), identity); e != nil {
+			impl.logger.WithFields(l.ErrorField(e)).Error("invalid identity")
+
+			continue
+		}
+
+		identities = append(identities, identity)
+	}
+
+	sort.Slice(identities, func(i, j int) bool {
+		return identities[i].LinkedAt.Before(identities[j].LinkedAt)
+	})
+
+	return
+}
+
+func (impl *accountsStorage) UnlinkIdentity(uid uint64, provider, subject string) (err error) {
+	n, err := identityUnlinkScript.Run(context.Background(), impl.redisCli, []string{impl.identitiesKey(),
+		impl.userIdentitiesKey(uid)}, identityField(provider, subject)).Int()
+	if err != nil {
+		return
+	}
+
+	if n != 0 {
+		err = commerr.ErrNotFound
+	}
+
+	return
+}
+
+func (impl *accountsStorage) SetPropertyData(accountName string, d interface{}) (err error) {
+	uid, exists, err := impl.GetIDFromAccountName(accountName)
+	if err != nil {
+		return
+	}
+
+	if !exists {
+		err = commerr.ErrNotFound
+
+		return
+	}
+
+	return impl.SetPropertyDataByUserID(uid, d)
+}
+
+func (impl *accountsStorage) SetPropertyDataByUserID(uid uint64, data interface{}) (err error) {
+	d, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+
+	return impl.runAccountUpdateScript(updateAccountPropertyDataScript, uid, d)
+}
+
+func (impl *accountsStorage) GetPropertyData(accountName string, d interface{}) (err error) {
+	uid, exists, err := impl.GetIDFromAccountName(accountName)
+	if err != nil {
+		return
+	}
+
+	if !exists {
+		err = commerr.ErrNotFound
+
+		return
+	}
+
+	return impl.GetPropertyDataByUserID(uid, d)
+}
+
+func (impl *accountsStorage) GetPropertyDataByUserID(uid uint64, d interface{}) (err error) {
+	ds, err := impl.redisCli.HGet(context.Background(), impl.accountKey(uid), "property_data").Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			err = commerr.ErrNotFound
+		}
+
+		return
+	}
+
+	err = json.Unmarshal(ds, d)
+
+	return
+}
+
+func (impl *accountsStorage) GetPropertyNamespace(uid uint64, ns string) (data []byte, version uint64, err error) {
+	is, err := impl.redisCli.HMGet(context.Background(), impl.propertyKey(uid), "d:"+ns, "v:"+ns).Result()
+	if err != nil {
+		return
+	}
+
+	if is[1] == nil {
+		return
+	}
+
+	data = []byte(cast.ToString(is[0]))
+	version = cast.ToUint64(is[1])
+
+	return
+}
+
+func (impl *accountsStorage) SetPropertyNamespace(uid uint64, ns string, version uint64, data []byte) (newVersion uint64, err error) {
+	n, err := propertyNamespaceSetScript.Run(context.Background(), impl.redisCli, []string{impl.accountKey(uid),
+		impl.propertyKey(uid)}, ns, version, data).Int64()
+	if err != nil {
+		return
+	}
+
+	switch n {
+	case -1:
+		err = commerr.ErrNotFound
+	case -2:
+		err = account.ErrPropertyVersionConflict
+	default:
+		newVersion = uint64(n)
+	}
+
+	return
+}
+
+//
+//
+//
+
+func (impl *accountsStorage) runAccountUpdateScript(script *redis.Script, uid uint64, args ...interface{}) (err error) {
+	n, err := script.Run(context.Background(), impl.redisCli, []string{impl.accountKey(uid)}, args...).Int()
+	if err != nil {
+		return
+	}
+
+	if n != 0 {
+		err = commerr.ErrNotFound
+	}
+
+	return
+}
+
+func (impl *accountsStorage) accountKey(userID uint64) string {
+	return impl.preKey + "uid:" + strconv.FormatUint(userID, 10)
+}
+
+// propertyKey is a hash of the data "d:<ns>" and version "v:<ns>" of property namespaces.
+func (impl *accountsStorage) propertyKey(userID uint64) string {
+	return impl.preKey + "prop:" + strconv.FormatUint(userID, 10)
+}
+
+func (impl *accountsStorage) accountNameKey(userName string) string {
+	return impl.preKey + "un:" + userName
+}
+
+func (impl *accountsStorage) accountCreateAtKey() string {
+	return impl.preKey + "users:create_at"
+}
+
+// usersNameKey is a lex sorted set of "name\0uid" of all accounts.
+func (impl *accountsStorage) usersNameKey() string {
+	return impl.preKey + "users:name"
+}
+
+// usersDeletedKey holds deleted accounts by create time, they are removed from accountCreateAtKey.
+func (impl *accountsStorage) usersDeletedKey() string {
+	return impl.preKey + "users:deleted"
+}
+
+// usersIndexVersionKey marks the name, deleted and role indexes are built for accounts created before them.
+func (impl *accountsStorage) usersIndexVersionKey() string {
+	return impl.preKey + "users:index_version"
+}
+
+func (impl *accountsStorage) accountTokenKey(token string) string {
+	return impl.preKey + "utk:" + token
+}
+
+func (impl *accountsStorage) accountIdTokensKey(userID uint64) string {
+	return impl.preKey + "utk-s:" + strconv.FormatUint(userID, 10)
+}
+
+func (impl *accountsStorage) accountTokenSessionKey(token string) string {
+	return impl.preKey + "utk-m:" + token
+}
+
+func (impl *accountsStorage) userRefreshTokenFamiliesKey(userID uint64) string {
+	return impl.preKey + "rt-u:" + strconv.FormatUint(userID, 10)
+}
+
+func (impl *accountsStorage) refreshTokenKey(refreshToken string) string {
+	return impl.preKey + "rt:" + refreshToken
+}
+
+func (impl *accountsStorage) refreshTokenFamilyKey(familyID string) string {
+	return impl.preKey + "rt-f:" + familyID
+}
+
+func (impl *accountsStorage) loginFailureKey(key string) string {
+	return impl.preKey + "lf:" + key
+}
+
+func (impl *accountsStorage) rolesKey() string {
+	return impl.preKey + "roles"
+}
+
+func (impl *accountsStorage) userRolesKey(userID uint64) string {
+	return impl.preKey + "ur:" + strconv.FormatUint(userID, 10)
+}
+
+func (impl *accountsStorage) roleUsersKey(roleName string) string {
+	return impl.preKey + "ru:" + roleName
+}
+
+// roleUsersCreateAtKey holds the users of the role by create time, like accountCreateAtKey.
+func (impl *accountsStorage) roleUsersCreateAtKey(roleName string) string {
+	return impl.preKey + "ru-c:" + roleName
+}
+
+// roleUsersNameKey is a lex sorted set of "name\0uid" of the users of the role, like usersNameKey.
+func (impl *accountsStorage) roleUsersNameKey(roleName string) string {
+	return impl.preKey + "ru-n:" + roleName
+}
+
+func (impl *accountsStorage) apiKeyKey(keyID string) string {
+	return impl.preKey + "ak:" + keyID
+}
+
+func (impl *accountsStorage) userAPIKeysKey(userID uint64) string {
+	return impl.preKey + "ak-u:" + strconv.FormatUint(userID, 10)
+}
+
+func (impl *accountsStorage) identitiesKey() string {
+	return impl.preKey + "identities"
+}
+
+func (impl *accountsStorage) userIdentitiesKey(userID uint64) string {
+	return impl.preKey + "idt-u:" + strconv.FormatUint(userID, 10)
+}
+
+func (impl *accountsStorage) oneTimeTokenKey(hashedToken string) string {
+	return impl.preKey + "ott:" + hashedToken
+}
+
+func (impl *accountsStorage) userOneTimeTokensKey(userID uint64, purpose string) string {
+	return impl.preKey + "ott-u:" + strconv.FormatUint(userID, 10) + ":" + purpose
+}
+
+func marshalSession(session *account.Session) (string, error) {
+	if session == nil {
+		return "", nil
+	}
+
+	d, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+
+	return string(d), nil
+}
+
+func identityField(provider, subject string) string {
+	return provider + "\x00" + subject
 }
@@ -2,24 +2,90 @@
 package redisimpls
 
 import (
-	"context"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/go-redis/redis/v8"
+	"github.com/sgostarter/i/commerr"
 	"github.com/sgostarter/libcomponents/account"
+	"github.com/sgostarter/libcomponents/account/storagetest"
 	"github.com/stretchr/testify/assert"
 )
 
-func Test1(t *testing.T) {
-	opts, err := redis.ParseURL("redis://:@127.0.0.1:6379") // redis://<user>:<password>@<host>:<port>/<db_number>
+func newRedisStorage(t *testing.T) account.Storage {
+	mr := miniredis.RunT(t)
+
+	return NewRedisAccountStorage("x:", redis.NewClient(&redis.Options{Addr: mr.Addr()}), nil)
+}
+
+func TestAccount(t *testing.T) {
+	storagetest.RunAccountTests(t, newRedisStorage)
+}
+
+func TestStorage(t *testing.T) {
+	storagetest.RunStorageTests(t, newRedisStorage)
+}
+
+func TestTenant(t *testing.T) {
+	storagetest.RunTenantTests(t, func(t *testing.T) account.TenantStorageFactory {
+		mr := miniredis.RunT(t)
+
+		return NewRedisTenantStorageFactory("x:", redis.NewClient(&redis.Options{Addr: mr.Addr()}), nil)
+	})
+}
+
+func TestMigrateUserIndexes(t *testing.T) {
+	mr := miniredis.RunT(t)
+	redisCli := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+
+	stg := NewRedisAccountStorage("x:", redisCli, nil)
+
+	uid1, err := stg.AddAccount("user1", "hpass1")
 	assert.Nil(t, err)
 
-	redisCli := redis.NewClient(opts)
+	uid2, err := stg.AddAccount("user2", "hpass2")
+	assert.Nil(t, err)
+
+	assert.Nil(t, stg.SetAccountState(uid2, account.AccountStateDeleted))
+
+	assert.Nil(t, stg.SetRole(&account.Role{Name: "ops"}))
+	assert.Nil(t, stg.AssignRole(uid1, "ops"))
+
+	// accounts created before the indexes
+	assert.True(t, mr.Del("x:users:name"))
+	assert.True(t, mr.Del("x:ru-c:ops"))
+	assert.True(t, mr.Del("x:ru-n:ops"))
+	assert.True(t, mr.Del("x:users:index_version"))
 
-	redisCli.FlushDB(context.Background())
+	stg = NewRedisAccountStorage("x:", redisCli, nil)
+	assert.NotNil(t, stg)
 
-	stg := NewRedisAccountStorage("x", redisCli, nil)
+	assert.True(t, mr.Exists("x:users:index_version"))
+
+	page, err := stg.QueryUsers(&account.UserQuery{SortBy: account.UserSortByName, Limit: 10})
+	assert.Nil(t, err)
+	assert.Len(t, page.Users, 1)
+	assert.Equal(t, uid1, page.Users[0].UserID)
+
+	page, err = stg.QueryUsers(&account.UserQuery{State: account.AccountStateDeleted, SortBy: account.UserSortByName,
+		Limit: 10})
+	assert.Nil(t, err)
+	assert.Len(t, page.Users, 1)
+	assert.Equal(t, uid2, page.Users[0].UserID)
+
+	for _, sortBy := range []account.UserSortField{account.UserSortByName, account.UserSortByCreateAt} {
+		page, err = stg.QueryUsers(&account.UserQuery{Role: "ops", SortBy: sortBy, Limit: 10})
+		assert.Nil(t, err)
+		assert.Len(t, page.Users, 1)
+		assert.Equal(t, uid1, page.Users[0].UserID)
+	}
+}
+
+func Test1(t *testing.T) {
+	var err error
+
+	stg := newRedisStorage(t)
 
 	f, err := stg.HasAccount()
 	assert.Nil(t, err)
@@ -118,7 +184,7 @@ func Test1(t *testing.T) {
 	var pd propertyData
 
 	err = stg.GetPropertyData("userX", &pd)
-	assert.Nil(t, err)
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
 
 	err = stg.SetPropertyData("userX", propertyData{
 		N: 9,
@@ -0,0 +1,109 @@
+package redisimpls
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sgostarter/i/l"
+	"github.com/sgostarter/libcomponents/account"
+)
+
+const defaultAuditStreamMaxLen = 10000
+
+// NewRedisAuditSink adds events to the stream preKey+"audit" and the stream of the user preKey+"audit:<uid>",
+// streams are trimmed to about maxLen events.
+func NewRedisAuditSink(preKey string, maxLen int64, redisCli *redis.Client, logger l.Wrapper) account.AuditSink {
+	if logger == nil {
+		logger = l.NewNopLoggerWrapper()
+	}
+
+	logger = logger.WithFields(l.StringField(l.ClsKey, "redisAuditSink"))
+
+	if redisCli == nil {
+		logger.Fatal("no redis client")
+	}
+
+	if maxLen <= 0 {
+		maxLen = defaultAuditStreamMaxLen
+	}
+
+	return &redisAuditSink{
+		logger:   logger,
+		preKey:   preKey,
+		maxLen:   maxLen,
+		redisCli: redisCli,
+	}
+}
+
+type redisAuditSink struct {
+	logger   l.Wrapper
+	preKey   string
+	maxLen   int64
+	redisCli *redis.Client
+}
+
+func (impl *redisAuditSink) Record(event *account.AuditEvent) (err error) {
+	d, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	_, err = impl.redisCli.Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.XAdd(context.Background(), impl.newXAddArgs(impl.streamKey(), d))
+
+		if event.UID != 0 {
+			pipe.XAdd(context.Background(), impl.newXAddArgs(impl.userStreamKey(event.UID), d))
+		}
+
+		return nil
+	})
+
+	return
+}
+
+func (impl *redisAuditSink) ListUserEvents(uid uint64, limit int) (events []*account.AuditEvent, err error) {
+	messages, err := impl.redisCli.XRevRangeN(context.Background(), impl.userStreamKey(uid), "+", "-",
+		int64(limit)).Result()
+	if err != nil {
+		return
+	}
+
+	for _, message := range messages {
+		var event account.AuditEvent
+
+		d, _ := message.Values["event"].(string)
+
+		if e := json.Unmarshal([]byte(d), &event); e != nil {
+			impl.logger.WithFields(l.ErrorField(e), l.StringField("id", message.ID)).Error("unmarshal audit event failed")
+
+			continue
+		}
+
+		events = append(events, &event)
+	}
+
+	return
+}
+
+//
+//
+//
+
+func (impl *redisAuditSink) newXAddArgs(stream string, d []byte) *redis.XAddArgs {
+	return &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: impl.maxLen,
+		Approx: true,
+		Values: []interface{}{"event", d},
+	}
+}
+
+func (impl *redisAuditSink) streamKey() string {
+	return impl.preKey + "audit"
+}
+
+func (impl *redisAuditSink) userStreamKey(uid uint64) string {
+	return impl.preKey + "audit:" + strconv.FormatUint(uid, 10)
+}
@@ -7,6 +7,7 @@ var (
 		local idKey =  KEYS[1]
 		local nameKey = KEYS[2]
 		local usersCreateAtKey = KEYS[3]
+		local usersNameKey = KEYS[4]
 
 		local vId = ARGV[1]
 		local vName = ARGV[2]
@@ -16,18 +17,19 @@ var (
 
 		local ret = redis.call("GET", nameKey)
 		if ret ~= false then
-			return redis.error_reply("name exists") 
+			return 1
 		end
 
 		local exists = redis.call('EXISTS', idKey)
 		
 		if exists == 1 then
-			return redis.error_reply("id exists") 
+			return 2
 		end
 
 		redis.call("HSET", idKey, "name", vName, "pass", vHPass, "data", vData, "create_at", vCreateAt)
 		redis.call("SET", nameKey, vId)
 		redis.call("ZADD", usersCreateAtKey, vCreateAt, vId)
+		redis.call("ZADD", usersNameKey, 0, vName .. "\0" .. vId)
 
 		return 0
 	`)
@@ -40,7 +42,7 @@ var (
 		local exists = redis.call('EXISTS', idKey)
 		
 		if exists == 0 then
-			return redis.error_reply("id not exists") 
+			return 1
 		end
 
 		redis.call("HSET", idKey, "pass", vHPass)
@@ -50,16 +52,41 @@ var (
 
 	updateAccountNameScript = redis.NewScript(`
 		local idKey =  KEYS[1]
+		local nameKey = KEYS[2]
+		local usersNameKey = KEYS[3]
 
-		local vName = ARGV[1]
+		local vPreKey = ARGV[1]
+		local vName = ARGV[2]
+		local vId = ARGV[3]
 
-		local exists = redis.call('EXISTS', idKey)
-		
-		if exists == 0 then
-			return redis.error_reply("id not exists") 
+		local oldName = redis.call("HGET", idKey, "name")
+		if oldName == false then
+			return 2
+		end
+
+		if oldName == vName then
+			return 0
+		end
+
+		if redis.call("EXISTS", nameKey) == 1 then
+			return 1
+		end
+
+		local oldNameKey = vPreKey .. "un:" .. oldName
+		if redis.call("GET", oldNameKey) == vId then
+			redis.call("DEL", oldNameKey)
 		end
 
+		redis.call("SET", nameKey, vId)
 		redis.call("HSET", idKey, "name", vName)
+		redis.call("ZREM", usersNameKey, oldName .. "\0" .. vId)
+		redis.call("ZADD", usersNameKey, 0, vName .. "\0" .. vId)
+
+		local roleNames = redis.call("SMEMBERS", vPreKey .. "ur:" .. vId)
+		for _, roleName in ipairs(roleNames) do
+			redis.call("ZREM", vPreKey .. "ru-n:" .. roleName, oldName .. "\0" .. vId)
+			redis.call("ZADD", vPreKey .. "ru-n:" .. roleName, 0, vName .. "\0" .. vId)
+		end
 
 		return 0
 	`)
@@ -72,7 +99,7 @@ var (
 		local exists = redis.call('EXISTS', idKey)
 		
 		if exists == 0 then
-			return redis.error_reply("id not exists") 
+			return 1
 		end
 
 		redis.call("HSET", idKey, "adv_cfg", vAdvCfg)
@@ -80,6 +107,148 @@ var (
 		return 0
 	`)
 
+	updateAccountTOTPScript = redis.NewScript(`
+		local idKey =  KEYS[1]
+
+		local vTOTP = ARGV[1]
+
+		local exists = redis.call('EXISTS', idKey)
+		
+		if exists == 0 then
+			return 1
+		end
+
+		redis.call("HSET", idKey, "totp", vTOTP)
+
+		return 0
+	`)
+
+	compareAndSetAccountTOTPScript = redis.NewScript(`
+		local idKey =  KEYS[1]
+
+		local vOldTOTP = ARGV[1]
+		local vTOTP = ARGV[2]
+
+		local exists = redis.call('EXISTS', idKey)
+
+		if exists == 0 then
+			return 1
+		end
+
+		local curTOTP = redis.call("HGET", idKey, "totp")
+		if not curTOTP then
+			curTOTP = ""
+		end
+
+		if curTOTP ~= vOldTOTP then
+			return 2
+		end
+
+		redis.call("HSET", idKey, "totp", vTOTP)
+
+		return 0
+	`)
+
+	updateAccountPasswordHistoryScript = redis.NewScript(`
+		local idKey =  KEYS[1]
+
+		local vPasswordHistory = ARGV[1]
+
+		local exists = redis.call('EXISTS', idKey)
+		
+		if exists == 0 then
+			return 1
+		end
+
+		redis.call("HSET", idKey, "pwdHistory", vPasswordHistory)
+
+		return 0
+	`)
+
+	updateAccountStateScript = redis.NewScript(`
+		local idKey =  KEYS[1]
+		local usersCreateAtKey = KEYS[2]
+		local usersDeletedKey = KEYS[3]
+
+		local vState = ARGV[1]
+		local vId = ARGV[2]
+
+		local createAt = redis.call("HGET", idKey, "create_at")
+		if createAt == false then
+			return 1
+		end
+
+		redis.call("HSET", idKey, "state", vState)
+
+		if vState == "deleted" then
+			redis.call("ZREM", usersCreateAtKey, vId)
+			redis.call("ZADD", usersDeletedKey, createAt, vId)
+		else
+			redis.call("ZADD", usersCreateAtKey, createAt, vId)
+			redis.call("ZREM", usersDeletedKey, vId)
+		end
+
+		return 0
+	`)
+
+	delAccountScript = redis.NewScript(`
+		local idKey =  KEYS[1]
+		local usersCreateAtKey = KEYS[2]
+		local usersDeletedKey = KEYS[3]
+		local usersNameKey = KEYS[4]
+
+		local vPreKey = ARGV[1]
+		local vId = ARGV[2]
+
+		local name = redis.call("HGET", idKey, "name")
+		if name == false then
+			return 1
+		end
+
+		local nameKey = vPreKey .. "un:" .. name
+		if redis.call("GET", nameKey) == vId then
+			redis.call("DEL", nameKey)
+		end
+
+		redis.call("ZREM", usersCreateAtKey, vId)
+		redis.call("ZREM", usersDeletedKey, vId)
+		redis.call("ZREM", usersNameKey, name .. "\0" .. vId)
+
+		local roleNames = redis.call("SMEMBERS", vPreKey .. "ur:" .. vId)
+		for _, roleName in ipairs(roleNames) do
+			redis.call("SREM", vPreKey .. "ru:" .. roleName, vId)
+			redis.call("ZREM", vPreKey .. "ru-c:" .. roleName, vId)
+			redis.call("ZREM", vPreKey .. "ru-n:" .. roleName, name .. "\0" .. vId)
+		end
+
+		local identities = redis.call("SMEMBERS", vPreKey .. "idt-u:" .. vId)
+		for _, identity in ipairs(identities) do
+			redis.call("HDEL", vPreKey .. "identities", identity)
+		end
+
+		redis.call("DEL", idKey, vPreKey .. "utk-s:" .. vId, vPreKey .. "rt-u:" .. vId, vPreKey .. "ur:" .. vId,
+			vPreKey .. "ak-u:" .. vId, vPreKey .. "prop:" .. vId, vPreKey .. "idt-u:" .. vId)
+
+		return 0
+	`)
+
+	updateAccountContactScript = redis.NewScript(`
+		local idKey =  KEYS[1]
+
+		local vContact = ARGV[1]
+		local vVerified = ARGV[2]
+
+		local exists = redis.call('EXISTS', idKey)
+		
+		if exists == 0 then
+			return 1
+		end
+
+		redis.call("HSET", idKey, "contact", vContact, "contact_verified", vVerified)
+
+		return 0
+	`)
+
 	updateAccountPropertyDataScript = redis.NewScript(`
 		local idKey =  KEYS[1]
 
@@ -88,7 +257,7 @@ var (
 		local exists = redis.call('EXISTS', idKey)
 		
 		if exists == 0 then
-			return redis.error_reply("id not exists") 
+			return 1
 		end
 
 		redis.call("HSET", idKey, "property_data", vData)
@@ -96,22 +265,55 @@ var (
 		return 0
 	`)
 
+	propertyNamespaceSetScript = redis.NewScript(`
+		local idKey =  KEYS[1]
+		local propertyKey = KEYS[2]
+
+		local vNs = ARGV[1]
+		local vVersion = tonumber(ARGV[2])
+		local vData = ARGV[3]
+
+		if redis.call("EXISTS", idKey) == 0 then
+			return -1
+		end
+
+		local version = tonumber(redis.call("HGET", propertyKey, "v:" .. vNs) or "0")
+		if version ~= vVersion then
+			return -2
+		end
+
+		redis.call("HSET", propertyKey, "d:" .. vNs, vData)
+
+		return redis.call("HINCRBY", propertyKey, "v:" .. vNs, 1)
+	`)
+
 	tokenAddScript = redis.NewScript(`
 		local tokenKey =  KEYS[1]
 		local idTokensKey = KEYS[2]
+		local tokenSessionKey = KEYS[3]
 
 		local vToken = ARGV[1]
 		local vUID = ARGV[2]
 		local vTTLSeconds = ARGV[3]
+		local vSession = ARGV[4]
+
+		if redis.call("EXISTS", tokenKey) == 1 then
+			return 1
+		end
 
 		redis.call("SET", tokenKey, vUID, "EX", vTTLSeconds)
 		redis.call("SADD", idTokensKey, vToken)
 
+		if vSession ~= "" then
+			redis.call("SET", tokenSessionKey, vSession, "EX", vTTLSeconds)
+		end
+
 		return 0
 	`)
 
 	tokenCheckScript = redis.NewScript(`
 		local tokenKey =  KEYS[1]
+		local tokenSessionKey = KEYS[2]
 
 		local vRenewSeconds = tonumber(ARGV[1])
 
@@ -129,6 +331,7 @@ var (
 		end
 		
 		redis.call("EXPIRE", tokenKey, ttl+vRenewSeconds)
+		redis.call("EXPIRE", tokenSessionKey, ttl+vRenewSeconds)
 
 		return 1
 	`)
@@ -136,12 +339,309 @@ var (
 	tokenDelScript = redis.NewScript(`
 		local tokenKey =  KEYS[1]
 		local idTokensKey = KEYS[2]
+		local tokenSessionKey = KEYS[3]
 
 		local vToken = ARGV[1]
 
-		redis.call("DEL", tokenKey)
+		redis.call("DEL", tokenKey, tokenSessionKey)
 		redis.call("SREM", idTokensKey, vToken)
 
 		return 0
 	`)
+
+	refreshTokenAddScript = redis.NewScript(`
+		local refreshTokenKey = KEYS[1]
+		local familyKey = KEYS[2]
+		local userFamiliesKey = KEYS[3]
+
+		local vRefreshToken = ARGV[1]
+		local vUID = ARGV[2]
+		local vFamilyID = ARGV[3]
+		local vAccessToken = ARGV[4]
+		local vExpiredAt = tonumber(ARGV[5])
+		local vSession = ARGV[6]
+
+		if redis.call("EXISTS", refreshTokenKey) == 1 then
+			return redis.error_reply("refresh token exists")
+		end
+
+		redis.call("HSET", refreshTokenKey, "uid", vUID, "family", vFamilyID, "access", vAccessToken,
+			"expired_at", vExpiredAt, "rotated", 0, "session", vSession)
+		redis.call("EXPIREAT", refreshTokenKey, vExpiredAt)
+		redis.call("SADD", familyKey, vRefreshToken)
+		redis.call("EXPIREAT", familyKey, vExpiredAt)
+		redis.call("SADD", userFamiliesKey, vFamilyID)
+
+		return 0
+	`)
+
+	refreshTokenRotateScript = redis.NewScript(`
+		local oldRefreshTokenKey = KEYS[1]
+		local newRefreshTokenKey = KEYS[2]
+		local familyKey = KEYS[3]
+		local userFamiliesKey = KEYS[4]
+
+		local vNewRefreshToken = ARGV[1]
+		local vUID = ARGV[2]
+		local vFamilyID = ARGV[3]
+		local vAccessToken = ARGV[4]
+		local vExpiredAt = tonumber(ARGV[5])
+		local vSession = ARGV[6]
+
+		local rotated = redis.call("HGET", oldRefreshTokenKey, "rotated")
+		if rotated == false then
+			return 1
+		end
+
+		if rotated == "1" then
+			return 2
+		end
+
+		if redis.call("EXISTS", newRefreshTokenKey) == 1 then
+			return 3
+		end
+
+		redis.call("HSET", oldRefreshTokenKey, "rotated", 1)
+
+		redis.call("HSET", newRefreshTokenKey, "uid", vUID, "family", vFamilyID, "access", vAccessToken,
+			"expired_at", vExpiredAt, "rotated", 0, "session", vSession)
+		redis.call("EXPIREAT", newRefreshTokenKey, vExpiredAt)
+		redis.call("SADD", familyKey, vNewRefreshToken)
+		redis.call("EXPIREAT", familyKey, vExpiredAt)
+		redis.call("SADD", userFamiliesKey, vFamilyID)
+
+		return 0
+	`)
+
+	refreshTokenFamilyRevokeScript = redis.NewScript(`
+		local familyKey = KEYS[1]
+
+		local vPreKey = ARGV[1]
+		local vFamilyID = ARGV[2]
+
+		local refreshTokens = redis.call("SMEMBERS", familyKey)
+		for _, refreshToken in ipairs(refreshTokens) do
+			local refreshTokenKey = vPreKey .. "rt:" .. refreshToken
+			local info = redis.call("HMGET", refreshTokenKey, "uid", "access")
+
+			if info[2] then
+				redis.call("DEL", vPreKey .. "utk:" .. info[2], vPreKey .. "utk-m:" .. info[2])
+				if info[1] then
+					redis.call("SREM", vPreKey .. "utk-s:" .. info[1], info[2])
+				end
+			end
+
+			if info[1] then
+				redis.call("SREM", vPreKey .. "rt-u:" .. info[1], vFamilyID)
+			end
+
+			redis.call("DEL", refreshTokenKey)
+		end
+
+		redis.call("DEL", familyKey)
+
+		return #refreshTokens
+	`)
+
+	loginFailureIncScript = redis.NewScript(`
+		local failureKey = KEYS[1]
+
+		local vNow = ARGV[1]
+		local vExpireMilliseconds = ARGV[2]
+
+		local failures = redis.call("HINCRBY", failureKey, "failures", 1)
+		redis.call("HSET", failureKey, "last_at", vNow)
+		redis.call("PEXPIRE", failureKey, vExpireMilliseconds)
+
+		return failures
+	`)
+
+	roleDelScript = redis.NewScript(`
+		local rolesKey = KEYS[1]
+		local roleUsersKey = KEYS[2]
+		local roleUsersCreateAtKey = KEYS[3]
+		local roleUsersNameKey = KEYS[4]
+
+		local vPreKey = ARGV[1]
+		local vRoleName = ARGV[2]
+
+		if redis.call("HDEL", rolesKey, vRoleName) == 0 then
+			return 1
+		end
+
+		local uids = redis.call("SMEMBERS", roleUsersKey)
+		for _, uid in ipairs(uids) do
+			redis.call("SREM", vPreKey .. "ur:" .. uid, vRoleName)
+		end
+
+		redis.call("DEL", roleUsersKey, roleUsersCreateAtKey, roleUsersNameKey)
+
+		return 0
+	`)
+
+	roleAssignScript = redis.NewScript(`
+		local rolesKey = KEYS[1]
+		local idKey = KEYS[2]
+		local userRolesKey = KEYS[3]
+		local roleUsersKey = KEYS[4]
+		local roleUsersCreateAtKey = KEYS[5]
+		local roleUsersNameKey = KEYS[6]
+
+		local vRoleName = ARGV[1]
+		local vUID = ARGV[2]
+
+		if redis.call("HEXISTS", rolesKey, vRoleName) == 0 or redis.call("EXISTS", idKey) == 0 then
+			return 1
+		end
+
+		local info = redis.call("HMGET", idKey, "name", "create_at")
+
+		redis.call("SADD", userRolesKey, vRoleName)
+		redis.call("SADD", roleUsersKey, vUID)
+		redis.call("ZADD", roleUsersCreateAtKey, info[2] or 0, vUID)
+		redis.call("ZADD", roleUsersNameKey, 0, info[1] .. "\0" .. vUID)
+
+		return 0
+	`)
+
+	roleUnassignScript = redis.NewScript(`
+		local idKey = KEYS[1]
+		local userRolesKey = KEYS[2]
+		local roleUsersKey = KEYS[3]
+		local roleUsersCreateAtKey = KEYS[4]
+		local roleUsersNameKey = KEYS[5]
+
+		local vRoleName = ARGV[1]
+		local vUID = ARGV[2]
+
+		redis.call("SREM", userRolesKey, vRoleName)
+		redis.call("SREM", roleUsersKey, vUID)
+		redis.call("ZREM", roleUsersCreateAtKey, vUID)
+
+		local name = redis.call("HGET", idKey, "name")
+		if name ~= false then
+			redis.call("ZREM", roleUsersNameKey, name .. "\0" .. vUID)
+		end
+
+		return 0
+	`)
+
+	apiKeyAddScript = redis.NewScript(`
+		local apiKeyKey = KEYS[1]
+		local userAPIKeysKey = KEYS[2]
+
+		local vInfo = ARGV[1]
+		local vKeyID = ARGV[2]
+		local vExpireAt = tonumber(ARGV[3])
+
+		if redis.call("EXISTS", apiKeyKey) == 1 then
+			return 1
+		end
+
+		redis.call("HSET", apiKeyKey, "info", vInfo)
+		redis.call("SADD", userAPIKeysKey, vKeyID)
+
+		if vExpireAt > 0 then
+			redis.call("PEXPIREAT", apiKeyKey, vExpireAt)
+		end
+
+		return 0
+	`)
+
+	apiKeyTouchScript = redis.NewScript(`
+		local apiKeyKey = KEYS[1]
+
+		local vLastUsedAt = ARGV[1]
+
+		if redis.call("EXISTS", apiKeyKey) == 0 then
+			return 1
+		end
+
+		redis.call("HSET", apiKeyKey, "last_used", vLastUsedAt)
+
+		return 0
+	`)
+
+	identityLinkScript = redis.NewScript(`
+		local idKey = KEYS[1]
+		local identitiesKey = KEYS[2]
+		local userIdentitiesKey = KEYS[3]
+
+		local vField = ARGV[1]
+		local vInfo = ARGV[2]
+
+		if redis.call("EXISTS", idKey) == 0 then
+			return 1
+		end
+
+		if redis.call("HSETNX", identitiesKey, vField, vInfo) == 0 then
+			return 2
+		end
+
+		redis.call("SADD", userIdentitiesKey, vField)
+
+		return 0
+	`)
+
+	identityUnlinkScript = redis.NewScript(`
+		local identitiesKey = KEYS[1]
+		local userIdentitiesKey = KEYS[2]
+
+		local vField = ARGV[1]
+
+		if redis.call("SREM", userIdentitiesKey, vField) == 0 then
+			return 1
+		end
+
+		redis.call("HDEL", identitiesKey, vField)
+
+		return 0
+	`)
+
+	oneTimeTokenAddScript = redis.NewScript(`
+		local tokenKey = KEYS[1]
+		local userTokensKey = KEYS[2]
+
+		local vInfo = ARGV[1]
+		local vHashedToken = ARGV[2]
+		local vExpireMilliseconds = ARGV[3]
+
+		if redis.call("EXISTS", tokenKey) == 1 then
+			return 1
+		end
+
+		redis.call("SET", tokenKey, vInfo, "PX", vExpireMilliseconds)
+		redis.call("SADD", userTokensKey, vHashedToken)
+		redis.call("PEXPIRE", userTokensKey, vExpireMilliseconds)
+
+		return 0
+	`)
+
+	oneTimeTokenConsumeScript = redis.NewScript(`
+		local tokenKey = KEYS[1]
+
+		local info = redis.call("GET", tokenKey)
+		if info == false then
+			return ""
+		end
+
+		redis.call("DEL", tokenKey)
+
+		return info
+	`)
+
+	oneTimeTokensDelScript = redis.NewScript(`
+		local userTokensKey = KEYS[1]
+
+		local vPreKey = ARGV[1]
+
+		local hashedTokens = redis.call("SMEMBERS", userTokensKey)
+		for _, hashedToken in ipairs(hashedTokens) do
+			redis.call("DEL", vPreKey .. "ott:" .. hashedToken)
+		end
+
+		redis.call("DEL", userTokensKey)
+
+		return #hashedTokens
+	`)
 )
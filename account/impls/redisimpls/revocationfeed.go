@@ -0,0 +1,85 @@
+package redisimpls
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sgostarter/i/l"
+	"github.com/sgostarter/libcomponents/account"
+)
+
+// NewRedisRevocationFeed shares revocations by redis pub/sub, revocations published while a subscriber
+// is disconnected are lost, so tokens must be short-lived. Subscriptions end when ctx is done.
+func NewRedisRevocationFeed(ctx context.Context, channel string, redisCli *redis.Client, logger l.Wrapper) account.RevocationFeed {
+	if logger == nil {
+		logger = l.NewNopLoggerWrapper()
+	}
+
+	logger = logger.WithFields(l.StringField(l.ClsKey, "redisRevocationFeed"))
+
+	if redisCli == nil {
+		logger.Fatal("no redis client")
+	}
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return &redisRevocationFeed{
+		ctx:      ctx,
+		logger:   logger,
+		channel:  channel,
+		redisCli: redisCli,
+	}
+}
+
+type redisRevocationFeed struct {
+	ctx      context.Context
+	logger   l.Wrapper
+	channel  string
+	redisCli *redis.Client
+}
+
+func (impl *redisRevocationFeed) Publish(revocation *account.Revocation) error {
+	d, err := json.Marshal(revocation)
+	if err != nil {
+		return err
+	}
+
+	return impl.redisCli.Publish(impl.ctx, impl.channel, d).Err()
+}
+
+func (impl *redisRevocationFeed) Subscribe(handler func(revocation *account.Revocation)) error {
+	pubSub := impl.redisCli.Subscribe(impl.ctx, impl.channel)
+
+	// wait for the subscription, so revocations published after Subscribe returns are not missed
+	_, err := pubSub.Receive(impl.ctx)
+	if err != nil {
+		_ = pubSub.Close()
+
+		return err
+	}
+
+	go func() {
+		<-impl.ctx.Done()
+
+		_ = pubSub.Close()
+	}()
+
+	go func() {
+		for msg := range pubSub.Channel() {
+			var revocation account.Revocation
+
+			if err := json.Unmarshal([]byte(msg.Payload), &revocation); err != nil {
+				impl.logger.WithFields(l.ErrorField(err)).Error("unmarshal revocation failed")
+
+				continue
+			}
+
+			handler(&revocation)
+		}
+	}()
+
+	return nil
+}
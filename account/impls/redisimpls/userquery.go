@@ -0,0 +1,368 @@
+package redisimpls
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sgostarter/libcomponents/account"
+	"github.com/spf13/cast"
+)
+
+const (
+	userQueryBatchSize = 200
+	usersIndexVersion  = "2"
+)
+
+type userCandidate struct {
+	uid    uint64
+	member string
+	score  float64
+}
+
+func (impl *accountsStorage) QueryUsers(query *account.UserQuery) (page *account.UserPage, err error) {
+	cursor, err := account.DecodeUserCursor(query.Cursor)
+	if err != nil {
+		return
+	}
+
+	page = &account.UserPage{}
+
+	var last *account.User
+
+	for offset := int64(0); len(page.Users) < query.Limit; offset += userQueryBatchSize {
+		candidates, e := impl.queryUserCandidates(query, cursor, offset)
+		if e != nil {
+			err = e
+
+			return
+		}
+
+		users, e := impl.loadQueryUsers(query, candidates)
+		if e != nil {
+			err = e
+
+			return
+		}
+
+		for idx := range users {
+			if len(page.Users) >= query.Limit {
+				break
+			}
+
+			page.Users = append(page.Users, users[idx])
+			last = &page.Users[len(page.Users)-1]
+		}
+
+		if len(candidates) < userQueryBatchSize {
+			break
+		}
+	}
+
+	if len(page.Users) == query.Limit {
+		page.NextCursor = account.EncodeUserCursor(&account.UserCursor{
+			SortKey: userSortKey(query, last),
+			UID:     last.UserID,
+		})
+	}
+
+	return
+}
+
+//
+//
+//
+
+// queryUserCandidates reads a batch of the index after the cursor, the indexes of the role keep deleted users too.
+func (impl *accountsStorage) queryUserCandidates(q *account.UserQuery, cursor *account.UserCursor, offset int64) (candidates []userCandidate, err error) {
+	if q.SortBy == account.UserSortByName {
+		return impl.queryUserCandidatesByName(q, cursor, offset)
+	}
+
+	key := impl.accountCreateAtKey()
+	if q.Role != "" {
+		key = impl.roleUsersCreateAtKey(q.Role)
+	} else if q.State == account.AccountStateDeleted {
+		key = impl.usersDeletedKey()
+	}
+
+	minS, maxS := "-inf", "+inf"
+
+	if q.CreatedAtStart > 0 {
+		minS = strconv.FormatInt(q.CreatedAtStart, 10)
+	}
+
+	if q.CreatedAtFinish > 0 {
+		maxS = strconv.FormatInt(q.CreatedAtFinish, 10)
+	}
+
+	var cursorScore float64
+
+	var cursorMember string
+
+	if cursor != nil {
+		cursorScore = cast.ToFloat64(cursor.SortKey)
+		cursorMember = strconv.FormatUint(cursor.UID, 10)
+
+		// members with the cursor score are filtered below
+		if q.Desc && (q.CreatedAtFinish <= 0 || int64(cursorScore) < q.CreatedAtFinish) {
+			maxS = cursor.SortKey
+		} else if !q.Desc && int64(cursorScore) > q.CreatedAtStart {
+			minS = cursor.SortKey
+		}
+	}
+
+	rangeBy := &redis.ZRangeBy{
+		Min:    minS,
+		Max:    maxS,
+		Offset: offset,
+		Count:  userQueryBatchSize,
+	}
+
+	var zs []redis.Z
+
+	if q.Desc {
+		zs, err = impl.redisCli.ZRevRangeByScoreWithScores(context.Background(), key, rangeBy).Result()
+	} else {
+		zs, err = impl.redisCli.ZRangeByScoreWithScores(context.Background(), key, rangeBy).Result()
+	}
+
+	if err != nil {
+		return
+	}
+
+	candidates = make([]userCandidate, 0, len(zs))
+
+	for _, z := range zs {
+		member := cast.ToString(z.Member)
+
+		if cursor != nil && z.Score == cursorScore &&
+			((!q.Desc && member <= cursorMember) || (q.Desc && member >= cursorMember)) {
+			// keep the batch size for the paging of the caller
+			candidates = append(candidates, userCandidate{})
+
+			continue
+		}
+
+		candidates = append(candidates, userCandidate{
+			uid:    cast.ToUint64(member),
+			member: member,
+			score:  z.Score,
+		})
+	}
+
+	return
+}
+
+func (impl *accountsStorage) queryUserCandidatesByName(q *account.UserQuery, cursor *account.UserCursor, offset int64) (candidates []userCandidate, err error) {
+	minS, maxS := "-", "+"
+
+	if q.NamePrefix != "" {
+		minS = "[" + q.NamePrefix
+		maxS = "(" + q.NamePrefix + "\xff"
+	}
+
+	if cursor != nil {
+		if q.Desc {
+			if maxS == "+" || cursor.SortKey < maxS[1:] {
+				maxS = "(" + cursor.SortKey
+			}
+		} else {
+			if minS == "-" || cursor.SortKey+"\x01" > minS[1:] {
+				minS = "[" + cursor.SortKey + "\x01"
+			}
+		}
+	}
+
+	rangeBy := &redis.ZRangeBy{
+		Min:    minS,
+		Max:    maxS,
+		Offset: offset,
+		Count:  userQueryBatchSize,
+	}
+
+	key := impl.usersNameKey()
+	if q.Role != "" {
+		key = impl.roleUsersNameKey(q.Role)
+	}
+
+	var members []string
+
+	if q.Desc {
+		members, err = impl.redisCli.ZRevRangeByLex(context.Background(), key, rangeBy).Result()
+	} else {
+		members, err = impl.redisCli.ZRangeByLex(context.Background(), key, rangeBy).Result()
+	}
+
+	if err != nil {
+		return
+	}
+
+	candidates = make([]userCandidate, 0, len(members))
+
+	for _, member := range members {
+		var uid uint64
+
+		if idx := strings.LastIndexByte(member, 0); idx >= 0 {
+			uid = cast.ToUint64(member[idx+1:])
+		}
+
+		candidates = append(candidates, userCandidate{
+			uid:    uid,
+			member: member,
+		})
+	}
+
+	return
+}
+
+// loadQueryUsers loads the candidates and filters them by the query.
+func (impl *accountsStorage) loadQueryUsers(q *account.UserQuery, candidates []userCandidate) (users []account.User, err error) {
+	pipe := impl.redisCli.Pipeline()
+
+	infoCmds := make([]*redis.SliceCmd, len(candidates))
+
+	for idx, candidate := range candidates {
+		if candidate.uid == 0 {
+			continue
+		}
+
+		infoCmds[idx] = pipe.HMGet(context.Background(), impl.accountKey(candidate.uid), "name", "create_at", "state")
+	}
+
+	_, err = pipe.Exec(context.Background())
+	if err != nil && err != redis.Nil {
+		return
+	}
+
+	err = nil
+
+	for idx, candidate := range candidates {
+		if infoCmds[idx] == nil {
+			continue
+		}
+
+		is := infoCmds[idx].Val()
+		if len(is) != 3 || is[0] == nil {
+			continue
+		}
+
+		user := account.User{
+			UserName: cast.ToString(is[0]),
+			UserID:   candidate.uid,
+			CreateAt: cast.ToInt64(is[1]),
+			State:    account.AccountState(cast.ToString(is[2])),
+		}
+
+		if user.State == "" {
+			user.State = account.AccountStateActive
+		}
+
+		if !matchUserQuery(q, &user) {
+			continue
+		}
+
+		users = append(users, user)
+	}
+
+	return
+}
+
+// migrateUserIndexes builds the name, deleted and role indexes for accounts created before them, it scans the
+// accounts once for each preKey and index version.
+func (impl *accountsStorage) migrateUserIndexes() (err error) {
+	v, err := impl.redisCli.Get(context.Background(), impl.usersIndexVersionKey()).Result()
+	if err != nil && err != redis.Nil {
+		return
+	}
+
+	if v == usersIndexVersion {
+		return nil
+	}
+
+	n, err := impl.redisCli.Exists(context.Background(), impl.accountCreateAtKey(), impl.usersDeletedKey()).Result()
+	if err != nil {
+		return
+	}
+
+	if n == 0 {
+		return impl.redisCli.Set(context.Background(), impl.usersIndexVersionKey(), usersIndexVersion, 0).Err()
+	}
+
+	iter := impl.redisCli.Scan(context.Background(), 0, impl.preKey+"uid:*", 500).Iterator()
+	for iter.Next(context.Background()) {
+		key := iter.Val()
+
+		uid, e := strconv.ParseUint(strings.TrimPrefix(key, impl.preKey+"uid:"), 10, 64)
+		if e != nil {
+			continue
+		}
+
+		is, e := impl.redisCli.HMGet(context.Background(), key, "name", "create_at", "state").Result()
+		if e != nil {
+			err = e
+
+			return
+		}
+
+		if is[0] == nil {
+			continue
+		}
+
+		roleNames, e := impl.redisCli.SMembers(context.Background(), impl.userRolesKey(uid)).Result()
+		if e != nil {
+			err = e
+
+			return
+		}
+
+		uidS := strconv.FormatUint(uid, 10)
+		nameMember := cast.ToString(is[0]) + "\x00" + uidS
+
+		_, err = impl.redisCli.Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
+			pipe.ZAdd(context.Background(), impl.usersNameKey(), &redis.Z{Member: nameMember})
+
+			if cast.ToString(is[2]) == string(account.AccountStateDeleted) {
+				pipe.ZAdd(context.Background(), impl.usersDeletedKey(), &redis.Z{Score: cast.ToFloat64(is[1]), Member: uidS})
+			}
+
+			for _, roleName := range roleNames {
+				pipe.ZAdd(context.Background(), impl.roleUsersCreateAtKey(roleName), &redis.Z{Score: cast.ToFloat64(is[1]), Member: uidS})
+				pipe.ZAdd(context.Background(), impl.roleUsersNameKey(roleName), &redis.Z{Member: nameMember})
+			}
+
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	if err = iter.Err(); err != nil {
+		return
+	}
+
+	return impl.redisCli.Set(context.Background(), impl.usersIndexVersionKey(), usersIndexVersion, 0).Err()
+}
+
+func userSortKey(q *account.UserQuery, user *account.User) string {
+	if q.SortBy == account.UserSortByName {
+		return user.UserName
+	}
+
+	return strconv.FormatInt(user.CreateAt, 10)
+}
+
+func matchUserQuery(q *account.UserQuery, user *account.User) bool {
+	if (q.State == "" && user.State == account.AccountStateDeleted) || (q.State != "" && user.State != q.State) {
+		return false
+	}
+
+	if !strings.HasPrefix(user.UserName, q.NamePrefix) || !strings.Contains(user.UserName, q.NameContains) {
+		return false
+	}
+
+	return (q.CreatedAtStart <= 0 || user.CreateAt >= q.CreatedAtStart) &&
+		(q.CreatedAtFinish <= 0 || user.CreateAt <= q.CreatedAtFinish)
+}
@@ -0,0 +1,61 @@
+package sqlaccountstorage
+
+import (
+	"strconv"
+	"strings"
+)
+
+type Dialect string
+
+const (
+	DialectSQLite   Dialect = "sqlite"
+	DialectPostgres Dialect = "postgres"
+)
+
+func (d Dialect) valid() bool {
+	return d == DialectSQLite || d == DialectPostgres
+}
+
+// rebind converts the ? placeholders of query to the placeholders of the dialect.
+func (d Dialect) rebind(query string) string {
+	if d != DialectPostgres {
+		return query
+	}
+
+	var sb strings.Builder
+
+	n := 0
+
+	for _, c := range query {
+		if c != '?' {
+			sb.WriteRune(c)
+
+			continue
+		}
+
+		n++
+
+		sb.WriteString("$" + strconv.Itoa(n))
+	}
+
+	return sb.String()
+}
+
+// schema fills the dialect specific types of migration statements.
+func (d Dialect) schema(statement string) string {
+	blobType := "BLOB"
+	if d == DialectPostgres {
+		blobType = "BYTEA"
+	}
+
+	return strings.ReplaceAll(statement, "{{blob}}", blobType)
+}
+
+// containsExpr returns the expression which is true when column contains the string parameter.
+func (d Dialect) containsExpr(column string) string {
+	if d == DialectPostgres {
+		return "strpos(" + column + ", ?) > 0"
+	}
+
+	return "instr(" + column + ", ?) > 0"
+}
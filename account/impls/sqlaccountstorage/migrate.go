@@ -0,0 +1,142 @@
+package sqlaccountstorage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// migrations are applied in order and never changed once released, append new versions for schema changes.
+// Times are unix nanoseconds except accounts.create_at, which is unix seconds like the other storages.
+var migrations = [][]string{
+	{
+		`CREATE TABLE accounts (
+			uid BIGINT PRIMARY KEY,
+			name TEXT NOT NULL,
+			hashed_password TEXT NOT NULL DEFAULT '',
+			create_at BIGINT NOT NULL,
+			state TEXT NOT NULL DEFAULT '',
+			contact TEXT NOT NULL DEFAULT '',
+			contact_verified BOOLEAN NOT NULL DEFAULT FALSE,
+			advance_config TEXT,
+			totp TEXT,
+			data {{blob}},
+			property_data {{blob}}
+		)`,
+		`CREATE UNIQUE INDEX accounts_name ON accounts (name)`,
+		`CREATE INDEX accounts_create_at ON accounts (create_at, uid)`,
+		`CREATE TABLE tokens (
+			token TEXT PRIMARY KEY,
+			uid BIGINT NOT NULL,
+			expired_at BIGINT NOT NULL,
+			session TEXT
+		)`,
+		`CREATE INDEX tokens_uid ON tokens (uid)`,
+		`CREATE INDEX tokens_expired_at ON tokens (expired_at)`,
+		`CREATE TABLE refresh_tokens (
+			token TEXT PRIMARY KEY,
+			uid BIGINT NOT NULL,
+			family_id TEXT NOT NULL,
+			access_token TEXT NOT NULL DEFAULT '',
+			rotated BOOLEAN NOT NULL DEFAULT FALSE,
+			expired_at BIGINT NOT NULL,
+			session TEXT
+		)`,
+		`CREATE INDEX refresh_tokens_family_id ON refresh_tokens (family_id)`,
+		`CREATE INDEX refresh_tokens_uid ON refresh_tokens (uid)`,
+		`CREATE INDEX refresh_tokens_expired_at ON refresh_tokens (expired_at)`,
+		`CREATE TABLE login_failures (
+			throttle_key TEXT PRIMARY KEY,
+			failures BIGINT NOT NULL,
+			last_failed_at BIGINT NOT NULL,
+			expired_at BIGINT NOT NULL
+		)`,
+		`CREATE INDEX login_failures_expired_at ON login_failures (expired_at)`,
+		`CREATE TABLE roles (
+			name TEXT PRIMARY KEY,
+			info TEXT NOT NULL
+		)`,
+		`CREATE TABLE user_roles (
+			uid BIGINT NOT NULL,
+			role_name TEXT NOT NULL,
+			assigned_at BIGINT NOT NULL,
+			PRIMARY KEY (uid, role_name)
+		)`,
+		`CREATE INDEX user_roles_role_name ON user_roles (role_name)`,
+		`CREATE TABLE api_keys (
+			key_id TEXT PRIMARY KEY,
+			uid BIGINT NOT NULL,
+			info TEXT NOT NULL,
+			last_used_at BIGINT NOT NULL DEFAULT 0,
+			expired_at BIGINT NOT NULL DEFAULT 0
+		)`,
+		`CREATE INDEX api_keys_uid ON api_keys (uid)`,
+		`CREATE TABLE one_time_tokens (
+			hashed_token TEXT PRIMARY KEY,
+			uid BIGINT NOT NULL,
+			purpose TEXT NOT NULL,
+			info TEXT NOT NULL,
+			expired_at BIGINT NOT NULL
+		)`,
+		`CREATE INDEX one_time_tokens_uid ON one_time_tokens (uid, purpose)`,
+		`CREATE INDEX one_time_tokens_expired_at ON one_time_tokens (expired_at)`,
+		`CREATE TABLE property_namespaces (
+			uid BIGINT NOT NULL,
+			ns TEXT NOT NULL,
+			data {{blob}},
+			version BIGINT NOT NULL,
+			PRIMARY KEY (uid, ns)
+		)`,
+	},
+	{
+		`CREATE TABLE identities (
+			provider TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			uid BIGINT NOT NULL,
+			linked_at BIGINT NOT NULL,
+			PRIMARY KEY (provider, subject)
+		)`,
+		`CREATE INDEX identities_uid ON identities (uid)`,
+	},
+	{
+		`ALTER TABLE accounts ADD COLUMN password_history TEXT`,
+	},
+}
+
+// migrate applies the pending migrations, each version in its own transaction.
+func (impl *sqlAccountStorageImpl) migrate(ctx context.Context) (err error) {
+	_, err = impl.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return
+	}
+
+	var version sql.NullInt64
+
+	err = impl.db.QueryRowContext(ctx, "SELECT MAX(version) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return
+	}
+
+	for v := int(version.Int64) + 1; v <= len(migrations); v++ {
+		err = impl.withTx(ctx, func(tx *sql.Tx) error {
+			for _, statement := range migrations[v-1] {
+				if _, e := tx.ExecContext(ctx, impl.dialect.schema(statement)); e != nil {
+					return e
+				}
+			}
+
+			_, e := tx.ExecContext(ctx, impl.dialect.rebind("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)"),
+				v, time.Now().UnixNano())
+
+			return e
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
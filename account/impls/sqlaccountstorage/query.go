@@ -0,0 +1,140 @@
+package sqlaccountstorage
+
+import (
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/sgostarter/libcomponents/account"
+	"github.com/spf13/cast"
+)
+
+func (impl *sqlAccountStorageImpl) QueryUsers(query *account.UserQuery) (page *account.UserPage, err error) {
+	cursor, err := account.DecodeUserCursor(query.Cursor)
+	if err != nil {
+		return
+	}
+
+	where, args := impl.userQueryWhere(query)
+
+	sortColumn := "create_at"
+	if query.SortBy == account.UserSortByName {
+		sortColumn = "name"
+	}
+
+	op, order := ">", "ASC"
+	if query.Desc {
+		op, order = "<", "DESC"
+	}
+
+	if cursor != nil {
+		var sortKey interface{} = cursor.SortKey
+		if query.SortBy != account.UserSortByName {
+			sortKey = cast.ToInt64(cursor.SortKey)
+		}
+
+		where += " AND (a." + sortColumn + " " + op + " ? OR (a." + sortColumn + " = ? AND a.uid " + op + " ?))"
+
+		args = append(args, sortKey, sortKey, int64(cursor.UID))
+	}
+
+	rows, err := impl.query("SELECT a.uid, a.name, a.create_at, a.state FROM accounts a WHERE "+where+
+		" ORDER BY a."+sortColumn+" "+order+", a.uid "+order+" LIMIT ?", append(args, query.Limit)...)
+	if err != nil {
+		return
+	}
+
+	defer closeRows(rows)
+
+	page = &account.UserPage{}
+
+	for rows.Next() {
+		var user account.User
+
+		var id int64
+
+		if err = rows.Scan(&id, &user.UserName, &user.CreateAt, &user.State); err != nil {
+			return
+		}
+
+		user.UserID = uint64(id)
+
+		if user.State == "" {
+			user.State = account.AccountStateActive
+		}
+
+		page.Users = append(page.Users, user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if len(page.Users) == query.Limit {
+		last := page.Users[len(page.Users)-1]
+
+		sortKey := last.UserName
+		if query.SortBy != account.UserSortByName {
+			sortKey = strconv.FormatInt(last.CreateAt, 10)
+		}
+
+		page.NextCursor = account.EncodeUserCursor(&account.UserCursor{
+			SortKey: sortKey,
+			UID:     last.UserID,
+		})
+	}
+
+	return
+}
+
+//
+//
+//
+
+func (impl *sqlAccountStorageImpl) userQueryWhere(q *account.UserQuery) (where string, args []interface{}) {
+	switch q.State {
+	case "":
+		where = "a.state <> ?"
+
+		args = append(args, account.AccountStateDeleted)
+	case account.AccountStateActive:
+		where = "(a.state = '' OR a.state = ?)"
+
+		args = append(args, q.State)
+	default:
+		where = "a.state = ?"
+
+		args = append(args, q.State)
+	}
+
+	if q.NamePrefix != "" {
+		where += " AND substr(a.name, 1, ?) = ?"
+
+		args = append(args, utf8.RuneCountInString(q.NamePrefix), q.NamePrefix)
+	}
+
+	if q.NameContains != "" {
+		where += " AND " + impl.dialect.containsExpr("a.name")
+
+		args = append(args, q.NameContains)
+	}
+
+	if q.Role != "" {
+		where += " AND EXISTS (SELECT 1 FROM user_roles r WHERE r.uid = a.uid AND r.role_name = ?)"
+
+		args = append(args, q.Role)
+	}
+
+	if q.CreatedAtStart > 0 {
+		where += " AND a.create_at >= ?"
+
+		args = append(args, q.CreatedAtStart)
+	}
+
+	if q.CreatedAtFinish > 0 {
+		where += " AND a.create_at <= ?"
+
+		args = append(args, q.CreatedAtFinish)
+	}
+
+	return
+}
@@ -0,0 +1,1203 @@
+package sqlaccountstorage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/godruoyi/go-snowflake"
+	"github.com/sgostarter/i/commerr"
+	"github.com/sgostarter/i/l"
+	"github.com/sgostarter/libcomponents/account"
+)
+
+const cleanExpiredInterval = time.Minute
+
+// NewSQLAccountStorage stores accounts in db, which must be opened by a driver of dialect. Pending schema
+// migrations are applied before it returns, so run one instance first when deploying a new version.
+func NewSQLAccountStorage(db *sql.DB, dialect Dialect, logger l.Wrapper) (account.Storage, error) {
+	if logger == nil {
+		logger = l.NewNopLoggerWrapper()
+	}
+
+	if db == nil || !dialect.valid() {
+		return nil, commerr.ErrInvalidArgument
+	}
+
+	impl := &sqlAccountStorageImpl{
+		logger:  logger.WithFields(l.StringField(l.ClsKey, "sqlAccountStorageImpl")),
+		db:      db,
+		dialect: dialect,
+	}
+
+	if err := impl.migrate(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return impl, nil
+}
+
+type sqlAccountStorageImpl struct {
+	logger  l.Wrapper
+	db      *sql.DB
+	dialect Dialect
+
+	lastCleanExpiredAt int64 // unix nano
+}
+
+func (impl *sqlAccountStorageImpl) AddAccount(accountName, hashedPassword string) (uid uint64, err error) {
+	return impl.AddAccountEx(0, accountName, hashedPassword, nil)
+}
+
+func (impl *sqlAccountStorageImpl) AddAccountEx(userID uint64, accountName, hashedPassword string, data []byte) (uid uint64, err error) {
+	uid = userID
+
+	if uid == 0 {
+		uid = snowflake.ID()
+	}
+
+	n, err := impl.exec("INSERT INTO accounts (uid, name, hashed_password, create_at, data) VALUES (?, ?, ?, ?, ?) "+
+		"ON CONFLICT DO NOTHING", int64(uid), accountName, hashedPassword, time.Now().Unix(), data)
+	if err != nil {
+		return
+	}
+
+	if n == 0 {
+		err = commerr.ErrAlreadyExists
+	}
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) SetHashedPassword(uid uint64, hashedPassword string) error {
+	return impl.updateAccount(uid, "hashed_password = ?", hashedPassword)
+}
+
+func (impl *sqlAccountStorageImpl) RenameAccountName(uid uint64, newAccountName string) error {
+	return impl.withTx(context.Background(), func(tx *sql.Tx) error {
+		var id int64
+
+		err := tx.QueryRow(impl.dialect.rebind("SELECT uid FROM accounts WHERE name = ?"), newAccountName).Scan(&id)
+		if err == nil {
+			if uint64(id) == uid {
+				return nil
+			}
+
+			return commerr.ErrAlreadyExists
+		}
+
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		result, err := tx.Exec(impl.dialect.rebind("UPDATE accounts SET name = ? WHERE uid = ?"), newAccountName, int64(uid))
+
+		return notFoundIfNoRows(result, err)
+	})
+}
+
+func (impl *sqlAccountStorageImpl) SetAdvanceConfig(uid uint64, cfg *account.AdvanceConfig) (err error) {
+	d, err := marshalJSON(cfg)
+	if err != nil {
+		return
+	}
+
+	return impl.updateAccount(uid, "advance_config = ?", d)
+}
+
+func (impl *sqlAccountStorageImpl) GetAdvanceConfig(uid uint64) (cfg *account.AdvanceConfig, err error) {
+	var d sql.NullString
+
+	err = impl.queryAccount(uid, "advance_config", &d)
+	if err != nil || !d.Valid {
+		return
+	}
+
+	cfg = &account.AdvanceConfig{}
+
+	err = json.Unmarshal([]byte(d.String), cfg)
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) FindAccount(accountName string) (uid uint64, hashedPassword string, err error) {
+	var id int64
+
+	err = impl.queryRow("SELECT uid, hashed_password FROM accounts WHERE name = ?", accountName).Scan(&id, &hashedPassword)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = commerr.ErrNotFound
+	}
+
+	uid = uint64(id)
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) GetAccount(uid uint64) (accountName string, hashedPassword string, err error) {
+	err = impl.queryAccount(uid, "name, hashed_password", &accountName, &hashedPassword)
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) GetAccountData(uid uint64) (data []byte, err error) {
+	err = impl.queryAccount(uid, "data", &data)
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) HasAccount() (f bool, err error) {
+	var n int
+
+	err = impl.queryRow("SELECT 1 FROM accounts WHERE state <> ? LIMIT 1", account.AccountStateDeleted).Scan(&n)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+
+		return
+	}
+
+	f = err == nil
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) ListUsers(createdAtStart, createdAtFinish int64) (accounts []account.User, err error) {
+	query := "SELECT uid, name, create_at FROM accounts WHERE state <> ?"
+	args := []interface{}{account.AccountStateDeleted}
+
+	if createdAtStart > 0 {
+		query += " AND create_at >= ?"
+
+		args = append(args, createdAtStart)
+	}
+
+	if createdAtFinish > 0 {
+		query += " AND create_at <= ?"
+
+		args = append(args, createdAtFinish)
+	}
+
+	rows, err := impl.query(query+" ORDER BY create_at, uid", args...)
+	if err != nil {
+		return
+	}
+
+	defer closeRows(rows)
+
+	accounts = make([]account.User, 0)
+
+	for rows.Next() {
+		var user account.User
+
+		var id int64
+
+		if err = rows.Scan(&id, &user.UserName, &user.CreateAt); err != nil {
+			return
+		}
+
+		user.UserID = uint64(id)
+
+		accounts = append(accounts, user)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) GetIDFromAccountName(accountName string) (uid uint64, exists bool, err error) {
+	var id int64
+
+	err = impl.queryRow("SELECT uid FROM accounts WHERE name = ?", accountName).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+
+		return
+	}
+
+	uid = uint64(id)
+	exists = err == nil
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) SetAccountState(uid uint64, state account.AccountState) error {
+	return impl.updateAccount(uid, "state = ?", state)
+}
+
+func (impl *sqlAccountStorageImpl) GetAccountState(uid uint64) (state account.AccountState, err error) {
+	err = impl.queryAccount(uid, "state", &state)
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) DelAccount(uid uint64) error {
+	return impl.withTx(context.Background(), func(tx *sql.Tx) error {
+		result, err := tx.Exec(impl.dialect.rebind("DELETE FROM accounts WHERE uid = ?"), int64(uid))
+		if err = notFoundIfNoRows(result, err); err != nil {
+			return err
+		}
+
+		for _, table := range []string{"tokens", "refresh_tokens", "user_roles", "api_keys", "one_time_tokens",
+			"property_namespaces", "identities"} {
+			if _, err = tx.Exec(impl.dialect.rebind("DELETE FROM "+table+" WHERE uid = ?"), int64(uid)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (impl *sqlAccountStorageImpl) SetContact(uid uint64, contact string, verified bool) error {
+	return impl.updateAccount(uid, "contact = ?, contact_verified = ?", contact, verified)
+}
+
+func (impl *sqlAccountStorageImpl) GetContact(uid uint64) (contact string, verified bool, err error) {
+	err = impl.queryAccount(uid, "contact, contact_verified", &contact, &verified)
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) AddToken(token string, uid uint64, expiredAt time.Time) error {
+	return impl.AddTokenEx(token, uid, expiredAt, nil)
+}
+
+func (impl *sqlAccountStorageImpl) AddTokenEx(token string, uid uint64, expiredAt time.Time, session *account.Session) (err error) {
+	impl.cleanExpired()
+
+	d, err := marshalJSON(session)
+	if err != nil {
+		return
+	}
+
+	n, err := impl.exec("INSERT INTO tokens (token, uid, expired_at, session) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING",
+		token, int64(uid), expiredAt.UnixNano(), d)
+	if err != nil {
+		return
+	}
+
+	if n == 0 {
+		err = commerr.ErrAlreadyExists
+	}
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) ListTokens(uid uint64) (tokens map[string]*account.Session, err error) {
+	rows, err := impl.query("SELECT token, expired_at, session FROM tokens WHERE uid = ? AND expired_at > ?",
+		int64(uid), time.Now().UnixNano())
+	if err != nil {
+		return
+	}
+
+	defer closeRows(rows)
+
+	tokens = make(map[string]*account.Session)
+
+	for rows.Next() {
+		var token string
+
+		var expiredAt int64
+
+		var d sql.NullString
+
+		if err = rows.Scan(&token, &expiredAt, &d); err != nil {
+			return
+		}
+
+		session := &account.Session{}
+
+		if d.Valid {
+			if err = json.Unmarshal([]byte(d.String), session); err != nil {
+				return
+			}
+		}
+
+		session.ExpiredAt = time.Unix(0, expiredAt)
+
+		tokens[token] = session
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) DelToken(token string) error {
+	return notFoundIfNoRows(impl.db.Exec(impl.dialect.rebind("DELETE FROM tokens WHERE token = ?"), token))
+}
+
+// TokenExists extends the expiry of existing tokens by renewDuration.
+func (impl *sqlAccountStorageImpl) TokenExists(token string, renewDuration time.Duration) (exists bool, err error) {
+	now := time.Now().UnixNano()
+
+	if renewDuration > 0 {
+		var n int64
+
+		n, err = impl.exec("UPDATE tokens SET expired_at = expired_at + ? WHERE token = ? AND expired_at > ?",
+			renewDuration.Nanoseconds(), token, now)
+		exists = n > 0
+
+		return
+	}
+
+	var one int
+
+	err = impl.queryRow("SELECT 1 FROM tokens WHERE token = ? AND expired_at > ?", token, now).Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+
+		return
+	}
+
+	exists = err == nil
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) AddRefreshToken(refreshToken string, info *account.RefreshTokenInfo) (err error) {
+	impl.cleanExpired()
+
+	n, err := impl.insertRefreshToken(impl.db, refreshToken, info)
+	if err != nil {
+		return
+	}
+
+	if n == 0 {
+		err = commerr.ErrAlreadyExists
+	}
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) GetRefreshToken(refreshToken string) (info *account.RefreshTokenInfo, err error) {
+	var uid, expiredAt int64
+
+	var d sql.NullString
+
+	info = &account.RefreshTokenInfo{}
+
+	err = impl.queryRow("SELECT uid, family_id, access_token, rotated, expired_at, session FROM refresh_tokens "+
+		"WHERE token = ? AND expired_at > ?", refreshToken, time.Now().UnixNano()).Scan(&uid, &info.FamilyID,
+		&info.AccessToken, &info.Rotated, &expiredAt, &d)
+	if err != nil {
+		info = nil
+
+		if errors.Is(err, sql.ErrNoRows) {
+			err = commerr.ErrNotFound
+		}
+
+		return
+	}
+
+	info.UID = uint64(uid)
+	info.ExpiredAt = time.Unix(0, expiredAt)
+
+	if d.Valid {
+		info.Session = &account.Session{}
+
+		err = json.Unmarshal([]byte(d.String), info.Session)
+	}
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) RotateRefreshToken(oldRefreshToken, newRefreshToken string, info *account.RefreshTokenInfo) error {
+	return impl.withTx(context.Background(), func(tx *sql.Tx) error {
+		now := time.Now().UnixNano()
+
+		result, err := tx.Exec(impl.dialect.rebind("UPDATE refresh_tokens SET rotated = ? "+
+			"WHERE token = ? AND rotated = ? AND expired_at > ?"), true, oldRefreshToken, false, now)
+		if err = notFoundIfNoRows(result, err); err != nil {
+			if !errors.Is(err, commerr.ErrNotFound) {
+				return err
+			}
+
+			var rotated bool
+
+			e := tx.QueryRow(impl.dialect.rebind("SELECT rotated FROM refresh_tokens WHERE token = ? AND expired_at > ?"),
+				oldRefreshToken, now).Scan(&rotated)
+			if e == nil && rotated {
+				err = account.ErrRefreshTokenReused
+			}
+
+			return err
+		}
+
+		n, err := impl.insertRefreshToken(tx, newRefreshToken, info)
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			return commerr.ErrAlreadyExists
+		}
+
+		return nil
+	})
+}
+
+func (impl *sqlAccountStorageImpl) RevokeRefreshTokenFamily(familyID string) error {
+	return impl.revokeRefreshTokens("family_id = ?", familyID)
+}
+
+func (impl *sqlAccountStorageImpl) RevokeUserRefreshTokens(uid uint64, exceptFamilyID string) error {
+	return impl.revokeRefreshTokens("uid = ? AND family_id <> ?", int64(uid), exceptFamilyID)
+}
+
+func (impl *sqlAccountStorageImpl) IncLoginFailure(key string, expiresAfter time.Duration) (failures int64, err error) {
+	impl.cleanExpired()
+
+	now := time.Now()
+
+	// an expired record starts over
+	err = impl.queryRow("INSERT INTO login_failures (throttle_key, failures, last_failed_at, expired_at) "+
+		"VALUES (?, 1, ?, ?) ON CONFLICT (throttle_key) DO UPDATE SET "+
+		"failures = CASE WHEN login_failures.expired_at < ? THEN 1 ELSE login_failures.failures + 1 END, "+
+		"last_failed_at = excluded.last_failed_at, expired_at = excluded.expired_at RETURNING failures",
+		key, now.UnixNano(), now.Add(expiresAfter).UnixNano(), now.UnixNano()).Scan(&failures)
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) GetLoginFailure(key string) (failures int64, lastFailedAt time.Time, err error) {
+	var lastFailedAtNano int64
+
+	err = impl.queryRow("SELECT failures, last_failed_at FROM login_failures WHERE throttle_key = ? AND expired_at > ?",
+		key, time.Now().UnixNano()).Scan(&failures, &lastFailedAtNano)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = nil
+		}
+
+		return
+	}
+
+	lastFailedAt = time.Unix(0, lastFailedAtNano)
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) ResetLoginFailure(key string) (err error) {
+	_, err = impl.exec("DELETE FROM login_failures WHERE throttle_key = ?", key)
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) SetTOTP(uid uint64, info *account.TOTPInfo) (err error) {
+	d, err := marshalJSON(info)
+	if err != nil {
+		return
+	}
+
+	return impl.updateAccount(uid, "totp = ?", d)
+}
+
+func (impl *sqlAccountStorageImpl) GetTOTP(uid uint64) (info *account.TOTPInfo, err error) {
+	var d sql.NullString
+
+	err = impl.queryAccount(uid, "totp", &d)
+	if err != nil || !d.Valid {
+		return
+	}
+
+	info = &account.TOTPInfo{}
+
+	err = json.Unmarshal([]byte(d.String), info)
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) CompareAndSetTOTP(uid uint64, oldInfo, info *account.TOTPInfo) (err error) {
+	oldD, err := marshalJSON(oldInfo)
+	if err != nil {
+		return
+	}
+
+	d, err := marshalJSON(info)
+	if err != nil {
+		return
+	}
+
+	query, args := "UPDATE accounts SET totp = ? WHERE uid = ? AND totp IS NULL", []interface{}{d, int64(uid)}
+	if oldD.Valid {
+		query, args = "UPDATE accounts SET totp = ? WHERE uid = ? AND totp = ?", append(args, oldD)
+	}
+
+	err = notFoundIfNoRows(impl.db.Exec(impl.dialect.rebind(query), args...))
+	if errors.Is(err, commerr.ErrNotFound) {
+		if err = impl.checkAccountExists(uid); err == nil {
+			err = commerr.ErrAborted
+		}
+	}
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) SetPasswordHistory(uid uint64, hashedPasswords []string) (err error) {
+	d, err := marshalJSON(hashedPasswords)
+	if err != nil {
+		return
+	}
+
+	return impl.updateAccount(uid, "password_history = ?", d)
+}
+
+func (impl *sqlAccountStorageImpl) GetPasswordHistory(uid uint64) (hashedPasswords []string, err error) {
+	var d sql.NullString
+
+	err = impl.queryAccount(uid, "password_history", &d)
+	if err != nil || !d.Valid {
+		return
+	}
+
+	err = json.Unmarshal([]byte(d.String), &hashedPasswords)
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) SetRole(role *account.Role) (err error) {
+	d, err := json.Marshal(role)
+	if err != nil {
+		return
+	}
+
+	_, err = impl.exec("INSERT INTO roles (name, info) VALUES (?, ?) ON CONFLICT (name) DO UPDATE SET info = excluded.info",
+		role.Name, string(d))
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) DelRole(roleName string) error {
+	return impl.withTx(context.Background(), func(tx *sql.Tx) error {
+		result, err := tx.Exec(impl.dialect.rebind("DELETE FROM roles WHERE name = ?"), roleName)
+		if err = notFoundIfNoRows(result, err); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(impl.dialect.rebind("DELETE FROM user_roles WHERE role_name = ?"), roleName)
+
+		return err
+	})
+}
+
+func (impl *sqlAccountStorageImpl) GetRole(roleName string) (role *account.Role, err error) {
+	var d string
+
+	err = impl.queryRow("SELECT info FROM roles WHERE name = ?", roleName).Scan(&d)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = commerr.ErrNotFound
+		}
+
+		return
+	}
+
+	role = &account.Role{}
+
+	err = json.Unmarshal([]byte(d), role)
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) ListRoles() (roles []*account.Role, err error) {
+	rows, err := impl.query("SELECT info FROM roles ORDER BY name")
+	if err != nil {
+		return
+	}
+
+	defer closeRows(rows)
+
+	roles = make([]*account.Role, 0)
+
+	for rows.Next() {
+		var d string
+
+		if err = rows.Scan(&d); err != nil {
+			return
+		}
+
+		role := &account.Role{}
+
+		if err = json.Unmarshal([]byte(d), role); err != nil {
+			return
+		}
+
+		roles = append(roles, role)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) AssignRole(uid uint64, roleName string) (err error) {
+	if _, err = impl.GetRole(roleName); err != nil {
+		return
+	}
+
+	if err = impl.checkAccountExists(uid); err != nil {
+		return
+	}
+
+	_, err = impl.exec("INSERT INTO user_roles (uid, role_name, assigned_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING",
+		int64(uid), roleName, time.Now().UnixNano())
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) UnassignRole(uid uint64, roleName string) (err error) {
+	if err = impl.checkAccountExists(uid); err != nil {
+		return
+	}
+
+	_, err = impl.exec("DELETE FROM user_roles WHERE uid = ? AND role_name = ?", int64(uid), roleName)
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) GetUserRoles(uid uint64) (roleNames []string, err error) {
+	if err = impl.checkAccountExists(uid); err != nil {
+		return
+	}
+
+	rows, err := impl.query("SELECT role_name FROM user_roles WHERE uid = ? ORDER BY assigned_at, role_name", int64(uid))
+	if err != nil {
+		return
+	}
+
+	defer closeRows(rows)
+
+	for rows.Next() {
+		var roleName string
+
+		if err = rows.Scan(&roleName); err != nil {
+			return
+		}
+
+		roleNames = append(roleNames, roleName)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) ListUsersByRole(roleName string) (uids []uint64, err error) {
+	rows, err := impl.query("SELECT uid FROM user_roles WHERE role_name = ? ORDER BY uid", roleName)
+	if err != nil {
+		return
+	}
+
+	defer closeRows(rows)
+
+	for rows.Next() {
+		var id int64
+
+		if err = rows.Scan(&id); err != nil {
+			return
+		}
+
+		uids = append(uids, uint64(id))
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) AddAPIKey(info *account.APIKey) (err error) {
+	impl.cleanExpired()
+
+	d, err := json.Marshal(info)
+	if err != nil {
+		return
+	}
+
+	n, err := impl.exec("INSERT INTO api_keys (key_id, uid, info, last_used_at, expired_at) VALUES (?, ?, ?, ?, ?) "+
+		"ON CONFLICT DO NOTHING", info.KeyID, int64(info.UID), string(d), toUnixNano(info.LastUsedAt),
+		toUnixNano(info.ExpiredAt))
+	if err != nil {
+		return
+	}
+
+	if n == 0 {
+		err = commerr.ErrAlreadyExists
+	}
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) GetAPIKey(keyID string) (info *account.APIKey, err error) {
+	rows, err := impl.query("SELECT info, last_used_at FROM api_keys WHERE key_id = ?", keyID)
+	if err != nil {
+		return
+	}
+
+	keys, err := scanAPIKeys(rows)
+	if err != nil {
+		return
+	}
+
+	if len(keys) == 0 {
+		err = commerr.ErrNotFound
+
+		return
+	}
+
+	info = keys[0]
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) ListAPIKeys(uid uint64) (keys []*account.APIKey, err error) {
+	rows, err := impl.query("SELECT info, last_used_at FROM api_keys WHERE uid = ? AND (expired_at = 0 OR expired_at > ?) "+
+		"ORDER BY key_id", int64(uid), time.Now().UnixNano())
+	if err != nil {
+		return
+	}
+
+	return scanAPIKeys(rows)
+}
+
+func (impl *sqlAccountStorageImpl) DelAPIKey(uid uint64, keyID string) error {
+	return notFoundIfNoRows(impl.db.Exec(impl.dialect.rebind("DELETE FROM api_keys WHERE key_id = ? AND uid = ?"),
+		keyID, int64(uid)))
+}
+
+func (impl *sqlAccountStorageImpl) TouchAPIKey(keyID string, lastUsedAt time.Time) error {
+	return notFoundIfNoRows(impl.db.Exec(impl.dialect.rebind("UPDATE api_keys SET last_used_at = ? WHERE key_id = ?"),
+		toUnixNano(lastUsedAt), keyID))
+}
+
+func (impl *sqlAccountStorageImpl) AddOneTimeToken(hashedToken string, info *account.OneTimeTokenInfo) (err error) {
+	impl.cleanExpired()
+
+	d, err := json.Marshal(info)
+	if err != nil {
+		return
+	}
+
+	n, err := impl.exec("INSERT INTO one_time_tokens (hashed_token, uid, purpose, info, expired_at) VALUES (?, ?, ?, ?, ?) "+
+		"ON CONFLICT DO NOTHING", hashedToken, int64(info.UID), info.Purpose, string(d), info.ExpiredAt.UnixNano())
+	if err != nil {
+		return
+	}
+
+	if n == 0 {
+		err = commerr.ErrAlreadyExists
+	}
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) ConsumeOneTimeToken(hashedToken string) (info *account.OneTimeTokenInfo, err error) {
+	var d string
+
+	err = impl.queryRow("DELETE FROM one_time_tokens WHERE hashed_token = ? RETURNING info", hashedToken).Scan(&d)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = commerr.ErrNotFound
+		}
+
+		return
+	}
+
+	info = &account.OneTimeTokenInfo{}
+
+	err = json.Unmarshal([]byte(d), info)
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) DelOneTimeTokens(uid uint64, purpose string) (err error) {
+	_, err = impl.exec("DELETE FROM one_time_tokens WHERE uid = ? AND purpose = ?", int64(uid), purpose)
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) LinkIdentity(identity *account.Identity) (err error) {
+	if err = impl.checkAccountExists(identity.UID); err != nil {
+		return
+	}
+
+	n, err := impl.exec("INSERT INTO identities (provider, subject, uid, linked_at) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING",
+		identity.Provider, identity.Subject, int64(identity.UID), toUnixNano(identity.LinkedAt))
+	if err != nil {
+		return
+	}
+
+	if n == 0 {
+		err = commerr.ErrAlreadyExists
+	}
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) FindIdentity(provider, subject string) (identity *account.Identity, err error) {
+	rows, err := impl.query("SELECT provider, subject, uid, linked_at FROM identities WHERE provider = ? AND subject = ?",
+		provider, subject)
+	if err != nil {
+		return
+	}
+
+	identities, err := scanIdentities(rows)
+	if err != nil {
+		return
+	}
+
+	if len(identities) == 0 {
+		err = commerr.ErrNotFound
+
+		return
+	}
+
+	identity = identities[0]
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) ListIdentities(uid uint64) (identities []*account.Identity, err error) {
+	rows, err := impl.query("SELECT provider, subject, uid, linked_at FROM identities WHERE uid = ? "+
+		"ORDER BY linked_at, provider, subject", int64(uid))
+	if err != nil {
+		return
+	}
+
+	return scanIdentities(rows)
+}
+
+func (impl *sqlAccountStorageImpl) UnlinkIdentity(uid uint64, provider, subject string) error {
+	return notFoundIfNoRows(impl.db.Exec(impl.dialect.rebind("DELETE FROM identities WHERE provider = ? AND subject = ? AND uid = ?"),
+		provider, subject, int64(uid)))
+}
+
+func (impl *sqlAccountStorageImpl) SetPropertyData(accountName string, d interface{}) (err error) {
+	uid, exists, err := impl.GetIDFromAccountName(accountName)
+	if err != nil {
+		return
+	}
+
+	if !exists {
+		err = commerr.ErrNotFound
+
+		return
+	}
+
+	return impl.SetPropertyDataByUserID(uid, d)
+}
+
+func (impl *sqlAccountStorageImpl) SetPropertyDataByUserID(uid uint64, d interface{}) (err error) {
+	dd, err := json.Marshal(d)
+	if err != nil {
+		return
+	}
+
+	return impl.updateAccount(uid, "property_data = ?", dd)
+}
+
+func (impl *sqlAccountStorageImpl) GetPropertyData(accountName string, d interface{}) (err error) {
+	uid, exists, err := impl.GetIDFromAccountName(accountName)
+	if err != nil {
+		return
+	}
+
+	if !exists {
+		err = commerr.ErrNotFound
+
+		return
+	}
+
+	return impl.GetPropertyDataByUserID(uid, d)
+}
+
+func (impl *sqlAccountStorageImpl) GetPropertyDataByUserID(uid uint64, d interface{}) (err error) {
+	var dd []byte
+
+	err = impl.queryAccount(uid, "property_data", &dd)
+	if err != nil {
+		return
+	}
+
+	if dd == nil {
+		err = commerr.ErrNotFound
+
+		return
+	}
+
+	err = json.Unmarshal(dd, d)
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) GetPropertyNamespace(uid uint64, ns string) (data []byte, version uint64, err error) {
+	var v int64
+
+	err = impl.queryRow("SELECT data, version FROM property_namespaces WHERE uid = ? AND ns = ?", int64(uid), ns).
+		Scan(&data, &v)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+
+	version = uint64(v)
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) SetPropertyNamespace(uid uint64, ns string, version uint64, data []byte) (newVersion uint64, err error) {
+	if err = impl.checkAccountExists(uid); err != nil {
+		return
+	}
+
+	var n int64
+
+	if version == 0 {
+		n, err = impl.exec("INSERT INTO property_namespaces (uid, ns, data, version) VALUES (?, ?, ?, 1) ON CONFLICT DO NOTHING",
+			int64(uid), ns, data)
+	} else {
+		n, err = impl.exec("UPDATE property_namespaces SET data = ?, version = version + 1 WHERE uid = ? AND ns = ? AND version = ?",
+			data, int64(uid), ns, int64(version))
+	}
+
+	if err != nil {
+		return
+	}
+
+	if n == 0 {
+		err = account.ErrPropertyVersionConflict
+
+		return
+	}
+
+	newVersion = version + 1
+
+	return
+}
+
+//
+//
+//
+
+func (impl *sqlAccountStorageImpl) exec(query string, args ...interface{}) (rowsAffected int64, err error) {
+	result, err := impl.db.Exec(impl.dialect.rebind(query), args...)
+	if err != nil {
+		return
+	}
+
+	return result.RowsAffected()
+}
+
+func (impl *sqlAccountStorageImpl) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return impl.db.Query(impl.dialect.rebind(query), args...)
+}
+
+func (impl *sqlAccountStorageImpl) queryRow(query string, args ...interface{}) *sql.Row {
+	return impl.db.QueryRow(impl.dialect.rebind(query), args...)
+}
+
+func (impl *sqlAccountStorageImpl) withTx(ctx context.Context, fn func(tx *sql.Tx) error) (err error) {
+	tx, err := impl.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	err = fn(tx)
+	if err != nil {
+		_ = tx.Rollback()
+
+		return
+	}
+
+	return tx.Commit()
+}
+
+func (impl *sqlAccountStorageImpl) updateAccount(uid uint64, set string, args ...interface{}) error {
+	return notFoundIfNoRows(impl.db.Exec(impl.dialect.rebind("UPDATE accounts SET "+set+" WHERE uid = ?"),
+		append(args, int64(uid))...))
+}
+
+func (impl *sqlAccountStorageImpl) queryAccount(uid uint64, columns string, dest ...interface{}) (err error) {
+	err = impl.queryRow("SELECT "+columns+" FROM accounts WHERE uid = ?", int64(uid)).Scan(dest...)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = commerr.ErrNotFound
+	}
+
+	return
+}
+
+func (impl *sqlAccountStorageImpl) checkAccountExists(uid uint64) error {
+	var one int
+
+	return impl.queryAccount(uid, "1", &one)
+}
+
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (impl *sqlAccountStorageImpl) insertRefreshToken(execer sqlExecer, refreshToken string, info *account.RefreshTokenInfo) (
+	rowsAffected int64, err error) {
+	d, err := marshalJSON(info.Session)
+	if err != nil {
+		return
+	}
+
+	result, err := execer.Exec(impl.dialect.rebind("INSERT INTO refresh_tokens "+
+		"(token, uid, family_id, access_token, rotated, expired_at, session) VALUES (?, ?, ?, ?, ?, ?, ?) "+
+		"ON CONFLICT DO NOTHING"), refreshToken, int64(info.UID), info.FamilyID, info.AccessToken, info.Rotated,
+		info.ExpiredAt.UnixNano(), d)
+	if err != nil {
+		return
+	}
+
+	return result.RowsAffected()
+}
+
+// revokeRefreshTokens removes the matched refresh tokens and their access tokens.
+func (impl *sqlAccountStorageImpl) revokeRefreshTokens(where string, args ...interface{}) error {
+	return impl.withTx(context.Background(), func(tx *sql.Tx) error {
+		_, err := tx.Exec(impl.dialect.rebind("DELETE FROM tokens WHERE token IN "+
+			"(SELECT access_token FROM refresh_tokens WHERE "+where+")"), args...)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(impl.dialect.rebind("DELETE FROM refresh_tokens WHERE "+where), args...)
+
+		return err
+	})
+}
+
+// cleanExpired removes expired rows by the expired_at indexes at most once every cleanExpiredInterval.
+func (impl *sqlAccountStorageImpl) cleanExpired() {
+	now := time.Now().UnixNano()
+
+	last := atomic.LoadInt64(&impl.lastCleanExpiredAt)
+	if now-last < int64(cleanExpiredInterval) || !atomic.CompareAndSwapInt64(&impl.lastCleanExpiredAt, last, now) {
+		return
+	}
+
+	for _, query := range []string{
+		"DELETE FROM tokens WHERE expired_at <= ?",
+		"DELETE FROM refresh_tokens WHERE expired_at <= ?",
+		"DELETE FROM login_failures WHERE expired_at <= ?",
+		"DELETE FROM one_time_tokens WHERE expired_at <= ?",
+		"DELETE FROM api_keys WHERE expired_at > 0 AND expired_at <= ?",
+	} {
+		if _, err := impl.exec(query, now); err != nil {
+			impl.logger.WithFields(l.ErrorField(err), l.StringField("query", query)).Error("clean expired failed")
+		}
+	}
+}
+
+func scanAPIKeys(rows *sql.Rows) (keys []*account.APIKey, err error) {
+	defer closeRows(rows)
+
+	for rows.Next() {
+		var d string
+
+		var lastUsedAt int64
+
+		if err = rows.Scan(&d, &lastUsedAt); err != nil {
+			return
+		}
+
+		key := &account.APIKey{}
+
+		if err = json.Unmarshal([]byte(d), key); err != nil {
+			return
+		}
+
+		key.LastUsedAt = fromUnixNano(lastUsedAt)
+
+		keys = append(keys, key)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+func scanIdentities(rows *sql.Rows) (identities []*account.Identity, err error) {
+	defer closeRows(rows)
+
+	for rows.Next() {
+		var (
+			uid      int64
+			linkedAt int64
+		)
+
+		identity := &account.Identity{}
+
+		if err = rows.Scan(&identity.Provider, &identity.Subject, &uid, &linkedAt); err != nil {
+			return
+		}
+
+		identity.UID = uint64(uid)
+		identity.LinkedAt = fromUnixNano(linkedAt)
+
+		identities = append(identities, identity)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+func notFoundIfNoRows(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return commerr.ErrNotFound
+	}
+
+	return nil
+}
+
+// marshalJSON returns NULL for nil v.
+func marshalJSON(v interface{}) (s sql.NullString, err error) {
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil()) {
+		return
+	}
+
+	d, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+
+	s = sql.NullString{String: string(d), Valid: true}
+
+	return
+}
+
+func closeRows(rows *sql.Rows) {
+	_ = rows.Close()
+}
+
+// toUnixNano keeps the zero time as 0.
+func toUnixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, n)
+}
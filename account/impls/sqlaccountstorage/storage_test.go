@@ -0,0 +1,157 @@
+// nolint
+package sqlaccountstorage
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/sgostarter/libcomponents/account"
+	"github.com/sgostarter/libcomponents/account/storagetest"
+	"github.com/stretchr/testify/assert"
+)
+
+// postgresDSNEnv enables the PostgreSQL tests, e.g. "postgres://postgres@127.0.0.1/test?sslmode=disable"
+const postgresDSNEnv = "ACCOUNT_TEST_POSTGRES_DSN"
+
+func newSQLiteStorage(t *testing.T) account.Storage {
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "account.db")+"?_busy_timeout=5000")
+	assert.Nil(t, err)
+
+	// sqlite allows one writer
+	db.SetMaxOpenConns(1)
+
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	stg, err := NewSQLAccountStorage(db, DialectSQLite, nil)
+	assert.Nil(t, err)
+
+	return stg
+}
+
+// newPostgresStorage uses a new schema for each storage.
+func newPostgresStorage(t *testing.T) account.Storage {
+	dsn := os.Getenv(postgresDSNEnv)
+
+	schema := "t_" + uuid.NewString()[:8]
+
+	db, err := sql.Open("postgres", dsn)
+	assert.Nil(t, err)
+
+	_, err = db.Exec("CREATE SCHEMA " + schema)
+	assert.Nil(t, err)
+
+	_ = db.Close()
+
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+
+	db, err = sql.Open("postgres", fmt.Sprintf("%s%ssearch_path=%s", dsn, sep, schema))
+	assert.Nil(t, err)
+
+	t.Cleanup(func() {
+		_, _ = db.Exec("DROP SCHEMA " + schema + " CASCADE")
+		_ = db.Close()
+	})
+
+	stg, err := NewSQLAccountStorage(db, DialectPostgres, nil)
+	assert.Nil(t, err)
+
+	return stg
+}
+
+func TestAccountSQLite(t *testing.T) {
+	storagetest.RunAccountTests(t, newSQLiteStorage)
+}
+
+func TestAccountPostgres(t *testing.T) {
+	if os.Getenv(postgresDSNEnv) == "" {
+		t.Skip(postgresDSNEnv + " is not set")
+	}
+
+	storagetest.RunAccountTests(t, newPostgresStorage)
+}
+
+func TestStorageSQLite(t *testing.T) {
+	storagetest.RunStorageTests(t, newSQLiteStorage)
+}
+
+func TestStoragePostgres(t *testing.T) {
+	if os.Getenv(postgresDSNEnv) == "" {
+		t.Skip(postgresDSNEnv + " is not set")
+	}
+
+	storagetest.RunStorageTests(t, newPostgresStorage)
+}
+
+func TestMigrate(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "account.db")
+
+	db, err := sql.Open("sqlite3", "file:"+dbFile)
+	assert.Nil(t, err)
+
+	defer db.Close()
+
+	stg, err := NewSQLAccountStorage(db, DialectSQLite, nil)
+	assert.Nil(t, err)
+
+	uid, err := stg.AddAccount("user1", "x")
+	assert.Nil(t, err)
+
+	_, err = stg.AddAccount("user1", "y")
+	assert.NotNil(t, err)
+
+	// migrated databases are opened again without changes
+	stg, err = NewSQLAccountStorage(db, DialectSQLite, nil)
+	assert.Nil(t, err)
+
+	accountName, _, err := stg.GetAccount(uid)
+	assert.Nil(t, err)
+	assert.EqualValues(t, "user1", accountName)
+
+	var version int
+
+	assert.Nil(t, db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version))
+	assert.EqualValues(t, len(migrations), version)
+
+	_, err = NewSQLAccountStorage(db, "mysql", nil)
+	assert.NotNil(t, err)
+}
+
+func TestTokenExpiry(t *testing.T) {
+	stg := newSQLiteStorage(t)
+
+	assert.Nil(t, stg.AddToken("t1", 1, time.Now().Add(time.Millisecond*50)))
+	assert.Nil(t, stg.AddToken("t2", 1, time.Now().Add(-time.Second)))
+
+	exists, err := stg.TokenExists("t2", 0)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	exists, err = stg.TokenExists("t1", time.Hour)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	time.Sleep(time.Millisecond * 100)
+
+	// renewed
+	exists, err = stg.TokenExists("t1", 0)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	tokens, err := stg.ListTokens(1)
+	assert.Nil(t, err)
+	assert.Len(t, tokens, 1)
+	assert.True(t, time.Until(tokens["t1"].ExpiredAt) > time.Minute*59)
+}
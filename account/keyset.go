@@ -0,0 +1,408 @@
+package account
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sgostarter/i/commerr"
+	"github.com/sgostarter/libeasygo/cuserror"
+)
+
+// SigningKey is a jwt key identified by KeyID, PrivateKey can be nil for verification only keys.
+type SigningKey struct {
+	KeyID      string
+	Method     jwt.SigningMethod
+	PrivateKey crypto.PrivateKey
+	PublicKey  crypto.PublicKey
+}
+
+func (key *SigningKey) signKey() (interface{}, error) {
+	if key.PrivateKey == nil {
+		return nil, cuserror.NewWithErrorMsg("no private key: " + key.KeyID)
+	}
+
+	return key.PrivateKey, nil
+}
+
+func (key *SigningKey) verifyKey() interface{} {
+	if key.PublicKey != nil {
+		return key.PublicKey
+	}
+
+	switch k := key.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		return &k.PublicKey
+	case *ecdsa.PrivateKey:
+		return &k.PublicKey
+	case ed25519.PrivateKey:
+		return k.Public()
+	}
+
+	return key.PrivateKey
+}
+
+// NewSigningKeyFromPEM loads a PKCS#8, PKCS#1 or SEC 1 private key, or a PKIX public key for verification only.
+func NewSigningKeyFromPEM(keyID string, pemData []byte) (key *SigningKey, err error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		err = commerr.ErrBadFormat
+
+		return
+	}
+
+	var k interface{}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		k, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		k, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		k, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		k, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		err = commerr.ErrBadFormat
+	}
+
+	if err != nil {
+		return
+	}
+
+	key = &SigningKey{
+		KeyID: keyID,
+	}
+
+	switch kk := k.(type) {
+	case *rsa.PrivateKey:
+		key.Method, key.PrivateKey = jwt.SigningMethodRS256, kk
+	case *ecdsa.PrivateKey:
+		key.PrivateKey = kk
+		key.Method, err = ecdsaSigningMethod(kk.Curve)
+	case ed25519.PrivateKey:
+		key.Method, key.PrivateKey = jwt.SigningMethodEdDSA, kk
+	case *rsa.PublicKey:
+		key.Method, key.PublicKey = jwt.SigningMethodRS256, kk
+	case *ecdsa.PublicKey:
+		key.PublicKey = kk
+		key.Method, err = ecdsaSigningMethod(kk.Curve)
+	case ed25519.PublicKey:
+		key.Method, key.PublicKey = jwt.SigningMethodEdDSA, kk
+	default:
+		err = commerr.ErrUnimplemented
+	}
+
+	if err != nil {
+		key = nil
+	}
+
+	return
+}
+
+// KeySet signs with one key and verifies with every key it holds, so old keys keep working during rotation.
+type KeySet struct {
+	signingKey *SigningKey
+	keys       map[string]*SigningKey
+}
+
+func NewKeySet(signingKey *SigningKey, verificationKeys ...*SigningKey) (*KeySet, error) {
+	ks := &KeySet{
+		signingKey: signingKey,
+		keys:       make(map[string]*SigningKey),
+	}
+
+	keys := verificationKeys
+	if signingKey != nil {
+		keys = append([]*SigningKey{signingKey}, verificationKeys...)
+	}
+
+	for _, key := range keys {
+		if key == nil || key.Method == nil {
+			return nil, commerr.ErrInvalidArgument
+		}
+
+		if _, ok := ks.keys[key.KeyID]; ok {
+			return nil, cuserror.NewWithErrorMsg("duplicate key id: " + key.KeyID)
+		}
+
+		ks.keys[key.KeyID] = key
+	}
+
+	return ks, nil
+}
+
+func (ks *KeySet) Sign(claims jwt.Claims) (token string, err error) {
+	if ks.signingKey == nil {
+		err = cuserror.NewWithErrorMsg("no signing key")
+
+		return
+	}
+
+	key, err := ks.signingKey.signKey()
+	if err != nil {
+		return
+	}
+
+	t := jwt.NewWithClaims(ks.signingKey.Method, claims)
+	if ks.signingKey.KeyID != "" {
+		t.Header["kid"] = ks.signingKey.KeyID
+	}
+
+	token, err = t.SignedString(key)
+
+	return
+}
+
+// Parse verifies tokenS with the key selected by its kid header and fills claims.
+func (ks *KeySet) Parse(tokenS string, claims jwt.Claims, options ...jwt.ParserOption) (err error) {
+	token, err := jwt.ParseWithClaims(tokenS, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+
+		key, ok := ks.keys[kid]
+		if !ok {
+			return nil, cuserror.NewWithErrorMsg(fmt.Sprintf("Unknown key id: %v", kid))
+		}
+
+		// Don't forget to validate the alg is what you expect:
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, cuserror.NewWithErrorMsg(fmt.Sprintf("Unexpected signing method: %v", token.Header["alg"]))
+		}
+
+		return key.verifyKey(), nil
+	}, options...)
+	if err != nil {
+		return
+	}
+
+	if !token.Valid {
+		err = commerr.ErrUnauthenticated
+	}
+
+	return
+}
+
+func (ks *KeySet) hasKey(kid string) bool {
+	_, ok := ks.keys[kid]
+
+	return ok
+}
+
+//
+// jwks
+//
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS exports the public keys of the set, symmetric keys are never exported.
+func (ks *KeySet) JWKS() ([]byte, error) {
+	jwks := JWKS{
+		Keys: make([]JWK, 0, len(ks.keys)),
+	}
+
+	keyIDs := make([]string, 0, len(ks.keys))
+	for keyID := range ks.keys {
+		keyIDs = append(keyIDs, keyID)
+	}
+
+	sort.Strings(keyIDs)
+
+	for _, keyID := range keyIDs {
+		key := ks.keys[keyID]
+
+		jwk := JWK{
+			Kid: key.KeyID,
+			Use: "sig",
+			Alg: key.Method.Alg(),
+		}
+
+		switch k := key.verifyKey().(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = b64(k.N.Bytes())
+			jwk.E = b64(big.NewInt(int64(k.E)).Bytes())
+		case *ecdsa.PublicKey:
+			size := (k.Curve.Params().BitSize + 7) / 8
+
+			jwk.Kty = "EC"
+			jwk.Crv = k.Curve.Params().Name
+			jwk.X = b64(k.X.FillBytes(make([]byte, size)))
+			jwk.Y = b64(k.Y.FillBytes(make([]byte, size)))
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = b64(k)
+		default:
+			continue
+		}
+
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+
+	return json.Marshal(jwks)
+}
+
+// ParseJWKS builds a verification only KeySet from a JWKS document. Keys which aren't for signatures or can't be
+// used (e.g. unknown kty or crv) are skipped, it fails only when no key is left.
+func ParseJWKS(d []byte) (ks *KeySet, err error) {
+	var jwks JWKS
+
+	err = json.Unmarshal(d, &jwks)
+	if err != nil {
+		return
+	}
+
+	keys := make([]*SigningKey, 0, len(jwks.Keys))
+
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, e := jwk.signingKey()
+		if e != nil {
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	if len(jwks.Keys) > 0 && len(keys) == 0 {
+		err = commerr.ErrUnimplemented
+
+		return
+	}
+
+	return NewKeySet(nil, keys...)
+}
+
+func (jwk *JWK) signingKey() (key *SigningKey, err error) {
+	key = &SigningKey{
+		KeyID: jwk.Kid,
+	}
+
+	switch jwk.Kty {
+	case "RSA":
+		var n, e []byte
+
+		if n, err = b64Decode(jwk.N); err != nil {
+			return
+		}
+
+		if e, err = b64Decode(jwk.E); err != nil {
+			return
+		}
+
+		key.Method = jwt.SigningMethodRS256
+
+		switch jwk.Alg {
+		case "RS384", "RS512", "PS256", "PS384", "PS512":
+			key.Method = jwt.GetSigningMethod(jwk.Alg)
+		}
+
+		key.PublicKey = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	case "EC":
+		var x, y []byte
+
+		if x, err = b64Decode(jwk.X); err != nil {
+			return
+		}
+
+		if y, err = b64Decode(jwk.Y); err != nil {
+			return
+		}
+
+		var curve elliptic.Curve
+
+		switch jwk.Crv {
+		case "P-256":
+			curve, key.Method = elliptic.P256(), jwt.SigningMethodES256
+		case "P-384":
+			curve, key.Method = elliptic.P384(), jwt.SigningMethodES384
+		case "P-521":
+			curve, key.Method = elliptic.P521(), jwt.SigningMethodES512
+		default:
+			err = commerr.ErrUnimplemented
+
+			return
+		}
+
+		key.PublicKey = &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			err = commerr.ErrUnimplemented
+
+			return
+		}
+
+		var x []byte
+
+		if x, err = b64Decode(jwk.X); err != nil {
+			return
+		}
+
+		key.Method = jwt.SigningMethodEdDSA
+		key.PublicKey = ed25519.PublicKey(x)
+	default:
+		err = commerr.ErrUnimplemented
+
+		return
+	}
+
+	return
+}
+
+// ecdsaSigningMethod picks the method of the curve as the crv of a JWK does.
+func ecdsaSigningMethod(curve elliptic.Curve) (method jwt.SigningMethod, err error) {
+	switch curve.Params().Name {
+	case "P-256":
+		method = jwt.SigningMethodES256
+	case "P-384":
+		method = jwt.SigningMethodES384
+	case "P-521":
+		method = jwt.SigningMethodES512
+	default:
+		err = commerr.ErrUnimplemented
+	}
+
+	return
+}
+
+func b64(d []byte) string {
+	return base64.RawURLEncoding.EncodeToString(d)
+}
+
+func b64Decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
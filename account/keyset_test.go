@@ -0,0 +1,230 @@
+// nolint
+package account
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sgostarter/i/commerr"
+	"github.com/sgostarter/i/l"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSigningKeys(t *testing.T) []*SigningKey {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	return []*SigningKey{
+		{KeyID: "rsa", Method: jwt.SigningMethodRS256, PrivateKey: rsaKey},
+		{KeyID: "ec", Method: jwt.SigningMethodES256, PrivateKey: ecKey},
+		{KeyID: "ed", Method: jwt.SigningMethodEdDSA, PrivateKey: edKey},
+	}
+}
+
+func TestKeySetRotation(t *testing.T) {
+	keys := newTestSigningKeys(t)
+
+	for idx, key := range keys {
+		ks, err := NewKeySet(key)
+		assert.Nil(t, err)
+
+		token, err := ks.Sign(&Claims{UID: 1})
+		assert.Nil(t, err)
+
+		// rotate to the next key, the old one stays for verification
+		next := keys[(idx+1)%len(keys)]
+
+		ksRotated, err := NewKeySet(next, key)
+		assert.Nil(t, err)
+
+		var claims Claims
+
+		err = ksRotated.Parse(token, &claims)
+		assert.Nil(t, err)
+		assert.EqualValues(t, 1, claims.UID)
+
+		ksNext, err := NewKeySet(next)
+		assert.Nil(t, err)
+
+		err = ksNext.Parse(token, &Claims{})
+		assert.NotNil(t, err)
+
+		// verify with public keys only
+		jwks, err := ksRotated.JWKS()
+		assert.Nil(t, err)
+
+		ksPublic, err := ParseJWKS(jwks)
+		assert.Nil(t, err)
+
+		err = ksPublic.Parse(token, &Claims{})
+		assert.Nil(t, err)
+
+		_, err = ksPublic.Sign(&Claims{})
+		assert.NotNil(t, err)
+	}
+
+	_, err := NewKeySet(keys[0], keys[0])
+	assert.NotNil(t, err)
+}
+
+func TestKeySetRejectsHMACWithPublicKey(t *testing.T) {
+	keys := newTestSigningKeys(t)
+
+	ks, err := NewKeySet(keys[0])
+	assert.Nil(t, err)
+
+	pub := x509.MarshalPKCS1PublicKey(&keys[0].PrivateKey.(*rsa.PrivateKey).PublicKey)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{UID: 1})
+	token.Header["kid"] = "rsa"
+
+	tokenS, err := token.SignedString(pub)
+	assert.Nil(t, err)
+
+	err = ks.Parse(tokenS, &Claims{})
+	assert.NotNil(t, err)
+}
+
+func TestSigningKeyFromPEM(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	d, err := x509.MarshalPKCS8PrivateKey(edKey)
+	assert.Nil(t, err)
+
+	key, err := NewSigningKeyFromPEM("k1", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: d}))
+	assert.Nil(t, err)
+	assert.EqualValues(t, "EdDSA", key.Method.Alg())
+	assert.EqualValues(t, "k1", key.KeyID)
+
+	// the method of ecdsa keys follows the curve
+	for curve, alg := range map[elliptic.Curve]string{elliptic.P256(): "ES256", elliptic.P384(): "ES384",
+		elliptic.P521(): "ES512"} {
+		ecKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+		assert.Nil(t, err)
+
+		d, err := x509.MarshalECPrivateKey(ecKey)
+		assert.Nil(t, err)
+
+		key, err := NewSigningKeyFromPEM("k1", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: d}))
+		assert.Nil(t, err)
+		assert.EqualValues(t, alg, key.Method.Alg())
+
+		ks, err := NewKeySet(key)
+		assert.Nil(t, err)
+
+		token, err := ks.Sign(&Claims{UID: 1})
+		assert.Nil(t, err)
+		assert.Nil(t, ks.Parse(token, &Claims{}))
+
+		d, err = x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+		assert.Nil(t, err)
+
+		key, err = NewSigningKeyFromPEM("k1", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: d}))
+		assert.Nil(t, err)
+		assert.EqualValues(t, alg, key.Method.Alg())
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	assert.Nil(t, err)
+
+	d, err = x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	assert.Nil(t, err)
+
+	_, err = NewSigningKeyFromPEM("k1", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: d}))
+	assert.ErrorIs(t, err, commerr.ErrUnimplemented)
+}
+
+func TestParseJWKSSkipsUnsupportedKeys(t *testing.T) {
+	keys := newTestSigningKeys(t)
+
+	ks, err := NewKeySet(keys[1])
+	assert.Nil(t, err)
+
+	token, err := ks.Sign(&Claims{UID: 1})
+	assert.Nil(t, err)
+
+	d, err := ks.JWKS()
+	assert.Nil(t, err)
+
+	var jwks JWKS
+
+	assert.Nil(t, json.Unmarshal(d, &jwks))
+
+	jwks.Keys = append(jwks.Keys,
+		JWK{Kty: "EC", Kid: "p192", Crv: "P-192", X: "AA", Y: "AA"},
+		JWK{Kty: "oct", Kid: "hmac"},
+		JWK{Kty: "OKP", Kid: "x25519", Crv: "X25519", X: "AA"},
+		JWK{Kty: "RSA", Kid: "enc", Use: "enc", N: "AQAB", E: "AQAB"})
+
+	d, err = json.Marshal(&jwks)
+	assert.Nil(t, err)
+
+	ksPublic, err := ParseJWKS(d)
+	assert.Nil(t, err)
+	assert.Nil(t, ksPublic.Parse(token, &Claims{}))
+
+	jwks.Keys = jwks.Keys[1:]
+
+	d, err = json.Marshal(&jwks)
+	assert.Nil(t, err)
+
+	_, err = ParseJWKS(d)
+	assert.ErrorIs(t, err, commerr.ErrUnimplemented)
+}
+
+func TestAccountTokenWithKeySet(t *testing.T) {
+	keys := newTestSigningKeys(t)
+
+	ks, err := NewKeySet(keys[0])
+	assert.Nil(t, err)
+
+	account := &accountImpl{
+		logger: l.NewConsoleLoggerWrapper(),
+		cfg: &Config{
+			Issuer:                 "iss1",
+			Audience:               []string{"aud1"},
+			TokenClaimExpiresAfter: time.Minute,
+		},
+		keySet: ks,
+	}
+
+	token, err := account.tokenNew(10, "user10")
+	assert.Nil(t, err)
+
+	uid, userName, err := account.tokenCheck(token)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 10, uid)
+	assert.EqualValues(t, "user10", userName)
+
+	var claims Claims
+
+	err = ks.Parse(token, &claims, jwt.WithIssuer("iss1"), jwt.WithAudience("aud1"), jwt.WithExpirationRequired())
+	assert.Nil(t, err)
+
+	account.cfg.Audience = []string{"aud2"}
+
+	_, _, err = account.tokenCheck(token)
+	assert.NotNil(t, err)
+
+	// a token is accepted when any of the configured audiences matches
+	account.cfg.Audience = []string{"aud2", "aud1"}
+
+	_, _, err = account.tokenCheck(token)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,206 @@
+package account
+
+import (
+	"fmt"
+
+	"github.com/sgostarter/i/commerr"
+	"github.com/sgostarter/i/l"
+)
+
+type AccountState string
+
+const (
+	AccountStateActive              AccountState = "active"
+	AccountStateDisabled            AccountState = "disabled"
+	AccountStatePendingVerification AccountState = "pendingVerification"
+	AccountStateDeleted             AccountState = "deleted"
+)
+
+type AccountInactiveError struct {
+	State AccountState
+}
+
+func (e *AccountInactiveError) Error() string {
+	return fmt.Sprintf("account is %s", e.State)
+}
+
+func (e *AccountInactiveError) Is(target error) bool {
+	return target == ErrAccountInactive
+}
+
+func (impl *accountImpl) GetAccountState(uid uint64) (state AccountState, err error) {
+	state, err = impl.storage.GetAccountState(uid)
+	if err != nil {
+		return
+	}
+
+	// accounts created before states were added have no state
+	if state == "" {
+		state = AccountStateActive
+	}
+
+	return
+}
+
+// Disable revokes all sessions, the account can't login until Enable.
+func (impl *accountImpl) Disable(uid uint64) error {
+	return impl.changeAccountState(uid, AccountStateDisabled, func(state AccountState) error {
+		if state == AccountStateDeleted {
+			return commerr.ErrNotFound
+		}
+
+		return nil
+	})
+}
+
+func (impl *accountImpl) Enable(uid uint64) error {
+	return impl.changeAccountState(uid, AccountStateActive, func(state AccountState) error {
+		if state == AccountStateDeleted {
+			return commerr.ErrNotFound
+		}
+
+		return nil
+	})
+}
+
+// SoftDelete revokes all sessions and hides the account from ListUsers, the account name stays reserved until Purge.
+func (impl *accountImpl) SoftDelete(uid uint64) error {
+	return impl.changeAccountState(uid, AccountStateDeleted, nil)
+}
+
+func (impl *accountImpl) Restore(uid uint64) error {
+	return impl.changeAccountState(uid, AccountStateActive, func(state AccountState) error {
+		if state != AccountStateDeleted {
+			return commerr.ErrInvalidArgument
+		}
+
+		return nil
+	})
+}
+
+// Purge removes the account with everything belongs to it, the account name can be registered again.
+func (impl *accountImpl) Purge(uid uint64) (err error) {
+	defer func() {
+		impl.audit(&AuditEvent{UID: uid, Action: AuditActionPurge}, err)
+	}()
+
+	tokens, err := impl.storage.ListTokens(uid)
+	if err != nil {
+		return
+	}
+
+	for token := range tokens {
+		impl.delToken(token)
+	}
+
+	err = impl.storage.RevokeUserRefreshTokens(uid, "")
+	if err != nil {
+		return
+	}
+
+	apiKeys, err := impl.storage.ListAPIKeys(uid)
+	if err != nil {
+		return
+	}
+
+	for _, apiKey := range apiKeys {
+		err = impl.storage.DelAPIKey(uid, apiKey.KeyID)
+		if err != nil {
+			return
+		}
+	}
+
+	roleNames, err := impl.storage.GetUserRoles(uid)
+	if err != nil {
+		return
+	}
+
+	for _, roleName := range roleNames {
+		err = impl.storage.UnassignRole(uid, roleName)
+		if err != nil {
+			return
+		}
+	}
+
+	impl.roleCache.Delete(userRolesCacheKey(uid))
+
+	for _, purpose := range []string{OneTimeTokenPurposePasswordReset, OneTimeTokenPurposeContactVerification} {
+		err = impl.storage.DelOneTimeTokens(uid, purpose)
+		if err != nil {
+			return
+		}
+	}
+
+	if e := impl.storage.ResetLoginFailure(uidThrottleKey(uid)); e != nil {
+		impl.logger.WithFields(l.ErrorField(e), l.UInt64Field("uid", uid)).Error("reset login failure failed")
+	}
+
+	accountName, _, _ := impl.storage.GetAccount(uid)
+
+	err = impl.storage.DelAccount(uid)
+	if err != nil {
+		return
+	}
+
+	_ = impl.fireHook(&HookEvent{Type: HookEventPurged, UID: uid, AccountName: accountName})
+
+	return
+}
+
+//
+//
+//
+
+func (impl *accountImpl) changeAccountState(uid uint64, newState AccountState, check func(state AccountState) error) (err error) {
+	state, err := impl.GetAccountState(uid)
+	if err != nil {
+		return
+	}
+
+	if check != nil {
+		err = check(state)
+		if err != nil {
+			return
+		}
+	}
+
+	if state == newState {
+		return
+	}
+
+	err = impl.storage.SetAccountState(uid, newState)
+
+	impl.audit(&AuditEvent{
+		UID:    uid,
+		Action: AuditActionChangeState,
+		Metadata: map[string]string{
+			"oldState": string(state),
+			"newState": string(newState),
+		},
+	}, err)
+
+	if err != nil {
+		return
+	}
+
+	if newState != AccountStateActive {
+		err = impl.RevokeAllSessions(uid, "")
+	}
+
+	return
+}
+
+func (impl *accountImpl) checkAccountActive(uid uint64) (err error) {
+	state, err := impl.GetAccountState(uid)
+	if err != nil {
+		return
+	}
+
+	if state != AccountStateActive {
+		err = &AccountInactiveError{
+			State: state,
+		}
+	}
+
+	return
+}
@@ -0,0 +1,213 @@
+package account
+
+import (
+	"time"
+
+	"github.com/sgostarter/i/commerr"
+	"github.com/sgostarter/i/l"
+)
+
+const (
+	OneTimeTokenPurposePasswordReset       = "passwordReset"
+	OneTimeTokenPurposeContactVerification = "contactVerification"
+)
+
+// OneTimeTokenInfo is stored by the hash of the token.
+type OneTimeTokenInfo struct {
+	UID       uint64    `json:"uid" yaml:"uid"`
+	Purpose   string    `json:"purpose" yaml:"purpose"`
+	Contact   string    `json:"contact,omitempty" yaml:"contact,omitempty"`
+	ExpiredAt time.Time `json:"expiredAt" yaml:"expiredAt"`
+}
+
+type Notification struct {
+	UID         uint64
+	AccountName string
+	Purpose     string
+	// Contact is empty for password reset, the notifier looks it up by itself or by GetContact
+	Contact   string
+	Token     string
+	ExpiredAt time.Time
+}
+
+// Notifier delivers one-time tokens to users, e.g. by email or sms.
+type Notifier interface {
+	Notify(notification *Notification) error
+}
+
+// RequestPasswordReset issues a password reset token and sends it by Config.Notifier when set.
+func (impl *accountImpl) RequestPasswordReset(accountName string) (token string, err error) {
+	uid, exists, err := impl.storage.GetIDFromAccountName(accountName)
+	if err != nil {
+		return
+	}
+
+	if !exists {
+		err = commerr.ErrNotFound
+
+		return
+	}
+
+	contact, _, err := impl.storage.GetContact(uid)
+	if err != nil {
+		return
+	}
+
+	return impl.issueOneTimeToken(uid, accountName, OneTimeTokenPurposePasswordReset, contact)
+}
+
+// CompletePasswordReset also invalidates other reset tokens and unlocks the account. The token is kept when
+// newPassword breaks the rules of PasswordPolicy which don't depend on the account, it's used up otherwise.
+func (impl *accountImpl) CompletePasswordReset(token, newPassword string) (err error) {
+	err = impl.checkPasswordPolicy("", newPassword, nil)
+	if err != nil {
+		return
+	}
+
+	info, err := impl.consumeOneTimeToken(token, OneTimeTokenPurposePasswordReset)
+	if err != nil {
+		return
+	}
+
+	err = impl.changePassword(info.UID, newPassword)
+
+	impl.audit(&AuditEvent{
+		UID:      info.UID,
+		Action:   AuditActionResetPassword,
+		Metadata: map[string]string{"method": "oneTimeToken"},
+	}, err)
+
+	if err != nil {
+		return
+	}
+
+	impl.delOneTimeTokens(info.UID, OneTimeTokenPurposePasswordReset)
+
+	return impl.Unlock(info.UID)
+}
+
+// RequestContactVerification sets an unverified contact and issues the token to verify it.
+func (impl *accountImpl) RequestContactVerification(uid uint64, contact string) (token string, err error) {
+	if contact == "" {
+		err = commerr.ErrInvalidArgument
+
+		return
+	}
+
+	accountName, _, err := impl.storage.GetAccount(uid)
+	if err != nil {
+		return
+	}
+
+	err = impl.storage.SetContact(uid, contact, false)
+	if err != nil {
+		return
+	}
+
+	return impl.issueOneTimeToken(uid, accountName, OneTimeTokenPurposeContactVerification, contact)
+}
+
+// CompleteContactVerification also activates accounts which are pending verification.
+func (impl *accountImpl) CompleteContactVerification(token string) (uid uint64, err error) {
+	info, err := impl.consumeOneTimeToken(token, OneTimeTokenPurposeContactVerification)
+	if err != nil {
+		return
+	}
+
+	contact, _, err := impl.storage.GetContact(info.UID)
+	if err != nil {
+		return
+	}
+
+	// the contact was changed after the token was issued
+	if contact != info.Contact {
+		err = commerr.ErrNotFound
+
+		return
+	}
+
+	err = impl.storage.SetContact(info.UID, contact, true)
+	if err != nil {
+		return
+	}
+
+	impl.delOneTimeTokens(info.UID, OneTimeTokenPurposeContactVerification)
+
+	state, err := impl.GetAccountState(info.UID)
+	if err != nil {
+		return
+	}
+
+	if state == AccountStatePendingVerification {
+		err = impl.storage.SetAccountState(info.UID, AccountStateActive)
+		if err != nil {
+			return
+		}
+	}
+
+	uid = info.UID
+
+	return
+}
+
+func (impl *accountImpl) GetContact(uid uint64) (contact string, verified bool, err error) {
+	return impl.storage.GetContact(uid)
+}
+
+//
+//
+//
+
+func (impl *accountImpl) issueOneTimeToken(uid uint64, accountName, purpose, contact string) (token string, err error) {
+	token, err = newRandomToken()
+	if err != nil {
+		return
+	}
+
+	info := &OneTimeTokenInfo{
+		UID:       uid,
+		Purpose:   purpose,
+		Contact:   contact,
+		ExpiredAt: time.Now().Add(impl.cfg.OneTimeTokenExpiresAfter),
+	}
+
+	err = impl.storage.AddOneTimeToken(hashSecretToken(token), info)
+	if err != nil {
+		return
+	}
+
+	if impl.cfg.Notifier == nil {
+		return
+	}
+
+	err = impl.cfg.Notifier.Notify(&Notification{
+		UID:         uid,
+		AccountName: accountName,
+		Purpose:     purpose,
+		Contact:     contact,
+		Token:       token,
+		ExpiredAt:   info.ExpiredAt,
+	})
+
+	return
+}
+
+func (impl *accountImpl) consumeOneTimeToken(token, purpose string) (info *OneTimeTokenInfo, err error) {
+	info, err = impl.storage.ConsumeOneTimeToken(hashSecretToken(token))
+	if err != nil {
+		return
+	}
+
+	if info.Purpose != purpose || time.Now().After(info.ExpiredAt) {
+		info = nil
+		err = commerr.ErrNotFound
+	}
+
+	return
+}
+
+func (impl *accountImpl) delOneTimeTokens(uid uint64, purpose string) {
+	if err := impl.storage.DelOneTimeTokens(uid, purpose); err != nil {
+		impl.logger.WithFields(l.ErrorField(err), l.UInt64Field("uid", uid)).Error("delete one-time tokens failed")
+	}
+}
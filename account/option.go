@@ -0,0 +1,90 @@
+package account
+
+import "time"
+
+type LoginOptions struct {
+	source string
+
+	deviceName string
+	clientIP   string
+	userAgent  string
+
+	metadata map[string]string
+
+	nonce string
+}
+
+type LoginOption func(o *LoginOptions)
+
+func loginOptionNew(option ...LoginOption) *LoginOptions {
+	opts := &LoginOptions{}
+	for _, o := range option {
+		o(opts)
+	}
+
+	return opts
+}
+
+// SourceLoginOption sets the caller source (e.g. client ip) used by per-source login throttling
+func SourceLoginOption(source string) LoginOption {
+	return func(o *LoginOptions) {
+		o.source = source
+	}
+}
+
+// SessionLoginOption sets the metadata of the session created by login, clientIP is also the default throttling source
+func SessionLoginOption(deviceName, clientIP, userAgent string) LoginOption {
+	return func(o *LoginOptions) {
+		o.deviceName = deviceName
+		o.clientIP = clientIP
+		o.userAgent = userAgent
+	}
+}
+
+// AuditLoginOption adds metadata to the audit event of the login
+func AuditLoginOption(metadata map[string]string) LoginOption {
+	return func(o *LoginOptions) {
+		o.metadata = mergeAuditMetadata(o.metadata, metadata)
+	}
+}
+
+// NonceLoginOption sets the nonce which the nonce claim of the ID token must match on LoginWithIdentity
+func NonceLoginOption(nonce string) LoginOption {
+	return func(o *LoginOptions) {
+		o.nonce = nonce
+	}
+}
+
+func (o *LoginOptions) throttleSource() string {
+	if o.source != "" {
+		return o.source
+	}
+
+	return o.clientIP
+}
+
+func (o *LoginOptions) newSession() *Session {
+	return &Session{
+		DeviceName: o.deviceName,
+		ClientIP:   o.clientIP,
+		UserAgent:  o.userAgent,
+		CreatedAt:  time.Now(),
+	}
+}
+
+func (o *LoginOptions) auditMetadata() map[string]string {
+	session := map[string]string{}
+
+	for k, v := range map[string]string{
+		"source":     o.source,
+		"deviceName": o.deviceName,
+		"clientIP":   o.clientIP,
+		"userAgent":  o.userAgent,
+	} {
+		if v != "" {
+			session[k] = v
+		}
+	}
+
+	return mergeAuditMetadata(session, o.metadata)
+}
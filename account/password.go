@@ -0,0 +1,332 @@
+package account
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/sgostarter/i/commerr"
+	"github.com/sgostarter/libeasygo/crypt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// PasswordHasher hashes passwords into self-describing strings which record the algorithm and parameters.
+type PasswordHasher interface {
+	Hash(password string) (hashedPassword string, err error)
+	Verify(password, hashedPassword string) (ok bool, err error)
+	// NeedsRehash reports whether hashedPassword was made by another algorithm or weaker settings.
+	NeedsRehash(hashedPassword string) bool
+}
+
+const (
+	pbkdf2Prefix   = "$pbkdf2-sha256$"
+	argon2idPrefix = "$argon2id$"
+
+	passwordSaltLen = 16
+	passwordKeyLen  = 32
+)
+
+//
+// pbkdf2
+//
+
+func NewPBKDF2PasswordHasher(iterCount int) PasswordHasher {
+	if iterCount <= 0 {
+		iterCount = 4096
+	}
+
+	return &pbkdf2PasswordHasher{
+		iterCount: iterCount,
+	}
+}
+
+type pbkdf2PasswordHasher struct {
+	iterCount int
+}
+
+func (hasher *pbkdf2PasswordHasher) Hash(password string) (hashedPassword string, err error) {
+	salt, err := passwordRandSalt()
+	if err != nil {
+		return
+	}
+
+	key := pbkdf2.Key([]byte(password), salt, hasher.iterCount, passwordKeyLen, sha256.New)
+
+	hashedPassword = fmt.Sprintf("%si=%d$%s$%s", pbkdf2Prefix, hasher.iterCount,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+
+	return
+}
+
+func (hasher *pbkdf2PasswordHasher) Verify(password, hashedPassword string) (ok bool, err error) {
+	return verifyHashedPassword(password, hashedPassword, 0)
+}
+
+func (hasher *pbkdf2PasswordHasher) NeedsRehash(hashedPassword string) bool {
+	if !strings.HasPrefix(hashedPassword, pbkdf2Prefix) {
+		return true
+	}
+
+	iterCount, _, _, err := parsePBKDF2Hash(hashedPassword)
+	if err != nil {
+		return true
+	}
+
+	return iterCount < hasher.iterCount
+}
+
+//
+// argon2id
+//
+
+func NewArgon2IDPasswordHasher(time, memory uint32, threads uint8) PasswordHasher {
+	if time == 0 {
+		time = 3
+	}
+
+	if memory == 0 {
+		memory = 64 * 1024
+	}
+
+	if threads == 0 {
+		threads = 2
+	}
+
+	return &argon2IDPasswordHasher{
+		time:    time,
+		memory:  memory,
+		threads: threads,
+	}
+}
+
+type argon2IDPasswordHasher struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+}
+
+func (hasher *argon2IDPasswordHasher) Hash(password string) (hashedPassword string, err error) {
+	salt, err := passwordRandSalt()
+	if err != nil {
+		return
+	}
+
+	key := argon2.IDKey([]byte(password), salt, hasher.time, hasher.memory, hasher.threads, passwordKeyLen)
+
+	hashedPassword = fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version,
+		hasher.memory, hasher.time, hasher.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+
+	return
+}
+
+func (hasher *argon2IDPasswordHasher) Verify(password, hashedPassword string) (ok bool, err error) {
+	return verifyHashedPassword(password, hashedPassword, 0)
+}
+
+func (hasher *argon2IDPasswordHasher) NeedsRehash(hashedPassword string) bool {
+	if !strings.HasPrefix(hashedPassword, argon2idPrefix) {
+		return true
+	}
+
+	version, memory, time, threads, _, _, err := parseArgon2IDHash(hashedPassword)
+	if err != nil {
+		return true
+	}
+
+	return version != argon2.Version || memory < hasher.memory || time < hasher.time || threads < hasher.threads
+}
+
+//
+// bcrypt
+//
+
+func NewBcryptPasswordHasher(cost int) PasswordHasher {
+	if cost < bcrypt.MinCost {
+		cost = bcrypt.DefaultCost
+	}
+
+	return &bcryptPasswordHasher{
+		cost: cost,
+	}
+}
+
+type bcryptPasswordHasher struct {
+	cost int
+}
+
+func (hasher *bcryptPasswordHasher) Hash(password string) (hashedPassword string, err error) {
+	d, err := bcrypt.GenerateFromPassword([]byte(password), hasher.cost)
+	if err != nil {
+		return
+	}
+
+	hashedPassword = string(d)
+
+	return
+}
+
+func (hasher *bcryptPasswordHasher) Verify(password, hashedPassword string) (ok bool, err error) {
+	return verifyHashedPassword(password, hashedPassword, 0)
+}
+
+func (hasher *bcryptPasswordHasher) NeedsRehash(hashedPassword string) bool {
+	if !isBcryptHash(hashedPassword) {
+		return true
+	}
+
+	cost, err := bcrypt.Cost([]byte(hashedPassword))
+	if err != nil {
+		return true
+	}
+
+	return cost < hasher.cost
+}
+
+//
+// legacy: the raw format of crypt.HashPassword, used when Config.PasswordHasher is not set
+//
+
+type legacyPasswordHasher struct {
+	iterCount int
+}
+
+func (hasher *legacyPasswordHasher) Hash(password string) (hashedPassword string, err error) {
+	return crypt.HashPassword(password, hasher.iterCount)
+}
+
+func (hasher *legacyPasswordHasher) Verify(password, hashedPassword string) (ok bool, err error) {
+	return verifyHashedPassword(password, hashedPassword, hasher.iterCount)
+}
+
+func (hasher *legacyPasswordHasher) NeedsRehash(_ string) bool {
+	return false
+}
+
+//
+//
+//
+
+// verifyHashedPassword checks password against a hash made by any supported algorithm,
+// legacyIterCount is used for hashes made by crypt.HashPassword.
+func verifyHashedPassword(password, hashedPassword string, legacyIterCount int) (ok bool, err error) {
+	switch {
+	case strings.HasPrefix(hashedPassword, pbkdf2Prefix):
+		iterCount, salt, key, e := parsePBKDF2Hash(hashedPassword)
+		if e != nil {
+			err = e
+
+			return
+		}
+
+		ok = subtle.ConstantTimeCompare(pbkdf2.Key([]byte(password), salt, iterCount, len(key), sha256.New), key) == 1
+	case strings.HasPrefix(hashedPassword, argon2idPrefix):
+		_, memory, time, threads, salt, key, e := parseArgon2IDHash(hashedPassword)
+		if e != nil {
+			err = e
+
+			return
+		}
+
+		ok = subtle.ConstantTimeCompare(argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key))), key) == 1
+	case isBcryptHash(hashedPassword):
+		ok = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password)) == nil
+	case !isLegacyHashedPassword(hashedPassword):
+		err = commerr.ErrUnimplemented
+	default:
+		if legacyIterCount <= 0 {
+			legacyIterCount = 4096
+		}
+
+		ok = crypt.CheckHashedPassword(password, hashedPassword, legacyIterCount)
+	}
+
+	return
+}
+
+func parsePBKDF2Hash(hashedPassword string) (iterCount int, salt, key []byte, err error) {
+	ps := strings.Split(strings.TrimPrefix(hashedPassword, pbkdf2Prefix), "$")
+	if len(ps) != 3 {
+		err = commerr.ErrBadFormat
+
+		return
+	}
+
+	_, err = fmt.Sscanf(ps[0], "i=%d", &iterCount)
+	if err != nil {
+		return
+	}
+
+	salt, err = base64.RawStdEncoding.DecodeString(ps[1])
+	if err != nil {
+		return
+	}
+
+	key, err = base64.RawStdEncoding.DecodeString(ps[2])
+	if err != nil {
+		return
+	}
+
+	if iterCount <= 0 || len(key) == 0 {
+		err = commerr.ErrBadFormat
+	}
+
+	return
+}
+
+func parseArgon2IDHash(hashedPassword string) (version int, memory, time uint32, threads uint8, salt, key []byte, err error) {
+	ps := strings.Split(strings.TrimPrefix(hashedPassword, argon2idPrefix), "$")
+	if len(ps) != 4 {
+		err = commerr.ErrBadFormat
+
+		return
+	}
+
+	_, err = fmt.Sscanf(ps[0], "v=%d", &version)
+	if err != nil {
+		return
+	}
+
+	_, err = fmt.Sscanf(ps[1], "m=%d,t=%d,p=%d", &memory, &time, &threads)
+	if err != nil {
+		return
+	}
+
+	salt, err = base64.RawStdEncoding.DecodeString(ps[2])
+	if err != nil {
+		return
+	}
+
+	key, err = base64.RawStdEncoding.DecodeString(ps[3])
+	if err != nil {
+		return
+	}
+
+	if time == 0 || threads == 0 || len(key) == 0 {
+		err = commerr.ErrBadFormat
+	}
+
+	return
+}
+
+func isLegacyHashedPassword(hashedPassword string) bool {
+	return !strings.HasPrefix(hashedPassword, "$")
+}
+
+func isBcryptHash(hashedPassword string) bool {
+	return strings.HasPrefix(hashedPassword, "$2a$") || strings.HasPrefix(hashedPassword, "$2b$") ||
+		strings.HasPrefix(hashedPassword, "$2y$")
+}
+
+func passwordRandSalt() (salt []byte, err error) {
+	salt = make([]byte, passwordSaltLen)
+
+	_, err = rand.Read(salt)
+
+	return
+}
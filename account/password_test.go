@@ -0,0 +1,59 @@
+// nolint
+package account
+
+import (
+	"testing"
+
+	"github.com/sgostarter/libeasygo/crypt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordHashers(t *testing.T) {
+	hashers := []PasswordHasher{
+		NewPBKDF2PasswordHasher(1024),
+		NewArgon2IDPasswordHasher(1, 1024, 1),
+		NewBcryptPasswordHasher(4),
+		&legacyPasswordHasher{iterCount: 4096},
+	}
+
+	for _, hasher := range hashers {
+		hashedPassword, err := hasher.Hash("pass1")
+		assert.Nil(t, err)
+		assert.False(t, hasher.NeedsRehash(hashedPassword))
+
+		for _, verifier := range hashers {
+			ok, err := verifier.Verify("pass1", hashedPassword)
+			assert.Nil(t, err)
+			assert.True(t, ok)
+
+			ok, err = verifier.Verify("pass2", hashedPassword)
+			assert.Nil(t, err)
+			assert.False(t, ok)
+		}
+	}
+}
+
+func TestPasswordNeedsRehash(t *testing.T) {
+	legacyHashedPassword, err := crypt.HashPassword("pass1", 4096)
+	assert.Nil(t, err)
+
+	assert.True(t, NewPBKDF2PasswordHasher(4096).NeedsRehash(legacyHashedPassword))
+
+	weakHashedPassword, err := NewPBKDF2PasswordHasher(1024).Hash("pass1")
+	assert.Nil(t, err)
+	assert.True(t, NewPBKDF2PasswordHasher(4096).NeedsRehash(weakHashedPassword))
+	assert.False(t, NewPBKDF2PasswordHasher(512).NeedsRehash(weakHashedPassword))
+	assert.True(t, NewArgon2IDPasswordHasher(1, 1024, 1).NeedsRehash(weakHashedPassword))
+
+	weakHashedPassword, err = NewArgon2IDPasswordHasher(1, 1024, 1).Hash("pass1")
+	assert.Nil(t, err)
+	assert.True(t, NewArgon2IDPasswordHasher(2, 1024, 1).NeedsRehash(weakHashedPassword))
+	assert.True(t, NewBcryptPasswordHasher(4).NeedsRehash(weakHashedPassword))
+
+	weakHashedPassword, err = NewBcryptPasswordHasher(4).Hash("pass1")
+	assert.Nil(t, err)
+	assert.True(t, NewBcryptPasswordHasher(5).NeedsRehash(weakHashedPassword))
+
+	_, err = NewPBKDF2PasswordHasher(1024).Verify("pass1", "$pbkdf2-sha256$i=1024$$")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,340 @@
+package account
+
+import (
+	"bytes"
+	"crypto/sha1" // nolint: gosec
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/sgostarter/i/commerr"
+)
+
+const (
+	minAccountNameLengthInPassword = 3
+	maxBreachedLineLength          = 128
+	breachedHashPrefixLength       = 5
+)
+
+type PasswordRule string
+
+const (
+	PasswordRuleMinLength   PasswordRule = "minLength"
+	PasswordRuleLower       PasswordRule = "lower"
+	PasswordRuleUpper       PasswordRule = "upper"
+	PasswordRuleDigit       PasswordRule = "digit"
+	PasswordRuleSymbol      PasswordRule = "symbol"
+	PasswordRuleAccountName PasswordRule = "accountName"
+	PasswordRuleHistory     PasswordRule = "history"
+	PasswordRuleBreached    PasswordRule = "breached"
+)
+
+// PasswordPolicy is checked by Register, ChangePassword and the password resets. Accounts provisioned by
+// LoginWithIdentity get random passwords which skip it.
+type PasswordPolicy struct {
+	// MinLength counts characters, default is 1
+	MinLength     int  `yaml:"minLength" json:"minLength"`
+	RequireLower  bool `yaml:"requireLower" json:"requireLower"`
+	RequireUpper  bool `yaml:"requireUpper" json:"requireUpper"`
+	RequireDigit  bool `yaml:"requireDigit" json:"requireDigit"`
+	RequireSymbol bool `yaml:"requireSymbol" json:"requireSymbol"`
+
+	// DisallowAccountName rejects passwords containing the account name case-insensitively, account names shorter
+	// than 3 characters are ignored
+	DisallowAccountName bool `yaml:"disallowAccountName" json:"disallowAccountName"`
+
+	// HistorySize is how many recent passwords, the current one included, can't be reused
+	HistorySize int `yaml:"historySize" json:"historySize"`
+
+	BreachedChecker BreachedPasswordChecker `yaml:"-" json:"-"`
+}
+
+func (policy *PasswordPolicy) fix() {
+	if policy.MinLength <= 0 {
+		policy.MinLength = 1
+	}
+}
+
+func (policy *PasswordPolicy) historySize() int {
+	if policy == nil {
+		return 0
+	}
+
+	return policy.HistorySize
+}
+
+// PasswordPolicyError lists every rule the password breaks.
+type PasswordPolicyError struct {
+	Violations []PasswordRule
+}
+
+func (e *PasswordPolicyError) Error() string {
+	rules := make([]string, 0, len(e.Violations))
+	for _, rule := range e.Violations {
+		rules = append(rules, string(rule))
+	}
+
+	return "password violates policy: " + strings.Join(rules, ", ")
+}
+
+func (e *PasswordPolicyError) Is(target error) bool {
+	return target == ErrPasswordPolicy || target == commerr.ErrInvalidArgument
+}
+
+// BreachedPasswordChecker reports passwords known from data breaches. It fails closed: an error of Breached is
+// returned by Register, ChangePassword and the password resets, so the password isn't set.
+type BreachedPasswordChecker interface {
+	Breached(password string) (breached bool, err error)
+}
+
+// FileBreachedPasswordChecker keeps the file open until Close.
+type FileBreachedPasswordChecker interface {
+	BreachedPasswordChecker
+	Close() error
+}
+
+// NewFileBreachedPasswordChecker checks passwords against a local file of SHA-1 hex hashes sorted ascending, one
+// per line with an optional ":count" suffix. A line holds either the full hash, as the ordered by hash download of
+// Pwned Passwords, or the k-anonymity form "prefix:suffix" of the 5 chars range prefix and the rest of the hash,
+// as the range API responses joined with their prefixes. Hashes are case insensitive.
+// The file is binary searched on every check, so it can be far larger than memory. It's opened once and kept open
+// until Close, create a new checker when the file is replaced.
+func NewFileBreachedPasswordChecker(fileName string) (FileBreachedPasswordChecker, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+
+		return nil, err
+	}
+
+	return &fileBreachedPasswordChecker{
+		f:    f,
+		size: fi.Size(),
+	}, nil
+}
+
+type fileBreachedPasswordChecker struct {
+	f    *os.File
+	size int64
+}
+
+func (checker *fileBreachedPasswordChecker) Breached(password string) (breached bool, err error) {
+	sum := sha1.Sum([]byte(password)) // nolint: gosec
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	// find the first line starting at or after lo whose hash isn't less than hash
+	lo, hi := int64(0), checker.size
+
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+
+		var lineHash string
+
+		lineHash, err = checker.hashLineAfter(mid)
+		if err != nil {
+			return
+		}
+
+		if lineHash == "" || lineHash >= hash {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+
+	lineHash, err := checker.hashLineAfter(lo)
+	if err != nil {
+		return
+	}
+
+	breached = lineHash == hash
+
+	return
+}
+
+func (checker *fileBreachedPasswordChecker) Close() error {
+	return checker.f.Close()
+}
+
+//
+//
+//
+
+// checkPasswordPolicy checks password against the policy, hashedPasswords are the recent passwords of the account.
+func (impl *accountImpl) checkPasswordPolicy(accountName, password string, hashedPasswords []string) (err error) {
+	policy := impl.cfg.PasswordPolicy
+	if policy == nil {
+		return
+	}
+
+	var violations []PasswordRule
+
+	if len([]rune(password)) < policy.MinLength {
+		violations = append(violations, PasswordRuleMinLength)
+	}
+
+	var hasLower, hasUpper, hasDigit, hasSymbol bool
+
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			hasLower = true
+		case unicode.IsUpper(c):
+			hasUpper = true
+		case unicode.IsDigit(c):
+			hasDigit = true
+		case unicode.IsPunct(c) || unicode.IsSymbol(c) || unicode.IsSpace(c):
+			hasSymbol = true
+		}
+	}
+
+	for _, c := range []struct {
+		required bool
+		has      bool
+		rule     PasswordRule
+	}{
+		{policy.RequireLower, hasLower, PasswordRuleLower},
+		{policy.RequireUpper, hasUpper, PasswordRuleUpper},
+		{policy.RequireDigit, hasDigit, PasswordRuleDigit},
+		{policy.RequireSymbol, hasSymbol, PasswordRuleSymbol},
+	} {
+		if c.required && !c.has {
+			violations = append(violations, c.rule)
+		}
+	}
+
+	if policy.DisallowAccountName && len([]rune(accountName)) >= minAccountNameLengthInPassword &&
+		strings.Contains(strings.ToLower(password), strings.ToLower(accountName)) {
+		violations = append(violations, PasswordRuleAccountName)
+	}
+
+	for _, hashedPassword := range hashedPasswords {
+		var ok bool
+
+		ok, err = impl.verifyPassword(password, hashedPassword)
+		if err != nil {
+			return
+		}
+
+		if ok {
+			violations = append(violations, PasswordRuleHistory)
+
+			break
+		}
+	}
+
+	if policy.BreachedChecker != nil {
+		var breached bool
+
+		breached, err = policy.BreachedChecker.Breached(password)
+		if err != nil {
+			return
+		}
+
+		if breached {
+			violations = append(violations, PasswordRuleBreached)
+		}
+	}
+
+	if len(violations) > 0 {
+		err = &PasswordPolicyError{
+			Violations: violations,
+		}
+	}
+
+	return
+}
+
+// recentHashedPasswords returns the current hashed password of the account followed by its password history,
+// at most PasswordPolicy.HistorySize of them.
+func (impl *accountImpl) recentHashedPasswords(uid uint64) (hashedPasswords []string, err error) {
+	historySize := impl.cfg.PasswordPolicy.historySize()
+	if historySize <= 0 {
+		return
+	}
+
+	_, hashedPassword, err := impl.storage.GetAccount(uid)
+	if err != nil {
+		return
+	}
+
+	history, err := impl.storage.GetPasswordHistory(uid)
+	if err != nil {
+		return
+	}
+
+	if hashedPassword != "" {
+		hashedPasswords = append(hashedPasswords, hashedPassword)
+	}
+
+	hashedPasswords = append(hashedPasswords, history...)
+
+	if len(hashedPasswords) > historySize {
+		hashedPasswords = hashedPasswords[:historySize]
+	}
+
+	return
+}
+
+// hashLineAfter returns the upper case full hash of the first line starting at or after offset, "" at the end of
+// file. The ':' of "prefix:suffix" lines is always at the same column, so their order is the order of the hashes.
+// Lines are at most maxBreachedLineLength bytes, so one read of twice that holds the rest of the current line and
+// the hash of the next one.
+func (checker *fileBreachedPasswordChecker) hashLineAfter(offset int64) (hash string, err error) {
+	if offset >= checker.size {
+		return
+	}
+
+	var buf [maxBreachedLineLength * 2]byte
+
+	// the line starts at offset when the byte before it ends the previous line
+	start := offset
+	if start > 0 {
+		start--
+	}
+
+	n, err := checker.f.ReadAt(buf[:], start)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return
+	}
+
+	err = nil
+
+	line := buf[:n]
+
+	if offset > 0 {
+		idx := bytes.IndexByte(line, '\n')
+		if idx < 0 {
+			if n == len(buf) {
+				err = commerr.ErrBadFormat
+			}
+
+			return
+		}
+
+		line = line[idx+1:]
+	}
+
+	if idx := bytes.IndexByte(line, '\n'); idx >= 0 {
+		line = line[:idx]
+	}
+
+	fields := bytes.SplitN(bytes.TrimSpace(line), []byte(":"), 3)
+
+	// "prefix:suffix[:count]" or "hash[:count]"
+	if len(fields[0]) == breachedHashPrefixLength && len(fields) > 1 {
+		hash = strings.ToUpper(string(fields[0]) + string(fields[1]))
+	} else {
+		hash = strings.ToUpper(string(fields[0]))
+	}
+
+	return
+}
@@ -0,0 +1,67 @@
+// nolint
+package account
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileBreachedPasswordChecker(t *testing.T) {
+	var lines, rangeLines []string
+
+	for _, password := range []string{"123456", "password", "qwerty", "letmein", "dragon", "monkey", "a", "b"} {
+		sum := sha1.Sum([]byte(password))
+		hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+		lines = append(lines, hash+":42")
+		rangeLines = append(rangeLines, hash[:5]+":"+hash[5:]+":42")
+	}
+
+	sort.Strings(lines)
+	sort.Strings(rangeLines)
+
+	fileName := filepath.Join(t.TempDir(), "pwned.txt")
+
+	for _, content := range []string{strings.Join(lines, "\n"), strings.Join(lines, "\r\n") + "\r\n",
+		strings.Join(rangeLines, "\n"), strings.ToLower(strings.Join(rangeLines, "\n"))} {
+		assert.Nil(t, os.WriteFile(fileName, []byte(content), 0o600))
+
+		checker, err := NewFileBreachedPasswordChecker(fileName)
+		assert.Nil(t, err)
+
+		for _, password := range []string{"123456", "password", "qwerty", "letmein", "dragon", "monkey", "a", "b"} {
+			breached, err := checker.Breached(password)
+			assert.Nil(t, err)
+			assert.True(t, breached, password)
+		}
+
+		for _, password := range []string{"", "c", "Secret001", "1234567"} {
+			breached, err := checker.Breached(password)
+			assert.Nil(t, err)
+			assert.False(t, breached, password)
+		}
+
+		assert.Nil(t, checker.Close())
+	}
+
+	_, err := NewFileBreachedPasswordChecker(filepath.Join(t.TempDir(), "none.txt"))
+	assert.NotNil(t, err)
+
+	// an empty file breaches nothing
+	assert.Nil(t, os.WriteFile(fileName, nil, 0o600))
+
+	checker, err := NewFileBreachedPasswordChecker(fileName)
+	assert.Nil(t, err)
+
+	breached, err := checker.Breached("a")
+	assert.Nil(t, err)
+	assert.False(t, breached)
+
+	assert.Nil(t, checker.Close())
+}
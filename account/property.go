@@ -0,0 +1,95 @@
+package account
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/sgostarter/i/commerr"
+)
+
+const maxPropertyUpdateRetries = 16
+
+// PropertyUpdater returns the new data of a namespace, data is nil and version is 0 when the namespace doesn't exist.
+// It may be called several times by UpdatePropertyData, returning an error stops the update.
+type PropertyUpdater func(data []byte, version uint64) (newData []byte, err error)
+
+func (impl *accountImpl) GetPropertyNamespace(uid uint64, ns string) (data []byte, version uint64, err error) {
+	if ns == "" {
+		err = commerr.ErrInvalidArgument
+
+		return
+	}
+
+	return impl.storage.GetPropertyNamespace(uid, ns)
+}
+
+// UpdatePropertyData sets the namespace by fn with compare-and-swap, fn is called again with the latest data
+// when another writer changes the namespace in between.
+func (impl *accountImpl) UpdatePropertyData(uid uint64, ns string, fn PropertyUpdater) (version uint64, err error) {
+	if ns == "" || fn == nil {
+		err = commerr.ErrInvalidArgument
+
+		return
+	}
+
+	for retry := 0; retry < maxPropertyUpdateRetries; retry++ {
+		var data, newData []byte
+
+		data, version, err = impl.storage.GetPropertyNamespace(uid, ns)
+		if err != nil {
+			return
+		}
+
+		newData, err = fn(data, version)
+		if err != nil {
+			return
+		}
+
+		version, err = impl.storage.SetPropertyNamespace(uid, ns, version, newData)
+		if !errors.Is(err, ErrPropertyVersionConflict) {
+			return
+		}
+
+		// jitter, so the conflicting writers don't retry in lockstep
+		time.Sleep(time.Duration(rand.Int63n(int64(retry+1) * int64(time.Millisecond)))) // nolint: gosec
+	}
+
+	return
+}
+
+// GetProperty unmarshals the JSON data of the namespace, v is the zero value when the namespace doesn't exist.
+func GetProperty[T any](acc Account, uid uint64, ns string) (v T, version uint64, err error) {
+	data, version, err := acc.GetPropertyNamespace(uid, ns)
+	if err != nil || version == 0 {
+		return
+	}
+
+	err = json.Unmarshal(data, &v)
+
+	return
+}
+
+// UpdateProperty updates the namespace as JSON of T by fn, see Account.UpdatePropertyData.
+func UpdateProperty[T any](acc Account, uid uint64, ns string, fn func(v *T) error) (v T, version uint64, err error) {
+	version, err = acc.UpdatePropertyData(uid, ns, func(data []byte, _ uint64) (newData []byte, err error) {
+		var newV T
+
+		if len(data) > 0 {
+			if err = json.Unmarshal(data, &newV); err != nil {
+				return
+			}
+		}
+
+		if err = fn(&newV); err != nil {
+			return
+		}
+
+		v = newV
+
+		return json.Marshal(newV)
+	})
+
+	return
+}
@@ -0,0 +1,110 @@
+package account
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/sgostarter/i/commerr"
+)
+
+const (
+	defaultUserQueryLimit = 50
+	maxUserQueryLimit     = 1000
+)
+
+type UserSortField string
+
+const (
+	UserSortByCreateAt UserSortField = "createAt"
+	UserSortByName     UserSortField = "name"
+)
+
+type UserQuery struct {
+	NamePrefix   string
+	NameContains string
+	// State filters by account state, deleted accounts are listed only when State is AccountStateDeleted
+	State AccountState
+	Role  string
+
+	CreatedAtStart  int64
+	CreatedAtFinish int64
+
+	SortBy UserSortField
+	Desc   bool
+
+	// Cursor is UserPage.NextCursor of the previous page, empty for the first page
+	Cursor string
+	Limit  int
+}
+
+type UserPage struct {
+	Users []User
+	// NextCursor is empty at the last page, it may also lead to an empty page
+	NextCursor string
+}
+
+// UserCursor is the position of a page, storages encode it by EncodeUserCursor.
+type UserCursor struct {
+	SortKey string `json:"k"`
+	UID     uint64 `json:"u"`
+}
+
+func EncodeUserCursor(cursor *UserCursor) string {
+	d, _ := json.Marshal(cursor)
+
+	return base64.RawURLEncoding.EncodeToString(d)
+}
+
+// DecodeUserCursor returns nil cursor for empty s.
+func DecodeUserCursor(s string) (cursor *UserCursor, err error) {
+	if s == "" {
+		return
+	}
+
+	d, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		err = commerr.ErrInvalidArgument
+
+		return
+	}
+
+	cursor = &UserCursor{}
+
+	if err = json.Unmarshal(d, cursor); err != nil {
+		cursor = nil
+		err = commerr.ErrInvalidArgument
+	}
+
+	return
+}
+
+func (impl *accountImpl) QueryUsers(query *UserQuery) (page *UserPage, err error) {
+	q := UserQuery{}
+	if query != nil {
+		q = *query
+	}
+
+	if q.Limit <= 0 {
+		q.Limit = defaultUserQueryLimit
+	}
+
+	if q.Limit > maxUserQueryLimit {
+		q.Limit = maxUserQueryLimit
+	}
+
+	switch q.SortBy {
+	case "":
+		q.SortBy = UserSortByCreateAt
+	case UserSortByCreateAt, UserSortByName:
+	default:
+		err = commerr.ErrInvalidArgument
+
+		return
+	}
+
+	if _, err = DecodeUserCursor(q.Cursor); err != nil {
+		return
+	}
+
+	return impl.storage.QueryUsers(&q)
+}
@@ -0,0 +1,173 @@
+package account
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/sgostarter/i/commerr"
+)
+
+// Role is a named permission set. A permission grants itself, "*" grants every permission and
+// a permission ending with ":*" grants every permission with its prefix, e.g. "order:*" grants "order:read".
+type Role struct {
+	Name        string   `json:"name" yaml:"name"`
+	Description string   `json:"description,omitempty" yaml:"description,omitempty"`
+	Permissions []string `json:"permissions" yaml:"permissions"`
+}
+
+func (role *Role) HasPermission(permission string) bool {
+	for _, granted := range role.Permissions {
+		if matchPermission(granted, permission) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (impl *accountImpl) SetRole(role *Role) (err error) {
+	if role == nil || role.Name == "" {
+		err = commerr.ErrInvalidArgument
+
+		return
+	}
+
+	err = impl.storage.SetRole(role)
+
+	impl.roleCache.Delete(roleCacheKey(role.Name))
+
+	return
+}
+
+func (impl *accountImpl) DelRole(roleName string) (err error) {
+	err = impl.storage.DelRole(roleName)
+
+	// the role is removed from users too
+	impl.roleCache.Flush()
+
+	return
+}
+
+func (impl *accountImpl) GetRole(roleName string) (role *Role, err error) {
+	return impl.storage.GetRole(roleName)
+}
+
+func (impl *accountImpl) ListRoles() (roles []*Role, err error) {
+	return impl.storage.ListRoles()
+}
+
+func (impl *accountImpl) AssignRole(uid uint64, roleName string) (err error) {
+	err = impl.storage.AssignRole(uid, roleName)
+
+	impl.roleCache.Delete(userRolesCacheKey(uid))
+
+	return
+}
+
+func (impl *accountImpl) UnassignRole(uid uint64, roleName string) (err error) {
+	err = impl.storage.UnassignRole(uid, roleName)
+
+	impl.roleCache.Delete(userRolesCacheKey(uid))
+
+	return
+}
+
+func (impl *accountImpl) GetUserRoles(uid uint64) (roleNames []string, err error) {
+	return impl.storage.GetUserRoles(uid)
+}
+
+func (impl *accountImpl) ListUsersByRole(roleName string) (uids []uint64, err error) {
+	return impl.storage.ListUsersByRole(roleName)
+}
+
+func (impl *accountImpl) HasPermission(uid uint64, permission string) (ok bool, err error) {
+	roleNames, err := impl.getUserRolesCached(uid)
+	if err != nil {
+		return
+	}
+
+	for _, roleName := range roleNames {
+		var role *Role
+
+		role, err = impl.getRoleCached(roleName)
+		if err != nil {
+			return
+		}
+
+		if role != nil && role.HasPermission(permission) {
+			ok = true
+
+			return
+		}
+	}
+
+	return
+}
+
+//
+//
+//
+
+func (impl *accountImpl) getUserRolesCached(uid uint64) (roleNames []string, err error) {
+	key := userRolesCacheKey(uid)
+
+	if v, ok := impl.roleCache.Get(key); ok {
+		roleNames, _ = v.([]string)
+
+		return
+	}
+
+	roleNames, err = impl.storage.GetUserRoles(uid)
+	if err != nil {
+		return
+	}
+
+	impl.roleCache.SetDefault(key, roleNames)
+
+	return
+}
+
+// getRoleCached returns nil role for roles which are deleted.
+func (impl *accountImpl) getRoleCached(roleName string) (role *Role, err error) {
+	key := roleCacheKey(roleName)
+
+	if v, ok := impl.roleCache.Get(key); ok {
+		role, _ = v.(*Role)
+
+		return
+	}
+
+	role, err = impl.storage.GetRole(roleName)
+	if err != nil {
+		if !errors.Is(err, commerr.ErrNotFound) {
+			return
+		}
+
+		role, err = nil, nil
+	}
+
+	impl.roleCache.SetDefault(key, role)
+
+	return
+}
+
+func roleCacheKey(roleName string) string {
+	return "r:" + roleName
+}
+
+func userRolesCacheKey(uid uint64) string {
+	return "u:" + strconv.FormatUint(uid, 10)
+}
+
+func matchPermission(granted, permission string) bool {
+	if granted == permission || granted == "*" {
+		return true
+	}
+
+	if strings.HasSuffix(granted, ":*") {
+		return strings.HasPrefix(permission, granted[:len(granted)-1])
+	}
+
+	return false
+}
@@ -0,0 +1,152 @@
+package account
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sgostarter/i/commerr"
+	"github.com/sgostarter/i/l"
+)
+
+// Revocation revokes an access token by its jti claim, or all access tokens of a session by its sid claim.
+type Revocation struct {
+	TokenID   string    `json:"tokenID,omitempty"`
+	SessionID string    `json:"sessionID,omitempty"`
+	UID       uint64    `json:"uid,omitempty"`
+	ExpiredAt time.Time `json:"expiredAt"` // the revocation can be forgotten after all tokens it matches are expired
+}
+
+// RevocationFeed shares revocations between Account instances which run with Config.StatelessWho.
+type RevocationFeed interface {
+	Publish(revocation *Revocation) error
+	// Subscribe calls handler for revocations published by every instance, including this one
+	Subscribe(handler func(revocation *Revocation)) error
+}
+
+func newRevocationList() *revocationList {
+	return &revocationList{
+		tokens:   make(map[string]time.Time),
+		sessions: make(map[string]time.Time),
+	}
+}
+
+type revocationList struct {
+	lock        sync.RWMutex
+	tokens      map[string]time.Time // jti -> expired at
+	sessions    map[string]time.Time // sid -> expired at
+	lastCleanAt time.Time
+}
+
+func (rl *revocationList) add(revocation *Revocation) {
+	if revocation == nil || time.Now().After(revocation.ExpiredAt) {
+		return
+	}
+
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	if revocation.TokenID != "" && revocation.ExpiredAt.After(rl.tokens[revocation.TokenID]) {
+		rl.tokens[revocation.TokenID] = revocation.ExpiredAt
+	}
+
+	if revocation.SessionID != "" && revocation.ExpiredAt.After(rl.sessions[revocation.SessionID]) {
+		rl.sessions[revocation.SessionID] = revocation.ExpiredAt
+	}
+
+	if time.Since(rl.lastCleanAt) > time.Minute {
+		rl.lastCleanAt = time.Now()
+
+		for id, expiredAt := range rl.tokens {
+			if rl.lastCleanAt.After(expiredAt) {
+				delete(rl.tokens, id)
+			}
+		}
+
+		for id, expiredAt := range rl.sessions {
+			if rl.lastCleanAt.After(expiredAt) {
+				delete(rl.sessions, id)
+			}
+		}
+	}
+}
+
+func (rl *revocationList) revoked(tokenID, sessionID string) bool {
+	rl.lock.RLock()
+	defer rl.lock.RUnlock()
+
+	if _, ok := rl.tokens[tokenID]; ok && tokenID != "" {
+		return true
+	}
+
+	if _, ok := rl.sessions[sessionID]; ok && sessionID != "" {
+		return true
+	}
+
+	return false
+}
+
+//
+//
+//
+
+// publishRevocation adds the revocation to the local list at once and shares it by the feed.
+func (impl *accountImpl) publishRevocation(revocation *Revocation) {
+	impl.revocations.add(revocation)
+
+	if impl.cfg.RevocationFeed == nil {
+		return
+	}
+
+	if err := impl.cfg.RevocationFeed.Publish(revocation); err != nil {
+		impl.logger.WithFields(l.ErrorField(err)).Error("publish revocation failed")
+	}
+}
+
+func (impl *accountImpl) revokeToken(token string) {
+	claims, err := impl.tokenParse(token)
+	if err != nil || claims.ExpiresAt == nil {
+		// invalid or expired tokens are rejected by stateless Who anyway
+		return
+	}
+
+	impl.publishRevocation(&Revocation{
+		TokenID:   claims.ID,
+		UID:       claims.UID,
+		ExpiredAt: claims.ExpiresAt.Time,
+	})
+}
+
+func (impl *accountImpl) revokeSessionTokens(sessionID string) {
+	if sessionID == "" || impl.cfg.TokenClaimExpiresAfter <= 0 {
+		return
+	}
+
+	impl.publishRevocation(&Revocation{
+		SessionID: sessionID,
+		ExpiredAt: time.Now().Add(impl.cfg.TokenClaimExpiresAfter),
+	})
+}
+
+func (impl *accountImpl) statelessWho(token string) (uid uint64, accountName string, err error) {
+	claims, err := impl.tokenParse(token)
+	if err != nil {
+		return
+	}
+
+	if claims.Purpose != "" || claims.ExpiresAt == nil {
+		err = commerr.ErrUnauthenticated
+
+		return
+	}
+
+	if impl.revocations.revoked(claims.ID, claims.SessionID) {
+		err = commerr.ErrNotFound
+
+		return
+	}
+
+	uid = claims.UID
+	accountName = claims.UserName
+
+	return
+}
@@ -0,0 +1,113 @@
+package account
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/sgostarter/i/commerr"
+	"github.com/sgostarter/i/l"
+)
+
+func (impl *accountImpl) ListSessions(uid uint64) (sessions []*Session, err error) {
+	tokens, err := impl.storage.ListTokens(uid)
+	if err != nil {
+		return
+	}
+
+	sessions = make([]*Session, 0, len(tokens))
+
+	for token, session := range tokens {
+		sessions = append(sessions, tokenSession(token, session))
+	}
+
+	return
+}
+
+func (impl *accountImpl) RevokeSession(uid uint64, sessionID string) (err error) {
+	tokens, err := impl.storage.ListTokens(uid)
+	if err != nil {
+		return
+	}
+
+	var found bool
+
+	for token, session := range tokens {
+		if tokenSession(token, session).SessionID != sessionID {
+			continue
+		}
+
+		found = true
+
+		impl.delToken(token)
+	}
+
+	if err = impl.storage.RevokeRefreshTokenFamily(sessionID); err != nil {
+		return
+	}
+
+	impl.revokeSessionTokens(sessionID)
+
+	if !found {
+		err = commerr.ErrNotFound
+	}
+
+	return
+}
+
+func (impl *accountImpl) RevokeAllSessions(uid uint64, exceptCurrentToken string) (err error) {
+	tokens, err := impl.storage.ListTokens(uid)
+	if err != nil {
+		return
+	}
+
+	var exceptSessionID string
+
+	if session, ok := tokens[exceptCurrentToken]; ok {
+		exceptSessionID = tokenSession(exceptCurrentToken, session).SessionID
+	}
+
+	for token, session := range tokens {
+		if token == exceptCurrentToken {
+			continue
+		}
+
+		if exceptSessionID != "" && tokenSession(token, session).SessionID == exceptSessionID {
+			continue
+		}
+
+		impl.delToken(token)
+	}
+
+	return impl.storage.RevokeUserRefreshTokens(uid, exceptSessionID)
+}
+
+//
+//
+//
+
+func (impl *accountImpl) delToken(token string) {
+	if err := impl.storage.DelToken(token); err != nil {
+		impl.logger.WithFields(l.ErrorField(err)).Error("delete token failed")
+
+		return
+	}
+
+	impl.revokeToken(token)
+}
+
+// tokenSession returns session of the token, tokens without session are identified by their hash.
+func tokenSession(token string, session *Session) *Session {
+	if session != nil && session.SessionID != "" {
+		return session
+	}
+
+	newSession := &Session{}
+	if session != nil {
+		*newSession = *session
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	newSession.SessionID = "t-" + hex.EncodeToString(sum[:8])
+
+	return newSession
+}
@@ -0,0 +1,985 @@
+// nolint
+package storagetest
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sgostarter/i/commerr"
+	"github.com/sgostarter/libcomponents/account"
+	"github.com/stretchr/testify/assert"
+)
+
+// NewStorage returns an empty storage, it's called once or more by each test.
+type NewStorage func(t *testing.T) account.Storage
+
+// RunAccountTests runs the behavioural tests of account.Account against the storages of newStorage,
+// every account.Storage implementation should pass them.
+func RunAccountTests(t *testing.T, newStorage NewStorage) {
+	for _, c := range []struct {
+		name string
+		fn   func(t *testing.T, newStorage NewStorage)
+	}{
+		{"RefreshToken", testRefreshToken},
+		{"RefreshTokenDisabled", testRefreshTokenDisabled},
+		{"PasswordRehashOnLogin", testPasswordRehashOnLogin},
+		{"LoginThrottle", testLoginThrottle},
+		{"LoginBackoff", testLoginBackoff},
+		{"TOTPLogin", testTOTPLogin},
+		{"Sessions", testSessions},
+		{"RBAC", testRBAC},
+		{"APIKey", testAPIKey},
+		{"AccountLifecycle", testAccountLifecycle},
+		{"PasswordReset", testPasswordReset},
+		{"ContactVerification", testContactVerification},
+		{"QueryUsers", testQueryUsers},
+		{"PropertyNamespace", testPropertyNamespace},
+		{"IdentityLogin", testIdentityLogin},
+		{"IdentityProviderConfig", testIdentityProviderConfig},
+		{"Hooks", testHooks},
+		{"PasswordPolicy", testPasswordPolicy},
+	} {
+		c := c
+
+		t.Run(c.name, func(t *testing.T) {
+			c.fn(t, newStorage)
+		})
+	}
+}
+
+func newTestAccount(t *testing.T, newStorage NewStorage, cfg *account.Config) (account.Account, account.Storage) {
+	stg := newStorage(t)
+
+	if cfg == nil {
+		cfg = &account.Config{}
+	}
+
+	cfg.TokenSignKey = "abcd"
+	cfg.PasswordHashIterCount = 16
+
+	return account.NewAccount(stg, cfg, nil), stg
+}
+
+func testRefreshToken(t *testing.T, newStorage NewStorage) {
+	acc, _ := newTestAccount(t, newStorage, &account.Config{
+		TokenExpiresAfter:        time.Minute,
+		RefreshTokenExpiresAfter: time.Hour,
+	})
+
+	uid, err := acc.Register("user1", "pass1")
+	assert.Nil(t, err)
+
+	result, err := acc.LoginEx("user1", "pass1")
+	assert.Nil(t, err)
+	assert.EqualValues(t, uid, result.UID)
+	assert.NotEmpty(t, result.RefreshToken)
+
+	result2, err := acc.Refresh(result.RefreshToken)
+	assert.Nil(t, err)
+	assert.NotEqual(t, result.RefreshToken, result2.RefreshToken)
+
+	uid2, accountName, err := acc.Who(result2.Token)
+	assert.Nil(t, err)
+	assert.EqualValues(t, uid, uid2)
+	assert.EqualValues(t, "user1", accountName)
+
+	_, err = acc.Refresh(result.RefreshToken)
+	assert.ErrorIs(t, err, account.ErrRefreshTokenReused)
+
+	_, _, err = acc.Who(result.Token)
+	assert.NotNil(t, err)
+
+	_, _, err = acc.Who(result2.Token)
+	assert.NotNil(t, err)
+
+	_, err = acc.Refresh(result2.RefreshToken)
+	assert.NotNil(t, err)
+}
+
+func testRefreshTokenDisabled(t *testing.T, newStorage NewStorage) {
+	acc, _ := newTestAccount(t, newStorage, nil)
+
+	_, err := acc.Register("user1", "pass1")
+	assert.Nil(t, err)
+
+	result, err := acc.LoginEx("user1", "pass1")
+	assert.Nil(t, err)
+	assert.Empty(t, result.RefreshToken)
+
+	_, err = acc.Refresh("x")
+	assert.NotNil(t, err)
+}
+
+func testPasswordRehashOnLogin(t *testing.T, newStorage NewStorage) {
+	stg := newStorage(t)
+
+	acc := account.NewAccount(stg, &account.Config{
+		PasswordHashIterCount: 16,
+		TokenSignKey:          "abcd",
+	}, nil)
+
+	uid, err := acc.Register("user1", "pass1")
+	assert.Nil(t, err)
+
+	hasher := account.NewArgon2IDPasswordHasher(1, 1024, 1)
+
+	// the same storage opened with a new hasher
+	acc = account.NewAccount(stg, &account.Config{
+		PasswordHashIterCount: 16,
+		TokenSignKey:          "abcd",
+		PasswordHasher:        hasher,
+	}, nil)
+
+	_, hashedPassword, err := acc.GetAccount(uid)
+	assert.Nil(t, err)
+	assert.True(t, hasher.NeedsRehash(hashedPassword))
+
+	_, _, err = acc.Login("user1", "pass2")
+	assert.NotNil(t, err)
+
+	_, _, err = acc.Login("user1", "pass1")
+	assert.Nil(t, err)
+
+	_, hashedPassword, err = acc.GetAccount(uid)
+	assert.Nil(t, err)
+	assert.False(t, hasher.NeedsRehash(hashedPassword))
+
+	_, _, err = acc.Login("user1", "pass1")
+	assert.Nil(t, err)
+}
+
+func testLoginThrottle(t *testing.T, newStorage NewStorage) {
+	acc, _ := newTestAccount(t, newStorage, &account.Config{
+		LoginThrottle: &account.LoginThrottleConfig{
+			MaxFailures:       3,
+			SourceMaxFailures: 5,
+			LockoutDuration:   time.Hour,
+		},
+	})
+
+	uid, err := acc.Register("user1", "pass1")
+	assert.Nil(t, err)
+
+	for idx := 0; idx < 3; idx++ {
+		_, err = acc.LoginEx("user1", "bad", account.SourceLoginOption("ip1"))
+		assert.NotNil(t, err)
+		assert.NotErrorIs(t, err, account.ErrLoginThrottled)
+	}
+
+	_, err = acc.LoginEx("user1", "pass1", account.SourceLoginOption("ip2"))
+	assert.ErrorIs(t, err, account.ErrLoginThrottled)
+
+	var throttledErr *account.LoginThrottledError
+
+	assert.ErrorAs(t, err, &throttledErr)
+	assert.True(t, throttledErr.Locked)
+	assert.True(t, throttledErr.RetryAfter > time.Minute*59)
+
+	err = acc.Unlock(uid)
+	assert.Nil(t, err)
+
+	_, err = acc.LoginEx("user1", "pass1", account.SourceLoginOption("ip2"))
+	assert.Nil(t, err)
+
+	for idx := 0; idx < 2; idx++ {
+		_, err = acc.LoginEx("nobody", "bad", account.SourceLoginOption("ip1"))
+		assert.NotErrorIs(t, err, account.ErrLoginThrottled)
+	}
+
+	_, err = acc.LoginEx("user1", "pass1", account.SourceLoginOption("ip1"))
+	assert.ErrorIs(t, err, account.ErrLoginThrottled)
+
+	_, err = acc.LoginEx("user1", "pass1")
+	assert.Nil(t, err)
+}
+
+func testLoginBackoff(t *testing.T, newStorage NewStorage) {
+	acc, _ := newTestAccount(t, newStorage, &account.Config{
+		LoginThrottle: &account.LoginThrottleConfig{
+			BaseDelay: time.Millisecond * 200,
+		},
+	})
+
+	_, err := acc.Register("user1", "pass1")
+	assert.Nil(t, err)
+
+	_, err = acc.LoginEx("user1", "bad")
+	assert.NotErrorIs(t, err, account.ErrLoginThrottled)
+
+	_, err = acc.LoginEx("user1", "pass1")
+	assert.ErrorIs(t, err, account.ErrLoginThrottled)
+
+	time.Sleep(time.Millisecond * 250)
+
+	_, err = acc.LoginEx("user1", "bad")
+	assert.NotErrorIs(t, err, account.ErrLoginThrottled)
+
+	time.Sleep(time.Millisecond * 250)
+
+	var throttledErr *account.LoginThrottledError
+
+	_, err = acc.LoginEx("user1", "pass1")
+	assert.ErrorAs(t, err, &throttledErr)
+	assert.False(t, throttledErr.Locked)
+
+	time.Sleep(throttledErr.RetryAfter)
+
+	_, err = acc.LoginEx("user1", "pass1")
+	assert.Nil(t, err)
+}
+
+func testTOTPLogin(t *testing.T, newStorage NewStorage) {
+	acc, stg := newTestAccount(t, newStorage, &account.Config{
+		TOTPIssuer: "ut",
+	})
+
+	uid, err := acc.Register("user1", "pass1")
+	assert.Nil(t, err)
+
+	secret, uri, err := acc.EnrollTOTP(uid)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, secret)
+	assert.Contains(t, uri, secret)
+
+	result, err := acc.LoginEx("user1", "pass1")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, result.Token)
+
+	_, err = acc.ConfirmTOTP(uid, "000000")
+	assert.NotNil(t, err)
+
+	info, err := stg.GetTOTP(uid)
+	assert.Nil(t, err)
+
+	recoveryCodes, err := acc.ConfirmTOTP(uid, currentTOTPCode(t, info.Secret, 0))
+	assert.Nil(t, err)
+	assert.Len(t, recoveryCodes, 10)
+
+	_, token, err := acc.Login("user1", "pass1")
+	assert.ErrorIs(t, err, account.ErrTOTPRequired)
+
+	_, _, err = acc.Who(token)
+	assert.NotNil(t, err)
+
+	result, err = acc.LoginEx("user1", "pass1")
+	assert.Nil(t, err)
+	assert.Empty(t, result.Token)
+	assert.NotEmpty(t, result.ChallengeToken)
+
+	_, err = acc.LoginVerifyTOTP(result.ChallengeToken, "000000")
+	assert.NotNil(t, err)
+
+	result2, err := acc.LoginVerifyTOTP(result.ChallengeToken, currentTOTPCode(t, info.Secret, 1))
+	assert.Nil(t, err)
+
+	uid2, _, err := acc.Who(result2.Token)
+	assert.Nil(t, err)
+	assert.EqualValues(t, uid, uid2)
+
+	// the challenge is used up
+	_, err = acc.LoginVerifyTOTP(result.ChallengeToken, recoveryCodes[0])
+	assert.ErrorIs(t, err, commerr.ErrUnauthenticated)
+
+	result, err = acc.LoginEx("user1", "pass1")
+	assert.Nil(t, err)
+
+	result2, err = acc.LoginVerifyTOTP(result.ChallengeToken, recoveryCodes[0])
+	assert.Nil(t, err)
+	assert.NotEmpty(t, result2.Token)
+
+	result, err = acc.LoginEx("user1", "pass1")
+	assert.Nil(t, err)
+
+	_, err = acc.LoginVerifyTOTP(result.ChallengeToken, recoveryCodes[0])
+	assert.NotNil(t, err)
+
+	// inactive accounts can't finish the login
+	assert.Nil(t, acc.Disable(uid))
+
+	_, err = acc.LoginVerifyTOTP(result.ChallengeToken, recoveryCodes[1])
+	assert.ErrorIs(t, err, account.ErrAccountInactive)
+
+	assert.Nil(t, acc.Enable(uid))
+
+	err = acc.DisableTOTP(uid)
+	assert.Nil(t, err)
+
+	result, err = acc.LoginEx("user1", "pass1")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, result.Token)
+}
+
+func testStorageTOTP(t *testing.T, stg account.Storage) {
+	assert.ErrorIs(t, stg.CompareAndSetTOTP(100, nil, &account.TOTPInfo{Secret: "s1"}), commerr.ErrNotFound)
+
+	uid, err := stg.AddAccount("user1", "pass1")
+	assert.Nil(t, err)
+
+	info, err := stg.GetTOTP(uid)
+	assert.Nil(t, err)
+	assert.Nil(t, info)
+
+	assert.Nil(t, stg.CompareAndSetTOTP(uid, nil, &account.TOTPInfo{Secret: "s1"}))
+	assert.ErrorIs(t, stg.CompareAndSetTOTP(uid, nil, &account.TOTPInfo{Secret: "s2"}), commerr.ErrAborted)
+
+	info, err = stg.GetTOTP(uid)
+	assert.Nil(t, err)
+	assert.EqualValues(t, "s1", info.Secret)
+
+	newInfo := *info
+	newInfo.LastUsedStep = 10
+	newInfo.UsedChallenges = map[string]int64{"c1": 100}
+
+	assert.Nil(t, stg.CompareAndSetTOTP(uid, info, &newInfo))
+
+	// the info read before the swap is stale
+	assert.ErrorIs(t, stg.CompareAndSetTOTP(uid, info, &account.TOTPInfo{Secret: "s2"}), commerr.ErrAborted)
+
+	info, err = stg.GetTOTP(uid)
+	assert.Nil(t, err)
+	assert.EqualValues(t, &newInfo, info)
+
+	assert.Nil(t, stg.CompareAndSetTOTP(uid, info, nil))
+
+	info, err = stg.GetTOTP(uid)
+	assert.Nil(t, err)
+	assert.Nil(t, info)
+}
+
+func currentTOTPCode(t *testing.T, secret string, stepOffset int64) string {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	assert.Nil(t, err)
+
+	var msg [8]byte
+
+	binary.BigEndian.PutUint64(msg[:], uint64(time.Now().Unix()/30+stepOffset))
+
+	h := hmac.New(sha1.New, key)
+	h.Write(msg[:])
+	sum := h.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:offset+4])&0x7fffffff)%1000000)
+}
+
+func testSessions(t *testing.T, newStorage NewStorage) {
+	acc, _ := newTestAccount(t, newStorage, &account.Config{
+		RefreshTokenExpiresAfter:       time.Hour,
+		RevokeSessionsOnPasswordChange: true,
+	})
+
+	uid, err := acc.Register("user1", "pass1")
+	assert.Nil(t, err)
+
+	result1, err := acc.LoginEx("user1", "pass1", account.SessionLoginOption("phone", "1.1.1.1", "ua1"))
+	assert.Nil(t, err)
+
+	result2, err := acc.LoginEx("user1", "pass1", account.SessionLoginOption("pc", "2.2.2.2", "ua2"))
+	assert.Nil(t, err)
+
+	_, token3, err := acc.Login("user1", "pass1")
+	assert.Nil(t, err)
+
+	sessions, err := acc.ListSessions(uid)
+	assert.Nil(t, err)
+	assert.Len(t, sessions, 3)
+
+	devices := make(map[string]*account.Session)
+	for _, session := range sessions {
+		devices[session.DeviceName] = session
+	}
+
+	assert.EqualValues(t, result1.SessionID, devices["phone"].SessionID)
+	assert.EqualValues(t, "1.1.1.1", devices["phone"].ClientIP)
+	assert.True(t, devices["phone"].ExpiredAt.After(time.Now()))
+
+	result1, err = acc.Refresh(result1.RefreshToken)
+	assert.Nil(t, err)
+	assert.EqualValues(t, devices["phone"].SessionID, result1.SessionID)
+
+	err = acc.RevokeSession(uid, result1.SessionID)
+	assert.Nil(t, err)
+
+	_, _, err = acc.Who(result1.Token)
+	assert.NotNil(t, err)
+
+	_, err = acc.Refresh(result1.RefreshToken)
+	assert.NotNil(t, err)
+
+	err = acc.RevokeAllSessions(uid, token3)
+	assert.Nil(t, err)
+
+	_, _, err = acc.Who(result2.Token)
+	assert.NotNil(t, err)
+
+	_, err = acc.Refresh(result2.RefreshToken)
+	assert.NotNil(t, err)
+
+	_, _, err = acc.Who(token3)
+	assert.Nil(t, err)
+
+	err = acc.ChangePassword(uid, "pass2")
+	assert.Nil(t, err)
+
+	_, _, err = acc.Who(token3)
+	assert.NotNil(t, err)
+
+	sessions, err = acc.ListSessions(uid)
+	assert.Nil(t, err)
+	assert.Empty(t, sessions)
+}
+
+func testRBAC(t *testing.T, newStorage NewStorage) {
+	acc, _ := newTestAccount(t, newStorage, &account.Config{
+		RolesInToken: true,
+	})
+
+	uid1, err := acc.Register("user1", "pass1")
+	assert.Nil(t, err)
+
+	uid2, err := acc.Register("user2", "pass2")
+	assert.Nil(t, err)
+
+	err = acc.SetRole(&account.Role{
+		Name:        "admin",
+		Permissions: []string{"*"},
+	})
+	assert.Nil(t, err)
+
+	err = acc.SetRole(&account.Role{
+		Name:        "reader",
+		Permissions: []string{"order:read", "user:*"},
+	})
+	assert.Nil(t, err)
+
+	roles, err := acc.ListRoles()
+	assert.Nil(t, err)
+	assert.Len(t, roles, 2)
+
+	err = acc.AssignRole(uid1, "unknown")
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+
+	assert.Nil(t, acc.AssignRole(uid1, "admin"))
+	assert.Nil(t, acc.AssignRole(uid2, "reader"))
+	assert.Nil(t, acc.AssignRole(uid2, "reader"))
+
+	uids, err := acc.ListUsersByRole("reader")
+	assert.Nil(t, err)
+	assert.EqualValues(t, []uint64{uid2}, uids)
+
+	for _, c := range []struct {
+		uid        uint64
+		permission string
+		ok         bool
+	}{
+		{uid1, "order:write", true},
+		{uid2, "order:read", true},
+		{uid2, "order:write", false},
+		{uid2, "user:read", true},
+		{uid2, "userx", false},
+	} {
+		ok, e := acc.HasPermission(c.uid, c.permission)
+		assert.Nil(t, e)
+		assert.EqualValues(t, c.ok, ok, c.permission)
+	}
+
+	_, token, err := acc.Login("user2", "pass2")
+	assert.Nil(t, err)
+
+	var claims account.Claims
+
+	_, _, err = jwt.NewParser().ParseUnverified(token, &claims)
+	assert.Nil(t, err)
+	assert.EqualValues(t, []string{"reader"}, claims.Roles)
+
+	assert.Nil(t, acc.UnassignRole(uid2, "reader"))
+
+	ok, err := acc.HasPermission(uid2, "order:read")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	assert.Nil(t, acc.DelRole("admin"))
+
+	roleNames, err := acc.GetUserRoles(uid1)
+	assert.Nil(t, err)
+	assert.Empty(t, roleNames)
+
+	ok, err = acc.HasPermission(uid1, "order:read")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	_, err = acc.GetRole("admin")
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+}
+
+func testAPIKey(t *testing.T, newStorage NewStorage) {
+	acc, _ := newTestAccount(t, newStorage, nil)
+
+	uid, err := acc.Register("user1", "pass1")
+	assert.Nil(t, err)
+
+	_, _, err = acc.CreateAPIKey(uid+1, "ci", nil, 0)
+	assert.NotNil(t, err)
+
+	key, info, err := acc.CreateAPIKey(uid, "ci", []string{"deploy:*"}, 0)
+	assert.Nil(t, err)
+	assert.Empty(t, info.HashedSecret)
+
+	key2, _, err := acc.CreateAPIKey(uid, "expiring", nil, time.Millisecond*50)
+	assert.Nil(t, err)
+
+	uid2, accountName, err := acc.Who(key)
+	assert.Nil(t, err)
+	assert.EqualValues(t, uid, uid2)
+	assert.EqualValues(t, "user1", accountName)
+
+	info, _, err = acc.WhoAPIKey(key)
+	assert.Nil(t, err)
+	assert.True(t, info.HasScope("deploy:prod"))
+	assert.False(t, info.HasScope("admin"))
+
+	_, _, err = acc.Who(key + "x")
+	assert.NotNil(t, err)
+
+	_, _, err = acc.Who(key2)
+	assert.Nil(t, err)
+
+	time.Sleep(time.Millisecond * 100)
+
+	_, _, err = acc.Who(key2)
+	assert.NotNil(t, err)
+
+	keys, err := acc.ListAPIKeys(uid)
+	assert.Nil(t, err)
+	assert.Len(t, keys, 1)
+	assert.EqualValues(t, "ci", keys[0].Name)
+	assert.Empty(t, keys[0].HashedSecret)
+	assert.False(t, keys[0].LastUsedAt.IsZero())
+
+	assert.NotNil(t, acc.RevokeAPIKey(uid+1, keys[0].KeyID))
+	assert.Nil(t, acc.RevokeAPIKey(uid, keys[0].KeyID))
+
+	_, _, err = acc.Who(key)
+	assert.NotNil(t, err)
+}
+
+func testAccountLifecycle(t *testing.T, newStorage NewStorage) {
+	acc, stg := newTestAccount(t, newStorage, &account.Config{
+		RefreshTokenExpiresAfter: time.Hour,
+	})
+
+	uid, err := acc.Register("user1", "pass1")
+	assert.Nil(t, err)
+
+	state, err := acc.GetAccountState(uid)
+	assert.Nil(t, err)
+	assert.EqualValues(t, account.AccountStateActive, state)
+
+	result, err := acc.LoginEx("user1", "pass1")
+	assert.Nil(t, err)
+
+	apiKey, _, err := acc.CreateAPIKey(uid, "ci", nil, 0)
+	assert.Nil(t, err)
+
+	assert.Nil(t, acc.Disable(uid))
+
+	_, _, err = acc.Who(result.Token)
+	assert.NotNil(t, err)
+
+	_, _, err = acc.Who(apiKey)
+	assert.ErrorIs(t, err, account.ErrAccountInactive)
+
+	_, err = acc.Refresh(result.RefreshToken)
+	assert.NotNil(t, err)
+
+	_, err = acc.LoginEx("user1", "pass1")
+	assert.ErrorIs(t, err, account.ErrAccountInactive)
+
+	assert.Nil(t, acc.Enable(uid))
+
+	result, err = acc.LoginEx("user1", "pass1")
+	assert.Nil(t, err)
+
+	// tokens left by a state change which didn't revoke the sessions
+	assert.Nil(t, stg.SetAccountState(uid, account.AccountStateDisabled))
+
+	_, _, err = acc.Who(result.Token)
+	assert.ErrorIs(t, err, account.ErrAccountInactive)
+
+	assert.Nil(t, stg.SetAccountState(uid, account.AccountStateActive))
+
+	_, _, err = acc.Who(result.Token)
+	assert.Nil(t, err)
+
+	assert.Nil(t, acc.SoftDelete(uid))
+
+	users, err := acc.ListUsers(0, 0)
+	assert.Nil(t, err)
+	assert.Empty(t, users)
+
+	assert.ErrorIs(t, acc.Enable(uid), commerr.ErrNotFound)
+
+	_, err = acc.Register("user1", "pass2")
+	assert.NotNil(t, err)
+
+	assert.Nil(t, acc.Restore(uid))
+	assert.ErrorIs(t, acc.Restore(uid), commerr.ErrInvalidArgument)
+
+	users, err = acc.ListUsers(0, 0)
+	assert.Nil(t, err)
+	assert.Len(t, users, 1)
+
+	assert.Nil(t, acc.SetPropertyDataByUserID(uid, map[string]string{"k": "v"}))
+
+	_, token, err := acc.Login("user1", "pass1")
+	assert.Nil(t, err)
+
+	assert.Nil(t, acc.Purge(uid))
+
+	_, _, err = acc.Who(token)
+	assert.NotNil(t, err)
+
+	_, _, err = acc.Who(apiKey)
+	assert.NotNil(t, err)
+
+	_, _, err = acc.GetAccount(uid)
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+
+	var d map[string]string
+
+	assert.ErrorIs(t, acc.GetPropertyDataByUserID(uid, &d), commerr.ErrNotFound)
+	assert.Nil(t, d)
+
+	f, err := acc.HasAccount()
+	assert.Nil(t, err)
+	assert.False(t, f)
+
+	uid2, err := acc.Register("user1", "pass2")
+	assert.Nil(t, err)
+	assert.NotEqual(t, uid, uid2)
+
+	acc2, _ := newTestAccount(t, newStorage, &account.Config{
+		RegisterPendingVerification: true,
+	})
+
+	uid, err = acc2.Register("user1", "pass1")
+	assert.Nil(t, err)
+
+	_, _, err = acc2.Login("user1", "pass1")
+	assert.ErrorIs(t, err, account.ErrAccountInactive)
+
+	assert.Nil(t, acc2.Enable(uid))
+
+	_, _, err = acc2.Login("user1", "pass1")
+	assert.Nil(t, err)
+}
+
+type testNotifier struct {
+	notifications []*account.Notification
+}
+
+func (n *testNotifier) Notify(notification *account.Notification) error {
+	n.notifications = append(n.notifications, notification)
+
+	return nil
+}
+
+func testPasswordReset(t *testing.T, newStorage NewStorage) {
+	notifier := &testNotifier{}
+
+	acc, _ := newTestAccount(t, newStorage, &account.Config{
+		Notifier:                       notifier,
+		RevokeSessionsOnPasswordChange: true,
+	})
+
+	_, err := acc.Register("user1", "pass1")
+	assert.Nil(t, err)
+
+	_, err = acc.RequestPasswordReset("user2")
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+
+	_, oldToken, err := acc.Login("user1", "pass1")
+	assert.Nil(t, err)
+
+	token1, err := acc.RequestPasswordReset("user1")
+	assert.Nil(t, err)
+
+	token2, err := acc.RequestPasswordReset("user1")
+	assert.Nil(t, err)
+
+	assert.Len(t, notifier.notifications, 2)
+	assert.EqualValues(t, token1, notifier.notifications[0].Token)
+	assert.EqualValues(t, account.OneTimeTokenPurposePasswordReset, notifier.notifications[0].Purpose)
+
+	assert.NotNil(t, acc.CompletePasswordReset("x"+token1, "pass2"))
+	assert.Nil(t, acc.CompletePasswordReset(token1, "pass2"))
+	assert.NotNil(t, acc.CompletePasswordReset(token1, "pass3"))
+	// other reset tokens are invalidated
+	assert.NotNil(t, acc.CompletePasswordReset(token2, "pass3"))
+
+	_, _, err = acc.Who(oldToken)
+	assert.NotNil(t, err)
+
+	_, _, err = acc.Login("user1", "pass1")
+	assert.NotNil(t, err)
+
+	_, _, err = acc.Login("user1", "pass2")
+	assert.Nil(t, err)
+}
+
+func testContactVerification(t *testing.T, newStorage NewStorage) {
+	notifier := &testNotifier{}
+
+	acc, _ := newTestAccount(t, newStorage, &account.Config{
+		Notifier:                    notifier,
+		RegisterPendingVerification: true,
+	})
+
+	uid, err := acc.Register("user1", "pass1")
+	assert.Nil(t, err)
+
+	token1, err := acc.RequestContactVerification(uid, "a@example.com")
+	assert.Nil(t, err)
+	assert.EqualValues(t, "a@example.com", notifier.notifications[0].Contact)
+
+	// the password reset token can't verify contact
+	resetToken, err := acc.RequestPasswordReset("user1")
+	assert.Nil(t, err)
+
+	_, err = acc.CompleteContactVerification(resetToken)
+	assert.NotNil(t, err)
+
+	token2, err := acc.RequestContactVerification(uid, "b@example.com")
+	assert.Nil(t, err)
+
+	// contact changed
+	_, err = acc.CompleteContactVerification(token1)
+	assert.NotNil(t, err)
+
+	_, _, err = acc.Login("user1", "pass1")
+	assert.ErrorIs(t, err, account.ErrAccountInactive)
+
+	uid2, err := acc.CompleteContactVerification(token2)
+	assert.Nil(t, err)
+	assert.EqualValues(t, uid, uid2)
+
+	contact, verified, err := acc.GetContact(uid)
+	assert.Nil(t, err)
+	assert.EqualValues(t, "b@example.com", contact)
+	assert.True(t, verified)
+
+	_, _, err = acc.Login("user1", "pass1")
+	assert.Nil(t, err)
+}
+
+func queryAllUsers(t *testing.T, acc account.Account, query account.UserQuery) (names []string) {
+	for pages := 0; pages < 100; pages++ {
+		page, err := acc.QueryUsers(&query)
+		assert.Nil(t, err)
+
+		for _, user := range page.Users {
+			names = append(names, user.UserName)
+		}
+
+		if page.NextCursor == "" {
+			return
+		}
+
+		query.Cursor = page.NextCursor
+	}
+
+	t.Fatal("too many pages")
+
+	return
+}
+
+func testQueryUsers(t *testing.T, newStorage NewStorage) {
+	acc, _ := newTestAccount(t, newStorage, nil)
+
+	var uids []uint64
+
+	for idx := 0; idx < 10; idx++ {
+		uid, err := acc.Register(fmt.Sprintf("user%02d", idx), "pass")
+		assert.Nil(t, err)
+
+		uids = append(uids, uid)
+	}
+
+	_, err := acc.Register("admin", "pass")
+	assert.Nil(t, err)
+
+	all := queryAllUsers(t, acc, account.UserQuery{Limit: 3})
+	assert.Len(t, all, 11)
+
+	names := queryAllUsers(t, acc, account.UserQuery{SortBy: account.UserSortByName, Limit: 4})
+	assert.EqualValues(t, []string{"admin", "user00", "user01", "user02", "user03", "user04",
+		"user05", "user06", "user07", "user08", "user09"}, names)
+
+	names = queryAllUsers(t, acc, account.UserQuery{SortBy: account.UserSortByName, Desc: true, NamePrefix: "user", Limit: 3})
+	assert.EqualValues(t, []string{"user09", "user08", "user07", "user06", "user05",
+		"user04", "user03", "user02", "user01", "user00"}, names)
+
+	names = queryAllUsers(t, acc, account.UserQuery{NameContains: "er0", Limit: 2})
+	assert.Len(t, names, 10)
+
+	assert.Nil(t, acc.SetRole(&account.Role{Name: "ops"}))
+	assert.Nil(t, acc.AssignRole(uids[1], "ops"))
+	assert.Nil(t, acc.AssignRole(uids[7], "ops"))
+
+	names = queryAllUsers(t, acc, account.UserQuery{Role: "ops", SortBy: account.UserSortByName, Limit: 1})
+	assert.EqualValues(t, []string{"user01", "user07"}, names)
+
+	names = queryAllUsers(t, acc, account.UserQuery{Role: "ops", Desc: true, Limit: 1})
+	assert.EqualValues(t, []string{"user07", "user01"}, names)
+
+	names = queryAllUsers(t, acc, account.UserQuery{Role: "ops", NamePrefix: "user0", Limit: 3})
+	assert.EqualValues(t, []string{"user01", "user07"}, names)
+
+	assert.Nil(t, acc.SoftDelete(uids[2]))
+	assert.Nil(t, acc.Disable(uids[3]))
+
+	names = queryAllUsers(t, acc, account.UserQuery{SortBy: account.UserSortByName, NamePrefix: "user", Limit: 5})
+	assert.Len(t, names, 9)
+	assert.NotContains(t, names, "user02")
+
+	names = queryAllUsers(t, acc, account.UserQuery{State: account.AccountStateDeleted})
+	assert.EqualValues(t, []string{"user02"}, names)
+
+	names = queryAllUsers(t, acc, account.UserQuery{State: account.AccountStateDisabled, SortBy: account.UserSortByName})
+	assert.EqualValues(t, []string{"user03"}, names)
+
+	assert.Nil(t, acc.RenameAccountName(uids[0], "zed"))
+
+	names = queryAllUsers(t, acc, account.UserQuery{SortBy: account.UserSortByName, Desc: true, Limit: 2})
+	assert.EqualValues(t, "zed", names[0])
+	assert.NotContains(t, names, "user00")
+
+	// the role indexes follow renames, unassignments, states and purges
+	assert.Nil(t, acc.AssignRole(uids[2], "ops"))
+	assert.Nil(t, acc.RenameAccountName(uids[7], "ops07"))
+
+	names = queryAllUsers(t, acc, account.UserQuery{Role: "ops", SortBy: account.UserSortByName, Limit: 1})
+	assert.EqualValues(t, []string{"ops07", "user01"}, names)
+
+	names = queryAllUsers(t, acc, account.UserQuery{Role: "ops", State: account.AccountStateDeleted, Limit: 1})
+	assert.EqualValues(t, []string{"user02"}, names)
+
+	assert.Nil(t, acc.UnassignRole(uids[1], "ops"))
+	assert.Nil(t, acc.Purge(uids[2]))
+
+	names = queryAllUsers(t, acc, account.UserQuery{Role: "ops", SortBy: account.UserSortByName, Desc: true, Limit: 1})
+	assert.EqualValues(t, []string{"ops07"}, names)
+
+	names = queryAllUsers(t, acc, account.UserQuery{Role: "ops", State: account.AccountStateDeleted, Limit: 1})
+	assert.Len(t, names, 0)
+
+	assert.Nil(t, acc.DelRole("ops"))
+
+	names = queryAllUsers(t, acc, account.UserQuery{Role: "ops", Limit: 1})
+	assert.Len(t, names, 0)
+
+	page, err := acc.QueryUsers(&account.UserQuery{SortBy: account.UserSortByName, NamePrefix: "user0", Limit: 1})
+	assert.Nil(t, err)
+	assert.EqualValues(t, "user01", page.Users[0].UserName)
+	assert.EqualValues(t, account.AccountStateActive, page.Users[0].State)
+
+	_, err = acc.QueryUsers(&account.UserQuery{SortBy: "bad"})
+	assert.ErrorIs(t, err, commerr.ErrInvalidArgument)
+
+	_, err = acc.QueryUsers(&account.UserQuery{Cursor: "!!"})
+	assert.ErrorIs(t, err, commerr.ErrInvalidArgument)
+}
+
+type testProfile struct {
+	Nickname string `json:"nickname"`
+	Counter  int    `json:"counter"`
+}
+
+func testPropertyNamespace(t *testing.T, newStorage NewStorage) {
+	acc, stg := newTestAccount(t, newStorage, nil)
+
+	uid, err := acc.Register("user1", "pass1")
+	assert.Nil(t, err)
+
+	profile, version, err := account.GetProperty[testProfile](acc, uid, "profile")
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0, version)
+	assert.EqualValues(t, testProfile{}, profile)
+
+	profile, version, err = account.UpdateProperty(acc, uid, "profile", func(v *testProfile) error {
+		v.Nickname = "nick"
+
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, version)
+	assert.EqualValues(t, "nick", profile.Nickname)
+
+	var wg sync.WaitGroup
+
+	for idx := 0; idx < 4; idx++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < 25; i++ {
+				_, _, e := account.UpdateProperty(acc, uid, "profile", func(v *testProfile) error {
+					v.Counter++
+
+					return nil
+				})
+				assert.Nil(t, e)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	profile, version, err = account.GetProperty[testProfile](acc, uid, "profile")
+	assert.Nil(t, err)
+	assert.EqualValues(t, 101, version)
+	assert.EqualValues(t, testProfile{Nickname: "nick", Counter: 100}, profile)
+
+	// other namespaces are independent
+	version, err = acc.UpdatePropertyData(uid, "settings", func(data []byte, version uint64) ([]byte, error) {
+		assert.Nil(t, data)
+		assert.EqualValues(t, 0, version)
+
+		return []byte(`{"theme":"dark"}`), nil
+	})
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, version)
+
+	_, err = stg.SetPropertyNamespace(uid, "settings", 0, []byte(`{}`))
+	assert.ErrorIs(t, err, account.ErrPropertyVersionConflict)
+
+	_, err = acc.UpdatePropertyData(uid, "settings", func([]byte, uint64) ([]byte, error) {
+		return nil, commerr.ErrAborted
+	})
+	assert.ErrorIs(t, err, commerr.ErrAborted)
+
+	data, version, err := acc.GetPropertyNamespace(uid, "settings")
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, version)
+	assert.EqualValues(t, `{"theme":"dark"}`, string(data))
+
+	_, err = acc.UpdatePropertyData(uid+1, "settings", func([]byte, uint64) ([]byte, error) {
+		return []byte(`{}`), nil
+	})
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+
+	assert.Nil(t, acc.Purge(uid))
+
+	_, version, err = acc.GetPropertyNamespace(uid, "settings")
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0, version)
+}
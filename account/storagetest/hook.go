@@ -0,0 +1,171 @@
+// nolint
+package storagetest
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sgostarter/i/commerr"
+	"github.com/sgostarter/libcomponents/account"
+	"github.com/stretchr/testify/assert"
+)
+
+func testHooks(t *testing.T, newStorage NewStorage) {
+	acc, stg := newTestAccount(t, newStorage, nil)
+
+	var (
+		lock   sync.Mutex
+		events []*account.HookEvent
+	)
+
+	record := func(event *account.HookEvent) error {
+		lock.Lock()
+		defer lock.Unlock()
+
+		events = append(events, event)
+
+		return nil
+	}
+
+	popEvents := func() (es []*account.HookEvent) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		es, events = events, nil
+
+		return
+	}
+
+	errProvision := errors.New("provision failed")
+
+	acc.OnRegistered(func(event *account.HookEvent) error {
+		if event.AccountName == "bad" {
+			return errProvision
+		}
+
+		return nil
+	})
+
+	for _, on := range []func(handler account.HookHandler, options ...account.HookOption){
+		acc.OnRegistered, acc.OnLogin, acc.OnPasswordChanged, acc.OnRenamed, acc.OnPurged,
+	} {
+		on(record)
+	}
+
+	// a failed sync handler rolls back the registration
+	_, err := acc.Register("bad", "pass1")
+	assert.ErrorIs(t, err, errProvision)
+	assert.Empty(t, popEvents())
+
+	_, _, err = stg.FindAccount("bad")
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+
+	uid, err := acc.Register("user1", "pass1")
+	assert.Nil(t, err)
+
+	_, _, err = acc.Login("user1", "pass2")
+	assert.ErrorIs(t, err, commerr.ErrPermissionDenied)
+
+	result, err := acc.LoginEx("user1", "pass1")
+	assert.Nil(t, err)
+
+	assert.Nil(t, acc.ChangePassword(uid, "pass2"))
+	assert.Nil(t, acc.RenameAccountName(uid, "user1"))
+	assert.Nil(t, acc.RenameAccountName(uid, "user2"))
+	assert.Nil(t, acc.Purge(uid))
+
+	es := popEvents()
+	if assert.Len(t, es, 5) {
+		assert.EqualValues(t, account.HookEventRegistered, es[0].Type)
+		assert.EqualValues(t, "user1", es[0].AccountName)
+
+		assert.EqualValues(t, account.HookEventLogin, es[1].Type)
+		assert.EqualValues(t, result.SessionID, es[1].SessionID)
+
+		assert.EqualValues(t, account.HookEventPasswordChanged, es[2].Type)
+
+		assert.EqualValues(t, account.HookEventRenamed, es[3].Type)
+		assert.EqualValues(t, "user1", es[3].OldAccountName)
+		assert.EqualValues(t, "user2", es[3].AccountName)
+
+		assert.EqualValues(t, account.HookEventPurged, es[4].Type)
+
+		for _, e := range es {
+			assert.EqualValues(t, uid, e.UID)
+			assert.False(t, e.Time.IsZero())
+		}
+	}
+
+	// async handlers are retried until they succeed
+	delivered := make(chan *account.HookEvent, 1)
+	attempts := 0
+
+	acc.OnRegistered(func(event *account.HookEvent) error {
+		attempts++
+		if attempts < 3 {
+			return errProvision
+		}
+
+		delivered <- event
+
+		return nil
+	}, account.AsyncHookOption(), account.RetryHookOption(3, time.Millisecond*10))
+
+	uid, err = acc.Register("user3", "pass3")
+	assert.Nil(t, err)
+
+	select {
+	case event := <-delivered:
+		assert.EqualValues(t, uid, event.UID)
+		assert.EqualValues(t, 3, attempts)
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "async hook isn't delivered")
+	}
+
+	// async handlers don't run when the registration is rolled back
+	_, err = acc.Register("bad", "pass1")
+	assert.ErrorIs(t, err, errProvision)
+
+	select {
+	case <-delivered:
+		assert.Fail(t, "async hook of rolled back registration")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// Close delivers the queued events, the later ones are dropped
+	acc2, _ := newTestAccount(t, newStorage, nil)
+
+	var logins int32
+
+	acc2.OnLogin(func(event *account.HookEvent) error {
+		time.Sleep(time.Millisecond * 10)
+		atomic.AddInt32(&logins, 1)
+
+		return nil
+	}, account.AsyncHookOption())
+
+	_, err = acc2.Register("user1", "pass1")
+	assert.Nil(t, err)
+
+	for idx := 0; idx < 3; idx++ {
+		_, _, err = acc2.Login("user1", "pass1")
+		assert.Nil(t, err)
+	}
+
+	acc2.Close()
+	assert.EqualValues(t, 3, atomic.LoadInt32(&logins))
+
+	_, _, err = acc2.Login("user1", "pass1")
+	assert.Nil(t, err)
+
+	time.Sleep(time.Millisecond * 50)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&logins))
+
+	acc2.Close()
+
+	// idle async hooks are closed at once
+	acc.Close()
+}
@@ -0,0 +1,331 @@
+// nolint
+package storagetest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sgostarter/i/commerr"
+	"github.com/sgostarter/libcomponents/account"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeIdentityProvider signs ID tokens and serves its JWKS in process.
+type fakeIdentityProvider struct {
+	t      *testing.T
+	issuer string
+	keySet *account.KeySet
+	server *httptest.Server
+}
+
+func newFakeIdentityProvider(t *testing.T, keyID string) *fakeIdentityProvider {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	ks, err := account.NewKeySet(&account.SigningKey{
+		KeyID:      keyID,
+		Method:     jwt.SigningMethodES256,
+		PrivateKey: key,
+	})
+	assert.Nil(t, err)
+
+	p := &fakeIdentityProvider{
+		t:      t,
+		keySet: ks,
+	}
+
+	p.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d, e := p.keySet.JWKS()
+		if e != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(d)
+	}))
+	p.issuer = p.server.URL
+
+	t.Cleanup(p.server.Close)
+
+	return p
+}
+
+func (p *fakeIdentityProvider) provider(name, clientID string) *account.IdentityProvider {
+	return &account.IdentityProvider{
+		Name:     name,
+		Issuer:   p.issuer,
+		ClientID: clientID,
+		JWKSURL:  p.server.URL + "/jwks",
+	}
+}
+
+// idToken signs a token for subject to clientID, claims override the defaults and nil removes one.
+func (p *fakeIdentityProvider) idToken(clientID, subject string, claims jwt.MapClaims) string {
+	mapClaims := jwt.MapClaims{
+		"iss": p.issuer,
+		"aud": clientID,
+		"sub": subject,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+
+	for k, v := range claims {
+		if v == nil {
+			delete(mapClaims, k)
+
+			continue
+		}
+
+		mapClaims[k] = v
+	}
+
+	token, err := p.keySet.Sign(mapClaims)
+	assert.Nil(p.t, err)
+
+	return token
+}
+
+func testIdentityLogin(t *testing.T, newStorage NewStorage) {
+	fake := newFakeIdentityProvider(t, "k1")
+	other := newFakeIdentityProvider(t, "k1")
+
+	provisioned := fake.provider("fake", "client1")
+	provisioned.AutoProvision = true
+	provisioned.AccountNameClaim = "preferred_username"
+
+	static := &account.IdentityProvider{
+		Name:     "static",
+		Issuer:   other.issuer,
+		ClientID: "client2",
+		KeySet:   other.keySet,
+	}
+
+	acc, stg := newTestAccount(t, newStorage, &account.Config{
+		IdentityProviders: []*account.IdentityProvider{provisioned, static},
+	})
+	assert.NotNil(t, acc)
+
+	// the identity is linked before the account is announced
+	var registeredIdentities []*account.Identity
+
+	acc.OnRegistered(func(event *account.HookEvent) error {
+		identities, err := stg.ListIdentities(event.UID)
+		assert.Nil(t, err)
+
+		registeredIdentities = append(registeredIdentities, identities...)
+
+		return nil
+	})
+
+	// first login provisions an account named by the claim
+	result, err := acc.LoginWithIdentity("fake", fake.idToken("client1", "sub1", jwt.MapClaims{"preferred_username": "alice"}))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, result.Token)
+
+	uid, accountName, err := acc.Who(result.Token)
+	assert.Nil(t, err)
+	assert.Equal(t, result.UID, uid)
+	assert.Equal(t, "alice", accountName)
+
+	identities, err := acc.ListIdentities(uid)
+	assert.Nil(t, err)
+	assert.Len(t, identities, 1)
+	assert.Equal(t, "fake", identities[0].Provider)
+	assert.Equal(t, "sub1", identities[0].Subject)
+	assert.Equal(t, uid, identities[0].UID)
+	assert.Len(t, registeredIdentities, 1)
+
+	result, err = acc.LoginWithIdentity("fake", fake.idToken("client1", "sub1", nil))
+	assert.Nil(t, err)
+	assert.Equal(t, uid, result.UID)
+
+	// the provisioned account has no usable password
+	_, _, err = acc.Login("alice", "")
+	assert.ErrorIs(t, err, commerr.ErrPermissionDenied)
+
+	// without the claim the account is named by provider and subject
+	result, err = acc.LoginWithIdentity("fake", fake.idToken("client1", "sub2", nil))
+	assert.Nil(t, err)
+
+	_, accountName, err = acc.Who(result.Token)
+	assert.Nil(t, err)
+	assert.Equal(t, "fake:sub2", accountName)
+
+	// invalid tokens
+	for _, c := range []struct {
+		provider string
+		token    string
+		err      error
+	}{
+		{"fake", fake.idToken("client2", "sub1", nil), commerr.ErrUnauthenticated},
+		{"fake", fake.idToken("client1", "sub1", jwt.MapClaims{"iss": "https://other"}), commerr.ErrUnauthenticated},
+		{"fake", fake.idToken("client1", "sub1", jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}), commerr.ErrUnauthenticated},
+		{"fake", fake.idToken("client1", "sub1", jwt.MapClaims{"exp": nil}), commerr.ErrUnauthenticated},
+		{"fake", fake.idToken("client1", "", nil), commerr.ErrUnauthenticated},
+		{"fake", other.idToken("client1", "sub1", jwt.MapClaims{"iss": fake.issuer}), commerr.ErrUnauthenticated},
+		{"fake", "not a token", commerr.ErrUnauthenticated},
+		{"unknown", fake.idToken("client1", "sub1", nil), commerr.ErrInvalidArgument},
+	} {
+		_, err = acc.LoginWithIdentity(c.provider, c.token)
+		assert.ErrorIs(t, err, c.err, c.token)
+	}
+
+	// nonce
+	_, err = acc.LoginWithIdentity("fake", fake.idToken("client1", "sub1", jwt.MapClaims{"nonce": "n1"}),
+		account.NonceLoginOption("n2"))
+	assert.ErrorIs(t, err, commerr.ErrUnauthenticated)
+
+	_, err = acc.LoginWithIdentity("fake", fake.idToken("client1", "sub1", nil), account.NonceLoginOption("n1"))
+	assert.ErrorIs(t, err, commerr.ErrUnauthenticated)
+
+	result, err = acc.LoginWithIdentity("fake", fake.idToken("client1", "sub1", jwt.MapClaims{"nonce": "n1"}),
+		account.NonceLoginOption("n1"))
+	assert.Nil(t, err)
+	assert.Equal(t, uid, result.UID)
+
+	// provisioning never takes over an existing account by name
+	bobUID, err := acc.Register("bob", "pass1")
+	assert.Nil(t, err)
+
+	_, err = acc.LoginWithIdentity("fake", fake.idToken("client1", "sub3", jwt.MapClaims{"preferred_username": "bob"}))
+	assert.ErrorIs(t, err, commerr.ErrAlreadyExists)
+
+	_, err = stg.FindIdentity("fake", "sub3")
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+
+	// link and unlink without provisioning
+	_, err = acc.LoginWithIdentity("static", other.idToken("client2", "sub1", nil))
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+
+	identity, err := acc.LinkIdentity(bobUID, "static", other.idToken("client2", "sub1", nil))
+	assert.Nil(t, err)
+	assert.Equal(t, "static", identity.Provider)
+	assert.Equal(t, "sub1", identity.Subject)
+
+	_, err = acc.LinkIdentity(uid, "static", other.idToken("client2", "sub1", nil))
+	assert.ErrorIs(t, err, commerr.ErrAlreadyExists)
+
+	_, err = acc.LinkIdentity(bobUID, "static", fake.idToken("client2", "sub1", nil))
+	assert.ErrorIs(t, err, commerr.ErrUnauthenticated)
+
+	result, err = acc.LoginWithIdentity("static", other.idToken("client2", "sub1", nil))
+	assert.Nil(t, err)
+	assert.Equal(t, bobUID, result.UID)
+
+	assert.ErrorIs(t, acc.UnlinkIdentity(uid, "static", "sub1"), commerr.ErrNotFound)
+	assert.Nil(t, acc.UnlinkIdentity(bobUID, "static", "sub1"))
+
+	_, err = acc.LoginWithIdentity("static", other.idToken("client2", "sub1", nil))
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+
+	// inactive accounts can't login, purged ones lose their identities
+	assert.Nil(t, acc.Disable(uid))
+
+	_, err = acc.LoginWithIdentity("fake", fake.idToken("client1", "sub1", nil))
+	assert.ErrorIs(t, err, account.ErrAccountInactive)
+
+	assert.Nil(t, acc.Purge(uid))
+
+	_, err = stg.FindIdentity("fake", "sub1")
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+
+	result, err = acc.LoginWithIdentity("fake", fake.idToken("client1", "sub1", jwt.MapClaims{"preferred_username": "alice"}))
+	assert.Nil(t, err)
+	assert.NotEqual(t, uid, result.UID)
+}
+
+func testIdentityProviderConfig(t *testing.T, newStorage NewStorage) {
+	fake := newFakeIdentityProvider(t, "k1")
+
+	for _, providers := range [][]*account.IdentityProvider{
+		{{Name: "fake", Issuer: fake.issuer, ClientID: "client1"}},
+		{{Name: "", Issuer: fake.issuer, ClientID: "client1", KeySet: fake.keySet}},
+		{fake.provider("fake", "client1"), fake.provider("fake", "client2")},
+	} {
+		acc, _ := newTestAccount(t, newStorage, &account.Config{
+			IdentityProviders: providers,
+		})
+		assert.Nil(t, acc)
+	}
+}
+
+func testStorageIdentity(t *testing.T, stg account.Storage) {
+	uid1, err := stg.AddAccount("u1", "p1")
+	assert.Nil(t, err)
+
+	uid2, err := stg.AddAccount("u2", "p2")
+	assert.Nil(t, err)
+
+	now := time.Now()
+
+	assert.ErrorIs(t, stg.LinkIdentity(&account.Identity{Provider: "p1", Subject: "s1", UID: uid1 + uid2, LinkedAt: now}),
+		commerr.ErrNotFound)
+
+	assert.Nil(t, stg.LinkIdentity(&account.Identity{Provider: "p1", Subject: "s1", UID: uid1, LinkedAt: now}))
+	assert.Nil(t, stg.LinkIdentity(&account.Identity{Provider: "p2", Subject: "s1", UID: uid1, LinkedAt: now.Add(time.Second)}))
+	assert.Nil(t, stg.LinkIdentity(&account.Identity{Provider: "p1", Subject: "s2", UID: uid2, LinkedAt: now}))
+
+	assert.ErrorIs(t, stg.LinkIdentity(&account.Identity{Provider: "p1", Subject: "s1", UID: uid1, LinkedAt: now}),
+		commerr.ErrAlreadyExists)
+	assert.ErrorIs(t, stg.LinkIdentity(&account.Identity{Provider: "p1", Subject: "s1", UID: uid2, LinkedAt: now}),
+		commerr.ErrAlreadyExists)
+
+	identity, err := stg.FindIdentity("p1", "s1")
+	assert.Nil(t, err)
+	assert.Equal(t, uid1, identity.UID)
+	assert.Equal(t, "p1", identity.Provider)
+	assert.Equal(t, "s1", identity.Subject)
+	assert.WithinDuration(t, now, identity.LinkedAt, time.Millisecond)
+
+	_, err = stg.FindIdentity("p1", "s3")
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+
+	_, err = stg.FindIdentity("p3", "s1")
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+
+	identities, err := stg.ListIdentities(uid1)
+	assert.Nil(t, err)
+	assert.Len(t, identities, 2)
+	assert.Equal(t, "p1", identities[0].Provider)
+	assert.Equal(t, "p2", identities[1].Provider)
+
+	identities, err = stg.ListIdentities(uid1 + uid2)
+	assert.Nil(t, err)
+	assert.Len(t, identities, 0)
+
+	assert.ErrorIs(t, stg.UnlinkIdentity(uid2, "p1", "s1"), commerr.ErrNotFound)
+	assert.ErrorIs(t, stg.UnlinkIdentity(uid1, "p1", "s3"), commerr.ErrNotFound)
+	assert.Nil(t, stg.UnlinkIdentity(uid1, "p1", "s1"))
+	assert.ErrorIs(t, stg.UnlinkIdentity(uid1, "p1", "s1"), commerr.ErrNotFound)
+
+	_, err = stg.FindIdentity("p1", "s1")
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+
+	// the subject can be linked again
+	assert.Nil(t, stg.LinkIdentity(&account.Identity{Provider: "p1", Subject: "s1", UID: uid2, LinkedAt: now}))
+
+	identities, err = stg.ListIdentities(uid2)
+	assert.Nil(t, err)
+	assert.Len(t, identities, 2)
+
+	// DelAccount removes linked identities
+	assert.Nil(t, stg.DelAccount(uid2))
+
+	_, err = stg.FindIdentity("p1", "s1")
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+
+	_, err = stg.FindIdentity("p1", "s2")
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+
+	identities, err = stg.ListIdentities(uid1)
+	assert.Nil(t, err)
+	assert.Len(t, identities, 1)
+}
@@ -0,0 +1,119 @@
+// nolint
+package storagetest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sgostarter/i/commerr"
+	"github.com/sgostarter/libcomponents/account"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBreachedPasswordChecker fails for the passwords mapped to false.
+type fakeBreachedPasswordChecker map[string]bool
+
+var errBreachedCheckerDown = errors.New("breached checker down")
+
+func (checker fakeBreachedPasswordChecker) Breached(password string) (bool, error) {
+	breached, ok := checker[password]
+	if ok && !breached {
+		return false, errBreachedCheckerDown
+	}
+
+	return breached, nil
+}
+
+func testPasswordPolicy(t *testing.T, newStorage NewStorage) {
+	acc, _ := newTestAccount(t, newStorage, &account.Config{
+		PasswordPolicy: &account.PasswordPolicy{
+			MinLength:           8,
+			RequireLower:        true,
+			RequireUpper:        true,
+			RequireDigit:        true,
+			DisallowAccountName: true,
+			HistorySize:         3,
+			BreachedChecker:     fakeBreachedPasswordChecker{"Password1": true, "Unchecked1": false},
+		},
+	})
+
+	var policyErr *account.PasswordPolicyError
+
+	_, err := acc.Register("alice", "")
+	assert.ErrorIs(t, err, account.ErrPasswordPolicy)
+	assert.ErrorIs(t, err, commerr.ErrInvalidArgument)
+
+	if assert.True(t, errors.As(err, &policyErr)) {
+		assert.EqualValues(t, []account.PasswordRule{account.PasswordRuleMinLength, account.PasswordRuleLower,
+			account.PasswordRuleUpper, account.PasswordRuleDigit}, policyErr.Violations)
+	}
+
+	_, err = acc.Register("alice", "xAlice123")
+	if assert.True(t, errors.As(err, &policyErr)) {
+		assert.EqualValues(t, []account.PasswordRule{account.PasswordRuleAccountName}, policyErr.Violations)
+	}
+
+	_, err = acc.Register("alice", "Password1")
+	if assert.True(t, errors.As(err, &policyErr)) {
+		assert.EqualValues(t, []account.PasswordRule{account.PasswordRuleBreached}, policyErr.Violations)
+	}
+
+	// the breached checker fails closed
+	_, err = acc.Register("alice", "Unchecked1")
+	assert.ErrorIs(t, err, errBreachedCheckerDown)
+
+	f, err := acc.HasAccount()
+	assert.Nil(t, err)
+	assert.False(t, f)
+
+	uid, err := acc.Register("alice", "Secret001")
+	assert.Nil(t, err)
+
+	err = acc.ChangePassword(uid, "weak")
+	assert.ErrorIs(t, err, account.ErrPasswordPolicy)
+
+	// the current and the 2 previous passwords can't be reused
+	err = acc.ChangePassword(uid, "Secret001")
+	if assert.True(t, errors.As(err, &policyErr)) {
+		assert.EqualValues(t, []account.PasswordRule{account.PasswordRuleHistory}, policyErr.Violations)
+	}
+
+	assert.Nil(t, acc.ChangePassword(uid, "Secret002"))
+	assert.Nil(t, acc.ChangePassword(uid, "Secret003"))
+
+	for _, password := range []string{"Secret001", "Secret002", "Secret003"} {
+		assert.ErrorIs(t, acc.ChangePassword(uid, password), account.ErrPasswordPolicy, password)
+		assert.ErrorIs(t, acc.ResetPassword("alice", password), account.ErrPasswordPolicy, password)
+	}
+
+	assert.Nil(t, acc.ChangePassword(uid, "Secret004"))
+	assert.Nil(t, acc.ChangePassword(uid, "Secret001"))
+
+	_, _, err = acc.Login("alice", "Secret001")
+	assert.Nil(t, err)
+}
+
+func testStoragePasswordHistory(t *testing.T, stg account.Storage) {
+	_, err := stg.GetPasswordHistory(100)
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+
+	assert.ErrorIs(t, stg.SetPasswordHistory(100, []string{"p1"}), commerr.ErrNotFound)
+
+	uid, err := stg.AddAccountEx(100, "u1", "p1", nil)
+	assert.Nil(t, err)
+
+	hashedPasswords, err := stg.GetPasswordHistory(uid)
+	assert.Nil(t, err)
+	assert.Empty(t, hashedPasswords)
+
+	assert.Nil(t, stg.SetPasswordHistory(uid, []string{"p2", "p1"}))
+
+	hashedPasswords, err = stg.GetPasswordHistory(uid)
+	assert.Nil(t, err)
+	assert.EqualValues(t, []string{"p2", "p1"}, hashedPasswords)
+
+	assert.Nil(t, stg.DelAccount(uid))
+
+	_, err = stg.GetPasswordHistory(uid)
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+}
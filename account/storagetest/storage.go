@@ -0,0 +1,384 @@
+// nolint
+package storagetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sgostarter/i/commerr"
+	"github.com/sgostarter/libcomponents/account"
+	"github.com/stretchr/testify/assert"
+)
+
+// RunStorageTests runs the conformance tests of account.Storage against the storages of newStorage,
+// they pin down the behaviours that account.Account relies on, every account.Storage implementation should pass them.
+func RunStorageTests(t *testing.T, newStorage NewStorage) {
+	for _, c := range []struct {
+		name string
+		fn   func(t *testing.T, stg account.Storage)
+	}{
+		{"Uniqueness", testStorageUniqueness},
+		{"Rename", testStorageRename},
+		{"MissingAccount", testStorageMissingAccount},
+		{"TokenExpiry", testStorageTokenExpiry},
+		{"TokenRenew", testStorageTokenRenew},
+		{"PropertyData", testStoragePropertyData},
+		{"ListUsersRange", testStorageListUsersRange},
+		{"Identity", testStorageIdentity},
+		{"PasswordHistory", testStoragePasswordHistory},
+		{"TOTP", testStorageTOTP},
+	} {
+		c := c
+
+		t.Run(c.name, func(t *testing.T) {
+			c.fn(t, newStorage(t))
+		})
+	}
+}
+
+func testStorageUniqueness(t *testing.T, stg account.Storage) {
+	f, err := stg.HasAccount()
+	assert.Nil(t, err)
+	assert.False(t, f)
+
+	uid, err := stg.AddAccountEx(100, "u1", "p1", []byte("d1"))
+	assert.Nil(t, err)
+	assert.EqualValues(t, 100, uid)
+
+	f, err = stg.HasAccount()
+	assert.Nil(t, err)
+	assert.True(t, f)
+
+	_, err = stg.AddAccountEx(101, "u1", "p2", nil)
+	assert.ErrorIs(t, err, commerr.ErrAlreadyExists)
+
+	_, err = stg.AddAccountEx(100, "u2", "p2", nil)
+	assert.ErrorIs(t, err, commerr.ErrAlreadyExists)
+
+	// the failed adds leave nothing behind
+	_, _, err = stg.FindAccount("u2")
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+
+	_, _, err = stg.GetAccount(101)
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+
+	uid, hashedPassword, err := stg.FindAccount("u1")
+	assert.Nil(t, err)
+	assert.EqualValues(t, 100, uid)
+	assert.Equal(t, "p1", hashedPassword)
+
+	data, err := stg.GetAccountData(100)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("d1"), data)
+
+	uid, err = stg.AddAccount("u2", "p2")
+	assert.Nil(t, err)
+	assert.NotEqualValues(t, 0, uid)
+	assert.NotEqualValues(t, 100, uid)
+
+	uid2, exists, err := stg.GetIDFromAccountName("u2")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, uid, uid2)
+
+	_, exists, err = stg.GetIDFromAccountName("u3")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+}
+
+func testStorageRename(t *testing.T, stg account.Storage) {
+	uid1, err := stg.AddAccount("u1", "p1")
+	assert.Nil(t, err)
+
+	uid2, err := stg.AddAccount("u2", "p2")
+	assert.Nil(t, err)
+
+	// onto an existing name
+	err = stg.RenameAccountName(uid1, "u2")
+	assert.ErrorIs(t, err, commerr.ErrAlreadyExists)
+
+	name, _, err := stg.GetAccount(uid1)
+	assert.Nil(t, err)
+	assert.Equal(t, "u1", name)
+
+	uid, _, err := stg.FindAccount("u2")
+	assert.Nil(t, err)
+	assert.Equal(t, uid2, uid)
+
+	// onto its own name
+	err = stg.RenameAccountName(uid1, "u1")
+	assert.Nil(t, err)
+
+	uid, _, err = stg.FindAccount("u1")
+	assert.Nil(t, err)
+	assert.Equal(t, uid1, uid)
+
+	// of a missing account
+	err = stg.RenameAccountName(uid1+uid2, "u3")
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+
+	_, exists, err := stg.GetIDFromAccountName("u3")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	err = stg.RenameAccountName(uid1, "u3")
+	assert.Nil(t, err)
+
+	name, hashedPassword, err := stg.GetAccount(uid1)
+	assert.Nil(t, err)
+	assert.Equal(t, "u3", name)
+	assert.Equal(t, "p1", hashedPassword)
+
+	uid, hashedPassword, err = stg.FindAccount("u3")
+	assert.Nil(t, err)
+	assert.Equal(t, uid1, uid)
+	assert.Equal(t, "p1", hashedPassword)
+
+	_, _, err = stg.FindAccount("u1")
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+
+	// the old name is free again
+	uid, err = stg.AddAccount("u1", "p4")
+	assert.Nil(t, err)
+	assert.NotEqual(t, uid1, uid)
+}
+
+func testStorageMissingAccount(t *testing.T, stg account.Storage) {
+	uid, err := stg.AddAccount("u1", "p1")
+	assert.Nil(t, err)
+
+	missingUID := uid + 1
+
+	_, _, err = stg.GetAccount(missingUID)
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+
+	_, err = stg.GetAccountData(missingUID)
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+
+	_, _, err = stg.FindAccount("u2")
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+
+	assert.ErrorIs(t, stg.SetHashedPassword(missingUID, "p2"), commerr.ErrNotFound)
+	assert.ErrorIs(t, stg.SetAdvanceConfig(missingUID, &account.AdvanceConfig{TokenExpiresAfter: time.Hour}),
+		commerr.ErrNotFound)
+	assert.ErrorIs(t, stg.SetTOTP(missingUID, &account.TOTPInfo{Secret: "s"}), commerr.ErrNotFound)
+	assert.ErrorIs(t, stg.SetContact(missingUID, "c", false), commerr.ErrNotFound)
+
+	_, err = stg.GetAdvanceConfig(missingUID)
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+
+	_, err = stg.GetAccountState(missingUID)
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+
+	// an existing account without advance config
+	cfg, err := stg.GetAdvanceConfig(uid)
+	assert.Nil(t, err)
+	assert.Nil(t, cfg)
+
+	assert.Nil(t, stg.SetAdvanceConfig(uid, &account.AdvanceConfig{TokenExpiresAfter: time.Hour}))
+
+	cfg, err = stg.GetAdvanceConfig(uid)
+	assert.Nil(t, err)
+	assert.NotNil(t, cfg)
+	assert.Equal(t, time.Hour, cfg.TokenExpiresAfter)
+
+	assert.Nil(t, stg.SetHashedPassword(uid, "p2"))
+
+	_, hashedPassword, err := stg.GetAccount(uid)
+	assert.Nil(t, err)
+	assert.Equal(t, "p2", hashedPassword)
+}
+
+func testStorageTokenExpiry(t *testing.T, stg account.Storage) {
+	uid, err := stg.AddAccount("u1", "p1")
+	assert.Nil(t, err)
+
+	assert.Nil(t, stg.AddToken("t1", uid, time.Now().Add(time.Hour)))
+	assert.ErrorIs(t, stg.AddToken("t1", uid, time.Now().Add(time.Hour)), commerr.ErrAlreadyExists)
+
+	// an expired token may be dropped or kept, but never reported
+	assert.Nil(t, stg.AddToken("t2", uid, time.Now().Add(-time.Second)))
+
+	exists, err := stg.TokenExists("t1", 0)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	exists, err = stg.TokenExists("t2", 0)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	exists, err = stg.TokenExists("t2", time.Hour)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	exists, err = stg.TokenExists("t3", 0)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	tokens, err := stg.ListTokens(uid)
+	assert.Nil(t, err)
+	assert.Len(t, tokens, 1)
+	assert.Contains(t, tokens, "t1")
+
+	assert.ErrorIs(t, stg.DelToken("t3"), commerr.ErrNotFound)
+	assert.Nil(t, stg.DelToken("t1"))
+	assert.ErrorIs(t, stg.DelToken("t1"), commerr.ErrNotFound)
+
+	exists, err = stg.TokenExists("t1", 0)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	tokens, err = stg.ListTokens(uid)
+	assert.Nil(t, err)
+	assert.Len(t, tokens, 0)
+}
+
+func testStorageTokenRenew(t *testing.T, stg account.Storage) {
+	uid, err := stg.AddAccount("u1", "p1")
+	assert.Nil(t, err)
+
+	expiredAt := time.Now().Add(time.Minute)
+
+	assert.Nil(t, stg.AddTokenEx("t1", uid, expiredAt, &account.Session{SessionID: "s1", DeviceName: "d1"}))
+
+	exists, err := stg.TokenExists("t1", 0)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	tokens, err := stg.ListTokens(uid)
+	assert.Nil(t, err)
+	assert.Contains(t, tokens, "t1")
+	assert.WithinDuration(t, expiredAt, tokens["t1"].ExpiredAt, 2*time.Second)
+
+	// renewal pushes the expiry out by the renew duration and keeps the session
+	exists, err = stg.TokenExists("t1", time.Hour)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	tokens, err = stg.ListTokens(uid)
+	assert.Nil(t, err)
+	assert.Contains(t, tokens, "t1")
+	assert.WithinDuration(t, expiredAt.Add(time.Hour), tokens["t1"].ExpiredAt, 2*time.Second)
+	assert.Equal(t, "s1", tokens["t1"].SessionID)
+	assert.Equal(t, "d1", tokens["t1"].DeviceName)
+}
+
+func testStoragePropertyData(t *testing.T, stg account.Storage) {
+	type property struct {
+		Name  string
+		Count int
+	}
+
+	uid, err := stg.AddAccount("u1", "p1")
+	assert.Nil(t, err)
+
+	var p property
+
+	// data never set is not found and d is left unchanged
+	assert.ErrorIs(t, stg.GetPropertyDataByUserID(uid, &p), commerr.ErrNotFound)
+	assert.ErrorIs(t, stg.GetPropertyData("u1", &p), commerr.ErrNotFound)
+	assert.ErrorIs(t, stg.GetPropertyData("u2", &p), commerr.ErrNotFound)
+	assert.ErrorIs(t, stg.SetPropertyData("u2", &property{Name: "x"}), commerr.ErrNotFound)
+	assert.ErrorIs(t, stg.SetPropertyDataByUserID(uid+1, &property{Name: "x"}), commerr.ErrNotFound)
+	assert.ErrorIs(t, stg.GetPropertyDataByUserID(uid+1, &p), commerr.ErrNotFound)
+	assert.Equal(t, property{}, p)
+
+	assert.Nil(t, stg.SetPropertyDataByUserID(uid, &property{Name: "x", Count: 1}))
+	assert.Nil(t, stg.GetPropertyData("u1", &p))
+	assert.Equal(t, property{Name: "x", Count: 1}, p)
+
+	assert.Nil(t, stg.SetPropertyData("u1", &property{Name: "y", Count: 2}))
+
+	p = property{}
+	assert.Nil(t, stg.GetPropertyDataByUserID(uid, &p))
+	assert.Equal(t, property{Name: "y", Count: 2}, p)
+
+	// property data follows the account across renames
+	assert.Nil(t, stg.RenameAccountName(uid, "u2"))
+
+	p = property{}
+	assert.Nil(t, stg.GetPropertyData("u2", &p))
+	assert.Equal(t, property{Name: "y", Count: 2}, p)
+	assert.ErrorIs(t, stg.GetPropertyData("u1", &p), commerr.ErrNotFound)
+}
+
+func testStorageListUsersRange(t *testing.T, stg account.Storage) {
+	users, err := stg.ListUsers(0, 0)
+	assert.Nil(t, err)
+	assert.Len(t, users, 0)
+
+	uid1, err := stg.AddAccount("u1", "p1")
+	assert.Nil(t, err)
+
+	uid2, err := stg.AddAccount("u2", "p2")
+	assert.Nil(t, err)
+
+	// create_at is in seconds, wait for the next one to split the users into two ranges
+	time.Sleep(time.Until(time.Unix(time.Now().Unix()+1, 0)))
+
+	uid3, err := stg.AddAccount("u3", "p3")
+	assert.Nil(t, err)
+
+	users, err = stg.ListUsers(0, 0)
+	assert.Nil(t, err)
+	assert.Len(t, users, 3)
+
+	createAts := make(map[uint64]int64)
+
+	for idx, user := range users {
+		createAts[user.UserID] = user.CreateAt
+
+		if idx > 0 {
+			assert.LessOrEqual(t, users[idx-1].CreateAt, user.CreateAt)
+		}
+	}
+
+	assert.Equal(t, createAts[uid1], createAts[uid2])
+	assert.Less(t, createAts[uid2], createAts[uid3])
+	assert.Equal(t, uid3, users[2].UserID)
+	assert.Equal(t, "u3", users[2].UserName)
+
+	userIDs := func(users []account.User) (uids []uint64) {
+		for _, user := range users {
+			uids = append(uids, user.UserID)
+		}
+
+		return
+	}
+
+	// both bounds are inclusive, 0 means unbounded
+	users, err = stg.ListUsers(createAts[uid1], 0)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []uint64{uid1, uid2, uid3}, userIDs(users))
+
+	users, err = stg.ListUsers(0, createAts[uid1])
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []uint64{uid1, uid2}, userIDs(users))
+
+	users, err = stg.ListUsers(createAts[uid3], createAts[uid3])
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []uint64{uid3}, userIDs(users))
+
+	users, err = stg.ListUsers(createAts[uid1], createAts[uid3])
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []uint64{uid1, uid2, uid3}, userIDs(users))
+
+	users, err = stg.ListUsers(createAts[uid3]+1, 0)
+	assert.Nil(t, err)
+	assert.Len(t, users, 0)
+
+	users, err = stg.ListUsers(0, createAts[uid1]-1)
+	assert.Nil(t, err)
+	assert.Len(t, users, 0)
+
+	// deleted accounts are not listed
+	assert.Nil(t, stg.DelAccount(uid2))
+
+	users, err = stg.ListUsers(0, 0)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []uint64{uid1, uid3}, userIDs(users))
+
+	f, err := stg.HasAccount()
+	assert.Nil(t, err)
+	assert.True(t, f)
+}
@@ -0,0 +1,352 @@
+// nolint
+package storagetest
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sgostarter/i/commerr"
+	"github.com/sgostarter/libcomponents/account"
+	"github.com/stretchr/testify/assert"
+)
+
+// NewTenantStorageFactory returns a factory of empty tenant storages, it's called once by each test.
+type NewTenantStorageFactory func(t *testing.T) account.TenantStorageFactory
+
+// RunTenantTests runs the tests of account.TenantAccounts against the storages of newFactory.
+func RunTenantTests(t *testing.T, newFactory NewTenantStorageFactory) {
+	for _, c := range []struct {
+		name string
+		fn   func(t *testing.T, newFactory NewTenantStorageFactory)
+	}{
+		{"TenantIsolation", testTenantIsolation},
+		{"TenantStatelessWho", testTenantStatelessWho},
+		{"TenantID", testTenantID},
+		{"TenantRegistration", testTenantRegistration},
+		{"MaxTenants", testMaxTenants},
+		{"TenantRevocationFeed", testTenantRevocationFeed},
+	} {
+		c := c
+
+		t.Run(c.name, func(t *testing.T) {
+			c.fn(t, newFactory)
+		})
+	}
+}
+
+func newTestTenantAccounts(t *testing.T, newFactory NewTenantStorageFactory, cfg *account.Config,
+	options ...account.TenantOption) (account.TenantAccounts, account.TenantStorageFactory) {
+	factory := newFactory(t)
+
+	if cfg == nil {
+		cfg = &account.Config{}
+	}
+
+	cfg.TokenSignKey = "abcd"
+	cfg.PasswordHashIterCount = 16
+
+	tenants := account.NewTenantAccounts(factory, cfg, nil, options...)
+	assert.NotNil(t, tenants)
+
+	return tenants, factory
+}
+
+func testTenantIsolation(t *testing.T, newFactory NewTenantStorageFactory) {
+	tenants, factory := newTestTenantAccounts(t, newFactory, nil)
+
+	acc1, err := tenants.Account("t1")
+	assert.Nil(t, err)
+
+	acc1x, err := tenants.Account("t1")
+	assert.Nil(t, err)
+	assert.Equal(t, acc1, acc1x)
+
+	acc2, err := tenants.Account("t2")
+	assert.Nil(t, err)
+
+	// names are unique per tenant
+	uid1, err := acc1.Register("alice", "pass1")
+	assert.Nil(t, err)
+
+	_, err = acc1.Register("alice", "pass3")
+	assert.ErrorIs(t, err, commerr.ErrAlreadyExists)
+
+	uid2, err := acc2.Register("alice", "pass2")
+	assert.Nil(t, err)
+	assert.NotEqual(t, uid1, uid2)
+
+	_, _, err = acc1.Login("alice", "pass2")
+	assert.ErrorIs(t, err, commerr.ErrPermissionDenied)
+
+	uid, token1, err := acc1.Login("alice", "pass1")
+	assert.Nil(t, err)
+	assert.Equal(t, uid1, uid)
+
+	uid, token2, err := acc2.Login("alice", "pass2")
+	assert.Nil(t, err)
+	assert.Equal(t, uid2, uid)
+
+	users, err := acc1.ListUsers(0, 0)
+	assert.Nil(t, err)
+	assert.Len(t, users, 1)
+	assert.Equal(t, uid1, users[0].UserID)
+
+	// tokens only work in their tenant
+	uid, accountName, err := acc1.Who(token1)
+	assert.Nil(t, err)
+	assert.Equal(t, uid1, uid)
+	assert.Equal(t, "alice", accountName)
+
+	_, _, err = acc2.Who(token1)
+	assert.ErrorIs(t, err, commerr.ErrUnauthenticated)
+
+	_, _, err = acc1.Who(token2)
+	assert.ErrorIs(t, err, commerr.ErrUnauthenticated)
+
+	tenantID, uid, accountName, err := tenants.Who(token2)
+	assert.Nil(t, err)
+	assert.Equal(t, "t2", tenantID)
+	assert.Equal(t, uid2, uid)
+	assert.Equal(t, "alice", accountName)
+
+	// the storage of a tenant keeps its accounts
+	stg1, err := factory("t1")
+	assert.Nil(t, err)
+
+	uid, _, err = stg1.FindAccount("alice")
+	assert.Nil(t, err)
+	assert.Equal(t, uid1, uid)
+
+	_, _, err = stg1.GetAccount(uid2)
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+
+	// tokens without tenant are rejected by tenants and the other way round
+	stg0, err := factory("t0")
+	assert.Nil(t, err)
+
+	acc0 := account.NewAccount(stg0, &account.Config{TokenSignKey: "abcd", PasswordHashIterCount: 16}, nil)
+
+	_, err = acc0.Register("alice", "pass0")
+	assert.Nil(t, err)
+
+	_, token0, err := acc0.Login("alice", "pass0")
+	assert.Nil(t, err)
+
+	_, _, _, err = tenants.Who(token0)
+	assert.ErrorIs(t, err, commerr.ErrUnauthenticated)
+
+	_, _, err = acc0.Who(token1)
+	assert.ErrorIs(t, err, commerr.ErrUnauthenticated)
+
+	_, _, _, err = tenants.Who("not a token")
+	assert.ErrorIs(t, err, commerr.ErrUnauthenticated)
+
+	assert.Nil(t, acc1.Logout(token1))
+
+	_, _, _, err = tenants.Who(token1)
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+}
+
+func testTenantStatelessWho(t *testing.T, newFactory NewTenantStorageFactory) {
+	tenants, _ := newTestTenantAccounts(t, newFactory, &account.Config{
+		StatelessWho:           true,
+		TokenClaimExpiresAfter: time.Hour,
+	})
+
+	acc1, err := tenants.Account("t1")
+	assert.Nil(t, err)
+
+	acc2, err := tenants.Account("t2")
+	assert.Nil(t, err)
+
+	uid1, err := acc1.Register("alice", "pass1")
+	assert.Nil(t, err)
+
+	_, token1, err := acc1.Login("alice", "pass1")
+	assert.Nil(t, err)
+
+	uid, _, err := acc1.Who(token1)
+	assert.Nil(t, err)
+	assert.Equal(t, uid1, uid)
+
+	// the signature is valid for every tenant, the tid claim isn't
+	_, _, err = acc2.Who(token1)
+	assert.ErrorIs(t, err, commerr.ErrUnauthenticated)
+
+	tenantID, uid, _, err := tenants.Who(token1)
+	assert.Nil(t, err)
+	assert.Equal(t, "t1", tenantID)
+	assert.Equal(t, uid1, uid)
+}
+
+func testTenantID(t *testing.T, newFactory NewTenantStorageFactory) {
+	tenants, factory := newTestTenantAccounts(t, newFactory, nil)
+
+	for _, tenantID := range []string{"", "../t1", "t/1", "t 1", "t:1", string(make([]byte, 65))} {
+		_, err := tenants.Account(tenantID)
+		assert.ErrorIs(t, err, commerr.ErrInvalidArgument, tenantID)
+
+		_, err = factory(tenantID)
+		assert.ErrorIs(t, err, commerr.ErrInvalidArgument, tenantID)
+	}
+
+	for _, tenantID := range []string{"t1", "T-1", "tenant_1"} {
+		_, err := tenants.Account(tenantID)
+		assert.Nil(t, err, tenantID)
+	}
+
+	stg, err := factory("t1")
+	assert.Nil(t, err)
+
+	assert.Nil(t, account.NewAccount(stg, &account.Config{TenantID: "../t1"}, nil))
+}
+
+func testTenantRegistration(t *testing.T, newFactory NewTenantStorageFactory) {
+	tenants, factory := newTestTenantAccounts(t, newFactory, nil)
+
+	acc1, err := tenants.Account("t1")
+	assert.Nil(t, err)
+
+	uid1, err := acc1.Register("alice", "pass1")
+	assert.Nil(t, err)
+
+	_, token1, err := acc1.Login("alice", "pass1")
+	assert.Nil(t, err)
+
+	// another instance on the same storages only knows t1 once it's registered or allowed
+	factoryCalls := 0
+	countingFactory := func(tenantID string) (account.Storage, error) {
+		factoryCalls++
+
+		return factory(tenantID)
+	}
+
+	newTenants := func(options ...account.TenantOption) account.TenantAccounts {
+		return account.NewTenantAccounts(countingFactory, &account.Config{
+			TokenSignKey:          "abcd",
+			PasswordHashIterCount: 16,
+		}, nil, options...)
+	}
+
+	tenants2 := newTenants()
+
+	_, _, _, err = tenants2.Who(token1)
+	assert.ErrorIs(t, err, commerr.ErrUnauthenticated)
+	assert.Equal(t, 0, factoryCalls)
+
+	_, err = tenants2.Account("t1")
+	assert.Nil(t, err)
+
+	tenantID, uid, _, err := tenants2.Who(token1)
+	assert.Nil(t, err)
+	assert.Equal(t, "t1", tenantID)
+	assert.Equal(t, uid1, uid)
+
+	tenants3 := newTenants(account.AllowedTenantsOption("t1"))
+
+	tenantID, uid, _, err = tenants3.Who(token1)
+	assert.Nil(t, err)
+	assert.Equal(t, "t1", tenantID)
+	assert.Equal(t, uid1, uid)
+
+	tenants4 := newTenants(account.AllowedTenantsOption("t2"))
+
+	_, _, _, err = tenants4.Who(token1)
+	assert.ErrorIs(t, err, commerr.ErrUnauthenticated)
+	assert.Equal(t, 2, factoryCalls)
+}
+
+func testMaxTenants(t *testing.T, newFactory NewTenantStorageFactory) {
+	tenants, _ := newTestTenantAccounts(t, newFactory, nil, account.MaxTenantsOption(2))
+
+	_, err := tenants.Account("t1")
+	assert.Nil(t, err)
+
+	_, err = tenants.Account("t2")
+	assert.Nil(t, err)
+
+	_, err = tenants.Account("t3")
+	assert.ErrorIs(t, err, commerr.ErrResourceExhausted)
+
+	_, err = tenants.Account("t1")
+	assert.Nil(t, err)
+}
+
+type testRevocationFeed struct {
+	lock     sync.Mutex
+	handlers []func(revocation *account.Revocation)
+}
+
+func (feed *testRevocationFeed) Publish(revocation *account.Revocation) error {
+	feed.lock.Lock()
+	handlers := feed.handlers
+	feed.lock.Unlock()
+
+	for _, handler := range handlers {
+		handler(revocation)
+	}
+
+	return nil
+}
+
+func (feed *testRevocationFeed) Subscribe(handler func(revocation *account.Revocation)) error {
+	feed.lock.Lock()
+	defer feed.lock.Unlock()
+
+	feed.handlers = append(feed.handlers, handler)
+
+	return nil
+}
+
+func testTenantRevocationFeed(t *testing.T, newFactory NewTenantStorageFactory) {
+	feed := &testRevocationFeed{}
+
+	tenants, _ := newTestTenantAccounts(t, newFactory, &account.Config{
+		StatelessWho:           true,
+		TokenClaimExpiresAfter: time.Hour,
+		RevocationFeed:         feed,
+	})
+
+	tokens := make(map[string]string)
+
+	for _, tenantID := range []string{"t1", "t2"} {
+		acc, err := tenants.Account(tenantID)
+		assert.Nil(t, err)
+
+		_, err = acc.Register("alice", "pass1")
+		assert.Nil(t, err)
+
+		_, tokens[tenantID], err = acc.Login("alice", "pass1")
+		assert.Nil(t, err)
+	}
+
+	// the feed is subscribed once for all tenants
+	assert.Len(t, feed.handlers, 1)
+
+	// revocations published by other instances reach the Account of the token
+	claims := &account.Claims{}
+
+	_, _, err := jwt.NewParser().ParseUnverified(tokens["t2"], claims)
+	assert.Nil(t, err)
+
+	assert.Nil(t, feed.Publish(&account.Revocation{
+		TokenID:   claims.ID,
+		ExpiredAt: claims.ExpiresAt.Time,
+	}))
+
+	_, _, _, err = tenants.Who(tokens["t2"])
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+
+	tenantID, _, _, err := tenants.Who(tokens["t1"])
+	assert.Nil(t, err)
+	assert.Equal(t, "t1", tenantID)
+
+	acc1, err := tenants.Account("t1")
+	assert.Nil(t, err)
+	assert.Nil(t, acc1.Logout(tokens["t1"]))
+
+	_, _, _, err = tenants.Who(tokens["t1"])
+	assert.ErrorIs(t, err, commerr.ErrNotFound)
+}
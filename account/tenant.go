@@ -0,0 +1,256 @@
+package account
+
+import (
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sgostarter/i/commerr"
+	"github.com/sgostarter/i/l"
+)
+
+const (
+	maxTenantIDLength = 64
+	defaultMaxTenants = 1024
+)
+
+// TenantStorageFactory returns the storage of a tenant, storages of different tenants must not share account names.
+type TenantStorageFactory func(tenantID string) (Storage, error)
+
+// TenantAccounts hosts an Account for each tenant, account names are unique per tenant and tokens carry the
+// tenant in their tid claim, so an Account rejects tokens of other tenants.
+type TenantAccounts interface {
+	// Account returns the Account of the tenant, it's created by the first call which registers the tenant for Who
+	Account(tenantID string) (Account, error)
+	// Who resolves the token by the Account of its tid claim, the tenant must be registered by Account or allowed
+	// by AllowedTenantsOption, otherwise the token is unauthenticated. API keys carry no tenant and must be resolved
+	// by the Account of their tenant
+	Who(token string) (tenantID string, uid uint64, accountName string, err error)
+	// Close closes the Accounts of all tenants
+	Close()
+}
+
+type TenantOptions struct {
+	allowedTenantIDs map[string]bool
+	maxTenants       int
+}
+
+type TenantOption func(o *TenantOptions)
+
+func tenantOptionNew(option ...TenantOption) *TenantOptions {
+	opts := &TenantOptions{
+		allowedTenantIDs: make(map[string]bool),
+		maxTenants:       defaultMaxTenants,
+	}
+
+	for _, o := range option {
+		o(opts)
+	}
+
+	return opts
+}
+
+// AllowedTenantsOption lets Who resolve the tokens of the tenants before Account is called for them
+func AllowedTenantsOption(tenantIDs ...string) TenantOption {
+	return func(o *TenantOptions) {
+		for _, tenantID := range tenantIDs {
+			o.allowedTenantIDs[tenantID] = true
+		}
+	}
+}
+
+// MaxTenantsOption caps the number of Accounts, Account fails with commerr.ErrResourceExhausted for new tenants
+// once it's reached. Accounts are never evicted as they keep the hooks. Default is 1024
+func MaxTenantsOption(maxTenants int) TenantOption {
+	return func(o *TenantOptions) {
+		if maxTenants > 0 {
+			o.maxTenants = maxTenants
+		}
+	}
+}
+
+// NewTenantAccounts shares cfg between tenants, each Account gets a copy with Config.TenantID set. The Accounts
+// share one revocation list, Config.RevocationFeed is subscribed once for all of them.
+func NewTenantAccounts(storageFactory TenantStorageFactory, cfg *Config, logger l.Wrapper,
+	options ...TenantOption) TenantAccounts {
+	if logger == nil {
+		logger = l.NewNopLoggerWrapper()
+	}
+
+	if storageFactory == nil {
+		logger.Error("no storage factory")
+
+		return nil
+	}
+
+	if cfg == nil {
+		logger.Error("no config")
+
+		return nil
+	}
+
+	impl := &tenantAccountsImpl{
+		logger:         logger.WithFields(l.StringField(l.ClsKey, "tenantAccountsImpl")),
+		storageFactory: storageFactory,
+		cfg:            cfg,
+		opts:           tenantOptionNew(options...),
+		revocations:    newRevocationList(),
+		accounts:       make(map[string]Account),
+	}
+
+	// jti and sid are random, so revocations of different tenants never collide
+	if cfg.RevocationFeed != nil {
+		if err := cfg.RevocationFeed.Subscribe(impl.revocations.add); err != nil {
+			logger.WithFields(l.ErrorField(err)).Error("subscribe revocation feed failed")
+
+			return nil
+		}
+	}
+
+	return impl
+}
+
+type tenantAccountsImpl struct {
+	logger         l.Wrapper
+	storageFactory TenantStorageFactory
+	cfg            *Config
+	opts           *TenantOptions
+	revocations    *revocationList
+
+	lock     sync.Mutex
+	accounts map[string]Account
+}
+
+func (impl *tenantAccountsImpl) Account(tenantID string) (acc Account, err error) {
+	if !ValidTenantID(tenantID) {
+		err = commerr.ErrInvalidArgument
+
+		return
+	}
+
+	impl.lock.Lock()
+	defer impl.lock.Unlock()
+
+	return impl.account(tenantID)
+}
+
+func (impl *tenantAccountsImpl) Who(token string) (tenantID string, uid uint64, accountName string, err error) {
+	tenantID, err = tokenTenantID(token)
+	if err != nil {
+		return
+	}
+
+	acc, err := impl.registeredAccount(tenantID)
+	if err != nil {
+		return
+	}
+
+	uid, accountName, err = acc.Who(token)
+
+	return
+}
+
+func (impl *tenantAccountsImpl) Close() {
+	impl.lock.Lock()
+	defer impl.lock.Unlock()
+
+	for _, acc := range impl.accounts {
+		acc.Close()
+	}
+}
+
+// ValidTenantID allows up to 64 letters, digits, '-' and '_', tenant ids are used in storage keys and paths.
+func ValidTenantID(tenantID string) bool {
+	if tenantID == "" || len(tenantID) > maxTenantIDLength {
+		return false
+	}
+
+	for _, c := range tenantID {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+
+	return true
+}
+
+//
+//
+//
+
+// registeredAccount doesn't create Accounts for tenants which are neither registered nor allowed, the tid claim
+// isn't verified yet.
+func (impl *tenantAccountsImpl) registeredAccount(tenantID string) (acc Account, err error) {
+	impl.lock.Lock()
+	defer impl.lock.Unlock()
+
+	acc, ok := impl.accounts[tenantID]
+	if ok {
+		return
+	}
+
+	if !impl.opts.allowedTenantIDs[tenantID] || !ValidTenantID(tenantID) {
+		err = commerr.ErrUnauthenticated
+
+		return
+	}
+
+	return impl.account(tenantID)
+}
+
+// account must be called with the lock held.
+func (impl *tenantAccountsImpl) account(tenantID string) (acc Account, err error) {
+	acc, ok := impl.accounts[tenantID]
+	if ok {
+		return
+	}
+
+	if len(impl.accounts) >= impl.opts.maxTenants {
+		err = commerr.ErrResourceExhausted
+
+		return
+	}
+
+	storage, err := impl.storageFactory(tenantID)
+	if err != nil {
+		return
+	}
+
+	cfg := *impl.cfg
+	cfg.TenantID = tenantID
+
+	acc = newAccount(storage, &cfg, impl.logger.WithFields(l.StringField("tenantID", tenantID)), impl.revocations)
+	if acc == nil {
+		err = commerr.ErrInternal
+
+		return
+	}
+
+	impl.accounts[tenantID] = acc
+
+	return
+}
+
+// tokenTenantID reads the tid claim without verifying the token, the Account of the tenant verifies it.
+func tokenTenantID(token string) (tenantID string, err error) {
+	tenantID, ok := unverifiedTenantID(token)
+	if !ok || tenantID == "" {
+		err = commerr.ErrUnauthenticated
+
+		return
+	}
+
+	return
+}
+
+func unverifiedTenantID(token string) (tenantID string, ok bool) {
+	claims := &Claims{}
+
+	if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err != nil {
+		return
+	}
+
+	tenantID = claims.TenantID
+	ok = true
+
+	return
+}
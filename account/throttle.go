@@ -0,0 +1,145 @@
+package account
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/sgostarter/i/l"
+)
+
+type LoginThrottleConfig struct {
+	// MaxFailures locks the account for LockoutDuration after this many failures, 0 means no lockout
+	MaxFailures       int           `yaml:"maxFailures" json:"maxFailures"`
+	SourceMaxFailures int           `yaml:"sourceMaxFailures" json:"sourceMaxFailures"`
+	LockoutDuration   time.Duration `yaml:"lockoutDuration" json:"lockoutDuration"`
+
+	// BaseDelay doubles on every failure before lockout, capped by MaxDelay
+	BaseDelay time.Duration `yaml:"baseDelay" json:"baseDelay"`
+	MaxDelay  time.Duration `yaml:"maxDelay" json:"maxDelay"`
+
+	// FailureWindow is how long failure counters live after the last failure
+	FailureWindow time.Duration `yaml:"failureWindow" json:"failureWindow"`
+}
+
+type LoginThrottledError struct {
+	RetryAfter time.Duration
+	Locked     bool
+}
+
+func (e *LoginThrottledError) Error() string {
+	if e.Locked {
+		return fmt.Sprintf("login locked, retry after %s", e.RetryAfter)
+	}
+
+	return fmt.Sprintf("login throttled, retry after %s", e.RetryAfter)
+}
+
+func (e *LoginThrottledError) Is(target error) bool {
+	return target == ErrLoginThrottled
+}
+
+func (cfg *LoginThrottleConfig) fix() {
+	if cfg.LockoutDuration <= 0 {
+		cfg.LockoutDuration = time.Minute * 15
+	}
+
+	if cfg.MaxDelay <= 0 {
+		cfg.MaxDelay = cfg.LockoutDuration
+	}
+
+	if cfg.FailureWindow <= 0 {
+		cfg.FailureWindow = cfg.LockoutDuration
+	}
+
+	if cfg.FailureWindow < cfg.LockoutDuration {
+		cfg.FailureWindow = cfg.LockoutDuration
+	}
+}
+
+func (cfg *LoginThrottleConfig) retryAfter(failures int64, lastFailedAt time.Time, maxFailures int) (err error) {
+	if failures <= 0 {
+		return
+	}
+
+	var until time.Time
+
+	locked := maxFailures > 0 && failures >= int64(maxFailures)
+
+	if locked {
+		until = lastFailedAt.Add(cfg.LockoutDuration)
+	} else if cfg.BaseDelay > 0 {
+		delay := cfg.MaxDelay
+
+		if failures < 32 {
+			if d := cfg.BaseDelay << (failures - 1); d > 0 && d < delay {
+				delay = d
+			}
+		}
+
+		until = lastFailedAt.Add(delay)
+	}
+
+	d := time.Until(until)
+	if d <= 0 {
+		return
+	}
+
+	err = &LoginThrottledError{
+		RetryAfter: d,
+		Locked:     locked,
+	}
+
+	return
+}
+
+func (impl *accountImpl) checkLoginThrottle(key string, maxFailures int) (err error) {
+	if impl.cfg.LoginThrottle == nil || key == "" {
+		return
+	}
+
+	failures, lastFailedAt, err := impl.storage.GetLoginFailure(key)
+	if err != nil {
+		return
+	}
+
+	return impl.cfg.LoginThrottle.retryAfter(failures, lastFailedAt, maxFailures)
+}
+
+func (impl *accountImpl) onLoginFailed(keys ...string) {
+	if impl.cfg.LoginThrottle == nil {
+		return
+	}
+
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+
+		if _, err := impl.storage.IncLoginFailure(key, impl.cfg.LoginThrottle.FailureWindow); err != nil {
+			impl.logger.WithFields(l.ErrorField(err), l.StringField("key", key)).Error("record login failure failed")
+		}
+	}
+}
+
+func (impl *accountImpl) onLoginSucceeded(uid uint64) {
+	if impl.cfg.LoginThrottle == nil {
+		return
+	}
+
+	if err := impl.storage.ResetLoginFailure(uidThrottleKey(uid)); err != nil {
+		impl.logger.WithFields(l.ErrorField(err), l.UInt64Field("uid", uid)).Error("reset login failure failed")
+	}
+}
+
+func uidThrottleKey(uid uint64) string {
+	return "uid:" + strconv.FormatUint(uid, 10)
+}
+
+func sourceThrottleKey(source string) string {
+	if source == "" {
+		return ""
+	}
+
+	return "src:" + source
+}
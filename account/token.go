@@ -1,52 +1,81 @@
 package account
 
 import (
-	"fmt"
+	"crypto/rand"
+	"encoding/base64"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"github.com/sgostarter/i/commerr"
-	"github.com/sgostarter/libeasygo/cuserror"
 )
 
 type Claims struct {
 	UID      uint64 `json:"uid"`
 	UserName string `json:"userName"`
+	Purpose  string `json:"purpose,omitempty"`
+	// SessionID lets stateless Who revoke every token of a session
+	SessionID string `json:"sid,omitempty"`
+	// Roles is set when Config.RolesInToken is on
+	Roles []string `json:"roles,omitempty"`
+	// TenantID is Config.TenantID
+	TenantID string `json:"tid,omitempty"`
 	jwt.RegisteredClaims
 }
 
 func (impl *accountImpl) tokenNew(uid uint64, userName string) (token string, err error) {
-	claims := Claims{
+	return impl.getKeySet().Sign(impl.newClaims(uid, userName, "", impl.cfg.TokenClaimExpiresAfter))
+}
+
+func (impl *accountImpl) newClaims(uid uint64, userName, purpose string, expiresIn time.Duration) *Claims {
+	claims := &Claims{
 		UID:      uid,
 		UserName: userName,
+		Purpose:  purpose,
+		TenantID: impl.cfg.TenantID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Issuer:    impl.cfg.Issuer,
+			Audience:  impl.cfg.Audience,
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
 		},
 	}
 
-	token, err = jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(impl.tokenKey)
+	if expiresIn > 0 {
+		claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(expiresIn))
+	}
 
-	return
+	return claims
 }
 
-func (impl *accountImpl) tokenCheck(tokenS string) (uid uint64, userName string, err error) {
-	var claims Claims
-
-	token, err := jwt.ParseWithClaims(tokenS, &claims, func(token *jwt.Token) (interface{}, error) {
-		// Don't forget to validate the alg is what you expect:
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, cuserror.NewWithErrorMsg(fmt.Sprintf("Unexpected signing method: %v", token.Header["alg"]))
-		}
+// getKeySet falls back to the HS256 key derived from Config.TokenSignKey.
+func (impl *accountImpl) getKeySet() *KeySet {
+	if impl.keySet != nil {
+		return impl.keySet
+	}
 
-		return impl.tokenKey, nil
-	})
+	return &KeySet{
+		signingKey: &SigningKey{
+			Method:     jwt.SigningMethodHS256,
+			PrivateKey: impl.tokenKey,
+		},
+		keys: map[string]*SigningKey{
+			"": {
+				Method:     jwt.SigningMethodHS256,
+				PrivateKey: impl.tokenKey,
+			},
+		},
+	}
+}
 
+func (impl *accountImpl) tokenCheck(tokenS string) (uid uint64, userName string, err error) {
+	claims, err := impl.tokenParse(tokenS)
 	if err != nil {
 		return
 	}
 
-	if !token.Valid {
+	if claims.Purpose != "" {
 		err = commerr.ErrUnauthenticated
 
 		return
@@ -57,3 +86,72 @@ func (impl *accountImpl) tokenCheck(tokenS string) (uid uint64, userName string,
 
 	return
 }
+
+// challengeNew signs a short-lived token which can only be used to finish a pending login step.
+func (impl *accountImpl) challengeNew(uid uint64, userName, purpose string, expiresIn time.Duration) (token string, err error) {
+	return impl.getKeySet().Sign(impl.newClaims(uid, userName, purpose, expiresIn))
+}
+
+func (impl *accountImpl) challengeCheck(tokenS, purpose string) (claims *Claims, err error) {
+	claims, err = impl.tokenParse(tokenS)
+	if err != nil {
+		return
+	}
+
+	if claims.Purpose != purpose || claims.ExpiresAt == nil || claims.ID == "" {
+		err = commerr.ErrUnauthenticated
+	}
+
+	return
+}
+
+func (impl *accountImpl) tokenParse(tokenS string) (claims *Claims, err error) {
+	claims = &Claims{}
+
+	var options []jwt.ParserOption
+
+	if impl.cfg.Issuer != "" {
+		options = append(options, jwt.WithIssuer(impl.cfg.Issuer))
+	}
+
+	err = impl.getKeySet().Parse(tokenS, claims, options...)
+	if err != nil {
+		return
+	}
+
+	if claims.TenantID != impl.cfg.TenantID || !matchAudience(claims.Audience, impl.cfg.Audience) {
+		err = commerr.ErrUnauthenticated
+	}
+
+	return
+}
+
+// matchAudience reports whether the token is for any of the configured audiences
+func matchAudience(tokenAudience jwt.ClaimStrings, audience []string) bool {
+	if len(audience) == 0 {
+		return true
+	}
+
+	for _, aud := range audience {
+		for _, tokenAud := range tokenAudience {
+			if aud == tokenAud {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func newRandomToken() (token string, err error) {
+	d := make([]byte, 32)
+
+	_, err = rand.Read(d)
+	if err != nil {
+		return
+	}
+
+	token = base64.RawURLEncoding.EncodeToString(d)
+
+	return
+}
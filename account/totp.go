@@ -0,0 +1,331 @@
+package account
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	// nolint: gosec
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sgostarter/i/commerr"
+)
+
+const (
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkewSteps     = 1
+	totpSecretLen     = 20
+	recoveryCodeCount = 10
+
+	totpChallengePurpose   = "totp"
+	totpChallengeExpiresIn = time.Minute * 5
+)
+
+type TOTPInfo struct {
+	Secret        string   `json:"secret" yaml:"secret"`
+	Confirmed     bool     `json:"confirmed" yaml:"confirmed"`
+	RecoveryCodes []string `json:"recoveryCodes,omitempty" yaml:"recoveryCodes,omitempty"` // sha256 hex
+	LastUsedStep  int64    `json:"lastUsedStep,omitempty" yaml:"lastUsedStep,omitempty"`
+	// UsedChallenges keeps the consumed challenge tokens until they expire, jti -> expired at (unix)
+	UsedChallenges map[string]int64 `json:"usedChallenges,omitempty" yaml:"usedChallenges,omitempty"`
+}
+
+func (impl *accountImpl) EnrollTOTP(uid uint64) (secret, uri string, err error) {
+	accountName, _, err := impl.storage.GetAccount(uid)
+	if err != nil {
+		return
+	}
+
+	info, err := impl.storage.GetTOTP(uid)
+	if err != nil {
+		return
+	}
+
+	if info != nil && info.Confirmed {
+		err = commerr.ErrAlreadyExists
+
+		return
+	}
+
+	d := make([]byte, totpSecretLen)
+
+	_, err = rand.Read(d)
+	if err != nil {
+		return
+	}
+
+	secret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(d)
+
+	err = impl.storage.SetTOTP(uid, &TOTPInfo{
+		Secret: secret,
+	})
+	if err != nil {
+		return
+	}
+
+	uri = totpURI(impl.cfg.TOTPIssuer, accountName, secret)
+
+	return
+}
+
+func (impl *accountImpl) ConfirmTOTP(uid uint64, code string) (recoveryCodes []string, err error) {
+	info, err := impl.storage.GetTOTP(uid)
+	if err != nil {
+		return
+	}
+
+	if info == nil {
+		err = commerr.ErrNotFound
+
+		return
+	}
+
+	if info.Confirmed {
+		err = commerr.ErrAlreadyExists
+
+		return
+	}
+
+	step, ok := totpVerify(info.Secret, code, info.LastUsedStep, time.Now())
+	if !ok {
+		err = commerr.ErrPermissionDenied
+
+		return
+	}
+
+	recoveryCodes, hashedRecoveryCodes, err := newRecoveryCodes()
+	if err != nil {
+		return
+	}
+
+	info.Confirmed = true
+	info.RecoveryCodes = hashedRecoveryCodes
+	info.LastUsedStep = step
+
+	err = impl.storage.SetTOTP(uid, info)
+
+	return
+}
+
+func (impl *accountImpl) DisableTOTP(uid uint64) error {
+	return impl.storage.SetTOTP(uid, nil)
+}
+
+func (impl *accountImpl) LoginVerifyTOTP(challenge, code string, options ...LoginOption) (result *LoginResult, err error) {
+	claims, err := impl.challengeCheck(challenge, totpChallengePurpose)
+	if err != nil {
+		return
+	}
+
+	uid, accountName := claims.UID, claims.UserName
+
+	defer func() {
+		impl.auditLogin(AuditActionLoginTOTP, uid, accountName, result, err, loginOptionNew(options...))
+	}()
+
+	uidKey := uidThrottleKey(uid)
+
+	var maxFailures int
+
+	if impl.cfg.LoginThrottle != nil {
+		maxFailures = impl.cfg.LoginThrottle.MaxFailures
+	}
+
+	err = impl.checkLoginThrottle(uidKey, maxFailures)
+	if err != nil {
+		return
+	}
+
+	err = impl.consumeTOTP(uid, uidKey, claims, code)
+	if err != nil {
+		return
+	}
+
+	impl.onLoginSucceeded(uid)
+
+	err = impl.checkAccountActive(uid)
+	if err != nil {
+		return
+	}
+
+	return impl.newLoginResult(uid, accountName, impl.cfg.RefreshTokenExpiresAfter > 0, loginOptionNew(options...).newSession())
+}
+
+//
+//
+//
+
+// consumeTOTP uses up the code and the challenge, the stored info is swapped only when nobody changed it since
+// it was read, so a code or a recovery code can't be used by concurrent logins twice.
+func (impl *accountImpl) consumeTOTP(uid uint64, uidKey string, claims *Claims, code string) (err error) {
+	oldInfo, err := impl.storage.GetTOTP(uid)
+	if err != nil {
+		return
+	}
+
+	if oldInfo == nil || !oldInfo.Confirmed {
+		err = commerr.ErrNotFound
+
+		return
+	}
+
+	now := time.Now()
+
+	if _, ok := oldInfo.UsedChallenges[claims.ID]; ok {
+		err = commerr.ErrUnauthenticated
+
+		return
+	}
+
+	info := *oldInfo
+	info.RecoveryCodes = append([]string(nil), oldInfo.RecoveryCodes...)
+
+	if step, ok := totpVerify(info.Secret, code, info.LastUsedStep, now); ok {
+		info.LastUsedStep = step
+	} else if idx := matchRecoveryCode(info.RecoveryCodes, code); idx >= 0 {
+		info.RecoveryCodes = append(info.RecoveryCodes[:idx], info.RecoveryCodes[idx+1:]...)
+	} else {
+		impl.onLoginFailed(uidKey)
+
+		err = commerr.ErrPermissionDenied
+
+		return
+	}
+
+	info.UsedChallenges = map[string]int64{
+		claims.ID: claims.ExpiresAt.Unix(),
+	}
+
+	for jti, expiredAt := range oldInfo.UsedChallenges {
+		if expiredAt >= now.Unix() {
+			info.UsedChallenges[jti] = expiredAt
+		}
+	}
+
+	err = impl.storage.CompareAndSetTOTP(uid, oldInfo, &info)
+	if errors.Is(err, commerr.ErrAborted) {
+		err = commerr.ErrUnauthenticated
+	}
+
+	return
+}
+
+func totpURI(issuer, accountName, secret string) string {
+	label := accountName
+	if issuer != "" {
+		label = issuer + ":" + accountName
+	}
+
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprintf("%d", totpDigits))
+	values.Set("period", fmt.Sprintf("%d", totpPeriod))
+
+	if issuer != "" {
+		values.Set("issuer", issuer)
+	}
+
+	return (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + label,
+		RawQuery: values.Encode(),
+	}).String()
+}
+
+func totpCode(secret string, step int64) (code string, err error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return
+	}
+
+	var msg [8]byte
+
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	h := hmac.New(sha1.New, key)
+	h.Write(msg[:])
+	sum := h.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	code = fmt.Sprintf("%0*d", totpDigits, n%1000000)
+
+	return
+}
+
+// totpVerify accepts codes of the adjacent steps which are newer than lastUsedStep.
+func totpVerify(secret, code string, lastUsedStep int64, now time.Time) (step int64, ok bool) {
+	if len(code) != totpDigits {
+		return
+	}
+
+	current := now.Unix() / totpPeriod
+
+	for s := current - totpSkewSteps; s <= current+totpSkewSteps; s++ {
+		if s <= lastUsedStep {
+			continue
+		}
+
+		expected, err := totpCode(secret, s)
+		if err != nil {
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return s, true
+		}
+	}
+
+	return
+}
+
+func newRecoveryCodes() (codes, hashedCodes []string, err error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	for idx := 0; idx < recoveryCodeCount; idx++ {
+		d := make([]byte, 6)
+
+		_, err = rand.Read(d)
+		if err != nil {
+			return
+		}
+
+		s := strings.ToLower(encoding.EncodeToString(d))
+		code := s[:5] + "-" + s[5:]
+
+		codes = append(codes, code)
+		hashedCodes = append(hashedCodes, hashRecoveryCode(code))
+	}
+
+	return
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+
+	return hex.EncodeToString(sum[:])
+}
+
+func matchRecoveryCode(hashedCodes []string, code string) int {
+	hashedCode := hashRecoveryCode(code)
+
+	for idx, c := range hashedCodes {
+		if subtle.ConstantTimeCompare([]byte(c), []byte(hashedCode)) == 1 {
+			return idx
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,40 @@
+// nolint
+package account
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 test vector, secret "12345678901234567890"
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+	code, err := totpCode(secret, 59/totpPeriod)
+	assert.Nil(t, err)
+	assert.EqualValues(t, "287082", code)
+
+	code, err = totpCode(secret, 1111111109/totpPeriod)
+	assert.Nil(t, err)
+	assert.EqualValues(t, "081804", code)
+
+	step, ok := totpVerify(secret, "081804", 0, time.Unix(1111111109+totpPeriod, 0))
+	assert.True(t, ok)
+	assert.EqualValues(t, 1111111109/totpPeriod, step)
+
+	_, ok = totpVerify(secret, "081804", step, time.Unix(1111111109, 0))
+	assert.False(t, ok)
+
+	_, ok = totpVerify(secret, "081804", 0, time.Unix(1111111109+totpPeriod*2, 0))
+	assert.False(t, ok)
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := totpURI("corp", "user1", "ABC")
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/corp:user1?"))
+	assert.Contains(t, uri, "secret=ABC")
+	assert.Contains(t, uri, "issuer=corp")
+}
@@ -0,0 +1,117 @@
+// nolint
+package wallet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+// utBackend builds the wallets and lockers of one implementation, those built by one utBackend work together.
+type utBackend struct {
+	newWallet func(keyPre string) Wallet
+	newLocker func(keyPre string) Locker
+
+	// foreignWallet and foreignLocker can't work with the ones of newWallet and newLocker
+	foreignWallet func(keyPre string) Wallet
+	foreignLocker func(keyPre string) Locker
+
+	// history and setHistory read and replace the raw history items of an account, oldest first
+	history    func(keyPre, account string) []string
+	setHistory func(keyPre, account string, rItems []string)
+
+	// wait lets the time pass for the expiration of the idempotency keys
+	wait func(d time.Duration)
+}
+
+func newMWFBackend(t *testing.T) *utBackend {
+	storage := NewMWFStorage("", nil)
+
+	return &utBackend{
+		newWallet: func(keyPre string) Wallet {
+			return NewMWFWallet(storage, keyPre)
+		},
+		newLocker: func(keyPre string) Locker {
+			return NewMWFLocker(storage, keyPre)
+		},
+		foreignWallet: func(keyPre string) Wallet {
+			return NewMWFWallet(NewMWFStorage("", nil), keyPre)
+		},
+		foreignLocker: func(keyPre string) Locker {
+			return NewMWFLocker(NewMWFStorage("", nil), keyPre)
+		},
+		history: func(keyPre, account string) (rItems []string) {
+			storage.read(func(d *mwfData) {
+				rItems = append(rItems, d.Lists[historyKey(keyPre, account)]...)
+			})
+
+			return
+		},
+		setHistory: func(keyPre, account string, rItems []string) {
+			assert.Nil(t, storage.change(func(d *mwfData) error {
+				d.Lists[historyKey(keyPre, account)] = rItems
+
+				return nil
+			}))
+		},
+		wait: time.Sleep,
+	}
+}
+
+func newRedisBackend(t *testing.T) *utBackend {
+	mr := miniredis.RunT(t)
+	redisCli := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+
+	return &utBackend{
+		newWallet: func(keyPre string) Wallet {
+			return NewRedisWallet(redisCli, keyPre)
+		},
+		newLocker: func(keyPre string) Locker {
+			return NewRedisLocker(redisCli, keyPre)
+		},
+		foreignWallet: func(keyPre string) Wallet {
+			return NewMWFWallet(NewMWFStorage("", nil), keyPre)
+		},
+		foreignLocker: func(keyPre string) Locker {
+			return NewMWFLocker(NewMWFStorage("", nil), keyPre)
+		},
+		history: func(keyPre, account string) []string {
+			rItems, err := redisCli.LRange(context.Background(), historyKey(keyPre, account), 0, -1).Result()
+			assert.Nil(t, err)
+
+			for idxB := 0; idxB < len(rItems)/2; idxB++ {
+				rItems[idxB], rItems[len(rItems)-1-idxB] = rItems[len(rItems)-1-idxB], rItems[idxB]
+			}
+
+			return rItems
+		},
+		setHistory: func(keyPre, account string, rItems []string) {
+			key := historyKey(keyPre, account)
+
+			assert.Nil(t, redisCli.Del(context.Background(), key).Err())
+
+			for _, rItem := range rItems {
+				assert.Nil(t, redisCli.LPush(context.Background(), key, rItem).Err())
+			}
+		},
+		wait: mr.FastForward,
+	}
+}
+
+// runBackends runs test on every implementation.
+func runBackends(t *testing.T, test func(t *testing.T, b *utBackend)) {
+	for name, newBackend := range map[string]func(t *testing.T) *utBackend{
+		"mwf":   newMWFBackend,
+		"redis": newRedisBackend,
+	} {
+		newBackend := newBackend
+
+		t.Run(name, func(t *testing.T) {
+			test(t, newBackend(t))
+		})
+	}
+}
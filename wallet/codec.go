@@ -1,6 +1,7 @@
 package wallet
 
 import (
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
@@ -12,15 +13,109 @@ type HistoryType int
 const (
 	HistoryTypeWW HistoryType = iota
 	HistoryTypeWL
+	// HistoryTypeEX is an exchange between assets, HE is the other asset
+	HistoryTypeEX
 )
 
-// COINS\nTYPE\nTIME\nME_WALLET\nHE_WALLET_OR_LOCK\nREMARK
+// history items are JSON records now, the ones stored before keep the legacy format
+// COINS\nTYPE[:ASSET]\nTIME\nME_WALLET\nHE_WALLET_OR_LOCK\nREMARK
+
+// historyPayload is the part of historyRecord built before the transfer.
+type historyPayload struct {
+	TxID         string            `json:"txId"`
+	Type         HistoryType       `json:"type"`
+	Asset        string            `json:"asset,omitempty"`
+	At           int64             `json:"at"`
+	Account      string            `json:"account"`
+	Counterparty string            `json:"counterparty"`
+	Remark       string            `json:"remark,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// historyRecord is stored in the history, Coins and Balance are filled in by the transfer which knows the balance
+// after it, see historyRecordOf.
+type historyRecord struct {
+	Coins   int64 `json:"coins"`
+	Balance int64 `json:"balance"`
+	historyPayload
+}
+
+func buildHistoryPayload(txID string, t HistoryType, asset, me, he, remark string, metadata map[string]string) string {
+	d, _ := json.Marshal(&historyPayload{
+		TxID:         txID,
+		Type:         t,
+		Asset:        asset,
+		At:           time.Now().UnixMilli(),
+		Account:      me,
+		Counterparty: he,
+		Remark:       remark,
+		Metadata:     metadata,
+	})
+
+	return string(d)
+}
+
+// historyRecordOf works like historyRecordLua.
+func historyRecordOf(coins, balance int64, payload string) string {
+	return fmt.Sprintf(`{"coins":%d,"balance":%d,%s`, coins, balance, payload[1:])
+}
+
+// ParseHistoryRecord parses both the JSON records and the legacy items, the legacy ones have no TxID, Balance
+// and Metadata.
+func ParseHistoryRecord(s string) (item *HistoryItem, err error) {
+	if !strings.HasPrefix(s, "{") {
+		item = &HistoryItem{}
+
+		item.Type, item.Asset, item.At, item.Coins, _, item.Counterparty, item.Remark, err = ParseAssetHistoryItem(s)
+		if err != nil {
+			item = nil
+		}
+
+		return
+	}
+
+	var record historyRecord
+
+	err = json.Unmarshal([]byte(s), &record)
+	if err != nil {
+		return
+	}
+
+	item = &HistoryItem{
+		TxID:         record.TxID,
+		Type:         record.Type,
+		Asset:        record.Asset,
+		Coins:        record.Coins,
+		Balance:      record.Balance,
+		At:           time.UnixMilli(record.At),
+		Counterparty: record.Counterparty,
+		Remark:       record.Remark,
+		Metadata:     record.Metadata,
+	}
+
+	return
+}
 
 func BuildHistoryPayload(t HistoryType, me, he, remark string) string {
-	return fmt.Sprintf("%d\n%d\n%s\n%s\n%s", t, time.Now().Unix(), me, he, remark)
+	return BuildAssetHistoryPayload(t, DefaultAsset, me, he, remark)
+}
+
+func BuildAssetHistoryPayload(t HistoryType, asset, me, he, remark string) string {
+	tp := strconv.Itoa(int(t))
+	if asset != DefaultAsset {
+		tp += ":" + asset
+	}
+
+	return fmt.Sprintf("%s\n%d\n%s\n%s\n%s", tp, time.Now().Unix(), me, he, remark)
 }
 
 func ParseHistoryItem(s string) (t HistoryType, at time.Time, coins int64, me, he, remark string, err error) {
+	t, _, at, coins, me, he, remark, err = ParseAssetHistoryItem(s)
+
+	return
+}
+
+func ParseAssetHistoryItem(s string) (t HistoryType, asset string, at time.Time, coins int64, me, he, remark string, err error) {
 	ps := strings.SplitN(s, "\n", 6)
 	if len(ps) != 6 {
 		err = ErrBadData
@@ -35,7 +130,9 @@ func ParseHistoryItem(s string) (t HistoryType, at time.Time, coins int64, me, h
 
 	coins = n
 
-	n, err = strconv.ParseInt(ps[1], 10, 64)
+	tp, asset, _ := strings.Cut(ps[1], ":")
+
+	n, err = strconv.ParseInt(tp, 10, 64)
 	if err != nil {
 		return
 	}
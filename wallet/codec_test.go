@@ -33,3 +33,51 @@ func TestCodec(t *testing.T) {
 	assert.True(t, time.Since(at) < time.Second)
 	assert.True(t, time.Since(at) > -time.Second)
 }
+
+func TestCodecAsset(t *testing.T) {
+	s := "-5\n" + BuildAssetHistoryPayload(HistoryTypeEX, "gems", "me", "gold", "a\nb")
+	ht, asset, _, coins, account, key, remark, err := ParseAssetHistoryItem(s)
+	assert.Nil(t, err)
+	assert.EqualValues(t, HistoryTypeEX, ht)
+	assert.EqualValues(t, "gems", asset)
+	assert.EqualValues(t, -5, coins)
+	assert.EqualValues(t, "me", account)
+	assert.EqualValues(t, "gold", key)
+	assert.EqualValues(t, "a\nb", remark)
+
+	// items without asset are of the default asset
+	_, asset, _, coins, _, _, _, err = ParseAssetHistoryItem("100\n" + BuildHistoryPayload(HistoryTypeWW, "me", "he", ""))
+	assert.Nil(t, err)
+	assert.EqualValues(t, DefaultAsset, asset)
+	assert.EqualValues(t, 100, coins)
+}
+
+func TestParseHistoryRecord(t *testing.T) {
+	s := historyRecordOf(-5, 20, buildHistoryPayload("tx", HistoryTypeWW, "gems", "me", "he", "a\nb",
+		map[string]string{"order": "1"}))
+	item, err := ParseHistoryRecord(s)
+	assert.Nil(t, err)
+	assert.EqualValues(t, "tx", item.TxID)
+	assert.EqualValues(t, HistoryTypeWW, item.Type)
+	assert.EqualValues(t, "gems", item.Asset)
+	assert.EqualValues(t, -5, item.Coins)
+	assert.EqualValues(t, 20, item.Balance)
+	assert.EqualValues(t, "he", item.Counterparty)
+	assert.EqualValues(t, "a\nb", item.Remark)
+	assert.EqualValues(t, map[string]string{"order": "1"}, item.Metadata)
+	assert.True(t, time.Since(item.At) < time.Second)
+
+	item, err = ParseHistoryRecord("100\n" + BuildAssetHistoryPayload(HistoryTypeWL, "gold", "me", "key", "r"))
+	assert.Nil(t, err)
+	assert.EqualValues(t, "", item.TxID)
+	assert.EqualValues(t, HistoryTypeWL, item.Type)
+	assert.EqualValues(t, "gold", item.Asset)
+	assert.EqualValues(t, 100, item.Coins)
+	assert.EqualValues(t, "key", item.Counterparty)
+	assert.EqualValues(t, "r", item.Remark)
+
+	_, err = ParseHistoryRecord("bad")
+	assert.NotNil(t, err)
+	_, err = ParseHistoryRecord("{bad")
+	assert.NotNil(t, err)
+}
@@ -9,5 +9,50 @@ var (
 	ErrExists    = errors.New("exists")
 	ErrNotExists = errors.New("not exists")
 
+	ErrHistoryBroken = errors.New("history broken")
+
+	ErrIdempotencyKeyMismatch = errors.New("idempotency key used by another request")
+
 	ErrStop = errors.New("stop")
 )
+
+// results of the transfer scripts, idempotency keys record them.
+const (
+	transResultOK                     = 0
+	transResultNoCoins                = 1
+	transResultExists                 = 2
+	transResultIdempotencyKeyMismatch = 3
+)
+
+func transResultErr(n int) error {
+	switch n {
+	case transResultOK:
+		return nil
+	case transResultNoCoins:
+		return ErrNoCoins
+	case transResultExists:
+		return ErrExists
+	case transResultIdempotencyKeyMismatch:
+		return ErrIdempotencyKeyMismatch
+	default:
+		return ErrFailed
+	}
+}
+
+// transResultCode returns false for errors which aren't transfer results.
+func transResultCode(err error) (n int, ok bool) {
+	ok = true
+
+	switch {
+	case err == nil:
+		n = transResultOK
+	case errors.Is(err, ErrNoCoins):
+		n = transResultNoCoins
+	case errors.Is(err, ErrExists):
+		n = transResultExists
+	default:
+		ok = false
+	}
+
+	return
+}
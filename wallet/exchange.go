@@ -0,0 +1,45 @@
+package wallet
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// exchangeCoins checks an exchange and returns the coins of toAsset for coins of fromAsset.
+func exchangeCoins(fromAsset string, coins int64, toAsset string, rate ExchangeRate) (toCoins int64, err error) {
+	if fromAsset == toAsset {
+		err = fmt.Errorf("%w: exchange within the same asset", ErrFailed)
+
+		return
+	}
+
+	if rate.From <= 0 || rate.To <= 0 {
+		err = fmt.Errorf("%w: invalid exchange rate", ErrFailed)
+
+		return
+	}
+
+	if coins <= 0 {
+		err = fmt.Errorf("%w: invalid coins amount", ErrFailed)
+
+		return
+	}
+
+	n := new(big.Int).Mul(big.NewInt(coins), big.NewInt(rate.To))
+	n.Quo(n, big.NewInt(rate.From))
+
+	if !n.IsInt64() {
+		err = fmt.Errorf("%w: exchanged coins overflow", ErrFailed)
+
+		return
+	}
+
+	toCoins = n.Int64()
+	if toCoins <= 0 {
+		err = fmt.Errorf("%w: too few coins to exchange", ErrFailed)
+
+		return
+	}
+
+	return
+}
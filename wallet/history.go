@@ -20,12 +20,7 @@ type redisHistoryImpl struct {
 }
 
 func (impl *redisHistoryImpl) accountRedisKey(account string) string {
-	accountRedisKey := "history:" + account
-	if impl.accountPre != "" {
-		accountRedisKey = impl.accountPre + ":" + accountRedisKey
-	}
-
-	return accountRedisKey
+	return historyKey(impl.accountPre, account)
 }
 
 func (impl *redisHistoryImpl) GetItems(ctx context.Context, account string, offset, count int64) (items []*HistoryItem, err error) {
@@ -50,27 +45,31 @@ func (impl *redisHistoryImpl) getItems(ctx context.Context, account string, star
 		return
 	}
 
-	items = make([]*HistoryItem, 0, len(rItems))
+	items = historyItems(rItems, reverseOutput)
 
-	for _, item := range rItems {
-		_, at, coins, _, _, remark, _ := ParseHistoryItem(item)
+	return
+}
 
-		items = append(items, &HistoryItem{
-			Coins:  coins,
-			At:     at,
-			Remark: remark,
-		})
+func (impl *redisHistoryImpl) Query(ctx context.Context, account string, query HistoryQuery) (items []*HistoryItem, total int64, err error) {
+	rItems, err := impl.redisCli.LRange(ctx, impl.accountRedisKey(account), 0, -1).Result()
+	if err != nil {
+		return
 	}
 
-	if reverseOutput {
-		for idxB := 0; idxB < len(rItems)-1; idxB++ {
-			items[idxB], items[len(rItems)-1-idxB] = items[len(rItems)-1-idxB], items[idxB]
-		}
-	}
+	items, total = queryHistoryItems(rItems, query)
 
 	return
 }
 
+func (impl *redisHistoryImpl) VerifyHistory(ctx context.Context, account string) error {
+	rItems, err := impl.redisCli.LRange(ctx, impl.accountRedisKey(account), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+
+	return verifyHistoryItems(rItems)
+}
+
 func (impl *redisHistoryImpl) Trans2CodeStorage(account string, storage HistoryCodeStorage) (err error) {
 	if storage == nil {
 		err = ErrFailed
@@ -101,8 +100,7 @@ func (impl *redisHistoryImpl) Trans2CodeStorage(account string, storage HistoryC
 
 		for ; idx >= 0; idx-- {
 			item := rItems[idx]
-			_, at, _, _, _, _, _ := ParseHistoryItem(item)
-			err = storage.Store(at, item)
+			err = storage.Store(historyItemAt(item), item)
 
 			if err != nil {
 				break
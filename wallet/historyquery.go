@@ -0,0 +1,100 @@
+package wallet
+
+import "time"
+
+// historyItems parses the raw items, the bad ones are kept empty like before.
+func historyItems(rItems []string, reverseOutput bool) (items []*HistoryItem) {
+	items = make([]*HistoryItem, 0, len(rItems))
+
+	for _, rItem := range rItems {
+		item, err := ParseHistoryRecord(rItem)
+		if err != nil {
+			item = &HistoryItem{}
+		}
+
+		items = append(items, item)
+	}
+
+	if reverseOutput {
+		for idxB := 0; idxB < len(items)/2; idxB++ {
+			items[idxB], items[len(items)-1-idxB] = items[len(items)-1-idxB], items[idxB]
+		}
+	}
+
+	return
+}
+
+// historyItemAt is zero for the bad items.
+func historyItemAt(rItem string) (at time.Time) {
+	if item, err := ParseHistoryRecord(rItem); err == nil {
+		at = item.At
+	}
+
+	return
+}
+
+// queryHistoryItems filters rItems, all the items of an account newest first, the bad ones are skipped.
+func queryHistoryItems(rItems []string, query HistoryQuery) (items []*HistoryItem, total int64) {
+	matched := make([]*HistoryItem, 0, len(rItems))
+
+	for _, rItem := range rItems {
+		item, err := ParseHistoryRecord(rItem)
+		if err != nil || !query.match(item) {
+			continue
+		}
+
+		matched = append(matched, item)
+	}
+
+	total = int64(len(matched))
+
+	if query.ASC {
+		for idxB := 0; idxB < len(matched)/2; idxB++ {
+			matched[idxB], matched[len(matched)-1-idxB] = matched[len(matched)-1-idxB], matched[idxB]
+		}
+	}
+
+	start := query.Offset
+	if start < 0 {
+		start = 0
+	}
+
+	if start > total {
+		start = total
+	}
+
+	end := total
+	if query.Count > 0 && start+query.Count < end {
+		end = start + query.Count
+	}
+
+	items = matched[start:end]
+
+	return
+}
+
+func (query *HistoryQuery) match(item *HistoryItem) bool {
+	if !query.Start.IsZero() && item.At.Before(query.Start) {
+		return false
+	}
+
+	if !query.End.IsZero() && !item.At.Before(query.End) {
+		return false
+	}
+
+	if query.Counterparty != "" && item.Counterparty != query.Counterparty {
+		return false
+	}
+
+	if len(query.Types) == 0 {
+		return true
+	}
+
+	for _, t := range query.Types {
+		if item.Type == t {
+			return true
+		}
+	}
+
+	return false
+}
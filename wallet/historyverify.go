@@ -0,0 +1,55 @@
+package wallet
+
+import "fmt"
+
+// HistoryBreakError is the first history item whose balance isn't the balance before it plus its coins.
+type HistoryBreakError struct {
+	// Offset is the offset of the item in GetItemsASC
+	Offset   int64
+	TxID     string
+	Asset    string
+	Expected int64
+	Balance  int64
+}
+
+func (e *HistoryBreakError) Error() string {
+	return fmt.Sprintf("history broken at %d, tx %s: balance of asset %q is %d, expected %d", e.Offset, e.TxID, e.Asset,
+		e.Balance, e.Expected)
+}
+
+func (e *HistoryBreakError) Is(target error) bool {
+	return target == ErrHistoryBroken
+}
+
+// verifyHistoryItems walks rItems, all the items of an account newest first, from the oldest one. Every asset has
+// its own chain which starts at its first item, the legacy items without balance are skipped.
+func verifyHistoryItems(rItems []string) error {
+	balances := make(map[string]int64)
+
+	for idx := len(rItems) - 1; idx >= 0; idx-- {
+		offset := int64(len(rItems) - 1 - idx)
+
+		item, err := ParseHistoryRecord(rItems[idx])
+		if err != nil {
+			return fmt.Errorf("%w: history item %d: %v", ErrBadData, offset, err)
+		}
+
+		if item.TxID == "" {
+			continue
+		}
+
+		if balance, ok := balances[item.Asset]; ok && balance+item.Coins != item.Balance {
+			return &HistoryBreakError{
+				Offset:   offset,
+				TxID:     item.TxID,
+				Asset:    item.Asset,
+				Expected: balance + item.Coins,
+				Balance:  item.Balance,
+			}
+		}
+
+		balances[item.Asset] = item.Balance
+	}
+
+	return nil
+}
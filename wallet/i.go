@@ -5,10 +5,42 @@ import (
 	"time"
 )
 
+// DefaultAsset is the asset of the wallets and lockers created before assets.
+const DefaultAsset = ""
+
 type HistoryItem struct {
-	Coins  int64
-	At     time.Time
-	Remark string
+	TxID  string
+	Type  HistoryType
+	Asset string
+	Coins int64
+	// Balance is the balance of the asset after the item
+	Balance      int64
+	At           time.Time
+	Counterparty string
+	Remark       string
+	Metadata     map[string]string
+}
+
+// HistoryQuery filters the history items, its zero value matches all the items, newest first.
+type HistoryQuery struct {
+	// Start and End limit At to [Start, End), they are unbounded when zero
+	Start time.Time
+	End   time.Time
+
+	// Types and Counterparty are ignored when empty
+	Types        []HistoryType
+	Counterparty string
+
+	Offset int64
+	// Count 0 returns all the matched items
+	Count int64
+	ASC   bool
+}
+
+// ExchangeRate gives To coins of the target asset for every From coins of the source asset.
+type ExchangeRate struct {
+	From int64
+	To   int64
 }
 
 type HistoryCodeStorage interface {
@@ -19,25 +51,40 @@ type History interface {
 	GetItems(ctx context.Context, account string, offset, count int64) ([]*HistoryItem, error)
 	GetItemsASC(ctx context.Context, account string, offset, count int64) ([]*HistoryItem, error)
 
+	// Query returns the page of the matched items and how many items are matched.
+	Query(ctx context.Context, account string, query HistoryQuery) (items []*HistoryItem, total int64, err error)
+
+	// VerifyHistory checks the balances of the items follow each other, the first break is a *HistoryBreakError.
+	VerifyHistory(ctx context.Context, account string) error
+
 	Trans2CodeStorage(account string, storage HistoryCodeStorage) (err error)
 }
 
+// Wallet transfers work on the asset of AssetOption.
 type Wallet interface {
 	GetHistory() History
 
 	TransToLocker(ctx context.Context, account string, coins int64, remark string, locker Locker, toAccount, key string, options ...Option) (err error)
 	TransToWallet(ctx context.Context, account string, coins int64, remarkFrom string, wallet Wallet, accountTo, remarkTo string, options ...Option) (err error)
 
-	GetCoins(ctx context.Context, account string) (int64, error)
+	// Exchange takes coins of fromAsset and gives toCoins of toAsset at rate, rounded down, to the account.
+	Exchange(ctx context.Context, account, fromAsset string, coins int64, toAsset string, rate ExchangeRate, remark string,
+		options ...Option) (toCoins int64, err error)
+
+	GetCoins(ctx context.Context, account, asset string) (int64, error)
+	GetBalances(ctx context.Context, account string) (balances map[string]int64, err error)
 }
 
+// Locker works on the asset of AssetOption.
 type Locker interface {
 	Set(ctx context.Context, account, key string, coins int64, options ...Option) error
-	Get(ctx context.Context, account, key string) (coins int64, exists bool, err error)
-	Rem(ctx context.Context, account, key string) error
+	Get(ctx context.Context, account, key string, options ...Option) (coins int64, exists bool, err error)
+	Rem(ctx context.Context, account, key string, options ...Option) error
 
-	GetTotal(ctx context.Context, account string) (int64, error)
+	GetTotal(ctx context.Context, account string, options ...Option) (int64, error)
 
 	TransToLocker(ctx context.Context, fromAccount, fromKey string, toLocker Locker, toAccount, toKey string, options ...Option) error
-	TransToWallet(ctx context.Context, account, key string, wallet Wallet, walletAccount string, remark string) error
+	// TransToWallet moves the coins of key to walletAccount, the history item goes to walletAccount in the history
+	// of wallet with key as its counterparty. The locker account gets no history item.
+	TransToWallet(ctx context.Context, account, key string, wallet Wallet, walletAccount string, remark string, options ...Option) error
 }
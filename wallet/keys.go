@@ -0,0 +1,52 @@
+package wallet
+
+// the keys of wallets, lockers and histories, they are shared by the redis and mwf implementations.
+
+func walletKey(keyPre string) string {
+	if keyPre == "" {
+		return "wallet"
+	}
+
+	return keyPre + ":" + "wallet"
+}
+
+// walletAssetKey is walletKey for DefaultAsset, so the wallets stored before assets keep working.
+func walletAssetKey(keyPre, asset string) string {
+	if asset == DefaultAsset {
+		return walletKey(keyPre)
+	}
+
+	return walletKey(keyPre) + ":asset:" + asset
+}
+
+// walletAssetsKey holds every asset but DefaultAsset the wallet has ever received.
+func walletAssetsKey(keyPre string) string {
+	return walletKey(keyPre) + ":assets"
+}
+
+func lockerKey(keyPre, account, asset string) string {
+	key := "locker:" + account
+	if asset != DefaultAsset {
+		key = "locker:asset:" + asset + ":" + account
+	}
+
+	if keyPre != "" {
+		key = keyPre + ":" + key
+	}
+
+	return key
+}
+
+// idempotencyKey is scoped by the wallet which runs the transfer.
+func idempotencyKey(keyPre, key string) string {
+	return walletKey(keyPre) + ":idempotency:" + key
+}
+
+func historyKey(keyPre, account string) string {
+	key := "history:" + account
+	if keyPre != "" {
+		key = keyPre + ":" + key
+	}
+
+	return key
+}
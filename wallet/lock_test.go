@@ -6,8 +6,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/go-redis/redis/v8"
-	"github.com/sgostarter/libconfig/ut"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -32,8 +32,8 @@ func initRedis(dsn string) (cli *redis.Client, err error) {
 
 // nolint: funlen
 func TestLockSet(t *testing.T) {
-	cfg := ut.SetupUTConfig4Redis(t)
-	redisCli, err := initRedis(cfg.RedisDSN)
+	mr := miniredis.RunT(t)
+	redisCli, err := initRedis("redis://" + mr.Addr())
 	assert.Nil(t, err)
 
 	user := "id"
@@ -125,8 +125,8 @@ func TestLockSet(t *testing.T) {
 }
 
 func TestLockTransfer(t *testing.T) {
-	cfg := ut.SetupUTConfig4Redis(t)
-	redisCli, err := initRedis(cfg.RedisDSN)
+	mr := miniredis.RunT(t)
+	redisCli, err := initRedis("redis://" + mr.Addr())
 	assert.Nil(t, err)
 
 	user1 := "id"
@@ -5,6 +5,7 @@ import (
 	"errors"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
 )
 
 const (
@@ -27,26 +28,23 @@ type redisLockerImpl struct {
 	redisKeyPre string
 }
 
-func (impl *redisLockerImpl) accountRedisKey(account string) string {
-	redisKey := "locker:" + account
-	if impl.redisKeyPre != "" {
-		redisKey = impl.redisKeyPre + ":" + redisKey
-	}
-
-	return redisKey
+func (impl *redisLockerImpl) accountRedisKey(account, asset string) string {
+	return lockerKey(impl.redisKeyPre, account, asset)
 }
 
 func (impl *redisLockerImpl) Set(ctx context.Context, account, key string, coins int64, options ...Option) error {
-	flag, err := optionNew(options...).ConflictFlag()
+	opts := optionNew(options...)
+
+	flag, err := opts.ConflictFlag()
 	if err != nil {
 		return err
 	}
 
-	return lockSetScript.Run(ctx, impl.redisCli, []string{impl.accountRedisKey(account)}, key, totalKey, coins, flag).Err()
+	return lockSetScript.Run(ctx, impl.redisCli, []string{impl.accountRedisKey(account, opts.asset)}, key, totalKey, coins, flag).Err()
 }
 
-func (impl *redisLockerImpl) Get(ctx context.Context, account, key string) (coins int64, exists bool, err error) {
-	coins, err = impl.redisCli.HGet(ctx, impl.accountRedisKey(account), key).Int64()
+func (impl *redisLockerImpl) Get(ctx context.Context, account, key string, options ...Option) (coins int64, exists bool, err error) {
+	coins, err = impl.redisCli.HGet(ctx, impl.accountRedisKey(account, optionNew(options...).asset), key).Int64()
 	if err == nil {
 		exists = true
 
@@ -60,12 +58,12 @@ func (impl *redisLockerImpl) Get(ctx context.Context, account, key string) (coin
 	return
 }
 
-func (impl *redisLockerImpl) Rem(ctx context.Context, account, key string) error {
-	return lockRemoveScript.Run(ctx, impl.redisCli, []string{impl.accountRedisKey(account)}, key, totalKey).Err()
+func (impl *redisLockerImpl) Rem(ctx context.Context, account, key string, options ...Option) error {
+	return lockRemoveScript.Run(ctx, impl.redisCli, []string{impl.accountRedisKey(account, optionNew(options...).asset)}, key, totalKey).Err()
 }
 
-func (impl *redisLockerImpl) GetTotal(ctx context.Context, account string) (int64, error) {
-	total, err := impl.redisCli.HGet(ctx, impl.accountRedisKey(account), totalKey).Int64()
+func (impl *redisLockerImpl) GetTotal(ctx context.Context, account string, options ...Option) (int64, error) {
+	total, err := impl.redisCli.HGet(ctx, impl.accountRedisKey(account, optionNew(options...).asset), totalKey).Int64()
 	if errors.Is(err, redis.Nil) {
 		err = nil
 	}
@@ -79,16 +77,19 @@ func (impl *redisLockerImpl) TransToLocker(ctx context.Context, fromAccount, fro
 		return ErrInvalidObject
 	}
 
-	flag, err := optionNew(options...).ConflictFlag()
+	opts := optionNew(options...)
+
+	flag, err := opts.ConflictFlag()
 	if err != nil {
 		return err
 	}
 
-	return lockTransferScript.Run(ctx, impl.redisCli, []string{impl.accountRedisKey(fromAccount), redisToLocker.accountRedisKey(toAccount)},
+	return lockTransferScript.Run(ctx, impl.redisCli, []string{impl.accountRedisKey(fromAccount, opts.asset), redisToLocker.accountRedisKey(toAccount, opts.asset)},
 		fromKey, totalKey, toKey, totalKey, flag).Err()
 }
 
-func (impl *redisLockerImpl) TransToWallet(ctx context.Context, account, key string, wallet Wallet, walletAccount, remark string) error {
+func (impl *redisLockerImpl) TransToWallet(ctx context.Context, account, key string, wallet Wallet, walletAccount, remark string,
+	options ...Option) error {
 	redisWallet, ok := wallet.(*redisWalletImpl)
 	if !ok {
 		return ErrInvalidObject
@@ -99,8 +100,11 @@ func (impl *redisLockerImpl) TransToWallet(ctx context.Context, account, key str
 		return ErrInvalidObject
 	}
 
-	n, err := lockerTrans2WalletScript.Run(ctx, impl.redisCli, []string{impl.accountRedisKey(account), redisWallet.walletRedisKey(),
-		redisHistory.accountRedisKey(account)}, key, totalKey, walletAccount, BuildHistoryPayload(HistoryTypeWL, account, key, remark)).Int()
+	opts := optionNew(options...)
+
+	n, err := lockerTrans2WalletScript.Run(ctx, impl.redisCli, []string{impl.accountRedisKey(account, opts.asset), redisWallet.walletRedisKey(opts.asset),
+		redisHistory.accountRedisKey(walletAccount), redisWallet.assetsRedisKey()}, key, totalKey, walletAccount,
+		buildHistoryPayload(uuid.NewString(), HistoryTypeWL, opts.asset, walletAccount, key, remark, opts.metadata), opts.asset).Int()
 	if err != nil {
 		return err
 	}
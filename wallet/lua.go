@@ -2,8 +2,57 @@ package wallet
 
 import "github.com/go-redis/redis/v8"
 
+// flagLua tests the bits of the ConflictFlag flag without the bit library, which isn't in every redis compatible
+// server.
+const flagLua = `
+		local function hasFlag(flag, f)
+			return math.floor(flag / f) % 2 == 1
+		end
+`
+
+// historyRecordLua fills coins and balance into the JSON payload built by buildHistoryPayload, like historyRecordOf.
+const historyRecordLua = `
+		local function historyRecord(coins, balance, payload)
+			return '{"coins":'..coins..',"balance":'..balance..','..string.sub(payload, 2)
+		end
+`
+
+// idempotencyLua keeps the result of a transfer with the fingerprint of its request as "RESULT:FINGERPRINT",
+// idempotencyResult returns nil when the transfer should run. The codes are those of transResultErr.
+const idempotencyLua = `
+		local function idempotencyResult(key, ttl, fingerprint)
+			if ttl <= 0 then
+				return nil
+			end
+
+			local recorded = redis.call("GET", key)
+			if recorded == false then
+				return nil
+			end
+
+			local sep = string.find(recorded, ":", 1, true)
+			if sep == nil then
+				return tonumber(recorded)
+			end
+
+			if string.sub(recorded, sep + 1) ~= fingerprint then
+				return 3
+			end
+
+			return tonumber(string.sub(recorded, 1, sep - 1))
+		end
+
+		local function idempotencyDone(key, ttl, fingerprint, ret)
+			if ttl > 0 then
+				redis.call("SET", key, ret..":"..fingerprint, "PX", ttl)
+			end
+
+			return ret
+		end
+`
+
 var (
-	lockSetScript = redis.NewScript(`
+	lockSetScript = redis.NewScript(flagLua + `
 		local account =  KEYS[1]
 
 		local idKey = ARGV[1]
@@ -19,7 +68,7 @@ var (
 		local incr = val
 		if ret == false then
 			redis.call("HSET", account, idKey, val)
-		elseif (bit.band(flag,1)) ~= 0 then
+		elseif hasFlag(flag, 1) then
 			redis.call("HINCRBY", account, idKey, val)
 		else
 			redis.call("HSET", account, idKey, val)
@@ -81,10 +130,12 @@ var (
 		return true
 	`)
 
-	walletTrans2LockerScript = redis.NewScript(`
+	walletTrans2LockerScript = redis.NewScript(flagLua + historyRecordLua + idempotencyLua + `
 		local wallet =  KEYS[1]
 		local toAccount = KEYS[2]
 		local history = KEYS[3]
+		local idempotency = KEYS[4]
+		local assets = KEYS[5]
 
 		local fromAccount = ARGV[1]
 		local fromCoins = tonumber(ARGV[2])
@@ -92,17 +143,29 @@ var (
 		local toTotalKey = ARGV[4]
 		local flag = tonumber(ARGV[5])
 		local historyRemark = ARGV[6]
+		local idempotencyTTL = tonumber(ARGV[7])
+		local asset = ARGV[8]
+		local fingerprint = ARGV[9]
+
+		local recorded = idempotencyResult(idempotency, idempotencyTTL, fingerprint)
+		if recorded ~= nil then
+			return recorded
+		end
+
+		local function done(ret)
+			return idempotencyDone(idempotency, idempotencyTTL, fingerprint, ret)
+		end
 
 		local coins = redis.call("HGET", wallet, fromAccount)
 		if coins == false or tonumber(coins) < fromCoins then
-			if (bit.band(flag,4)) == 0 then
-				return 1
+			if not hasFlag(flag, 4) then
+				return done(1)
 			end
 		end
 
 		local toCoins = redis.call("HGET", toAccount, toIDKey)
-		if not toCoins == false and (bit.band(flag,1)) == 0 then
-			return 2
+		if not toCoins == false and not hasFlag(flag, 1) then
+			return done(2)
 		end
 
 		if toCoins == false then
@@ -113,18 +176,25 @@ var (
 
 		redis.call("HINCRBY", toAccount, toTotalKey, fromCoins)
 
-		redis.call("HINCRBY", wallet, fromAccount, -fromCoins)
+		if asset ~= "" then
+			redis.call("HSET", assets, asset, 1)
+		end
 
-		redis.call("LPUSH",  history, -fromCoins.."\n"..historyRemark)
+		local balance = redis.call("HINCRBY", wallet, fromAccount, -fromCoins)
 
-		return 0
+		redis.call("LPUSH",  history, historyRecord(-fromCoins, balance, historyRemark))
+
+		return done(0)
 	`)
 
-	walletTrans2WalletScript = redis.NewScript(`
+	walletTrans2WalletScript = redis.NewScript(flagLua + historyRecordLua + idempotencyLua + `
 		local walletFrom =  KEYS[1]
 		local walletTo = KEYS[2]
 		local historyFrom = KEYS[3]
 		local historyTo = KEYS[4]
+		local idempotency = KEYS[5]
+		local assetsFrom = KEYS[6]
+		local assetsTo = KEYS[7]
 
 		local fromAccount = ARGV[1]
 		local fromCoins = tonumber(ARGV[2])
@@ -132,49 +202,123 @@ var (
 		local flag = tonumber(ARGV[4])
 		local historyFromRemark = ARGV[5]
 		local historyToRemark = ARGV[6]
+		local idempotencyTTL = tonumber(ARGV[7])
+		local asset = ARGV[8]
+		local fingerprint = ARGV[9]
 
 		if tonumber(fromCoins) <= 0 then
 			return redis.error_reply("invalid coins amount") 
 		end
 
+		local recorded = idempotencyResult(idempotency, idempotencyTTL, fingerprint)
+		if recorded ~= nil then
+			return recorded
+		end
+
+		local function done(ret)
+			return idempotencyDone(idempotency, idempotencyTTL, fingerprint, ret)
+		end
+
 		local coins = redis.call("HGET", walletFrom, fromAccount)
 		if coins == false or tonumber(coins) < fromCoins then
-			if (bit.band(flag,4)) == 0 then
-				return 1
+			if not hasFlag(flag, 4) then
+				return done(1)
 			end
 		end
 
-		redis.call("HINCRBY", walletFrom, fromAccount, -fromCoins)
-		redis.call("HINCRBY", walletTo, toAccount, fromCoins)
+		if asset ~= "" then
+			redis.call("HSET", assetsFrom, asset, 1)
+			redis.call("HSET", assetsTo, asset, 1)
+		end
+
+		local balanceFrom = redis.call("HINCRBY", walletFrom, fromAccount, -fromCoins)
+		local balanceTo = redis.call("HINCRBY", walletTo, toAccount, fromCoins)
 
-		redis.call("LPUSH",  historyFrom, -fromCoins.."\n"..historyFromRemark)
-		redis.call("LPUSH",  historyTo, fromCoins.."\n"..historyToRemark)
+		redis.call("LPUSH",  historyFrom, historyRecord(-fromCoins, balanceFrom, historyFromRemark))
+		redis.call("LPUSH",  historyTo, historyRecord(fromCoins, balanceTo, historyToRemark))
 
-		return 0
+		return done(0)
 	`)
 
-	lockerTrans2WalletScript = redis.NewScript(`
+	lockerTrans2WalletScript = redis.NewScript(historyRecordLua + `
 		local fromAccount =  KEYS[1]
 		local wallet = KEYS[2]
 		local history = KEYS[3]
+		local assets = KEYS[4]
 
 		local fromIDKey = ARGV[1]
 		local fromTotalKey = ARGV[2]
 		local walletAccount = ARGV[3]
 		local historyMember = ARGV[4]
+		local asset = ARGV[5]
 
 		local fromCoins = redis.call("HGET", fromAccount, fromIDKey)
 		if fromCoins == false then
 			return 1
 		end
 
-		redis.call("HINCRBY", wallet, walletAccount, fromCoins)
+		if asset ~= "" then
+			redis.call("HSET", assets, asset, 1)
+		end
+
+		local balance = redis.call("HINCRBY", wallet, walletAccount, fromCoins)
 
 		redis.call("HDEL", fromAccount, fromIDKey)
 		redis.call("HINCRBY", fromAccount, fromTotalKey, -tonumber(fromCoins))
 
-		redis.call("LPUSH", history, fromCoins.."\n"..historyMember)
+		redis.call("LPUSH", history, historyRecord(fromCoins, balance, historyMember))
 
 		return 0
 	`)
+
+	walletExchangeScript = redis.NewScript(flagLua + historyRecordLua + idempotencyLua + `
+		local walletFrom =  KEYS[1]
+		local walletTo = KEYS[2]
+		local history = KEYS[3]
+		local idempotency = KEYS[4]
+		local assets = KEYS[5]
+
+		local account = ARGV[1]
+		local fromCoins = tonumber(ARGV[2])
+		local fromAsset = ARGV[3]
+		local toCoins = tonumber(ARGV[4])
+		local toAsset = ARGV[5]
+		local flag = tonumber(ARGV[6])
+		local historyFromRemark = ARGV[7]
+		local historyToRemark = ARGV[8]
+		local idempotencyTTL = tonumber(ARGV[9])
+		local fingerprint = ARGV[10]
+
+		local recorded = idempotencyResult(idempotency, idempotencyTTL, fingerprint)
+		if recorded ~= nil then
+			return recorded
+		end
+
+		local function done(ret)
+			return idempotencyDone(idempotency, idempotencyTTL, fingerprint, ret)
+		end
+
+		local coins = redis.call("HGET", walletFrom, account)
+		if coins == false or tonumber(coins) < fromCoins then
+			if not hasFlag(flag, 4) then
+				return done(1)
+			end
+		end
+
+		if fromAsset ~= "" then
+			redis.call("HSET", assets, fromAsset, 1)
+		end
+
+		if toAsset ~= "" then
+			redis.call("HSET", assets, toAsset, 1)
+		end
+
+		local balanceFrom = redis.call("HINCRBY", walletFrom, account, -fromCoins)
+		local balanceTo = redis.call("HINCRBY", walletTo, account, toCoins)
+
+		redis.call("LPUSH",  history, historyRecord(-fromCoins, balanceFrom, historyFromRemark))
+		redis.call("LPUSH",  history, historyRecord(toCoins, balanceTo, historyToRemark))
+
+		return done(0)
+	`)
 )
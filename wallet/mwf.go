@@ -0,0 +1,211 @@
+package wallet
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sgostarter/i/stg"
+	"github.com/sgostarter/libeasygo/stg/mwf"
+)
+
+// NewMWFStorage keeps wallets, lockers and histories in fileName, they are kept in memory only when fileName is empty.
+// Wallets and lockers working together must share the storage, it makes their transfers atomic like the redis scripts.
+func NewMWFStorage(fileName string, storage stg.FileStorage) *MWFStorage {
+	return &MWFStorage{
+		d: mwf.NewMemWithFile[*mwfData, mwf.Serial, mwf.Lock](newMWFData(), &mwf.JSONSerial{}, &sync.RWMutex{},
+			fileName, storage),
+	}
+}
+
+type MWFStorage struct {
+	d *mwf.MemWithFile[*mwfData, mwf.Serial, mwf.Lock]
+}
+
+// mwfData mirrors the redis layout and keys: wallets and lockers are hashes, histories are lists.
+type mwfData struct {
+	Hashes map[string]map[string]int64 `json:"hashes"`
+	// Lists are kept oldest first, index 0 of the redis list is the last item
+	Lists map[string][]string `json:"lists"`
+	// Idempotency holds the transfer results by idempotency key
+	Idempotency map[string]*mwfIdempotency `json:"idempotency,omitempty"`
+}
+
+type mwfIdempotency struct {
+	Result      int       `json:"result"`
+	Fingerprint string    `json:"fingerprint"`
+	ExpiredAt   time.Time `json:"expiredAt"`
+}
+
+var errMWFIdempotencyHit = errors.New("idempotency hit")
+
+func newMWFData() *mwfData {
+	return &mwfData{
+		Hashes:      make(map[string]map[string]int64),
+		Lists:       make(map[string][]string),
+		Idempotency: make(map[string]*mwfIdempotency),
+	}
+}
+
+func (stg *MWFStorage) read(proc func(d *mwfData)) {
+	stg.d.Read(func(d *mwfData) {
+		if d == nil {
+			d = newMWFData()
+		}
+
+		proc(d)
+	})
+}
+
+// change saves nothing when proc fails, proc must check everything before its first change.
+func (stg *MWFStorage) change(proc func(d *mwfData) error) error {
+	return stg.d.Change(func(d *mwfData) (newD *mwfData, err error) {
+		newD = d
+		if newD == nil {
+			newD = newMWFData()
+		}
+
+		if newD.Hashes == nil {
+			newD.Hashes = make(map[string]map[string]int64)
+		}
+
+		if newD.Lists == nil {
+			newD.Lists = make(map[string][]string)
+		}
+
+		if newD.Idempotency == nil {
+			newD.Idempotency = make(map[string]*mwfIdempotency)
+		}
+
+		err = proc(newD)
+
+		return
+	})
+}
+
+// changeIdempotent works like change when ttl is 0, otherwise the result of proc is saved with key and the fingerprint
+// of the request in the same change, and the saved result is returned without running proc until ttl passes. A request
+// with another fingerprint gets ErrIdempotencyKeyMismatch.
+func (stg *MWFStorage) changeIdempotent(key, fingerprint string, ttl time.Duration, proc func(d *mwfData) error) (err error) {
+	if ttl <= 0 {
+		return stg.change(proc)
+	}
+
+	var result int
+
+	err = stg.change(func(d *mwfData) error {
+		now := time.Now()
+
+		if r, ok := d.Idempotency[key]; ok && now.Before(r.ExpiredAt) {
+			result = r.Result
+			if r.Fingerprint != fingerprint {
+				result = transResultIdempotencyKeyMismatch
+			}
+
+			return errMWFIdempotencyHit
+		}
+
+		procErr := proc(d)
+
+		var ok bool
+
+		result, ok = transResultCode(procErr)
+		if !ok {
+			return procErr
+		}
+
+		for k, r := range d.Idempotency {
+			if !now.Before(r.ExpiredAt) {
+				delete(d.Idempotency, k)
+			}
+		}
+
+		d.Idempotency[key] = &mwfIdempotency{
+			Result:      result,
+			Fingerprint: fingerprint,
+			ExpiredAt:   now.Add(ttl),
+		}
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, errMWFIdempotencyHit) {
+		return
+	}
+
+	return transResultErr(result)
+}
+
+//
+//
+//
+
+func (d *mwfData) hGet(key, field string) (v int64, ok bool) {
+	v, ok = d.Hashes[key][field]
+
+	return
+}
+
+func (d *mwfData) hSet(key, field string, v int64) {
+	h, ok := d.Hashes[key]
+	if !ok {
+		h = make(map[string]int64)
+		d.Hashes[key] = h
+	}
+
+	h[field] = v
+}
+
+func (d *mwfData) hIncrBy(key, field string, v int64) (newV int64) {
+	old, _ := d.hGet(key, field)
+
+	newV = old + v
+
+	d.hSet(key, field, newV)
+
+	return
+}
+
+func (d *mwfData) hDel(key, field string) {
+	h, ok := d.Hashes[key]
+	if !ok {
+		return
+	}
+
+	delete(h, field)
+
+	if len(h) == 0 {
+		delete(d.Hashes, key)
+	}
+}
+
+func (d *mwfData) lPush(key string, coins, balance int64, payload string) {
+	d.Lists[key] = append(d.Lists[key], historyRecordOf(coins, balance, payload))
+}
+
+// lRange returns the items of the redis LRANGE command, newest first.
+func (d *mwfData) lRange(key string, start, stop int64) (items []string) {
+	list := d.Lists[key]
+	n := int64(len(list))
+
+	if start < 0 {
+		start += n
+	}
+
+	if start < 0 {
+		start = 0
+	}
+
+	if stop < 0 {
+		stop += n
+	}
+
+	if stop >= n {
+		stop = n - 1
+	}
+
+	for idx := start; idx <= stop; idx++ {
+		items = append(items, list[n-1-idx])
+	}
+
+	return
+}
@@ -0,0 +1,277 @@
+// nolint
+package wallet
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMWFLockSet(t *testing.T) {
+	ctx := context.Background()
+	user := "id"
+	key := "test"
+
+	locker := NewMWFLocker(NewMWFStorage("", nil), "x")
+
+	coins, exists, err := locker.Get(ctx, user, key)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	assert.EqualValues(t, 0, coins)
+
+	assert.Nil(t, locker.Set(ctx, user, key, 10))
+
+	coins, exists, err = locker.Get(ctx, user, key)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	assert.EqualValues(t, 10, coins)
+
+	assert.ErrorIs(t, locker.Set(ctx, user, key, 5), ErrExists)
+
+	assert.Nil(t, locker.Set(ctx, user, key, 6, AccumulationIfExistsOption()))
+
+	coins, _, err = locker.Get(ctx, user, key)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 16, coins)
+
+	total, err := locker.GetTotal(ctx, user)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 16, total)
+
+	assert.Nil(t, locker.Set(ctx, user, key, 6, OverflowIfExistsOption()))
+
+	total, err = locker.GetTotal(ctx, user)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 6, total)
+
+	assert.ErrorIs(t, locker.Set(ctx, user, key, 6, OverflowIfExistsOption(), AccumulationIfExistsOption()), ErrConflict)
+
+	assert.Nil(t, locker.Set(ctx, user, key+"X", 7, AccumulationIfExistsOption()))
+
+	total, err = locker.GetTotal(ctx, user)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 13, total)
+
+	assert.Nil(t, locker.Rem(ctx, user, key))
+	assert.Nil(t, locker.Rem(ctx, user, key))
+
+	total, err = locker.GetTotal(ctx, user)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 7, total)
+}
+
+func TestMWFLockTransfer(t *testing.T) {
+	ctx := context.Background()
+	user1 := "id"
+	user2 := "id2"
+
+	locker := NewMWFLocker(NewMWFStorage("", nil), "x")
+
+	assert.Nil(t, locker.Set(ctx, user1, "key1", 5))
+	assert.Nil(t, locker.Set(ctx, user1, "key11", 6))
+	assert.Nil(t, locker.Set(ctx, user1, "key111", 10))
+
+	assert.Nil(t, locker.TransToLocker(ctx, user1, "key1", locker, user2, "key2"))
+	assert.ErrorIs(t, locker.TransToLocker(ctx, user1, "key1", locker, user2, "key3"), ErrNotExists)
+
+	checkTotal := func(user string, expected int64) {
+		total, err := locker.GetTotal(ctx, user)
+		assert.Nil(t, err)
+		assert.EqualValues(t, expected, total)
+	}
+
+	checkTotal(user1, 16)
+	checkTotal(user2, 5)
+
+	assert.ErrorIs(t, locker.TransToLocker(ctx, user1, "key11", locker, user2, "key2"), ErrExists)
+	assert.Nil(t, locker.TransToLocker(ctx, user1, "key11", locker, user2, "key2", AccumulationIfExistsOption()))
+
+	checkTotal(user1, 10)
+	checkTotal(user2, 11)
+
+	assert.ErrorIs(t, locker.TransToLocker(ctx, user1, "key111", locker, user2, "key2", OverflowIfExistsOption()), ErrExists)
+
+	checkTotal(user1, 10)
+	checkTotal(user2, 11)
+
+	assert.ErrorIs(t, locker.TransToLocker(ctx, user1, "key111", NewMWFLocker(NewMWFStorage("", nil), "x"), user2, "key2"),
+		ErrInvalidObject)
+}
+
+func TestMWFWallet(t *testing.T) {
+	ctx := context.Background()
+	user := "user"
+	fileName := filepath.Join(t.TempDir(), "wallet.json")
+
+	storage := NewMWFStorage(fileName, nil)
+	wallet := NewMWFWallet(storage, "8")
+	locker := NewMWFLocker(storage, "x")
+
+	assert.Nil(t, locker.Set(ctx, user, "key1", 5))
+	assert.Nil(t, locker.Set(ctx, user, "key2", 6))
+
+	assert.Nil(t, locker.TransToWallet(ctx, user, "key1", wallet, user, "key1 to wallet"))
+	assert.ErrorIs(t, locker.TransToWallet(ctx, user, "key1", wallet, user, "key1 to wallet"), ErrNotExists)
+
+	total, err := locker.GetTotal(ctx, user)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 6, total)
+
+	coins, err := wallet.GetCoins(ctx, user, DefaultAsset)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 5, coins)
+
+	assert.ErrorIs(t, wallet.TransToLocker(ctx, user, 6, "remark1", locker, user, "keyx"), ErrNoCoins)
+	assert.ErrorIs(t, wallet.TransToLocker(ctx, user, 2, "remark1", locker, user, "key2"), ErrExists)
+	assert.Nil(t, wallet.TransToLocker(ctx, user, 2, "remark1", locker, user, "keyx"))
+
+	total, err = locker.GetTotal(ctx, user)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 8, total)
+
+	coins, err = wallet.GetCoins(ctx, user, DefaultAsset)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 3, coins)
+
+	items, err := wallet.GetHistory().GetItems(ctx, user, 0, 0)
+	assert.Nil(t, err)
+
+	if assert.Len(t, items, 2) {
+		assert.EqualValues(t, -2, items[0].Coins)
+		assert.EqualValues(t, "remark1", items[0].Remark)
+		assert.EqualValues(t, 5, items[1].Coins)
+		assert.EqualValues(t, "key1 to wallet", items[1].Remark)
+	}
+
+	// everything is loaded again from the file
+	storage = NewMWFStorage(fileName, nil)
+	wallet = NewMWFWallet(storage, "8")
+	locker = NewMWFLocker(storage, "x")
+
+	coins, err = wallet.GetCoins(ctx, user, DefaultAsset)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 3, coins)
+
+	coins, exists, err := locker.Get(ctx, user, "keyx")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	assert.EqualValues(t, 2, coins)
+
+	items, err = wallet.GetHistory().GetItems(ctx, user, 0, 0)
+	assert.Nil(t, err)
+	assert.Len(t, items, 2)
+
+	assert.ErrorIs(t, wallet.TransToLocker(ctx, user, 1, "", NewMWFLocker(NewMWFStorage("", nil), "x"), user, "keyy"),
+		ErrInvalidObject)
+	assert.ErrorIs(t, locker.TransToWallet(ctx, user, "keyx", NewMWFWallet(NewMWFStorage("", nil), "8"), user, ""),
+		ErrInvalidObject)
+}
+
+func TestMWFWallet2(t *testing.T) {
+	ctx := context.Background()
+	user1 := "user1"
+	user2 := "user2"
+
+	storage := NewMWFStorage("", nil)
+	wallet1 := NewMWFWallet(storage, "8")
+	wallet2 := NewMWFWallet(storage, "9")
+	locker := NewMWFLocker(storage, "x")
+
+	assert.Nil(t, locker.Set(ctx, user1, "key1", 1000))
+	assert.Nil(t, locker.TransToWallet(ctx, user1, "key1", wallet1, user1, "hoho"))
+
+	assert.Nil(t, wallet1.TransToWallet(ctx, user1, 10, "remarkFrom", wallet2, user2, "remarkTo"))
+	assert.ErrorIs(t, wallet1.TransToWallet(ctx, user1, 1000, "remarkFrom", wallet2, user2, "remarkTo"), ErrNoCoins)
+	assert.ErrorIs(t, wallet1.TransToWallet(ctx, user1, 0, "remarkFrom", wallet2, user2, "remarkTo", AllowNegativeOption()),
+		ErrFailed)
+	assert.Nil(t, wallet1.TransToWallet(ctx, user1, 1000, "remarkFrom", wallet2, user2, "remarkTo", OverflowIfExistsOption(),
+		AllowNegativeOption()))
+
+	coins, err := wallet1.GetCoins(ctx, user1, DefaultAsset)
+	assert.Nil(t, err)
+	assert.EqualValues(t, -10, coins)
+
+	coins, err = wallet2.GetCoins(ctx, user2, DefaultAsset)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1010, coins)
+
+	items, err := wallet2.GetHistory().GetItems(ctx, user2, 0, 0)
+	assert.Nil(t, err)
+	assert.Len(t, items, 2)
+
+	items, err = wallet1.GetHistory().GetItems(ctx, user2, 0, 0)
+	assert.Nil(t, err)
+	assert.Len(t, items, 0)
+
+	assert.ErrorIs(t, wallet1.TransToWallet(ctx, user1, 1, "", NewMWFWallet(NewMWFStorage("", nil), "9"), user2, ""),
+		ErrInvalidObject)
+}
+
+func TestMWFWalletHistory(t *testing.T) {
+	ctx := context.Background()
+	user1 := "user1"
+	user2 := "user2"
+
+	wallet1 := NewMWFWallet(NewMWFStorage("", nil), "8")
+
+	for idx := int64(1); idx <= 10; idx++ {
+		assert.Nil(t, wallet1.TransToWallet(ctx, user1, idx, fmt.Sprintf("1to2 %d", idx),
+			wallet1, user2, fmt.Sprintf("2from1 %d", idx), AllowNegativeOption()))
+	}
+
+	fnCheckCoins := func(items []*HistoryItem, coins ...int64) {
+		if assert.Len(t, items, len(coins)) {
+			for idx, item := range items {
+				assert.EqualValues(t, coins[idx], item.Coins)
+			}
+		}
+	}
+
+	items, err := wallet1.GetHistory().GetItems(ctx, user1, 0, 3)
+	assert.Nil(t, err)
+	fnCheckCoins(items, -10, -9, -8)
+
+	items, err = wallet1.GetHistory().GetItems(ctx, user1, 8, 5)
+	assert.Nil(t, err)
+	fnCheckCoins(items, -2, -1)
+
+	items, err = wallet1.GetHistory().GetItemsASC(ctx, user2, 0, 4)
+	assert.Nil(t, err)
+	fnCheckCoins(items, 1, 2, 3, 4)
+
+	items, err = wallet1.GetHistory().GetItemsASC(ctx, user2, 8, 5)
+	assert.Nil(t, err)
+	fnCheckCoins(items, 9, 10)
+
+	items, err = wallet1.GetHistory().GetItemsASC(ctx, user2, 10, 5)
+	assert.Nil(t, err)
+	fnCheckCoins(items)
+
+	assert.Equal(t, ErrFailed, wallet1.GetHistory().Trans2CodeStorage(user2, nil))
+
+	for _, c := range []struct {
+		cnt    int
+		stored int
+		left   []int64
+	}{
+		{0, 0, []int64{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}},
+		{1, 1, []int64{10, 9, 8, 7, 6, 5, 4, 3, 2}},
+		{2, 2, []int64{10, 9, 8, 7, 6, 5, 4}},
+		{3, 3, []int64{10, 9, 8, 7}},
+		{9999, 4, nil},
+	} {
+		stg := &utHistoryStorage{
+			cnt: c.cnt,
+		}
+
+		assert.Nil(t, wallet1.GetHistory().Trans2CodeStorage(user2, stg))
+		assert.Len(t, stg.items, c.stored)
+
+		items, err = wallet1.GetHistory().GetItems(ctx, user2, 0, 1000)
+		assert.Nil(t, err)
+		fnCheckCoins(items, c.left...)
+	}
+}
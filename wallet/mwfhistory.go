@@ -0,0 +1,142 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+)
+
+func newMWFHistory(storage *MWFStorage, keyPre string) *mwfHistoryImpl {
+	return &mwfHistoryImpl{
+		storage: storage,
+		keyPre:  keyPre,
+	}
+}
+
+type mwfHistoryImpl struct {
+	storage *MWFStorage
+	keyPre  string
+}
+
+func (impl *mwfHistoryImpl) accountKey(account string) string {
+	return historyKey(impl.keyPre, account)
+}
+
+func (impl *mwfHistoryImpl) GetItems(_ context.Context, account string, offset, count int64) ([]*HistoryItem, error) {
+	if count == 0 {
+		count = 10000
+	}
+
+	return impl.getItems(account, offset, offset+count-1, false), nil
+}
+
+func (impl *mwfHistoryImpl) GetItemsASC(_ context.Context, account string, offset, count int64) ([]*HistoryItem, error) {
+	if count == 0 {
+		count = 10000
+	}
+
+	return impl.getItems(account, -offset-count, -offset-1, true), nil
+}
+
+func (impl *mwfHistoryImpl) getItems(account string, start, stop int64, reverseOutput bool) (items []*HistoryItem) {
+	var rItems []string
+
+	key := impl.accountKey(account)
+
+	impl.storage.read(func(d *mwfData) {
+		rItems = d.lRange(key, start, stop)
+	})
+
+	items = historyItems(rItems, reverseOutput)
+
+	return
+}
+
+func (impl *mwfHistoryImpl) Query(_ context.Context, account string, query HistoryQuery) (items []*HistoryItem, total int64, err error) {
+	var rItems []string
+
+	key := impl.accountKey(account)
+
+	impl.storage.read(func(d *mwfData) {
+		rItems = d.lRange(key, 0, -1)
+	})
+
+	items, total = queryHistoryItems(rItems, query)
+
+	return
+}
+
+func (impl *mwfHistoryImpl) VerifyHistory(_ context.Context, account string) error {
+	var rItems []string
+
+	key := impl.accountKey(account)
+
+	impl.storage.read(func(d *mwfData) {
+		rItems = d.lRange(key, 0, -1)
+	})
+
+	return verifyHistoryItems(rItems)
+}
+
+// Trans2CodeStorage moves the items to storage oldest first, like the redis history it stops without error on ErrStop
+// and keeps the items which weren't stored.
+func (impl *mwfHistoryImpl) Trans2CodeStorage(account string, storage HistoryCodeStorage) (err error) {
+	if storage == nil {
+		err = ErrFailed
+
+		return
+	}
+
+	key := impl.accountKey(account)
+
+	page := 1000
+
+	for {
+		var items []string
+
+		impl.storage.read(func(d *mwfData) {
+			list := d.Lists[key]
+			if len(list) > page {
+				list = list[:page]
+			}
+
+			items = append(items, list...)
+		})
+
+		if len(items) == 0 {
+			break
+		}
+
+		stored := 0
+
+		for ; stored < len(items); stored++ {
+			err = storage.Store(historyItemAt(items[stored]), items[stored])
+			if err != nil {
+				break
+			}
+		}
+
+		// new items are appended, the stored ones are still at the head
+		if errTrim := impl.storage.change(func(d *mwfData) error {
+			d.Lists[key] = d.Lists[key][stored:]
+			if len(d.Lists[key]) == 0 {
+				delete(d.Lists, key)
+			}
+
+			return nil
+		}); errTrim != nil && err == nil {
+			err = errTrim
+		}
+
+		if errors.Is(err, ErrStop) {
+			err = nil
+
+			break
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	return
+}
@@ -0,0 +1,160 @@
+package wallet
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+)
+
+// NewMWFLocker works like NewRedisLocker on storage, keyPre plays the role of redisKeyPre.
+func NewMWFLocker(storage *MWFStorage, keyPre string) Locker {
+	return &mwfLockerImpl{
+		storage: storage,
+		keyPre:  keyPre,
+	}
+}
+
+type mwfLockerImpl struct {
+	storage *MWFStorage
+	keyPre  string
+}
+
+func (impl *mwfLockerImpl) accountKey(account, asset string) string {
+	return lockerKey(impl.keyPre, account, asset)
+}
+
+func (impl *mwfLockerImpl) Set(_ context.Context, account, key string, coins int64, options ...Option) error {
+	opts := optionNew(options...)
+
+	flag, err := opts.ConflictFlag()
+	if err != nil {
+		return err
+	}
+
+	accountKey := impl.accountKey(account, opts.asset)
+
+	return impl.storage.change(func(d *mwfData) error {
+		oldCoins, exists := d.hGet(accountKey, key)
+		if exists && flag <= 0 {
+			return ErrExists
+		}
+
+		incr := coins
+
+		if exists && flag&0x01 != 0 {
+			d.hIncrBy(accountKey, key, coins)
+		} else {
+			d.hSet(accountKey, key, coins)
+
+			incr -= oldCoins
+		}
+
+		d.hIncrBy(accountKey, totalKey, incr)
+
+		return nil
+	})
+}
+
+func (impl *mwfLockerImpl) Get(_ context.Context, account, key string, options ...Option) (coins int64, exists bool, err error) {
+	accountKey := impl.accountKey(account, optionNew(options...).asset)
+
+	impl.storage.read(func(d *mwfData) {
+		coins, exists = d.hGet(accountKey, key)
+	})
+
+	return
+}
+
+func (impl *mwfLockerImpl) Rem(_ context.Context, account, key string, options ...Option) error {
+	accountKey := impl.accountKey(account, optionNew(options...).asset)
+
+	return impl.storage.change(func(d *mwfData) error {
+		coins, exists := d.hGet(accountKey, key)
+		if !exists {
+			return nil
+		}
+
+		d.hIncrBy(accountKey, totalKey, -coins)
+		d.hDel(accountKey, key)
+
+		return nil
+	})
+}
+
+func (impl *mwfLockerImpl) GetTotal(_ context.Context, account string, options ...Option) (total int64, err error) {
+	accountKey := impl.accountKey(account, optionNew(options...).asset)
+
+	impl.storage.read(func(d *mwfData) {
+		total, _ = d.hGet(accountKey, totalKey)
+	})
+
+	return
+}
+
+func (impl *mwfLockerImpl) TransToLocker(_ context.Context, fromAccount, fromKey string, toLocker Locker, toAccount, toKey string,
+	options ...Option) error {
+	mToLocker, ok := toLocker.(*mwfLockerImpl)
+	if !ok || mToLocker.storage != impl.storage {
+		return ErrInvalidObject
+	}
+
+	opts := optionNew(options...)
+
+	flag, err := opts.ConflictFlag()
+	if err != nil {
+		return err
+	}
+
+	fromAccountKey := impl.accountKey(fromAccount, opts.asset)
+	toAccountKey := mToLocker.accountKey(toAccount, opts.asset)
+
+	return impl.storage.change(func(d *mwfData) error {
+		coins, exists := d.hGet(fromAccountKey, fromKey)
+		if !exists {
+			return ErrNotExists
+		}
+
+		if _, exists = d.hGet(toAccountKey, toKey); exists && flag != 0x01 {
+			return ErrExists
+		}
+
+		d.hIncrBy(toAccountKey, toKey, coins)
+		d.hIncrBy(toAccountKey, totalKey, coins)
+
+		d.hDel(fromAccountKey, fromKey)
+		d.hIncrBy(fromAccountKey, totalKey, -coins)
+
+		return nil
+	})
+}
+
+func (impl *mwfLockerImpl) TransToWallet(_ context.Context, account, key string, wallet Wallet, walletAccount, remark string,
+	options ...Option) error {
+	mWallet, ok := wallet.(*mwfWalletImpl)
+	if !ok || mWallet.storage != impl.storage {
+		return ErrInvalidObject
+	}
+
+	opts := optionNew(options...)
+
+	accountKey := impl.accountKey(account, opts.asset)
+	toKey := mWallet.walletKey(opts.asset)
+	payload := buildHistoryPayload(uuid.NewString(), HistoryTypeWL, opts.asset, walletAccount, key, remark, opts.metadata)
+
+	return impl.storage.change(func(d *mwfData) error {
+		coins, exists := d.hGet(accountKey, key)
+		if !exists {
+			return ErrNotExists
+		}
+
+		mWallet.addAsset(d, opts.asset)
+		balance := d.hIncrBy(toKey, walletAccount, coins)
+
+		d.hDel(accountKey, key)
+		d.hIncrBy(accountKey, totalKey, -coins)
+
+		d.lPush(mWallet.history.accountKey(walletAccount), coins, balance, payload)
+
+		return nil
+	})
+}
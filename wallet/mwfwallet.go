@@ -0,0 +1,203 @@
+package wallet
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// NewMWFWallet works like NewRedisWallet on storage, keyPre plays the role of redisKeyPre.
+func NewMWFWallet(storage *MWFStorage, keyPre string) Wallet {
+	return &mwfWalletImpl{
+		history: newMWFHistory(storage, keyPre),
+		storage: storage,
+		keyPre:  keyPre,
+	}
+}
+
+type mwfWalletImpl struct {
+	history *mwfHistoryImpl
+	storage *MWFStorage
+	keyPre  string
+}
+
+func (impl *mwfWalletImpl) GetHistory() History {
+	return impl.history
+}
+
+func (impl *mwfWalletImpl) TransToLocker(_ context.Context, account string, coins int64, remark string, locker Locker,
+	toAccount, key string, options ...Option) (err error) {
+	opts := optionNew(options...)
+
+	flag, err := opts.ConflictFlag()
+	if err != nil {
+		return
+	}
+
+	mLocker, ok := locker.(*mwfLockerImpl)
+	if !ok || mLocker.storage != impl.storage {
+		err = ErrInvalidObject
+
+		return
+	}
+
+	fromKey := impl.walletKey(opts.asset)
+	toKey := mLocker.accountKey(toAccount, opts.asset)
+	payload := buildHistoryPayload(uuid.NewString(), HistoryTypeWL, opts.asset, account, key, remark, opts.metadata)
+
+	fingerprint := opts.idempotencyFingerprint("transToLocker", account, coins, toKey, key)
+
+	return impl.storage.changeIdempotent(impl.idempotencyKey(opts), fingerprint, opts.idempotencyTTL(), func(d *mwfData) error {
+		if balance, exists := d.hGet(fromKey, account); (!exists || balance < coins) && flag&0x04 == 0 {
+			return ErrNoCoins
+		}
+
+		if _, exists := d.hGet(toKey, key); exists && flag&0x01 == 0 {
+			return ErrExists
+		}
+
+		d.hIncrBy(toKey, key, coins)
+		d.hIncrBy(toKey, totalKey, coins)
+		impl.addAsset(d, opts.asset)
+		balance := d.hIncrBy(fromKey, account, -coins)
+		d.lPush(impl.history.accountKey(account), -coins, balance, payload)
+
+		return nil
+	})
+}
+
+func (impl *mwfWalletImpl) TransToWallet(_ context.Context, account string, coins int64, remarkFrom string, wallet Wallet,
+	accountTo, remarkTo string, options ...Option) (err error) {
+	opts := optionNew(options...)
+
+	flag, err := opts.ConflictFlag()
+	if err != nil {
+		return
+	}
+
+	toWallet, ok := wallet.(*mwfWalletImpl)
+	if !ok || toWallet.storage != impl.storage {
+		err = ErrInvalidObject
+
+		return
+	}
+
+	if coins <= 0 {
+		err = fmt.Errorf("%w: invalid coins amount", ErrFailed)
+
+		return
+	}
+
+	fromKey := impl.walletKey(opts.asset)
+	toKey := toWallet.walletKey(opts.asset)
+	txID := uuid.NewString()
+	payloadFrom := buildHistoryPayload(txID, HistoryTypeWW, opts.asset, account, accountTo, remarkFrom, opts.metadata)
+	payloadTo := buildHistoryPayload(txID, HistoryTypeWW, opts.asset, accountTo, account, remarkTo, opts.metadata)
+
+	fingerprint := opts.idempotencyFingerprint("transToWallet", account, coins, toKey, accountTo)
+
+	return impl.storage.changeIdempotent(impl.idempotencyKey(opts), fingerprint, opts.idempotencyTTL(), func(d *mwfData) error {
+		if balance, exists := d.hGet(fromKey, account); (!exists || balance < coins) && flag&0x04 == 0 {
+			return ErrNoCoins
+		}
+
+		impl.addAsset(d, opts.asset)
+		toWallet.addAsset(d, opts.asset)
+		balanceFrom := d.hIncrBy(fromKey, account, -coins)
+		balanceTo := d.hIncrBy(toKey, accountTo, coins)
+		d.lPush(impl.history.accountKey(account), -coins, balanceFrom, payloadFrom)
+		d.lPush(toWallet.history.accountKey(accountTo), coins, balanceTo, payloadTo)
+
+		return nil
+	})
+}
+
+func (impl *mwfWalletImpl) Exchange(_ context.Context, account, fromAsset string, coins int64, toAsset string, rate ExchangeRate,
+	remark string, options ...Option) (toCoins int64, err error) {
+	opts := optionNew(options...)
+
+	flag, err := opts.ConflictFlag()
+	if err != nil {
+		return
+	}
+
+	toCoins, err = exchangeCoins(fromAsset, coins, toAsset, rate)
+	if err != nil {
+		return
+	}
+
+	fromKey := impl.walletKey(fromAsset)
+	toKey := impl.walletKey(toAsset)
+	historyKey := impl.history.accountKey(account)
+	txID := uuid.NewString()
+	payloadFrom := buildHistoryPayload(txID, HistoryTypeEX, fromAsset, account, toAsset, remark, opts.metadata)
+	payloadTo := buildHistoryPayload(txID, HistoryTypeEX, toAsset, account, fromAsset, remark, opts.metadata)
+
+	fingerprint := opts.idempotencyFingerprint("exchange", account, fromAsset, coins, toAsset, rate.From, rate.To)
+
+	err = impl.storage.changeIdempotent(impl.idempotencyKey(opts), fingerprint, opts.idempotencyTTL(), func(d *mwfData) error {
+		if balance, exists := d.hGet(fromKey, account); (!exists || balance < coins) && flag&0x04 == 0 {
+			return ErrNoCoins
+		}
+
+		impl.addAsset(d, fromAsset)
+		impl.addAsset(d, toAsset)
+		balanceFrom := d.hIncrBy(fromKey, account, -coins)
+		balanceTo := d.hIncrBy(toKey, account, toCoins)
+		d.lPush(historyKey, -coins, balanceFrom, payloadFrom)
+		d.lPush(historyKey, toCoins, balanceTo, payloadTo)
+
+		return nil
+	})
+
+	return
+}
+
+func (impl *mwfWalletImpl) GetCoins(_ context.Context, account, asset string) (val int64, err error) {
+	key := impl.walletKey(asset)
+
+	impl.storage.read(func(d *mwfData) {
+		val, _ = d.hGet(key, account)
+	})
+
+	return
+}
+
+func (impl *mwfWalletImpl) GetBalances(_ context.Context, account string) (balances map[string]int64, err error) {
+	balances = make(map[string]int64)
+
+	impl.storage.read(func(d *mwfData) {
+		assets := []string{DefaultAsset}
+		for asset := range d.Hashes[impl.assetsKey()] {
+			assets = append(assets, asset)
+		}
+
+		for _, asset := range assets {
+			if coins, exists := d.hGet(impl.walletKey(asset), account); exists {
+				balances[asset] = coins
+			}
+		}
+	})
+
+	return
+}
+
+func (impl *mwfWalletImpl) walletKey(asset string) string {
+	return walletAssetKey(impl.keyPre, asset)
+}
+
+func (impl *mwfWalletImpl) assetsKey() string {
+	return walletAssetsKey(impl.keyPre)
+}
+
+// addAsset records the asset in the wallet like the redis scripts do.
+func (impl *mwfWalletImpl) addAsset(d *mwfData, asset string) {
+	if asset != DefaultAsset {
+		d.hSet(impl.assetsKey(), asset, 1)
+	}
+}
+
+func (impl *mwfWalletImpl) idempotencyKey(opts *Options) string {
+	return idempotencyKey(impl.keyPre, opts.idempotencyKey)
+}
@@ -1,9 +1,25 @@
 package wallet
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+const defaultIdempotencyExpiresAfter = time.Hour * 24
+
 type Options struct {
 	allowNegative        bool
 	overflowIfExists     bool
 	accumulationIfExists bool
+
+	idempotencyKey          string
+	idempotencyExpiresAfter time.Duration
+
+	asset string
+
+	metadata map[string]string
 }
 
 func (opt *Options) ConflictFlag() (flag int, err error) {
@@ -54,3 +70,61 @@ func AccumulationIfExistsOption() Option {
 		d.accumulationIfExists = true
 	}
 }
+
+// IdempotencyKeyOption makes Wallet.TransToWallet, Wallet.TransToLocker and Wallet.Exchange run once per key, repeated
+// calls return the result of the first one until expiresAfter (default 24 hours, rounded up to milliseconds) passes.
+// The keys of a wallet are shared by all its operations and accounts, a call reusing the key of another request fails
+// with ErrIdempotencyKeyMismatch.
+func IdempotencyKeyOption(key string, expiresAfter time.Duration) Option {
+	return func(d *Options) {
+		d.idempotencyKey = key
+		d.idempotencyExpiresAfter = expiresAfter
+	}
+}
+
+// AssetOption selects the asset the wallets and lockers work on, DefaultAsset is used without it.
+func AssetOption(asset string) Option {
+	return func(d *Options) {
+		d.asset = asset
+	}
+}
+
+// MetadataOption is recorded in the history items of the transfer.
+func MetadataOption(metadata map[string]string) Option {
+	return func(d *Options) {
+		d.metadata = metadata
+	}
+}
+
+// idempotencyFingerprint identifies the request recorded with the idempotency key, the remarks and the metadata are
+// left out as they may differ between retries.
+func (opt *Options) idempotencyFingerprint(op string, args ...interface{}) string {
+	if opt.idempotencyKey == "" {
+		return ""
+	}
+
+	flag, _ := opt.ConflictFlag()
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%#v", append([]interface{}{op, opt.asset, flag}, args...))))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// idempotencyTTL is 0 when there is no idempotency key, it's rounded up to whole milliseconds as the redis storage
+// takes milliseconds and 0 turns the idempotency off.
+func (opt *Options) idempotencyTTL() time.Duration {
+	if opt.idempotencyKey == "" {
+		return 0
+	}
+
+	if opt.idempotencyExpiresAfter <= 0 {
+		return defaultIdempotencyExpiresAfter
+	}
+
+	ttl := opt.idempotencyExpiresAfter.Truncate(time.Millisecond)
+	if ttl < opt.idempotencyExpiresAfter {
+		ttl += time.Millisecond
+	}
+
+	return ttl
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
 )
 
 var (
@@ -32,7 +33,9 @@ func (impl *redisWalletImpl) GetHistory() History {
 }
 
 func (impl *redisWalletImpl) TransToLocker(ctx context.Context, account string, coins int64, remark string, locker Locker, toAccount, key string, options ...Option) (err error) {
-	flag, err := optionNew(options...).ConflictFlag()
+	opts := optionNew(options...)
+
+	flag, err := opts.ConflictFlag()
 	if err != nil {
 		return err
 	}
@@ -44,31 +47,24 @@ func (impl *redisWalletImpl) TransToLocker(ctx context.Context, account string,
 		return
 	}
 
-	val, err := walletTrans2LockerScript.Run(ctx, impl.redisCli, []string{impl.walletRedisKey(), rLocker.accountRedisKey(toAccount), impl.history.accountRedisKey(account)},
-		account, coins, key, totalKey, flag, BuildHistoryPayload(HistoryTypeWL, account, key, remark)).Int()
+	toKey := rLocker.accountRedisKey(toAccount, opts.asset)
+
+	val, err := walletTrans2LockerScript.Run(ctx, impl.redisCli, []string{impl.walletRedisKey(opts.asset), toKey,
+		impl.history.accountRedisKey(account), impl.idempotencyRedisKey(opts), impl.assetsRedisKey()}, account, coins, key, totalKey, flag,
+		buildHistoryPayload(uuid.NewString(), HistoryTypeWL, opts.asset, account, key, remark, opts.metadata), opts.idempotencyTTL().Milliseconds(),
+		opts.asset, opts.idempotencyFingerprint("transToLocker", account, coins, toKey, key)).Int()
 	if err != nil {
 		return err
 	}
 
-	if val == 0 {
-		return
-	}
-
-	switch val {
-	case 1:
-		err = ErrNoCoins
-	case 2:
-		err = ErrExists
-	default:
-		err = ErrFailed
-	}
-
-	return err
+	return transResultErr(val)
 }
 
 func (impl *redisWalletImpl) TransToWallet(ctx context.Context, account string, coins int64, remarkFrom string, wallet Wallet,
 	accountTo, remarkTo string, options ...Option) (err error) {
-	flag, err := optionNew(options...).ConflictFlag()
+	opts := optionNew(options...)
+
+	flag, err := opts.ConflictFlag()
 	if err != nil {
 		return err
 	}
@@ -85,31 +81,55 @@ func (impl *redisWalletImpl) TransToWallet(ctx context.Context, account string,
 		return ErrInvalidObject
 	}
 
-	val, err := walletTrans2WalletScript.Run(ctx, impl.redisCli, []string{impl.walletRedisKey(), toWallet.walletRedisKey(), impl.history.accountRedisKey(account),
-		redisHistoryTo.accountRedisKey(accountTo)}, account, coins, accountTo, flag,
-		BuildHistoryPayload(HistoryTypeWW, account, accountTo, remarkFrom),
-		BuildHistoryPayload(HistoryTypeWW, accountTo, account, remarkTo)).Int()
+	txID := uuid.NewString()
+	toKey := toWallet.walletRedisKey(opts.asset)
+
+	val, err := walletTrans2WalletScript.Run(ctx, impl.redisCli, []string{impl.walletRedisKey(opts.asset), toKey,
+		impl.history.accountRedisKey(account), redisHistoryTo.accountRedisKey(accountTo), impl.idempotencyRedisKey(opts), impl.assetsRedisKey(),
+		toWallet.assetsRedisKey()}, account, coins, accountTo, flag,
+		buildHistoryPayload(txID, HistoryTypeWW, opts.asset, account, accountTo, remarkFrom, opts.metadata),
+		buildHistoryPayload(txID, HistoryTypeWW, opts.asset, accountTo, account, remarkTo, opts.metadata), opts.idempotencyTTL().Milliseconds(),
+		opts.asset, opts.idempotencyFingerprint("transToWallet", account, coins, toKey, accountTo)).Int()
 
 	if err != nil {
 		return err
 	}
 
-	if val == 0 {
+	return transResultErr(val)
+}
+
+func (impl *redisWalletImpl) Exchange(ctx context.Context, account, fromAsset string, coins int64, toAsset string, rate ExchangeRate,
+	remark string, options ...Option) (toCoins int64, err error) {
+	opts := optionNew(options...)
+
+	flag, err := opts.ConflictFlag()
+	if err != nil {
 		return
 	}
 
-	switch val {
-	case 1:
-		err = ErrNoCoins
-	default:
-		err = ErrFailed
+	toCoins, err = exchangeCoins(fromAsset, coins, toAsset, rate)
+	if err != nil {
+		return
 	}
 
+	txID := uuid.NewString()
+
+	val, err := walletExchangeScript.Run(ctx, impl.redisCli, []string{impl.walletRedisKey(fromAsset), impl.walletRedisKey(toAsset),
+		impl.history.accountRedisKey(account), impl.idempotencyRedisKey(opts), impl.assetsRedisKey()}, account, coins, fromAsset,
+		toCoins, toAsset, flag, buildHistoryPayload(txID, HistoryTypeEX, fromAsset, account, toAsset, remark, opts.metadata),
+		buildHistoryPayload(txID, HistoryTypeEX, toAsset, account, fromAsset, remark, opts.metadata), opts.idempotencyTTL().Milliseconds(),
+		opts.idempotencyFingerprint("exchange", account, fromAsset, coins, toAsset, rate.From, rate.To)).Int()
+	if err != nil {
+		return
+	}
+
+	err = transResultErr(val)
+
 	return
 }
 
-func (impl *redisWalletImpl) GetCoins(ctx context.Context, account string) (val int64, err error) {
-	val, err = impl.redisCli.HGet(ctx, impl.walletRedisKey(), account).Int64()
+func (impl *redisWalletImpl) GetCoins(ctx context.Context, account, asset string) (val int64, err error) {
+	val, err = impl.redisCli.HGet(ctx, impl.walletRedisKey(asset), account).Int64()
 	if errors.Is(err, redis.Nil) {
 		err = nil
 	}
@@ -117,10 +137,58 @@ func (impl *redisWalletImpl) GetCoins(ctx context.Context, account string) (val
 	return
 }
 
-func (impl *redisWalletImpl) walletRedisKey() string {
-	if impl.redisKeyPre == "" {
-		return "wallet"
+// GetBalances returns the coins of every asset the account has.
+func (impl *redisWalletImpl) GetBalances(ctx context.Context, account string) (balances map[string]int64, err error) {
+	assets, err := impl.redisCli.HKeys(ctx, impl.assetsRedisKey()).Result()
+	if err != nil {
+		return
 	}
 
-	return impl.redisKeyPre + ":" + "wallet"
+	assets = append([]string{DefaultAsset}, assets...)
+
+	pipe := impl.redisCli.Pipeline()
+
+	cmds := make([]*redis.StringCmd, 0, len(assets))
+	for _, asset := range assets {
+		cmds = append(cmds, pipe.HGet(ctx, impl.walletRedisKey(asset), account))
+	}
+
+	if _, err = pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return
+	}
+
+	err = nil
+
+	balances = make(map[string]int64)
+
+	for idx, cmd := range cmds {
+		var coins int64
+
+		coins, err = cmd.Int64()
+		if errors.Is(err, redis.Nil) {
+			err = nil
+
+			continue
+		}
+
+		if err != nil {
+			return
+		}
+
+		balances[assets[idx]] = coins
+	}
+
+	return
+}
+
+func (impl *redisWalletImpl) walletRedisKey(asset string) string {
+	return walletAssetKey(impl.redisKeyPre, asset)
+}
+
+func (impl *redisWalletImpl) assetsRedisKey() string {
+	return walletAssetsKey(impl.redisKeyPre)
+}
+
+func (impl *redisWalletImpl) idempotencyRedisKey(opts *Options) string {
+	return idempotencyKey(impl.redisKeyPre, opts.idempotencyKey)
 }
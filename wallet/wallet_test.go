@@ -4,16 +4,17 @@ package wallet
 import (
 	"context"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
-	"github.com/sgostarter/libconfig/ut"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestRedisWallet(t *testing.T) {
-	cfg := ut.SetupUTConfig4Redis(t)
-	redisCli, err := initRedis(cfg.RedisDSN)
+	mr := miniredis.RunT(t)
+	redisCli, err := initRedis("redis://" + mr.Addr())
 	assert.Nil(t, err)
 
 	user := "user"
@@ -38,7 +39,7 @@ func TestRedisWallet(t *testing.T) {
 	assert.Nil(t, err)
 	assert.EqualValues(t, 6, total)
 
-	total, err = wallet.GetCoins(context.Background(), user)
+	total, err = wallet.GetCoins(context.Background(), user, DefaultAsset)
 	assert.Nil(t, err)
 	assert.EqualValues(t, 5, total)
 
@@ -49,15 +50,15 @@ func TestRedisWallet(t *testing.T) {
 	assert.Nil(t, err)
 	assert.EqualValues(t, 8, total)
 
-	total, err = wallet.GetCoins(context.Background(), user)
+	total, err = wallet.GetCoins(context.Background(), user, DefaultAsset)
 	assert.Nil(t, err)
 	assert.EqualValues(t, 3, total)
 }
 
 // nolint
 func TestRedisWallet2(t *testing.T) {
-	cfg := ut.SetupUTConfig4Redis(t)
-	redisCli, err := initRedis(cfg.RedisDSN)
+	mr := miniredis.RunT(t)
+	redisCli, err := initRedis("redis://" + mr.Addr())
 	assert.Nil(t, err)
 
 	user1 := "user1"
@@ -94,8 +95,8 @@ func TestRedisWallet2(t *testing.T) {
 
 // nolint
 func TestRedisWallet3(t *testing.T) {
-	cfg := ut.SetupUTConfig4Redis(t)
-	redisCli, err := initRedis(cfg.RedisDSN)
+	mr := miniredis.RunT(t)
+	redisCli, err := initRedis("redis://" + mr.Addr())
 	assert.Nil(t, err)
 
 	user1 := "user1"
@@ -188,8 +189,8 @@ func (stg *utHistoryStorage) Store(_ time.Time, item string) (err error) {
 
 // nolint
 func TestRedisWallet4(t *testing.T) {
-	cfg := ut.SetupUTConfig4Redis(t)
-	redisCli, err := initRedis(cfg.RedisDSN)
+	mr := miniredis.RunT(t)
+	redisCli, err := initRedis("redis://" + mr.Addr())
 	assert.Nil(t, err)
 
 	user1 := "user1"
@@ -285,3 +286,356 @@ func TestRedisWallet4(t *testing.T) {
 	assert.Nil(t, err)
 	fnCheckItems(items, 0, 0, 0, "", "")
 }
+
+func TestWalletIdempotency(t *testing.T) {
+	runBackends(t, func(t *testing.T, b *utBackend) {
+		ctx := context.Background()
+		user1 := "user1"
+		user2 := "user2"
+
+		wallet1 := b.newWallet("8")
+		wallet2 := b.newWallet("9")
+		locker := b.newLocker("x")
+
+		assert.Nil(t, locker.Set(ctx, user1, "key1", 100))
+		assert.Nil(t, locker.TransToWallet(ctx, user1, "key1", wallet1, user1, ""))
+
+		checkCoins := func(wallet Wallet, user string, expected int64) {
+			coins, err := wallet.GetCoins(ctx, user, DefaultAsset)
+			assert.Nil(t, err)
+			assert.EqualValues(t, expected, coins)
+		}
+
+		for idx := 0; idx < 3; idx++ {
+			assert.Nil(t, wallet1.TransToWallet(ctx, user1, 10, "", wallet2, user2, "", IdempotencyKeyOption("k1", time.Hour)))
+		}
+
+		checkCoins(wallet1, user1, 90)
+		checkCoins(wallet2, user2, 10)
+
+		items, err := wallet2.GetHistory().GetItems(ctx, user2, 0, 0)
+		assert.Nil(t, err)
+		assert.Len(t, items, 1)
+
+		// the failure is replayed even though there are enough coins now
+		assert.ErrorIs(t, wallet2.TransToWallet(ctx, user2, 20, "", wallet1, user1, "", IdempotencyKeyOption("k2", time.Hour)),
+			ErrNoCoins)
+		assert.Nil(t, wallet1.TransToWallet(ctx, user1, 10, "", wallet2, user2, ""))
+		assert.ErrorIs(t, wallet2.TransToWallet(ctx, user2, 20, "", wallet1, user1, "", IdempotencyKeyOption("k2", time.Hour)),
+			ErrNoCoins)
+
+		// a key is shared by all the operations and accounts of a wallet
+		assert.ErrorIs(t, wallet1.TransToWallet(ctx, user1, 20, "", wallet2, user2, "", IdempotencyKeyOption("k1", time.Hour)),
+			ErrIdempotencyKeyMismatch)
+		assert.ErrorIs(t, wallet1.TransToWallet(ctx, user2, 10, "", wallet2, user2, "", IdempotencyKeyOption("k1", time.Hour)),
+			ErrIdempotencyKeyMismatch)
+		assert.ErrorIs(t, wallet1.TransToLocker(ctx, user1, 10, "", locker, user1, "key2", IdempotencyKeyOption("k1", time.Hour)),
+			ErrIdempotencyKeyMismatch)
+		assert.ErrorIs(t, wallet1.TransToWallet(ctx, user1, 10, "", wallet2, user2, "", IdempotencyKeyOption("k1", time.Hour),
+			AssetOption("gems")), ErrIdempotencyKeyMismatch)
+
+		checkCoins(wallet1, user1, 80)
+		checkCoins(wallet2, user2, 20)
+
+		// the keys of another wallet are another set
+		assert.Nil(t, wallet2.TransToWallet(ctx, user2, 20, "", wallet1, user1, "", IdempotencyKeyOption("k1", time.Hour)))
+
+		checkCoins(wallet1, user1, 100)
+		checkCoins(wallet2, user2, 0)
+
+		assert.Nil(t, wallet1.TransToLocker(ctx, user1, 5, "", locker, user1, "key2", IdempotencyKeyOption("k3", time.Hour)))
+		assert.Nil(t, wallet1.TransToLocker(ctx, user1, 5, "", locker, user1, "key2", IdempotencyKeyOption("k3", time.Hour)))
+		assert.ErrorIs(t, wallet1.TransToLocker(ctx, user1, 5, "", locker, user1, "key2"), ErrExists)
+
+		checkCoins(wallet1, user1, 95)
+
+		// the key runs again once it expires
+		assert.Nil(t, wallet1.TransToWallet(ctx, user1, 1, "", wallet2, user2, "", IdempotencyKeyOption("k4", time.Millisecond*50)))
+		assert.Nil(t, wallet1.TransToWallet(ctx, user1, 1, "", wallet2, user2, "", IdempotencyKeyOption("k4", time.Millisecond*50)))
+
+		checkCoins(wallet2, user2, 1)
+
+		b.wait(time.Millisecond * 100)
+
+		assert.Nil(t, wallet1.TransToWallet(ctx, user1, 1, "", wallet2, user2, "", IdempotencyKeyOption("k4", time.Millisecond*50)))
+
+		checkCoins(wallet2, user2, 2)
+	})
+
+	// expiries under a millisecond don't turn the idempotency off
+	for expiresAfter, ttl := range map[time.Duration]time.Duration{
+		time.Nanosecond: time.Millisecond, time.Millisecond: time.Millisecond,
+		time.Millisecond + time.Microsecond: time.Millisecond * 2, 0: defaultIdempotencyExpiresAfter,
+	} {
+		assert.EqualValues(t, ttl, optionNew(IdempotencyKeyOption("k1", expiresAfter)).idempotencyTTL())
+	}
+}
+
+func TestWalletAssets(t *testing.T) {
+	runBackends(t, func(t *testing.T, b *utBackend) {
+		ctx := context.Background()
+		user1 := "user1"
+		user2 := "user2"
+
+		wallet1 := b.newWallet("8")
+		wallet2 := b.newWallet("9")
+		locker := b.newLocker("x")
+
+		assert.Nil(t, locker.Set(ctx, user1, "key1", 100))
+		assert.Nil(t, locker.Set(ctx, user1, "key1", 10, AssetOption("gems")))
+
+		total, err := locker.GetTotal(ctx, user1, AssetOption("gems"))
+		assert.Nil(t, err)
+		assert.EqualValues(t, 10, total)
+
+		assert.Nil(t, locker.TransToWallet(ctx, user1, "key1", wallet1, user1, ""))
+		assert.Nil(t, locker.TransToWallet(ctx, user1, "key1", wallet1, user1, "", AssetOption("gems")))
+
+		checkBalances := func(wallet Wallet, user string, expected map[string]int64) {
+			balances, err := wallet.GetBalances(ctx, user)
+			assert.Nil(t, err)
+			assert.EqualValues(t, expected, balances)
+		}
+
+		checkBalances(wallet1, user1, map[string]int64{DefaultAsset: 100, "gems": 10})
+
+		assert.ErrorIs(t, wallet1.TransToWallet(ctx, user1, 11, "", wallet2, user2, "", AssetOption("gems")), ErrNoCoins)
+		assert.Nil(t, wallet1.TransToWallet(ctx, user1, 4, "", wallet2, user2, "", AssetOption("gems")))
+
+		checkBalances(wallet1, user1, map[string]int64{DefaultAsset: 100, "gems": 6})
+		checkBalances(wallet2, user2, map[string]int64{"gems": 4})
+
+		// 3 coins for every 2 gems
+		toCoins, err := wallet1.Exchange(ctx, user1, "gems", 5, DefaultAsset, ExchangeRate{From: 2, To: 3}, "buy")
+		assert.Nil(t, err)
+		assert.EqualValues(t, 7, toCoins)
+
+		_, err = wallet1.Exchange(ctx, user1, "gems", 5, DefaultAsset, ExchangeRate{From: 2, To: 3}, "buy")
+		assert.ErrorIs(t, err, ErrNoCoins)
+		_, err = wallet1.Exchange(ctx, user1, "gems", 1, "gems", ExchangeRate{From: 1, To: 1}, "")
+		assert.ErrorIs(t, err, ErrFailed)
+		_, err = wallet1.Exchange(ctx, user1, "gems", 1, DefaultAsset, ExchangeRate{From: 2, To: 1}, "")
+		assert.ErrorIs(t, err, ErrFailed)
+
+		toCoins, err = wallet1.Exchange(ctx, user1, DefaultAsset, 100, "gold", ExchangeRate{From: 10, To: 1}, "")
+		assert.Nil(t, err)
+		assert.EqualValues(t, 10, toCoins)
+
+		checkBalances(wallet1, user1, map[string]int64{DefaultAsset: 7, "gems": 1, "gold": 10})
+
+		assert.Nil(t, wallet1.TransToLocker(ctx, user1, 10, "", locker, user1, "key2", AssetOption("gold")))
+
+		coins, exists, err := locker.Get(ctx, user1, "key2", AssetOption("gold"))
+		assert.Nil(t, err)
+		assert.True(t, exists)
+		assert.EqualValues(t, 10, coins)
+
+		_, exists, err = locker.Get(ctx, user1, "key2")
+		assert.Nil(t, err)
+		assert.False(t, exists)
+
+		coins, err = wallet1.GetCoins(ctx, user1, "gold")
+		assert.Nil(t, err)
+		assert.EqualValues(t, 0, coins)
+
+		items, err := wallet1.GetHistory().GetItems(ctx, user1, 0, 5)
+		assert.Nil(t, err)
+
+		if assert.Len(t, items, 5) {
+			for idx, c := range []struct {
+				asset string
+				coins int64
+			}{
+				{"gold", -10}, {"gold", 10}, {DefaultAsset, -100}, {DefaultAsset, 7}, {"gems", -5},
+			} {
+				assert.EqualValues(t, c.asset, items[idx].Asset)
+				assert.EqualValues(t, c.coins, items[idx].Coins)
+			}
+		}
+	})
+}
+
+func TestWalletHistoryQuery(t *testing.T) {
+	runBackends(t, func(t *testing.T, b *utBackend) {
+		ctx := context.Background()
+		user1 := "user1"
+		user2 := "user2"
+		user3 := "user3"
+
+		wallet := b.newWallet("8")
+		locker := b.newLocker("x")
+
+		// an item stored before the JSON records
+		b.setHistory("8", user1, []string{"100\n" + BuildHistoryPayload(HistoryTypeWW, user1, user3, "legacy")})
+
+		assert.Nil(t, locker.Set(ctx, user1, "key1", 100))
+		assert.Nil(t, locker.TransToWallet(ctx, user1, "key1", wallet, user1, "", MetadataOption(map[string]string{"order": "1"})))
+
+		// the items keep milliseconds
+		time.Sleep(time.Millisecond * 2)
+
+		start := time.Now().Truncate(time.Millisecond)
+
+		assert.Nil(t, wallet.TransToWallet(ctx, user1, 10, "", wallet, user2, ""))
+		assert.Nil(t, wallet.TransToWallet(ctx, user1, 20, "", wallet, user3, ""))
+		assert.Nil(t, wallet.TransToWallet(ctx, user1, 30, "", wallet, user2, ""))
+
+		items, total, err := wallet.GetHistory().Query(ctx, user1, HistoryQuery{})
+		assert.Nil(t, err)
+		assert.EqualValues(t, 5, total)
+
+		if assert.Len(t, items, 5) {
+			assert.EqualValues(t, -30, items[0].Coins)
+			assert.EqualValues(t, 40, items[0].Balance)
+			assert.EqualValues(t, user2, items[0].Counterparty)
+			assert.NotEmpty(t, items[0].TxID)
+			assert.EqualValues(t, HistoryTypeWL, items[3].Type)
+			assert.EqualValues(t, 100, items[3].Balance)
+			assert.EqualValues(t, map[string]string{"order": "1"}, items[3].Metadata)
+			assert.EqualValues(t, "legacy", items[4].Remark)
+			assert.EqualValues(t, "", items[4].TxID)
+		}
+
+		items2, _, err := wallet.GetHistory().Query(ctx, user2, HistoryQuery{Counterparty: user1})
+		assert.Nil(t, err)
+
+		if assert.Len(t, items2, 2) {
+			assert.EqualValues(t, items[0].TxID, items2[0].TxID)
+			assert.EqualValues(t, 40, items2[0].Balance)
+		}
+
+		items, total, err = wallet.GetHistory().Query(ctx, user1, HistoryQuery{
+			Types:        []HistoryType{HistoryTypeWW},
+			Counterparty: user2,
+			ASC:          true,
+		})
+		assert.Nil(t, err)
+		assert.EqualValues(t, 2, total)
+
+		if assert.Len(t, items, 2) {
+			assert.EqualValues(t, -10, items[0].Coins)
+			assert.EqualValues(t, -30, items[1].Coins)
+		}
+
+		items, total, err = wallet.GetHistory().Query(ctx, user1, HistoryQuery{
+			Start:  start,
+			End:    time.Now().Add(time.Second),
+			Offset: 1,
+			Count:  1,
+		})
+		assert.Nil(t, err)
+		assert.EqualValues(t, 3, total)
+
+		if assert.Len(t, items, 1) {
+			assert.EqualValues(t, -20, items[0].Coins)
+		}
+
+		items, total, err = wallet.GetHistory().Query(ctx, user1, HistoryQuery{End: start})
+		assert.Nil(t, err)
+		assert.EqualValues(t, 2, total)
+		assert.Len(t, items, 2)
+
+		items, total, err = wallet.GetHistory().Query(ctx, user1, HistoryQuery{Offset: 10})
+		assert.Nil(t, err)
+		assert.EqualValues(t, 5, total)
+		assert.Len(t, items, 0)
+	})
+}
+
+func TestWalletVerifyHistory(t *testing.T) {
+	runBackends(t, func(t *testing.T, b *utBackend) {
+		ctx := context.Background()
+		user1 := "user1"
+		user2 := "user2"
+
+		wallet := b.newWallet("8")
+		locker := b.newLocker("x")
+		// the legacy items carry no balance
+		b.setHistory("8", user1, []string{"100\n" + BuildHistoryPayload(HistoryTypeWW, user1, user2, "legacy")})
+
+		assert.Nil(t, locker.Set(ctx, user1, "key1", 100))
+		assert.Nil(t, locker.TransToWallet(ctx, user1, "key1", wallet, user1, ""))
+		assert.Nil(t, wallet.TransToWallet(ctx, user1, 10, "", wallet, user2, ""))
+		_, err := wallet.Exchange(ctx, user1, DefaultAsset, 50, "gems", ExchangeRate{From: 10, To: 1}, "")
+		assert.Nil(t, err)
+		assert.Nil(t, wallet.TransToLocker(ctx, user1, 2, "", locker, user1, "key2", AssetOption("gems")))
+		assert.Nil(t, wallet.TransToWallet(ctx, user1, 5, "", wallet, user2, ""))
+
+		// the locked coins of one account go to the wallet of the other
+		assert.Nil(t, locker.Set(ctx, user2, "key3", 20))
+		assert.Nil(t, locker.TransToWallet(ctx, user2, "key3", wallet, user1, ""))
+		assert.Nil(t, locker.Set(ctx, user1, "key4", 7))
+		assert.Nil(t, locker.TransToWallet(ctx, user1, "key4", wallet, user2, ""))
+
+		assert.Nil(t, wallet.GetHistory().VerifyHistory(ctx, user1))
+		assert.Nil(t, wallet.GetHistory().VerifyHistory(ctx, user2))
+
+		items, err := wallet.GetHistory().GetItemsASC(ctx, user1, 0, 0)
+		assert.Nil(t, err)
+
+		if assert.Len(t, items, 8) {
+			for idx, balance := range []int64{0, 100, 90, 40, 5, 3, 35, 55} {
+				assert.EqualValues(t, balance, items[idx].Balance)
+			}
+		}
+
+		items2, err := wallet.GetHistory().GetItemsASC(ctx, user2, 0, 0)
+		assert.Nil(t, err)
+
+		if assert.Len(t, items2, 3) {
+			for idx, balance := range []int64{10, 15, 22} {
+				assert.EqualValues(t, balance, items2[idx].Balance)
+			}
+		}
+
+		// the balance after the exchange out of the default asset is changed
+		rItems := b.history("8", user1)
+		rItems[3] = strings.Replace(rItems[3], `"balance":40`, `"balance":41`, 1)
+		b.setHistory("8", user1, rItems)
+
+		err = wallet.GetHistory().VerifyHistory(ctx, user1)
+		assert.ErrorIs(t, err, ErrHistoryBroken)
+
+		var breakErr *HistoryBreakError
+		if assert.ErrorAs(t, err, &breakErr) {
+			assert.EqualValues(t, 3, breakErr.Offset)
+			assert.EqualValues(t, items[3].TxID, breakErr.TxID)
+			assert.EqualValues(t, DefaultAsset, breakErr.Asset)
+			assert.EqualValues(t, 40, breakErr.Expected)
+			assert.EqualValues(t, 41, breakErr.Balance)
+		}
+	})
+}
+
+func TestLockerToOtherWallet(t *testing.T) {
+	runBackends(t, func(t *testing.T, b *utBackend) {
+		ctx := context.Background()
+		alice := "alice"
+		bob := "bob"
+
+		wallet := b.newWallet("8")
+		locker := b.newLocker("x")
+
+		assert.Nil(t, locker.Set(ctx, alice, "key1", 10))
+		assert.Nil(t, locker.Set(ctx, alice, "key2", 5))
+		assert.Nil(t, locker.TransToWallet(ctx, alice, "key1", wallet, bob, "from alice"))
+		assert.Nil(t, locker.TransToWallet(ctx, alice, "key2", wallet, bob, "from alice"))
+
+		items, err := wallet.GetHistory().GetItems(ctx, alice, 0, 0)
+		assert.Nil(t, err)
+		assert.Len(t, items, 0)
+
+		items, err = wallet.GetHistory().GetItems(ctx, bob, 0, 0)
+		assert.Nil(t, err)
+
+		if assert.Len(t, items, 2) {
+			assert.EqualValues(t, 5, items[0].Coins)
+			assert.EqualValues(t, 15, items[0].Balance)
+			assert.EqualValues(t, "key2", items[0].Counterparty)
+			assert.EqualValues(t, 10, items[1].Coins)
+			assert.EqualValues(t, 10, items[1].Balance)
+		}
+
+		assert.Nil(t, wallet.GetHistory().VerifyHistory(ctx, bob))
+	})
+}